@@ -10,18 +10,11 @@ import (
 	"github.com/conformal/btcwire"
 )
 
-// maybeAcceptBlock potentially accepts a block into the memory block chain.
-// It performs several validation checks which depend on its position within
-// the block chain before adding it.  The block is expected to have already gone
-// through ProcessBlock before calling this function with it.
-func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) error {
-	// Get a block node for the block previous to this one.  Will be nil
-	// if this is the genesis block.
-	prevNode, err := b.getPrevNodeFromBlock(block)
-	if err != nil {
-		return err
-	}
-
+// checkBlockHeaderContext performs several validation checks on the passed
+// block header which depend on its position within the block chain as
+// described by the passed node for the previous block.  The previous node will
+// be nil for the genesis block.
+func (b *BlockChain) checkBlockHeaderContext(header *btcwire.BlockHeader, blockHash *btcwire.ShaHash, prevNode *blockNode) error {
 	// The height of this block one more than the referenced previous block.
 	blockHeight := int64(0)
 	if prevNode != nil {
@@ -31,16 +24,15 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) error {
 	// Ensure the difficulty specified in the block header matches the
 	// calculated difficulty based on the previous block and difficulty
 	// retarget rules.
-	blockHeader := block.MsgBlock().Header
 	expectedDifficulty, err := b.calcNextRequiredDifficulty(prevNode)
 	if err != nil {
 		return err
 	}
-	blockDifficulty := blockHeader.Bits
+	blockDifficulty := header.Bits
 	if blockDifficulty != expectedDifficulty {
 		str := "block difficulty of %d is not the expected value of %d"
 		str = fmt.Sprintf(str, blockDifficulty, expectedDifficulty)
-		return RuleError(str)
+		return ruleError(ErrUnexpectedDifficulty, str)
 	}
 
 	// Ensure the timestamp for the block header is after the median time of
@@ -49,15 +41,90 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) error {
 	if err != nil {
 		return err
 	}
-	if !blockHeader.Timestamp.After(medianTime) {
+	if !header.Timestamp.After(medianTime) {
 		str := "block timestamp of %v is not after expected %v"
-		str = fmt.Sprintf(str, blockHeader.Timestamp, medianTime)
-		return RuleError(str)
+		str = fmt.Sprintf(str, header.Timestamp, medianTime)
+		return ruleError(ErrTimeTooOld, str)
+	}
+
+	// Ensure chain matches up to predetermined checkpoints.
+	if !b.verifyCheckpoint(blockHeight, blockHash) {
+		str := fmt.Sprintf("block at height %d does not match "+
+			"checkpoint hash", blockHeight)
+		return ruleError(ErrBadCheckpoint, str)
+	}
+
+	// Prevent blocks which fork the main chain before the latest known
+	// checkpoint.  Such a fork could never become the main chain, so this
+	// rejects it outright rather than spending resources on it.
+	checkpoint, err := b.latestKnownCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil && blockHeight < checkpoint.Height {
+		str := fmt.Sprintf("block at height %d forks the main chain "+
+			"before the previous checkpoint at height %d",
+			blockHeight, checkpoint.Height)
+		return ruleError(ErrForkTooOld, str)
+	}
+
+	return nil
+}
+
+// maybeAcceptBlock potentially accepts a block into the memory block chain.
+// It performs several validation checks which depend on its position within
+// the block chain before adding it.  The block is expected to have already gone
+// through ProcessBlock before calling this function with it.  It returns
+// whether or not the block ended up on the main chain.
+func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) (bool, error) {
+	// Get a block node for the block previous to this one.  Will be nil
+	// if this is the genesis block.
+	prevNode, err := b.getPrevNodeFromBlock(block)
+	if err != nil {
+		return false, err
+	}
+
+	// Reject blocks which build on a block that is known to be invalid
+	// since they can never be valid either.
+	if prevNode != nil && prevNode.status.knownInvalid() {
+		str := fmt.Sprintf("previous block %v is known to be invalid",
+			prevNode.hash)
+		return false, ruleError(ErrInvalidAncestorBlock, str)
+	}
+
+	// The height of this block one more than the referenced previous block.
+	blockHeight := int64(0)
+	if prevNode != nil {
+		blockHeight = prevNode.height + 1
 	}
 
-	// Ensure all transactions in the block are finalized.
+	// Perform the checks on the block header which depend on its position
+	// within the block chain.  It's safe to ignore the error on Sha since
+	// it's already cached.
+	blockHeader := &block.MsgBlock().Header
+	blockHash, _ := block.Sha()
+	err = b.checkBlockHeaderContext(blockHeader, blockHash, prevNode)
+	if err != nil {
+		return false, err
+	}
+
+	// Ensure all transactions in the block are finalized.  Lock times are
+	// evaluated against the median time past of the previous block instead
+	// of the block timestamp once the relative lock time rules are active.
+	// This is part of BIP_0113.
+	lockTimeCutoff := blockHeader.Timestamp
+	csvActive, err := b.isCSVActive(prevNode)
+	if err != nil {
+		return false, err
+	}
+	if csvActive {
+		lockTimeCutoff, err = b.calcPastMedianTime(prevNode)
+		if err != nil {
+			return false, err
+		}
+	}
 	for i, tx := range block.MsgBlock().Transactions {
-		if !isFinalizedTransaction(tx, blockHeight, blockHeader.Timestamp) {
+		if !IsFinalizedTransaction(tx, blockHeight, lockTimeCutoff) {
 			// Use the TxSha function from the block rather
 			// than the transaction itself since the block version
 			// is cached.  Also, it's safe to ignore the error here
@@ -66,60 +133,77 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) error {
 			txSha, _ := block.TxSha(i)
 			str := fmt.Sprintf("block contains unfinalized "+
 				"transaction %v", txSha)
-			return RuleError(str)
+			return false, ruleError(ErrUnfinalizedTx, str)
 		}
 	}
 
-	// Ensure chain matches up to predetermined checkpoints.
-	// It's safe to ignore the error on Sha since it's already cached.
-	blockHash, _ := block.Sha()
-	if !b.verifyCheckpoint(blockHeight, blockHash) {
-		// TODO(davec): This should probably be a distinct error type
-		// (maybe CheckpointError).  Since this error shouldn't happen
-		// unless the peer is connected to a rogue network serving up an
-		// alternate chain, the caller would likely need to react by
-		// disconnecting peers and rolling back the chain to the last
-		// known good point.
-		str := fmt.Sprintf("block at height %d does not match "+
-			"checkpoint hash", blockHeight)
-		return RuleError(str)
-	}
-
 	// Reject version 1 blocks once a majority of the network has upgraded.
 	// Rules:
 	//  95% (950 / 1000) for main network
 	//  75% (75 / 100) for the test network
 	// This is part of BIP_0034.
 	if blockHeader.Version == 1 {
-		minRequired := uint64(950)
-		numToCheck := uint64(1000)
-		if b.btcnet == btcwire.TestNet3 || b.btcnet == btcwire.TestNet {
-			minRequired = 75
-			numToCheck = 100
-		}
+		minRequired := b.chainParams.BlockRejectNumRequired
+		numToCheck := b.chainParams.BlockUpgradeNumToCheck
 		if b.isMajorityVersion(2, prevNode, minRequired, numToCheck) {
 			str := "new blocks with version %d are no longer valid"
 			str = fmt.Sprintf(str, blockHeader.Version)
-			return RuleError(str)
+			return false, ruleError(ErrBlockVersionTooOld, str)
+		}
+	}
+
+	// Reject version 2 blocks once a majority of the network has upgraded
+	// to blocks which require strictly DER encoded signatures.
+	// Rules:
+	//  95% (950 / 1000) for main network
+	//  75% (75 / 100) for the test network
+	// This is part of BIP_0066.
+	if blockHeader.Version < strictDERVersion {
+		minRequired := b.chainParams.BlockRejectNumRequired
+		numToCheck := b.chainParams.BlockUpgradeNumToCheck
+		if b.isMajorityVersion(strictDERVersion, prevNode, minRequired,
+			numToCheck) {
+
+			str := "new blocks with version %d are no longer valid"
+			str = fmt.Sprintf(str, blockHeader.Version)
+			return false, ruleError(ErrBlockVersionTooOld, str)
+		}
+	}
+
+	// Reject version 3 blocks once a majority of the network has upgraded
+	// to blocks which enforce OP_CHECKLOCKTIMEVERIFY.
+	// Rules:
+	//  95% (950 / 1000) for main network
+	//  75% (75 / 100) for the test network
+	// This is part of BIP_0065.
+	if blockHeader.Version < checkLockTimeVerifyVersion {
+		minRequired := b.chainParams.BlockRejectNumRequired
+		numToCheck := b.chainParams.BlockUpgradeNumToCheck
+		if b.isMajorityVersion(checkLockTimeVerifyVersion, prevNode,
+			minRequired, numToCheck) {
+
+			str := "new blocks with version %d are no longer valid"
+			str = fmt.Sprintf(str, blockHeader.Version)
+			return false, ruleError(ErrBlockVersionTooOld, str)
 		}
 	}
 
 	// Ensure coinbase starts with serialized block heights for blocks
 	// whose version is the serializedHeightVersion or newer once a majority
-	// of the network has upgraded.
+	// of the network has upgraded.  The majority was reached long ago on
+	// the networks with a known activation height, so the potentially
+	// expensive majority check is skipped for blocks after it.
 	// Rules:
 	//  75% (750 / 1000) for main network
 	//  51% (51 / 100) for the test network
 	// This is part of BIP_0034.
 	if blockHeader.Version >= serializedHeightVersion {
-		minRequired := uint64(750)
-		numToCheck := uint64(1000)
-		if b.btcnet == btcwire.TestNet3 || b.btcnet == btcwire.TestNet {
-			minRequired = 51
-			numToCheck = 100
-		}
-		if b.isMajorityVersion(serializedHeightVersion, prevNode,
-			minRequired, numToCheck) {
+		minRequired := b.chainParams.BlockEnforceNumRequired
+		numToCheck := b.chainParams.BlockUpgradeNumToCheck
+		bip0034Height := b.chainParams.BIP0034Height
+		if (bip0034Height != 0 && blockHeight >= bip0034Height) ||
+			b.isMajorityVersion(serializedHeightVersion, prevNode,
+				minRequired, numToCheck) {
 
 			expectedHeight := int64(0)
 			if prevNode != nil {
@@ -128,7 +212,7 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) error {
 			coinbaseTx := block.MsgBlock().Transactions[0]
 			err := checkSerializedHeight(coinbaseTx, expectedHeight)
 			if err != nil {
-				return err
+				return false, err
 			}
 		}
 	}
@@ -145,15 +229,25 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block) error {
 	// Connect the passed block to the chain while respecting proper chain
 	// selection according to the chain with the most proof of work.  This
 	// also handles validation of the transaction scripts.
-	err = b.connectBestChain(newNode, block)
+	isMainChain, err := b.connectBestChain(newNode, block)
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	// The block is now part of the block chain, so there is no longer any
+	// need to track its header separately.  Headers which can no longer
+	// become part of the main chain are removed as well.
+	b.chainLock.Lock()
+	delete(b.headerIndex, *blockHash)
+	if err := b.pruneHeaderIndex(); err != nil {
+		log.Warnf("Unable to prune block headers: %v", err)
+	}
+	b.chainLock.Unlock()
+
 	// Notify the caller that the new block was accepted into the block
 	// chain.  The caller would typically want to react by relaying the
 	// inventory to other peers.
 	b.sendNotification(NTBlockAccepted, block)
 
-	return nil
+	return isMainChain, nil
 }
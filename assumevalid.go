@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// SetAssumeValid sets the hash of a block whose ancestors, along with the block
+// itself, are assumed to have valid scripts.  The scripts of those blocks are
+// not run while all of the other rules are still enforced and the transaction
+// outputs they create and spend are still tracked.  This is similar to how
+// scripts are not run for the blocks before the latest checkpoint, but the
+// block is chosen by the caller and is independent of the checkpoints.  Pass
+// nil to run the scripts of all blocks after the latest checkpoint again.
+//
+// The block is only assumed valid once its header is known, such as via
+// ProcessBlockHeader, and it is part of the chain with the most cumulative work
+// known to this instance.  This ensures an assumed block which the network
+// has not built on does not cause scripts to be skipped.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetAssumeValid(hash *btcwire.ShaHash) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.assumeValid = hash
+	b.assumeValidNode = nil
+	b.assumeValidHashes = nil
+	b.assumeValidTip = nil
+}
+
+// bestKnownTip returns the node with the most cumulative work out of the end of
+// the main chain and the best header.
+func (b *BlockChain) bestKnownTip() *blockNode {
+	best := b.bestChain
+	if b.bestHeader != nil && (best == nil ||
+		b.bestHeader.workSum.Cmp(best.workSum) > 0) {
+
+		best = b.bestHeader
+	}
+	return best
+}
+
+// loadAssumeValidNode finds the node for the assumed valid block and records
+// the hashes of its ancestors which are not yet in the main chain by height so
+// checking whether a block is one of them does not require walking the chain
+// for every block.  It returns false when the block is not known yet.
+func (b *BlockChain) loadAssumeValidNode() (bool, error) {
+	if b.assumeValidNode != nil {
+		return true, nil
+	}
+
+	node, ok := b.headerIndex[*b.assumeValid]
+	if !ok {
+		node, ok = b.index[*b.assumeValid]
+	}
+	if !ok {
+		return false, nil
+	}
+
+	baseHeight := int64(0)
+	if b.bestChain != nil {
+		baseHeight = b.bestChain.height + 1
+	}
+	var hashes []btcwire.ShaHash
+	if node.height >= baseHeight {
+		hashes = make([]btcwire.ShaHash, node.height-baseHeight+1)
+	}
+	for iterNode := node; iterNode != nil && iterNode.height >= baseHeight; {
+		hashes[iterNode.height-baseHeight] = *iterNode.hash
+
+		var err error
+		iterNode, err = b.getPrevNodeFromNode(iterNode)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	b.assumeValidNode = node
+	b.assumeValidHashes = hashes
+	b.assumeValidBase = baseHeight
+	return true, nil
+}
+
+// isAssumedValid returns whether or not the scripts of the block for the passed
+// node are assumed to be valid per the block set via SetAssumeValid.  Only
+// blocks after the end of the main chain as of when the assumed valid block
+// became known are considered.
+func (b *BlockChain) isAssumedValid(node *blockNode) (bool, error) {
+	if b.assumeValid == nil {
+		return false, nil
+	}
+	found, err := b.loadAssumeValidNode()
+	if err != nil || !found {
+		return false, err
+	}
+
+	// The node must be the assumed valid block or one of its ancestors.
+	assumeNode := b.assumeValidNode
+	index := node.height - b.assumeValidBase
+	if index < 0 || index >= int64(len(b.assumeValidHashes)) ||
+		!b.assumeValidHashes[index].IsEqual(node.hash) {
+
+		return false, nil
+	}
+
+	// The assumed valid block must be part of the chain with the most
+	// cumulative work.  The tip the check last succeeded for is remembered
+	// so the walk normally only covers the blocks or headers processed
+	// since.
+	tip := b.bestKnownTip()
+	for iterNode := tip; iterNode != b.assumeValidTip; {
+		if iterNode == nil || iterNode.height < assumeNode.height {
+			return false, nil
+		}
+		if iterNode.height == assumeNode.height {
+			if !iterNode.hash.IsEqual(assumeNode.hash) {
+				return false, nil
+			}
+			break
+		}
+
+		iterNode, err = b.getPrevNodeFromNode(iterNode)
+		if err != nil {
+			return false, err
+		}
+	}
+	b.assumeValidTip = tip
+
+	return true, nil
+}
@@ -0,0 +1,465 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcwire"
+	"io"
+	"time"
+)
+
+const (
+	// blockIndexVersion is the version of the serialized block index
+	// format written by SaveBlockIndex.  Version 2 added the blocks which
+	// are known to be invalid and version 3 added the spend journal.
+	blockIndexVersion = 3
+
+	// blockIndexWindow is the number of the most recent block nodes which
+	// are created immediately when loading a block index.  It covers a
+	// full difficulty retarget interval, which is the furthest back the
+	// nodes are needed to process new blocks in the normal case.  The
+	// older nodes are only created once they are needed.
+	blockIndexWindow = 2016
+
+	// maxSerializedSpent is the maximum number of spent outputs a
+	// serialized spend journal entry may have.  It is the number of the
+	// smallest possible transaction inputs, which are 41 bytes, that fit in
+	// a block.
+	maxSerializedSpent = btcwire.MaxBlockPayload / 41
+)
+
+// These constants define the flags stored with each serialized block node.
+const (
+	// blockIndexFlagExtData indicates the block contained extension data.
+	// See hasExtensionData.
+	blockIndexFlagExtData = 1 << iota
+)
+
+// serializedBlockIndexHeader is the fixed size information at the start of a
+// serialized block index.
+type serializedBlockIndexHeader struct {
+	Version   uint32
+	NumNodes  uint32
+	Height    int64
+	PrevBlock btcwire.ShaHash
+}
+
+// serializedBlockNode is the information stored for each block node in a
+// serialized block index.  The height and parent of each node are implied by
+// its position and the work is recalculated from the bits.
+type serializedBlockNode struct {
+	Hash      btcwire.ShaHash
+	Version   uint32
+	Bits      uint32
+	Timestamp uint32
+	Flags     uint8
+}
+
+// serializedInvalidBlock is the information stored for each block which is
+// known to be invalid in a serialized block index.
+type serializedInvalidBlock struct {
+	Hash      btcwire.ShaHash
+	ErrorCode uint32
+}
+
+// serializedSpendJournalEntry is the fixed size information stored for each
+// spend journal entry in a serialized block index.  It is followed by the
+// outputs the block spent.
+type serializedSpendJournalEntry struct {
+	Hash     btcwire.ShaHash
+	Height   int64
+	NumSpent uint32
+}
+
+// serializedSpentTxOut is the information stored for each output spent by a
+// block in a serialized spend journal entry.  The height it was spent at is
+// implied by the entry.
+type serializedSpentTxOut struct {
+	OutPoint    btcwire.OutPoint
+	SpenderHash btcwire.ShaHash
+}
+
+// SaveBlockIndex writes a compact serialization of the main chain block nodes
+// which are currently in memory to the passed writer.  The nodes are those from
+// the end of the main chain back to the oldest contiguous node which has been
+// loaded.  The serialized index can be loaded with LoadBlockIndex when the
+// chain is next created from the same database in order to avoid loading the
+// nodes from the database one at a time.  The blocks which are known to have
+// failed validation are written along with the nodes, so they are still
+// rejected without validating them again after a restart.  So is the spend
+// journal, which is the undo data for the most recent main chain blocks, so
+// blocks can still be disconnected and side chains validated without fetching
+// and re-processing the disconnected blocks after a restart.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SaveBlockIndex(w io.Writer) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return fmt.Errorf("the main chain has not been " +
+			"initialized yet")
+	}
+
+	// Collect the nodes from the oldest to the newest.
+	var nodes []*blockNode
+	for node := b.bestChain; node != nil; node = node.parent {
+		nodes = append(nodes, node)
+	}
+	for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+
+	// The hash of the block before the oldest node is needed to link it to
+	// the rest of the chain once it's loaded again.
+	oldest := nodes[0]
+	header := serializedBlockIndexHeader{
+		Version:  blockIndexVersion,
+		NumNodes: uint32(len(nodes)),
+		Height:   oldest.height,
+	}
+	if oldest.height != 0 {
+		block, err := b.db.FetchBlockBySha(oldest.hash)
+		if err != nil {
+			return err
+		}
+		header.PrevBlock = block.MsgBlock().Header.PrevBlock
+	}
+
+	bw := bufio.NewWriter(w)
+	err := binary.Write(bw, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		serialized := serializedBlockNode{
+			Hash:      *node.hash,
+			Version:   node.version,
+			Bits:      node.bits,
+			Timestamp: uint32(node.timestamp.Unix()),
+		}
+		if node.hasExtensionData {
+			serialized.Flags |= blockIndexFlagExtData
+		}
+		err := binary.Write(bw, binary.LittleEndian, &serialized)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write the blocks which are known to be invalid from the oldest to
+	// the newest so the most recent ones are kept when they are loaded.
+	numInvalid := uint32(len(b.invalidBlockOrder))
+	err = binary.Write(bw, binary.LittleEndian, numInvalid)
+	if err != nil {
+		return err
+	}
+	for i := range b.invalidBlockOrder {
+		hash := &b.invalidBlockOrder[i]
+		serialized := serializedInvalidBlock{
+			Hash:      *hash,
+			ErrorCode: uint32(b.invalidBlocks[*hash].ErrorCode),
+		}
+		err := binary.Write(bw, binary.LittleEndian, &serialized)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write the spend journal from the oldest entry to the newest.
+	numEntries := uint32(len(b.spendJournal))
+	err = binary.Write(bw, binary.LittleEndian, numEntries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range b.spendJournal {
+		serialized := serializedSpendJournalEntry{
+			Hash:     *entry.hash,
+			Height:   entry.height,
+			NumSpent: uint32(len(entry.spent)),
+		}
+		err := binary.Write(bw, binary.LittleEndian, &serialized)
+		if err != nil {
+			return err
+		}
+		for _, spent := range entry.spent {
+			serializedSpent := serializedSpentTxOut{
+				OutPoint:    spent.outPoint,
+				SpenderHash: *spent.spenderHash,
+			}
+			err := binary.Write(bw, binary.LittleEndian,
+				&serializedSpent)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// readSpendJournal reads the spend journal of a serialized block index from the
+// passed reader.  The entries must be for the most recent of the passed
+// serialized main chain nodes, the oldest of which is at the passed height.
+func readSpendJournal(r io.Reader, nodes []serializedBlockNode, height int64) ([]*spendJournalEntry, error) {
+	var numEntries uint32
+	err := binary.Read(r, binary.LittleEndian, &numEntries)
+	if err != nil {
+		return nil, err
+	}
+	if numEntries > uint32(len(nodes)) {
+		return nil, fmt.Errorf("the block index contains %d spend "+
+			"journal entries for %d blocks", numEntries, len(nodes))
+	}
+
+	entries := make([]*spendJournalEntry, 0, numEntries)
+	for i := len(nodes) - int(numEntries); i < len(nodes); i++ {
+		var serialized serializedSpendJournalEntry
+		err := binary.Read(r, binary.LittleEndian, &serialized)
+		if err != nil {
+			return nil, err
+		}
+		if serialized.Hash != nodes[i].Hash ||
+			serialized.Height != height+int64(i) {
+
+			return nil, fmt.Errorf("the spend journal entry for "+
+				"block %v (height %d) does not match the block "+
+				"index", &serialized.Hash, serialized.Height)
+		}
+		if serialized.NumSpent > maxSerializedSpent {
+			return nil, fmt.Errorf("the spend journal entry for "+
+				"block %v contains %d spent outputs which "+
+				"exceeds the max of %d", &serialized.Hash,
+				serialized.NumSpent, maxSerializedSpent)
+		}
+
+		hash := serialized.Hash
+		entry := spendJournalEntry{
+			hash:   &hash,
+			height: serialized.Height,
+			spent:  make([]*spentTxOut, 0, serialized.NumSpent),
+		}
+		for j := uint32(0); j < serialized.NumSpent; j++ {
+			var serializedSpent serializedSpentTxOut
+			err := binary.Read(r, binary.LittleEndian,
+				&serializedSpent)
+			if err != nil {
+				return nil, err
+			}
+			spenderHash := serializedSpent.SpenderHash
+			entry.spent = append(entry.spent, &spentTxOut{
+				outPoint:    serializedSpent.OutPoint,
+				spenderHash: &spenderHash,
+				height:      entry.height,
+			})
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// newBlockNodeFromSerialized returns a new main chain block node at the passed
+// height from the passed serialized block node.  Its workSum is just the work
+// for the node.
+func newBlockNodeFromSerialized(serialized *serializedBlockNode, height int64) *blockNode {
+	hash := serialized.Hash
+	node := blockNode{
+		hash:             &hash,
+		height:           height,
+		workSum:          CalcWork(serialized.Bits),
+		inMainChain:      true,
+		hasExtensionData: serialized.Flags&blockIndexFlagExtData != 0,
+		version:          serialized.Version,
+		bits:             serialized.Bits,
+		timestamp:        time.Unix(int64(serialized.Timestamp), 0),
+	}
+	return &node
+}
+
+// loadDeferredParent returns the parent of the passed node from the nodes of a
+// loaded block index which have not been created yet.  It returns nil when the
+// parent is not one of them, in which case it has to be loaded from the
+// database instead.  It must be called with the process lock held.
+func (b *BlockChain) loadDeferredParent(node *blockNode) *blockNode {
+	numDeferred := len(b.deferredNodes)
+	if numDeferred == 0 || node != b.root ||
+		node.height != b.deferredHeight+int64(numDeferred) {
+
+		return nil
+	}
+
+	serialized := &b.deferredNodes[numDeferred-1]
+	parent := newBlockNodeFromSerialized(serialized, node.height-1)
+	b.deferredNodes = b.deferredNodes[:numDeferred-1]
+
+	// Link the node to the existing nodes the same way loadBlockNode does
+	// when loading the parent of the root from the database.
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	node.parent = parent
+	parent.children = append(parent.children, node)
+	addChildrenWork(parent, parent.workSum)
+	b.root = parent
+	b.index[*parent.hash] = parent
+	b.depNodes[*parent.hash] = append(b.depNodes[*parent.hash], node)
+
+	// The oldest node is linked to the rest of the chain by the hash of the
+	// block before it.
+	if len(b.deferredNodes) == 0 {
+		b.depNodes[b.deferredPrevBlock] = append(
+			b.depNodes[b.deferredPrevBlock], parent)
+	}
+
+	return parent
+}
+
+// LoadBlockIndex loads a block index previously written by SaveBlockIndex from
+// the passed reader.  It must be called before any blocks are processed.  The
+// index must end with the block at the end of the main chain in the database,
+// otherwise the index is stale and an error is returned without loading it.
+//
+// Only the nodes for the most recent blocks are created immediately, which is
+// enough to start processing new blocks.  The rest are created on demand as
+// older blocks are needed, which is still considerably faster than loading them
+// from the database.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) LoadBlockIndex(r io.Reader) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.root != nil {
+		return fmt.Errorf("the block index can only be loaded before " +
+			"any blocks are processed")
+	}
+
+	br := bufio.NewReader(r)
+	var header serializedBlockIndexHeader
+	err := binary.Read(br, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+	if header.Version == 0 || header.Version > blockIndexVersion {
+		return fmt.Errorf("unsupported block index version %d",
+			header.Version)
+	}
+	if header.NumNodes == 0 {
+		return fmt.Errorf("the block index does not contain any nodes")
+	}
+
+	// Read all of the serialized nodes, but only create and link the nodes
+	// for the most recent blocks.
+	serializedNodes := make([]serializedBlockNode, header.NumNodes)
+	err = binary.Read(br, binary.LittleEndian, serializedNodes)
+	if err != nil {
+		return err
+	}
+
+	// Read the blocks which are known to be invalid.  Only the error code
+	// they failed validation with is stored.
+	var serializedInvalid []serializedInvalidBlock
+	if header.Version >= 2 {
+		var numInvalid uint32
+		err = binary.Read(br, binary.LittleEndian, &numInvalid)
+		if err != nil {
+			return err
+		}
+		if numInvalid > maxInvalidBlocks {
+			return fmt.Errorf("the block index contains %d invalid "+
+				"blocks which exceeds the max of %d", numInvalid,
+				maxInvalidBlocks)
+		}
+		serializedInvalid = make([]serializedInvalidBlock, numInvalid)
+		err = binary.Read(br, binary.LittleEndian, serializedInvalid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read the spend journal.
+	var spendJournal []*spendJournalEntry
+	if header.Version >= 3 {
+		spendJournal, err = readSpendJournal(br, serializedNodes,
+			header.Height)
+		if err != nil {
+			return err
+		}
+	}
+
+	numDeferred := 0
+	if len(serializedNodes) > blockIndexWindow {
+		numDeferred = len(serializedNodes) - blockIndexWindow
+	}
+	nodes := make([]*blockNode, 0, len(serializedNodes)-numDeferred)
+	var parent *blockNode
+	for i := numDeferred; i < len(serializedNodes); i++ {
+		node := newBlockNodeFromSerialized(&serializedNodes[i],
+			header.Height+int64(i))
+		if parent != nil {
+			node.parent = parent
+			node.workSum.Add(parent.workSum, node.workSum)
+			parent.children = append(parent.children, node)
+		}
+		nodes = append(nodes, node)
+		parent = node
+	}
+
+	// Make sure the index is for the current end of the main chain.
+	tip := nodes[len(nodes)-1]
+	newestHash, newestHeight, err := b.db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if !tip.hash.IsEqual(newestHash) || tip.height != newestHeight {
+		return fmt.Errorf("the block index ends at block %v (height "+
+			"%d) instead of the end of the main chain %v (height "+
+			"%d)", tip.hash, tip.height, newestHash, newestHeight)
+	}
+
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	// The oldest created node is linked to the rest of the chain by the
+	// hash of the block before it, which is the newest deferred node when
+	// there are any.
+	b.deferredNodes = serializedNodes[:numDeferred]
+	b.deferredHeight = header.Height
+	b.deferredPrevBlock = header.PrevBlock
+	rootPrevHash := header.PrevBlock
+	if numDeferred > 0 {
+		rootPrevHash = serializedNodes[numDeferred-1].Hash
+	}
+
+	b.root = nodes[0]
+	b.depNodes[rootPrevHash] = append(b.depNodes[rootPrevHash], nodes[0])
+	for i, node := range nodes {
+		b.index[*node.hash] = node
+		if i > 0 {
+			prevHash := *nodes[i-1].hash
+			b.depNodes[prevHash] = append(b.depNodes[prevHash], node)
+		}
+	}
+	b.bestChain = tip
+
+	for i := range serializedInvalid {
+		hash := serializedInvalid[i].Hash
+		code := ErrorCode(serializedInvalid[i].ErrorCode)
+		str := fmt.Sprintf("block %v previously failed validation "+
+			"with %v", &hash, code)
+		b.invalidBlocks[hash] = ruleError(code, str)
+		b.invalidBlockOrder = append(b.invalidBlockOrder, hash)
+	}
+
+	for _, entry := range spendJournal {
+		b.addSpendJournalEntry(entry)
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+const (
+	// blockIndexHeaderSize, blockIndexNodeSize, and blockIndexInvalidSize
+	// are the sizes of the header, of each node, and of each invalid block
+	// of a serialized block index.
+	blockIndexHeaderSize  = 48
+	blockIndexNodeSize    = 45
+	blockIndexInvalidSize = 36
+)
+
+// TestBlockIndexRoundTrip ensures a block index written by SaveBlockIndex can
+// be loaded by LoadBlockIndex along with the blocks which are known to be
+// invalid and the spend journal, and that version 1 and 2 indexes, which don't
+// have them, still load and are written back as version 3.
+func TestBlockIndexRoundTrip(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, db, teardown := newTestChain(t, "blockindextest", &params, nil)
+	defer teardown()
+
+	// The fourth block spends the coinbase of the first one, so the spend
+	// journal is needed to tell it was unspent as of the blocks before.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 3)
+	blocks = append(blocks, g.nextBlock(blocks[2],
+		func(msgBlock *btcwire.MsgBlock) {
+			msgBlock.AddTransaction(spendTx(blocks[0], 1000))
+		}))
+	blocks = append(blocks, g.nextBlock(blocks[3]))
+	processBlocks(t, chain, blocks)
+	coinbaseHash, _ := blocks[0].MsgBlock().Transactions[0].TxSha()
+	spentOut := btcwire.NewOutPoint(&coinbaseHash, 0)
+	tip := blocks[len(blocks)-1]
+	bad := g.nextBlock(tip, overpayCoinbase)
+	_, _, err := chain.ProcessBlock(bad)
+	checkRuleError(t, "ProcessBlock (invalid block)", err,
+		btcchain.ErrBadCoinbaseValue)
+
+	var v3 bytes.Buffer
+	if err := chain.SaveBlockIndex(&v3); err != nil {
+		t.Fatalf("SaveBlockIndex: unexpected error %v", err)
+	}
+	if version := binary.LittleEndian.Uint32(v3.Bytes()); version != 3 {
+		t.Fatalf("SaveBlockIndex: got version %d, want 3", version)
+	}
+
+	// A version 2 index is the same without the spend journal and a
+	// version 1 index is also without the invalid blocks.
+	numNodes := binary.LittleEndian.Uint32(v3.Bytes()[4:])
+	v1Size := blockIndexHeaderSize + blockIndexNodeSize*int(numNodes)
+	v1 := make([]byte, v1Size)
+	copy(v1, v3.Bytes())
+	binary.LittleEndian.PutUint32(v1, 1)
+	v2 := make([]byte, v1Size+4+blockIndexInvalidSize)
+	copy(v2, v3.Bytes())
+	binary.LittleEndian.PutUint32(v2, 2)
+
+	// The invalid block is still known after loading the version 2 and 3
+	// indexes, so blocks which build on it are rejected, while it is not
+	// after loading the version 1 index, so they are orphans.  Only the
+	// version 3 index restores the spend journal.
+	tests := []struct {
+		name        string
+		serialized  []byte
+		wantInvalid bool
+		wantJournal bool
+	}{
+		{"version 3", v3.Bytes(), true, true},
+		{"version 2", v2, true, false},
+		{"version 1", v1, false, false},
+	}
+	for i, test := range tests {
+		loaded := newChain(t, db, &params, nil)
+		err := loaded.LoadBlockIndex(bytes.NewReader(test.serialized))
+		if err != nil {
+			t.Fatalf("LoadBlockIndex #%d (%s): unexpected error %v",
+				i, test.name, err)
+		}
+		checkBestBlock(t, "LoadBlockIndex ("+test.name+")", loaded, tip)
+
+		unspent, err := loaded.FetchUtxoAtHeight(spentOut, 2)
+		if test.wantJournal && (err != nil || !unspent) {
+			t.Fatalf("FetchUtxoAtHeight #%d (%s): got unspent %v, "+
+				"error %v, want unspent", i, test.name, unspent,
+				err)
+		}
+		if !test.wantJournal && err == nil {
+			t.Fatalf("FetchUtxoAtHeight #%d (%s): expected error", i,
+				test.name)
+		}
+
+		_, isOrphan, err := loaded.ProcessBlock(g.nextBlock(bad))
+		if test.wantInvalid {
+			checkRuleError(t, "ProcessBlock ("+test.name+")", err,
+				btcchain.ErrInvalidAncestorBlock)
+		} else if err != nil || !isOrphan {
+			t.Fatalf("ProcessBlock #%d (%s): got orphan %v, error "+
+				"%v, want orphan", i, test.name, isOrphan, err)
+		}
+
+		// The loaded index is written back as version 3 and can be
+		// loaded again.
+		var resaved bytes.Buffer
+		if err := loaded.SaveBlockIndex(&resaved); err != nil {
+			t.Fatalf("SaveBlockIndex #%d (%s): unexpected error %v",
+				i, test.name, err)
+		}
+		version := binary.LittleEndian.Uint32(resaved.Bytes())
+		if version != 3 {
+			t.Fatalf("SaveBlockIndex #%d (%s): got version %d, "+
+				"want 3", i, test.name, version)
+		}
+		reloaded := newChain(t, db, &params, nil)
+		err = reloaded.LoadBlockIndex(bytes.NewReader(resaved.Bytes()))
+		if err != nil {
+			t.Fatalf("LoadBlockIndex #%d (%s resaved): unexpected "+
+				"error %v", i, test.name, err)
+		}
+		checkBestBlock(t, "LoadBlockIndex ("+test.name+" resaved)",
+			reloaded, tip)
+	}
+}
+
+// TestLoadBlockIndexErrors ensures LoadBlockIndex rejects block indexes which
+// are malformed or stale without loading them, so the chain can still be
+// loaded from the database afterwards.
+func TestLoadBlockIndexErrors(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, db, teardown := newTestChain(t, "blockindextest", &params, nil)
+	defer teardown()
+
+	// The stale index is saved before the last block is processed.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 3)
+	processBlocks(t, chain, blocks[:2])
+	var stale bytes.Buffer
+	if err := chain.SaveBlockIndex(&stale); err != nil {
+		t.Fatalf("SaveBlockIndex: unexpected error %v", err)
+	}
+	processBlocks(t, chain, blocks[2:])
+	var current bytes.Buffer
+	if err := chain.SaveBlockIndex(&current); err != nil {
+		t.Fatalf("SaveBlockIndex: unexpected error %v", err)
+	}
+
+	// withUint32 returns a copy of the current index with the value at the
+	// passed offset replaced.
+	withUint32 := func(offset int, value uint32) []byte {
+		serialized := append([]byte(nil), current.Bytes()...)
+		binary.LittleEndian.PutUint32(serialized[offset:], value)
+		return serialized
+	}
+	numNodes := binary.LittleEndian.Uint32(current.Bytes()[4:])
+	invalidOffset := blockIndexHeaderSize +
+		blockIndexNodeSize*int(numNodes)
+
+	tests := []struct {
+		name       string
+		serialized []byte
+	}{
+		{"empty", nil},
+		{"truncated header", current.Bytes()[:blockIndexHeaderSize-1]},
+		{"version 0", withUint32(0, 0)},
+		{"unsupported version", withUint32(0, 4)},
+		{"no nodes", withUint32(4, 0)},
+		{"truncated nodes", current.Bytes()[:invalidOffset-1]},
+		{"too many invalid blocks", withUint32(invalidOffset,
+			0xffffffff)},
+		{"too many spend journal entries", withUint32(invalidOffset+4,
+			0xffffffff)},
+		{"truncated spend journal", current.Bytes()[:current.Len()-1]},
+		{"stale", stale.Bytes()},
+	}
+
+	for i, test := range tests {
+		loaded := newChain(t, db, &params, nil)
+		err := loaded.LoadBlockIndex(bytes.NewReader(test.serialized))
+		if err == nil {
+			t.Errorf("LoadBlockIndex #%d (%s): expected error", i,
+				test.name)
+			continue
+		}
+
+		// Nothing was loaded, so the main chain is loaded from the
+		// database when the next block is processed.
+		if hash, _ := loaded.BestBlock(); hash != nil {
+			t.Errorf("LoadBlockIndex #%d (%s): loaded best block %v",
+				i, test.name, hash)
+		}
+	}
+
+	// An index can't be loaded once blocks have been processed.
+	err := chain.LoadBlockIndex(bytes.NewReader(current.Bytes()))
+	if err == nil {
+		t.Errorf("LoadBlockIndex (blocks processed): expected error")
+	}
+}
+
+// tipDb is a btcdb.Db which only knows the end of the main chain.  It allows a
+// block index to be loaded without a database which contains all of its
+// blocks.
+type tipDb struct {
+	btcdb.Db
+	hash   *btcwire.ShaHash
+	height int64
+}
+
+// NewestSha returns the hash and height of the end of the main chain.  It is
+// part of the btcdb.Db interface.
+func (db *tipDb) NewestSha() (*btcwire.ShaHash, int64, error) {
+	return db.hash, db.height, nil
+}
+
+// benchBlockIndex returns a version 1 serialized block index with the passed
+// number of nodes starting from the genesis block of the passed parameters
+// along with a database which ends with its last node.
+func benchBlockIndex(params *btcchain.Params, numNodes int) ([]byte, btcdb.Db) {
+	genesisHeader := &params.GenesisBlock.Header
+	serialized := make([]byte, blockIndexHeaderSize+
+		blockIndexNodeSize*numNodes)
+	binary.LittleEndian.PutUint32(serialized, 1)
+	binary.LittleEndian.PutUint32(serialized[4:], uint32(numNodes))
+
+	var hash btcwire.ShaHash
+	for i := 0; i < numNodes; i++ {
+		binary.LittleEndian.PutUint64(hash[:], uint64(i+1))
+		node := serialized[blockIndexHeaderSize+blockIndexNodeSize*i:]
+		copy(node, hash[:])
+		binary.LittleEndian.PutUint32(node[32:],
+			uint32(genesisHeader.Version))
+		binary.LittleEndian.PutUint32(node[36:], genesisHeader.Bits)
+		binary.LittleEndian.PutUint32(node[40:],
+			uint32(genesisHeader.Timestamp.Unix())+uint32(i)*600)
+	}
+	return serialized, &tipDb{hash: &hash, height: int64(numNodes - 1)}
+}
+
+// BenchmarkLoadBlockIndex benchmarks loading a block index with as many nodes
+// as a long chain has, which only creates the nodes for the most recent blocks.
+func BenchmarkLoadBlockIndex(b *testing.B) {
+	params := btcchain.RegressionNetParams
+	serialized, db := benchBlockIndex(&params, 300000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain, err := btcchain.New(db, &params, nil)
+		if err != nil {
+			b.Fatalf("New: unexpected error %v", err)
+		}
+		err = chain.LoadBlockIndex(bytes.NewReader(serialized))
+		if err != nil {
+			b.Fatalf("LoadBlockIndex: unexpected error %v", err)
+		}
+	}
+}
+
+// BenchmarkLoadBlockIndexAllNodes benchmarks loading the same block index as
+// BenchmarkLoadBlockIndex followed by creating all of the nodes which are
+// otherwise only created on demand, which is what loading it used to do.
+func BenchmarkLoadBlockIndexAllNodes(b *testing.B) {
+	params := btcchain.RegressionNetParams
+	serialized, db := benchBlockIndex(&params, 300000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain, err := btcchain.New(db, &params, nil)
+		if err != nil {
+			b.Fatalf("New: unexpected error %v", err)
+		}
+		err = chain.LoadBlockIndex(bytes.NewReader(serialized))
+		if err != nil {
+			b.Fatalf("LoadBlockIndex: unexpected error %v", err)
+		}
+		chain.TstCreateDeferredNodes()
+	}
+}
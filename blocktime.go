@@ -0,0 +1,82 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"sort"
+	"time"
+)
+
+// mainChainMedianTime returns the median time of the main chain block at the
+// passed height and the medianTimeBlocks-1 blocks before it.  This is the same
+// value calcPastMedianTime returns, but it is calculated directly from the
+// database so it does not require the block nodes to be loaded.
+func (b *BlockChain) mainChainMedianTime(height int64) (time.Time, error) {
+	timestamps := make([]time.Time, 0, medianTimeBlocks)
+	for h := height; h >= 0 && h > height-medianTimeBlocks; h-- {
+		block, err := b.fetchMainChainBlockByHeight(h)
+		if err != nil {
+			return time.Time{}, err
+		}
+		timestamps = append(timestamps, block.MsgBlock().Header.Timestamp)
+	}
+
+	// See calcPastMedianTime for a discussion of why the middle element
+	// is used even when there is an even number of timestamps.
+	sort.Sort(timeSorter(timestamps))
+	return timestamps[len(timestamps)/2], nil
+}
+
+// BlockByTimestamp returns the hash and height of the most recent main chain
+// block with a median time past that is not after the passed time.  This is
+// useful for locating the block at a given date, such as the creation date, or
+// birthday, of a wallet.
+//
+// The median time past is used as opposed to the individual block timestamps
+// since, unlike the timestamps, it never decreases as the chain grows.  This
+// allows the block to be found with a binary search over the main chain
+// heights, so only the blocks needed to calculate the median time past of a
+// logarithmic number of heights are loaded rather than walking the chain.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) BlockByTimestamp(t time.Time) (*btcwire.ShaHash, int64, error) {
+	_, bestHeight, err := b.db.NewestSha()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Search for the first block with a median time after the passed time.
+	// The block before it is the one being searched for.  Since
+	// sort.Search has no way to return an error, the first one is saved
+	// and returned once the search completes.
+	var searchErr error
+	firstAfter := sort.Search(int(bestHeight+1), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		medianTime, err := b.mainChainMedianTime(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return medianTime.After(t)
+	})
+	if searchErr != nil {
+		return nil, 0, searchErr
+	}
+	if firstAfter == 0 {
+		return nil, 0, fmt.Errorf("no main chain blocks have a median "+
+			"time at or before %v", t)
+	}
+
+	height := int64(firstAfter - 1)
+	hash, err := b.db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash, height, nil
+}
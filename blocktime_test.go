@@ -0,0 +1,99 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestBlockByTimestamp ensures BlockByTimestamp finds the most recent main
+// chain block with a median time past at or before the passed time, including
+// when the block timestamps themselves are out of order.
+func TestBlockByTimestamp(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "blocktimetest", &params, nil)
+	defer teardown()
+
+	// Build a main chain where the timestamp of one block is before the
+	// one of its parent.
+	g := newBlockGenerator(&params)
+	blocks := []*btcutil.Block{g.genesis()}
+	for i := 1; i <= 30; i++ {
+		var block *btcutil.Block
+		if i == 15 {
+			block = g.nextBlock(blocks[i-1],
+				func(msgBlock *btcwire.MsgBlock) {
+					msgBlock.Header.Timestamp = msgBlock.Header.
+						Timestamp.Add(-30 * time.Minute)
+				})
+		} else {
+			block = g.nextBlock(blocks[i-1])
+		}
+		blocks = append(blocks, block)
+	}
+	processBlocks(t, chain, blocks[1:])
+
+	// Calculate the median time past of every block the slow way.
+	medianTimes := make([]time.Time, len(blocks))
+	for i := range blocks {
+		var timestamps []time.Time
+		for j := i; j >= 0 && j > i-11; j-- {
+			timestamps = append(timestamps,
+				blocks[j].MsgBlock().Header.Timestamp)
+		}
+		sort.Sort(btcchain.TstTimeSorter(timestamps))
+		medianTimes[i] = timestamps[len(timestamps)/2]
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+	}{
+		{"genesis", medianTimes[0]},
+		{"just before the first block", medianTimes[1].Add(-time.Second)},
+		{"exactly at a block", medianTimes[12]},
+		{"between blocks", medianTimes[20].Add(time.Second)},
+		{"after out of order timestamp", medianTimes[16]},
+		{"at the tip", medianTimes[30]},
+		{"after the tip", medianTimes[30].Add(time.Hour)},
+	}
+
+	for i, test := range tests {
+		// Several blocks can share a median time past, in which case
+		// the most recent of them is the one which must be found.
+		var wantHeight int64
+		for h := range medianTimes {
+			if !medianTimes[h].After(test.t) {
+				wantHeight = int64(h)
+			}
+		}
+
+		hash, height, err := chain.BlockByTimestamp(test.t)
+		if err != nil {
+			t.Errorf("BlockByTimestamp #%d (%s): unexpected error %v",
+				i, test.name, err)
+			continue
+		}
+		if height != wantHeight ||
+			!hash.IsEqual(blockHash(blocks[wantHeight])) {
+
+			t.Errorf("BlockByTimestamp #%d (%s): got %v (height %d), "+
+				"want %v (height %d)", i, test.name, hash, height,
+				blockHash(blocks[wantHeight]), wantHeight)
+		}
+	}
+
+	// There is no block with a median time past before the genesis block.
+	_, _, err := chain.BlockByTimestamp(medianTimes[0].Add(-time.Second))
+	if err == nil {
+		t.Errorf("BlockByTimestamp: expected error for time before the " +
+			"genesis block")
+	}
+}
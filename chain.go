@@ -12,11 +12,44 @@ import (
 	"github.com/conformal/btcwire"
 	"math/big"
 	"sort"
+	"sync"
 	"time"
 )
 
-// maxOrphanBlocks is the maximum number of orphan blocks that can be queued.
-const maxOrphanBlocks = 100
+const (
+	// maxOrphanBlocks is the maximum number of orphan blocks that can be
+	// queued.
+	maxOrphanBlocks = 100
+
+	// maxOrphanAge is the maximum amount of time an orphan block is held
+	// while waiting for its parent.
+	maxOrphanAge = time.Hour
+)
+
+const (
+	// maxKnownBlockVersion is the highest block version this package
+	// knows the rules for.  Blocks with a higher version are an indication
+	// the network has been upgraded to rules which are not implemented
+	// here.
+	maxKnownBlockVersion = checkLockTimeVerifyVersion
+
+	// unknownVersionNumToCheck is the number of previous blocks which are
+	// examined when determining whether to warn about blocks with unknown
+	// versions.
+	unknownVersionNumToCheck = 1000
+
+	// unknownVersionWarnThreshold is the number of blocks out of the
+	// previous unknownVersionNumToCheck blocks which must have an unknown
+	// version in order to warn that a majority of the network may be
+	// running newer software.
+	unknownVersionWarnThreshold = 510
+
+	// unknownVersionRulesThreshold is the number of blocks out of the
+	// previous unknownVersionNumToCheck blocks which must have an unknown
+	// version in order to warn that new rules have very likely been
+	// activated by a supermajority of the network.
+	unknownVersionRulesThreshold = 950
+)
 
 // blockNode represents a block within the block chain and is primarily used to
 // aid in selecting the best chain to be the main chain.  The main chain is
@@ -38,13 +71,21 @@ type blockNode struct {
 
 	// workSum is the total amount of work in the chain up to and including
 	// this node.
-	workSum *big.Rat
+	workSum *big.Int
 
 	// inMainChain denotes whether the block node is currently on the
 	// the main chain or not.  This is used to help find the common
 	// ancestor when switching chains.
 	inMainChain bool
 
+	// status houses the validation state of the block.  See blockStatus.
+	status blockStatus
+
+	// hasExtensionData denotes whether or not the serialized block
+	// contained data beyond what is understood at the protocol version it
+	// was decoded with.
+	hasExtensionData bool
+
 	// Some fields from block headers to aid in best chain selection.
 	version   uint32
 	bits      uint32
@@ -64,28 +105,32 @@ func newBlockNode(block *btcutil.Block) *blockNode {
 	blockHeader := block.MsgBlock().Header
 	node := blockNode{
 		hash:      blockSha,
-		workSum:   calcWork(blockHeader.Bits),
+		workSum:   CalcWork(blockHeader.Bits),
 		height:    block.Height(),
 		version:   blockHeader.Version,
 		bits:      blockHeader.Bits,
 		timestamp: blockHeader.Timestamp,
+
+		hasExtensionData: hasExtensionData(block),
 	}
 	return &node
 }
 
 // orphanBlock represents a block that we don't yet have the parent for.  It
-// is a normal block plus an expiration time to prevent caching the orphan
-// forever.
+// is a normal block plus the time it was received to prevent caching the
+// orphan forever and its serialized size to limit the memory used by the orphan
+// pool.
 type orphanBlock struct {
-	block      *btcutil.Block
-	expiration time.Time
+	block    *btcutil.Block
+	received time.Time
+	size     int64
 }
 
 // addChildrenWork adds the passed work amount to all children all the way
 // down the chain.  It is used primarily to allow a new node to be dynamically
 // inserted from the database into the memory chain prior to nodes we already
 // have and update their work values accordingly.
-func addChildrenWork(node *blockNode, work *big.Rat) {
+func addChildrenWork(node *blockNode, work *big.Int) {
 	for _, childNode := range node.children {
 		childNode.workSum.Add(childNode.workSum, work)
 		addChildrenWork(childNode, work)
@@ -115,19 +160,197 @@ func removeChildNode(children []*blockNode, node *blockNode) []*blockNode {
 // follow all rules, orphan handling, checkpoint handling, and best chain
 // selection with reorganization.
 type BlockChain struct {
-	db            btcdb.Db
-	btcnet        btcwire.BitcoinNet
-	notifications chan *Notification
-	root          *blockNode
-	bestChain     *blockNode
-	index         map[btcwire.ShaHash]*blockNode
-	depNodes      map[btcwire.ShaHash][]*blockNode
-	orphans       map[btcwire.ShaHash]*orphanBlock
-	prevOrphans   map[btcwire.ShaHash][]*orphanBlock
-	oldestOrphan  *orphanBlock
-	blockCache    map[btcwire.ShaHash]*btcutil.Block
-	noVerify      bool
-	noCheckpoints bool
+	// processLock serializes all processing which modifies the chain or
+	// dynamically loads block nodes, such as ProcessBlock.  It is held for
+	// the entire duration of the processing including the potentially
+	// long running script validation.
+	//
+	// chainLock protects the committed state of the chain for read-only
+	// queries.  It is only held exclusively while the processing which
+	// holds processLock briefly commits changes to that state, so queries
+	// are able to proceed while blocks are being validated.  It must never
+	// be held while calling code which might acquire it again or while
+	// sending notifications.
+	processLock sync.Mutex
+	chainLock   sync.RWMutex
+
+	db               btcdb.Db
+	chainParams      *Params
+	notifications    chan *Notification
+	tipUpdates       chan TipUpdate
+	resurrectTxns    chan []ReorgTx
+	root             *blockNode
+	bestChain        *blockNode
+	index            map[btcwire.ShaHash]*blockNode
+	depNodes         map[btcwire.ShaHash][]*blockNode
+	orphans          map[btcwire.ShaHash]*orphanBlock
+	prevOrphans      map[btcwire.ShaHash][]*orphanBlock
+	orphanBytes      int64
+	blockCache       map[btcwire.ShaHash]*btcutil.Block
+	blockCacheBytes  int64
+	noVerify         bool
+	noCheckpoints    bool
+	scanSigEncodings bool
+
+	// checkpoints houses the checkpoints used by the chain.  They are the
+	// ones from the network parameters unless others were provided.  See
+	// checkpointData.
+	checkpoints *checkpointData
+
+	// These fields cache the header of the latest known checkpoint.  See
+	// latestKnownCheckpointHeader.
+	checkpointHeader     *btcwire.BlockHeader
+	checkpointHeaderHash *btcwire.ShaHash
+
+	// These fields track which unknown version warnings have been issued
+	// so the caller is only notified when the situation gets worse.
+	unknownVersionsWarned bool
+	unknownRulesWarned    bool
+
+	// These fields are used to track how often blocks are reorganized out
+	// of the main chain and how deep those reorganizations are.  The
+	// tracked reorganizations are the ones which took place after
+	// reorgWindowStart blocks were connected.  See SuggestedConfirmations.
+	blocksConnected  int64
+	reorgWindowStart int64
+	recentReorgs     []trackedReorg
+
+	// recentStats houses the statistics gathered for the most recently
+	// connected main chain blocks.  scriptTypeTotals houses the output
+	// script type counts for all of the main chain blocks which were
+	// connected by this instance.
+	recentStats      []*blockStats
+	scriptTypeTotals ScriptTypeCounts
+
+	// burnedTotals houses the cumulative amount of burned coins as of each
+	// main chain block starting from the genesis block.  It is indexed by
+	// block height.
+	burnedTotals []int64
+
+	// headerIndex houses nodes for block headers which have been processed
+	// via ProcessBlockHeader, but for which the full block is not yet
+	// available.  bestHeader is the header node with the most cumulative
+	// work.  headerPruneHeight is the height the header index was last
+	// pruned at.  See pruneHeaderIndex.
+	headerIndex       map[btcwire.ShaHash]*blockNode
+	bestHeader        *blockNode
+	headerPruneHeight int64
+
+	// These fields track the processing quotas and resource usage of the
+	// sources blocks are processed from.  See ProcessBlockFromSource.
+	sourceQuotas map[string]SourceQuota
+	sourceUsages map[string]*sourceUsage
+	defaultQuota SourceQuota
+
+	// indexers houses the optional indexes which are kept in sync with the
+	// main chain.  See AddIndexer.
+	indexers []*indexerState
+
+	// rejectedBlocks houses the most recent blocks which were rejected for
+	// rule violations.  They are also recorded to the file at
+	// rejectLogPath, which currently contains rejectLogLines records, when
+	// it is set.  See SetRejectedBlockLog.
+	rejectedBlocks []RejectedBlock
+	rejectLogPath  string
+	rejectLogLines int
+
+	// spendJournal houses the outputs spent by the most recent main chain
+	// blocks ordered by height while spentOutputs indexes them by the
+	// spent output.  See FetchUtxoAtHeight.
+	spendJournal []*spendJournalEntry
+	spentOutputs map[btcwire.OutPoint]*spentTxOut
+
+	// remoteTips houses the most recent tip reported by each source via
+	// ObserveRemoteTip.  See checkDivergence.
+	remoteTips         map[string]*remoteTip
+	divergenceDepth    int64
+	divergenceReported bool
+
+	// finalityDepth is the number of confirmations after which main chain
+	// blocks are reported via NTBlockFinalized notifications while
+	// finalizedHeight and finalizedHash identify the last reported block.
+	// lastFinalized is the last reported block passed to SetFinalityDepth
+	// and finalityResolved is whether or not it has been looked up yet.
+	// See SetFinalityDepth.
+	finalityDepth    int64
+	finalizedHeight  int64
+	finalizedHash    btcwire.ShaHash
+	lastFinalized    *btcwire.ShaHash
+	finalityResolved bool
+
+	// invalidBlocks houses the rule errors of the most recent blocks which
+	// failed validation, including those which were rejected for building
+	// on one, while invalidBlockOrder tracks the order they were added in.
+	// See markBlockInvalid.
+	invalidBlocks     map[btcwire.ShaHash]RuleError
+	invalidBlockOrder []btcwire.ShaHash
+
+	// reorgJournalPath is the file reorganizations are journaled to.  See
+	// SetReorgJournal.
+	reorgJournalPath string
+
+	// genesisChecked is whether or not the database has been verified to
+	// contain the genesis block of the network.  See InitGenesis.
+	genesisChecked bool
+
+	// sideChainDir is the directory side chain blocks are persisted to
+	// while storedBlocks houses the hashes of the blocks which are, some
+	// of which may have been evicted from the side chain block cache.  See
+	// SetSideChainBlockDir.
+	sideChainDir string
+	storedBlocks map[btcwire.ShaHash]struct{}
+
+	// maxReorgDepth is the maximum number of main chain blocks a
+	// reorganization may disconnect.  See SetMaxReorgDepth.
+	maxReorgDepth int64
+
+	// sanityLimits houses the transaction size and count limits enforced
+	// by the block sanity checks.  See SetSanityLimits.
+	sanityLimits SanityLimits
+
+	// timeSource provides the network-adjusted time used when validating
+	// block timestamps.  See SetMedianTimeSource.
+	timeSource MedianTimeSource
+
+	// resourceLimits houses the caps on the memory used by the chain.  See
+	// SetResourceLimits.
+	resourceLimits ResourceLimits
+
+	// scriptWorkers is the number of goroutines used to validate scripts.
+	// See SetScriptValidationWorkers.
+	scriptWorkers int
+
+	// scriptEngine verifies the scripts of transaction inputs.  See
+	// NewWithScriptEngine.
+	scriptEngine ScriptEngine
+
+	// interrupt is closed to stop long-running operations early.  See
+	// SetInterrupt.
+	interrupt <-chan struct{}
+
+	// assumeValid is the hash of the block whose ancestors are assumed to
+	// have valid scripts.  The remaining fields cache its node, the hashes
+	// of its ancestors after the main chain by height starting at
+	// assumeValidBase, and the best tip it was last found to be part of.
+	// See SetAssumeValid.
+	assumeValid       *btcwire.ShaHash
+	assumeValidNode   *blockNode
+	assumeValidHashes []btcwire.ShaHash
+	assumeValidBase   int64
+	assumeValidTip    *blockNode
+
+	// deferredNodes houses the serialized nodes from a loaded block index
+	// which have not been created yet, starting with the node at
+	// deferredHeight whose previous block is deferredPrevBlock.  See
+	// LoadBlockIndex.
+	deferredNodes     []serializedBlockNode
+	deferredHeight    int64
+	deferredPrevBlock btcwire.ShaHash
+
+	// thresholdCaches houses the cached threshold states of each of the
+	// version bits deployments keyed by the last block of each retarget
+	// interval.  See thresholdState.
+	thresholdCaches [numDeployments]map[btcwire.ShaHash]ThresholdState
 }
 
 // DisableVerify provides a mechanism to disable transaction script validation
@@ -163,6 +386,7 @@ func (b *BlockChain) removeOrphanBlock(orphan *orphanBlock) {
 	// the error on Sha since it's cached.
 	orphanHash, _ := orphan.block.Sha()
 	delete(b.orphans, *orphanHash)
+	b.orphanBytes -= orphan.size
 
 	// Remove the reference from the previous orphan index too.
 	prevHash := &orphan.block.MsgBlock().Header.PrevBlock
@@ -183,52 +407,89 @@ func (b *BlockChain) removeOrphanBlock(orphan *orphanBlock) {
 	}
 }
 
-// addOrphanBlock adds the passed block (which is already determined to be
-// an orphan prior calling this function) to the orphan pool.  It lazily cleans
-// up any expired blocks so a separate cleanup poller doesn't need to be run.
-// It also imposes a maximum limit on the number of outstanding orphan
-// blocks and will remove the oldest received orphan block if the limit is
-// exceeded.
-func (b *BlockChain) addOrphanBlock(block *btcutil.Block) {
-	// Remove expired orphan blocks.
+// oldestOrphanBlock returns the orphan block which was received first or nil
+// when there are no orphans.
+func (b *BlockChain) oldestOrphanBlock() *orphanBlock {
+	var oldest *orphanBlock
 	for _, oBlock := range b.orphans {
-		if time.Now().After(oBlock.expiration) {
-			b.removeOrphanBlock(oBlock)
-			continue
+		if oldest == nil || oBlock.received.Before(oldest.received) {
+			oldest = oBlock
 		}
+	}
+	return oldest
+}
 
-		// Update the oldest orphan block pointer so it can be discarded
-		// in case the orphan pool fills up.
-		if b.oldestOrphan == nil || oBlock.expiration.Before(b.oldestOrphan.expiration) {
-			b.oldestOrphan = oBlock
+// removeExpiredOrphans removes the orphan blocks which have been waiting for
+// their parents for longer than the max orphan age from the orphan pool.  It is
+// called lazily as blocks are processed so a separate cleanup poller doesn't
+// need to be run.
+func (b *BlockChain) removeExpiredOrphans() {
+	expiration := time.Now().Add(-b.orphanAge())
+	for _, oBlock := range b.orphans {
+		if oBlock.received.Before(expiration) {
+			orphanHash, _ := oBlock.block.Sha()
+			log.Debugf("Expiring orphan block %v received at %v",
+				orphanHash, oBlock.received)
+			b.removeOrphanBlock(oBlock)
 		}
 	}
+}
 
-	// Limit orphan blocks to prevent memory exhaustion.
-	if len(b.orphans)+1 > maxOrphanBlocks {
-		// Remove the oldest orphan to make room for the new one.
-		b.removeOrphanBlock(b.oldestOrphan)
-		b.oldestOrphan = nil
+// addOrphanBlock adds the passed block (which is already determined to be
+// an orphan prior calling this function) to the orphan pool.  It imposes a
+// maximum limit on the number of outstanding orphan blocks and their total
+// size and will remove the oldest received orphan blocks until the new one
+// fits within the limits.  A ResourceError is returned, without removing any
+// orphans, when the block is larger than the total size limit on its own.
+func (b *BlockChain) addOrphanBlock(block *btcutil.Block) error {
+	serializedBlock, err := block.Bytes()
+	if err != nil {
+		return deserializationError(err)
+	}
+	size := int64(len(serializedBlock))
+
+	// Reject orphans which could never fit within the total size limit
+	// before evicting anything, otherwise a single large orphan would
+	// flush the entire pool.
+	maxBytes := b.resourceLimits.MaxOrphanBytes
+	if maxBytes > 0 && size > maxBytes {
+		str := fmt.Sprintf("orphan block of %d bytes exceeds the max "+
+			"allowed orphan pool size of %d bytes", size, maxBytes)
+		return ResourceError(str)
+	}
+
+	// Limit orphan blocks to prevent memory exhaustion.  The oldest
+	// orphans are the least likely to still have their parents arrive, so
+	// they are removed to make room for the new one.
+	for len(b.orphans) > 0 && (len(b.orphans)+1 > b.orphanLimit() ||
+		(maxBytes > 0 && b.orphanBytes+size > maxBytes)) {
+
+		oldest := b.oldestOrphanBlock()
+		oldestHash, _ := oldest.block.Sha()
+		log.Debugf("Evicting orphan block %v to make room for new "+
+			"orphans", oldestHash)
+		b.removeOrphanBlock(oldest)
 	}
 
 	// Get the block sha.  It is safe to ignore the error here since any
 	// errors would've been caught prior to calling this function.
 	blockSha, _ := block.Sha()
 
-	// Insert the block into the orphan map with an expiration time
-	// 1 hour from now.
-	expiration := time.Now().Add(time.Hour)
+	// Insert the block into the orphan map along with the time it was
+	// received so it expires if its parent never arrives.
 	oBlock := &orphanBlock{
-		block:      block,
-		expiration: expiration,
+		block:    block,
+		received: time.Now(),
+		size:     size,
 	}
 	b.orphans[*blockSha] = oBlock
+	b.orphanBytes += size
 
 	// Add to previous hash lookup index for faster dependency lookups.
 	prevHash := &block.MsgBlock().Header.PrevBlock
 	b.prevOrphans[*prevHash] = append(b.prevOrphans[*prevHash], oBlock)
 
-	return
+	return nil
 }
 
 // loadBlockNode loads the block identified by hash from the block database,
@@ -239,13 +500,18 @@ func (b *BlockChain) loadBlockNode(hash *btcwire.ShaHash) (*blockNode, error) {
 	// Load the block from the db.
 	block, err := b.db.FetchBlockBySha(hash)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 
 	// Create the new block node for the block and set the work.
 	node := newBlockNode(block)
 	node.inMainChain = true
 
+	// Adding the node to the chain updates the work sums of existing
+	// nodes, so prevent queries from seeing them mid-update.
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
 	// Add the node to the chain.
 	// There are several possibilities here:
 	//  1) This node is a child of an existing block node
@@ -339,15 +605,21 @@ func (b *BlockChain) getPrevNodeFromNode(node *blockNode) (*blockNode, error) {
 	}
 
 	// Genesis block.
-	if node.hash.IsEqual(&btcwire.GenesisHash) {
+	if node.hash.IsEqual(b.chainParams.GenesisHash) {
 		return nil, nil
 	}
 
+	// Create the previous block node from a loaded block index when it is
+	// available there since that avoids loading the block from the db.
+	if prevNode := b.loadDeferredParent(node); prevNode != nil {
+		return prevNode, nil
+	}
+
 	// Load the actual block for this block node from the db to ascertain
 	// the previous hash.
 	block, err := b.db.FetchBlockBySha(node.hash)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 
 	// Dynamically load the previous block from the block database, create
@@ -387,13 +659,91 @@ func (b *BlockChain) isMajorityVersion(minVer uint32, startNode *blockNode, numR
 	return numFound >= numRequired
 }
 
+// countUnknownVersions returns the number of blocks out of the previous
+// numToCheck blocks in the chain starting with startNode which have a version
+// that is higher than the latest version known to this package along with the
+// number of blocks that were actually checked (which will be fewer than
+// numToCheck near the beginning of the block chain).
+func (b *BlockChain) countUnknownVersions(startNode *blockNode, numToCheck uint64) (uint64, uint64) {
+	numUnknown := uint64(0)
+	numChecked := uint64(0)
+	iterNode := startNode
+	for ; numChecked < numToCheck && iterNode != nil; numChecked++ {
+		if b.isUnknownVersion(iterNode.version) {
+			numUnknown++
+		}
+
+		// Get the previous block node.  This function is used over
+		// simply accessing iterNode.parent directly as it will
+		// dynamically create previous block nodes as needed.  This
+		// helps allow only the pieces of the chain that are needed
+		// to remain in memory.
+		var err error
+		iterNode, err = b.getPrevNodeFromNode(iterNode)
+		if err != nil {
+			break
+		}
+	}
+
+	return numUnknown, numChecked
+}
+
+// warnUnknownVersions examines the versions of the blocks leading up to and
+// including the passed node, which is expected to be the new end of the main
+// chain, and notifies the caller via an NTUnknownVersion notification when a
+// majority of them have a version this package does not know about.  A
+// further, more urgent, notification is sent once a supermajority of them
+// have an unknown version since that means new rules have most likely been
+// activated.  Each warning is only sent once unless the number of blocks with
+// unknown versions drops back below the associated threshold.
+func (b *BlockChain) warnUnknownVersions(node *blockNode) {
+	// There is nothing new to warn about when the block is a known version
+	// and no warnings have been issued which might need to be reset.
+	if !b.isUnknownVersion(node.version) && !b.unknownVersionsWarned {
+		return
+	}
+
+	numUnknown, numChecked := b.countUnknownVersions(node,
+		unknownVersionNumToCheck)
+	warn := numUnknown >= unknownVersionWarnThreshold
+	warnRules := numUnknown >= unknownVersionRulesThreshold
+
+	// Only notify when the situation has gotten worse since the last
+	// warning.
+	notify := (warn && !b.unknownVersionsWarned) ||
+		(warnRules && !b.unknownRulesWarned)
+	b.unknownVersionsWarned = warn
+	b.unknownRulesWarned = warnRules
+	if !notify {
+		return
+	}
+
+	if warnRules {
+		log.Warnf("%d of the last %d blocks have an unknown version -- "+
+			"new rules are very likely in effect which are not "+
+			"being enforced", numUnknown, numChecked)
+	} else {
+		log.Warnf("%d of the last %d blocks have an unknown version -- "+
+			"a majority of the network may be running newer "+
+			"software", numUnknown, numChecked)
+	}
+
+	b.sendNotification(NTUnknownVersion, &UnknownVersionWarning{
+		Hash:          node.hash,
+		Height:        node.height,
+		NumUnknown:    numUnknown,
+		NumChecked:    numChecked,
+		Supermajority: warnRules,
+	})
+}
+
 // calcPastMedianTime calculates the median time of the previous few blocks
 // prior to, and including, the passed block node.  It is primarily used to
 // validate new blocks have sane timestamps.
 func (b *BlockChain) calcPastMedianTime(startNode *blockNode) (time.Time, error) {
 	// Genesis block.
 	if startNode == nil {
-		return btcwire.GenesisBlock.Header.Timestamp, nil
+		return b.chainParams.GenesisBlock.Header.Timestamp, nil
 	}
 
 	// Create a slice of the previous few block timestamps used to calculate
@@ -486,8 +836,9 @@ func (b *BlockChain) getReorganizeNodes(node *blockNode) (*list.List, *list.List
 }
 
 // connectBlock handles connecting the passed node/block to the end of the main
-// (best) chain.
-func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block) error {
+// (best) chain.  The passed statistics are those that were gathered for the
+// block when it was checked by checkConnectBlock.
+func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block, stats *blockStats) error {
 	// Make sure it's extending the end of the best chain.
 	prevHash := &block.MsgBlock().Header.PrevBlock
 	if b.bestChain != nil && !prevHash.IsEqual(b.bestChain.hash) {
@@ -498,24 +849,48 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block) error {
 	// Insert the block into the database which houses the main chain.
 	_, err := b.db.InsertBlock(block)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
 	// TODO(davec): Remove transactions from memory transaction pool.
 
 	// Add the new node to the memory main chain indices for faster
 	// lookups.
+	b.chainLock.Lock()
 	node.inMainChain = true
 	b.index[*node.hash] = node
 	b.depNodes[*prevHash] = append(b.depNodes[*prevHash], node)
 
 	// This node is now the end of the best chain.
 	b.bestChain = node
+	b.blocksConnected++
+	b.addBlockStats(stats)
+	b.trackBurnedAmount(node, block)
+	b.addSpendJournalEntry(newSpendJournalEntry(node, block))
+	b.chainLock.Unlock()
+
+	// Update the optional indexes before notifying the caller so they
+	// reflect the block by the time the caller reacts to it.
+	b.connectIndexers(block)
 
 	// Notify the caller that the block was connected to the main chain.
 	// The caller would typically want to react with actions such as
 	// updating wallets.
 	b.sendNotification(NTBlockConnected, block)
+	b.sendTipUpdate()
+
+	// Warn the caller if the network appears to have been upgraded to
+	// rules this package does not know about.
+	b.warnUnknownVersions(node)
+
+	// Report on the encodings of the signatures in the block if requested.
+	b.reportSignatureEncodings(node, block)
+
+	// Report any block which is now deep enough to be considered final.
+	b.reportFinalizedBlocks(node)
+
+	// Discard any side chains which are now too deep to hold.
+	b.pruneSideChains()
 
 	return nil
 }
@@ -536,22 +911,33 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block) erro
 	}
 	err = b.db.DropAfterBlockBySha(prevNode.hash)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
 	// TODO(davec): Put transactions back in memory transaction pool.
 
 	// Put block in the side chain cache.
+	b.chainLock.Lock()
 	node.inMainChain = false
-	b.blockCache[*node.hash] = block
+	b.cacheSideChainBlock(node.hash, block)
 
 	// This node's parent is now the end of the best chain.
 	b.bestChain = node.parent
+	if stats := b.removeBlockStats(node); stats != nil {
+		b.scriptTypeTotals.subtract(&stats.scriptTypes)
+	}
+	b.untrackBurnedAmount(node)
+	b.removeSpendJournalEntry(node.hash)
+	b.chainLock.Unlock()
+
+	// Update the optional indexes.
+	b.disconnectIndexers(block)
 
 	// Notify the caller that the block was disconnect from the main chain.
 	// The caller would typically want to react with actions such as
 	// updating wallets.
 	b.sendNotification(NTBlockDisconnected, block)
+	b.sendTipUpdate()
 
 	return nil
 }
@@ -564,12 +950,12 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block) erro
 // the end of the chain) and nodes the are being attached must be in forwards
 // order (think pushing them onto the end of the chain).
 func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error {
-	// Ensure all of the needed side chain blocks are in the cache.
+	// Ensure all of the needed side chain blocks are in the cache.  Any
+	// which were evicted are loaded from the side chain block directory.
 	for e := attachNodes.Front(); e != nil; e = e.Next() {
 		n := e.Value.(*blockNode)
-		if _, exists := b.blockCache[*n.hash]; !exists {
-			return fmt.Errorf("block %v is missing from the side "+
-				"chain block cache", n.hash)
+		if _, err := b.fetchSideChainBlock(n); err != nil {
+			return err
 		}
 	}
 
@@ -585,39 +971,107 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 	// at least a couple of ways accomplish that rollback, but both involve
 	// tweaking the chain.  This approach catches these issues before ever
 	// modifying the chain.
+	//
+	// Since the chain has not been modified yet, this is also the point at
+	// which the reorganization can be interrupted.
+	attachStats := make([]*blockStats, 0, attachNodes.Len())
 	for e := attachNodes.Front(); e != nil; e = e.Next() {
+		if b.interruptRequested() {
+			return ErrInterrupted
+		}
+
 		n := e.Value.(*blockNode)
 		block := b.blockCache[*n.hash]
-		err := b.checkConnectBlock(n, block)
+		stats, err := b.checkConnectBlock(n, block, true)
+		if ruleErr, ok := err.(RuleError); ok {
+			prevHash := &block.MsgBlock().Header.PrevBlock
+			b.markBlockInvalid(n.hash, prevHash, ruleErr)
+		}
 		if err != nil {
-			return err
+			return nodeError(err, n)
 		}
-
+		attachStats = append(attachStats, stats)
 	}
 
-	// Disconnect blocks from the main chain.
+	// Load the blocks to disconnect from the database.  They are kept in
+	// forwards order so the transactions they contain can be compared
+	// against those of the new best chain blocks below.
+	detachBlocks := make([]*btcutil.Block, detachNodes.Len())
+	i := len(detachBlocks)
+	var forkHash *btcwire.ShaHash
 	for e := detachNodes.Front(); e != nil; e = e.Next() {
 		n := e.Value.(*blockNode)
 		block, err := b.db.FetchBlockBySha(n.hash)
 		if err != nil {
-			return err
+			return nodeError(dbError(err), n)
 		}
-		err = b.disconnectBlock(n, block)
+		i--
+		detachBlocks[i] = block
+		forkHash = &block.MsgBlock().Header.PrevBlock
+	}
+	attachBlocks := make([]*btcutil.Block, 0, attachNodes.Len())
+	for e := attachNodes.Front(); e != nil; e = e.Next() {
+		n := e.Value.(*blockNode)
+		attachBlocks = append(attachBlocks, b.blockCache[*n.hash])
+	}
+
+	// Journal the reorganization before modifying the chain so it can be
+	// completed after a crash.  The journal is left in place if any of the
+	// modifications below fail.
+	journaled := b.reorgJournalPath != "" && detachNodes.Len() > 0
+	if journaled {
+		err := b.writeReorgJournal(forkHash, detachBlocks, attachBlocks)
 		if err != nil {
-			return err
+			return fmt.Errorf("unable to write reorganization "+
+				"journal %s: %v", b.reorgJournalPath, err)
+		}
+	}
+
+	// Disconnect blocks from the main chain.
+	i = len(detachBlocks)
+	for e := detachNodes.Front(); e != nil; e = e.Next() {
+		n := e.Value.(*blockNode)
+		i--
+		err := b.disconnectBlock(n, detachBlocks[i])
+		if err != nil {
+			return nodeError(err, n)
 		}
 	}
 
 	// Connect the new best chain blocks.
+	i = 0
 	for e := attachNodes.Front(); e != nil; e = e.Next() {
 		n := e.Value.(*blockNode)
-		block := b.blockCache[*n.hash]
-		err := b.connectBlock(n, block)
+		err := b.connectBlock(n, attachBlocks[i], attachStats[i])
+		i++
 		if err != nil {
-			return err
+			return nodeError(err, n)
 		}
-		delete(b.blockCache, *n.hash)
+		b.chainLock.Lock()
+		b.uncacheSideChainBlock(n.hash)
+		b.chainLock.Unlock()
+	}
+	if journaled {
+		b.removeReorgJournal()
+	}
+
+	// Keep track of how deep the reorganization was.
+	b.chainLock.Lock()
+	b.recordReorg(int64(detachNodes.Len()))
+	b.chainLock.Unlock()
+
+	// Notify the caller which transactions changed confirmation status due
+	// to the reorganization so it doesn't have to compare the blocks
+	// itself.
+	if forkHash == nil && len(attachBlocks) > 0 {
+		forkHash = &attachBlocks[0].MsgBlock().Header.PrevBlock
 	}
+	diff, err := calcReorgTxDiff(forkHash, detachBlocks, attachBlocks)
+	if err != nil {
+		return err
+	}
+	b.sendNotification(NTReorganization, diff)
+	b.sendResurrectTxns(diff)
 
 	return nil
 }
@@ -627,8 +1081,10 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 // proof of work.  In the typical case, the new block simply extends the main
 // chain.  However, it may also be extending (or creating) a side chain (fork)
 // which may or may not end up becoming the main chain depending on which fork
-// cumulatively has the most proof of work.
-func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block) error {
+// cumulatively has the most proof of work.  It returns whether or not the block
+// ended up on the main chain (either due to extending the main chain or causing
+// a reorganization to become the main chain).
+func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block) (bool, error) {
 	// We haven't selected a best chain yet or we are extending the main
 	// (best) chain with a new block.  This is the most common case.
 	if b.bestChain == nil || node.parent.hash.IsEqual(b.bestChain.hash) {
@@ -637,15 +1093,15 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block) err
 		// be necessary to get this node to the main chain) without
 		// violating any rules and without actually connecting the
 		// block.
-		err := b.checkConnectBlock(node, block)
+		stats, err := b.checkConnectBlock(node, block, true)
 		if err != nil {
-			return err
+			return false, nodeError(err, node)
 		}
 
 		// Connect the block to the main chain.
-		err = b.connectBlock(node, block)
+		err = b.connectBlock(node, block, stats)
 		if err != nil {
-			return err
+			return false, nodeError(err, node)
 		}
 
 		// Connect the parent node to this node.
@@ -653,7 +1109,7 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block) err
 			node.parent.children = append(node.parent.children, node)
 		}
 
-		return nil
+		return true, nil
 	}
 
 	// We're extending (or creating) a side chain which may or may not
@@ -661,18 +1117,28 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block) err
 	// for future processing, so add the block to the side chain holding
 	// cache.
 	log.Debugf("Adding block %v to side chain cache", node.hash)
-	b.blockCache[*node.hash] = block
+	b.chainLock.Lock()
+	b.cacheSideChainBlock(node.hash, block)
 	b.index[*node.hash] = node
+	b.chainLock.Unlock()
 
 	// We're extending (or creating) a side chain, but the cumulative
 	// work for this new side chain is not enough to make it the new chain.
+	// Only the work counts, not the number of blocks, and a side chain
+	// with the same work as the main chain does not replace it, so the
+	// chain which was seen first wins ties.
 	if node.workSum.Cmp(b.bestChain.workSum) <= 0 {
 		// Connect the parent node to this node.
 		node.inMainChain = false
 		if node.parent != nil {
 			node.parent.children = append(node.parent.children, node)
 		}
-		return nil
+
+		// Warn the caller when the side chain is about to become
+		// the main chain.
+		b.warnPendingReorg(node)
+
+		return false, nil
 	}
 
 	// We're extending (or creating) a side chain and the cumulative work
@@ -684,33 +1150,77 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block) err
 	// common ancenstor (the point where the chain forked).
 	detachNodes, attachNodes := b.getReorganizeNodes(node)
 
+	// Connect the parent node to this node.  This is done before the
+	// reorganization since the block remains on the side chain when it
+	// fails.
+	node.inMainChain = false
+	if node.parent != nil {
+		node.parent.children = append(node.parent.children, node)
+	}
+
+	// Keep the block on the side chain when the reorganization would be
+	// deeper than allowed.
+	err := b.checkReorgDepth(node, detachNodes)
+	if err != nil {
+		return false, nodeError(err, node)
+	}
+
 	// Reorganize the chain.
-	err := b.reorganizeChain(detachNodes, attachNodes)
+	err = b.reorganizeChain(detachNodes, attachNodes)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return true, nil
 }
 
-// New returns a BlockChain instance for the passed bitcoin network using the
-// provided backing database.  It accepts a channel on which asynchronous
+// New returns a BlockChain instance using the provided backing database for the
+// network defined by the passed parameters, such as &MainNetParams.  The
+// parameters must not be modified while the chain is in use.  The database is
+// checked to be for the same network before the first block is processed, or
+// up front via InitGenesis.  It accepts a channel on which asynchronous
 // notifications will be sent when various events take place.  See the
 // documentation for Notification and NotificationType for details on the
 // types and contents of notifications.  The provided channel can be nil if the
 // caller is not interested in receiving notifications.
-func New(db btcdb.Db, btcnet btcwire.BitcoinNet, c chan *Notification) *BlockChain {
+//
+// Callers which journal reorganizations should call SetReorgJournal right after
+// creating the chain since that is when a reorganization which was interrupted
+// by a crash is detected and completed.
+//
+// An error is returned when the parameters can't be used, such as when the max
+// block weight, base subsidy, or target time per block is zero, since that
+// would otherwise only surface once blocks are processed.
+func New(db btcdb.Db, params *Params, c chan *Notification) (*BlockChain, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
 	b := BlockChain{
-		db:            db,
-		btcnet:        btcnet,
-		notifications: c,
-		root:          nil,
-		bestChain:     nil,
-		index:         make(map[btcwire.ShaHash]*blockNode),
-		depNodes:      make(map[btcwire.ShaHash][]*blockNode),
-		orphans:       make(map[btcwire.ShaHash]*orphanBlock),
-		prevOrphans:   make(map[btcwire.ShaHash][]*orphanBlock),
-		blockCache:    make(map[btcwire.ShaHash]*btcutil.Block),
-	}
-	return &b
+		db:              db,
+		chainParams:     params,
+		notifications:   c,
+		tipUpdates:      make(chan TipUpdate, 1),
+		root:            nil,
+		bestChain:       nil,
+		index:           make(map[btcwire.ShaHash]*blockNode),
+		depNodes:        make(map[btcwire.ShaHash][]*blockNode),
+		orphans:         make(map[btcwire.ShaHash]*orphanBlock),
+		prevOrphans:     make(map[btcwire.ShaHash][]*orphanBlock),
+		blockCache:      make(map[btcwire.ShaHash]*btcutil.Block),
+		storedBlocks:    make(map[btcwire.ShaHash]struct{}),
+		headerIndex:     make(map[btcwire.ShaHash]*blockNode),
+		sourceQuotas:    make(map[string]SourceQuota),
+		sourceUsages:    make(map[string]*sourceUsage),
+		spentOutputs:    make(map[btcwire.OutPoint]*spentTxOut),
+		remoteTips:      make(map[string]*remoteTip),
+		invalidBlocks:   make(map[btcwire.ShaHash]RuleError),
+		divergenceDepth: defaultDivergenceDepth,
+		finalizedHeight: -1,
+		sanityLimits:    DefaultSanityLimits,
+		timeSource:      NewMedianTime(),
+		scriptEngine:    NewBtcscriptEngine(),
+		checkpoints:     newCheckpointData(params.Checkpoints),
+	}
+	return &b, nil
 }
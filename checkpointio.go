@@ -0,0 +1,76 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// checkpointRecord is the form a Checkpoint is stored in by ReadCheckpoints.
+// The hash is stored as a string so the files are human readable and can be
+// maintained by hand.
+type checkpointRecord struct {
+	Height int64
+	Hash   string
+}
+
+// ReadCheckpoints reads checkpoints from the passed reader.  The data must be a
+// JSON array of objects with a Height and a Hash field, where the hash is a
+// big-endian hex string, such as the following, where the hashes are
+// shortened for brevity:
+//
+//	[
+//		{"Height": 11111, "Hash": "0000000069e244f7...b26e7c1d"},
+//		{"Height": 33333, "Hash": "000000002dd5588a...dfb5d0a6"}
+//	]
+//
+// The returned checkpoints are in the order they appear in the data.  They are
+// suitable for passing to NewWithCheckpoints or NewWithCustomCheckpoints, which
+// perform the validation of the checkpoints against each other.
+func ReadCheckpoints(r io.Reader) ([]Checkpoint, error) {
+	var records []checkpointRecord
+	err := json.NewDecoder(r).Decode(&records)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode checkpoints: %v", err)
+	}
+
+	checkpoints := make([]Checkpoint, 0, len(records))
+	for _, record := range records {
+		hash, err := btcwire.NewShaHashFromStr(record.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash for checkpoint at "+
+				"height %d: %v", record.Height, err)
+		}
+		checkpoints = append(checkpoints, Checkpoint{
+			Height: record.Height,
+			Hash:   hash,
+		})
+	}
+	return checkpoints, nil
+}
+
+// NewWithCustomCheckpoints is the same as New except only the passed
+// checkpoints are used instead of the ones in the network parameters.  This
+// allows alternative networks and test deployments to use their own
+// checkpoints, for example loaded with ReadCheckpoints, without any code
+// changes.  An error is also returned if any of the passed checkpoints are
+// invalid or conflict with each other.  Passing no checkpoints results in a
+// chain without any checkpoints.
+func NewWithCustomCheckpoints(db btcdb.Db, params *Params, c chan *Notification, checkpoints []Checkpoint) (*BlockChain, error) {
+	b, err := New(db, params, c)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mergeCheckpoints(&checkpointData{}, checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	b.checkpoints = data
+	return b, nil
+}
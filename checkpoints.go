@@ -6,13 +6,21 @@ package btcchain
 
 import (
 	"fmt"
+	"github.com/conformal/btcdb"
 	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
+	"sort"
 )
 
+// CheckpointConfirmations is the number of blocks before the end of the
+// current best block chain that a good checkpoint candidate must be.
 const CheckpointConfirmations = 2016
 
+// checkpointForkDistance is the number of blocks on either side of a
+// checkpoint candidate which must not have any known side chain blocks.
+const checkpointForkDistance = 144
+
 // A checkpoint is a known good point in the block chain.  Using checkpoints
 // allows a few optimizations for old blocks during initial download and also
 // prevents forks from old blocks.
@@ -41,29 +49,23 @@ type checkpointData struct {
 	checkpointsByHeight map[int64]*Checkpoint
 }
 
-// checkpointDataMainNet contains checkpoint data for the main network.
-var checkpointDataMainNet = checkpointData{
-	checkpoints: []Checkpoint{
-		{11111, newShaHashFromStr("0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d")},
-		{33333, newShaHashFromStr("000000002dd5588a74784eaa7ab0507a18ad16a236e7b1ce69f00d7ddfb5d0a6")},
-		{74000, newShaHashFromStr("0000000000573993a3c9e41ce34471c079dcf5f52a0e824a81e7f953b8661a20")},
-		{105000, newShaHashFromStr("00000000000291ce28027faea320c8d2b054b2e0fe44a773f3eefb151d6bdc97")},
-		{134444, newShaHashFromStr("00000000000005b12ffd4cd315cd34ffd4a594f430ac814c91184a0d42d2b0fe")},
-		{168000, newShaHashFromStr("000000000000099e61ea72015e79632f216fe6cb33d7899acb35b75c8303b763")},
-		{193000, newShaHashFromStr("000000000000059f452a5f7340de6682a977387c17010ff6e6c3bd83ca8b1317")},
-		{210000, newShaHashFromStr("000000000000048b95347e83192f69cf0366076336c639f9b7228e9ba171342e")},
-		{216116, newShaHashFromStr("00000000000001b4f4b433e81ee46494af945cf96014816a4e2370f11b23df4e")},
-		{225430, newShaHashFromStr("00000000000001c108384350f74090433e7fcf79a606b8e797f065b130575932")},
-	},
-	checkpointsByHeight: nil, // Automatically generated in init.
+// mainNetCheckpoints are the checkpoints for the main network.
+var mainNetCheckpoints = []Checkpoint{
+	{11111, newShaHashFromStr("0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d")},
+	{33333, newShaHashFromStr("000000002dd5588a74784eaa7ab0507a18ad16a236e7b1ce69f00d7ddfb5d0a6")},
+	{74000, newShaHashFromStr("0000000000573993a3c9e41ce34471c079dcf5f52a0e824a81e7f953b8661a20")},
+	{105000, newShaHashFromStr("00000000000291ce28027faea320c8d2b054b2e0fe44a773f3eefb151d6bdc97")},
+	{134444, newShaHashFromStr("00000000000005b12ffd4cd315cd34ffd4a594f430ac814c91184a0d42d2b0fe")},
+	{168000, newShaHashFromStr("000000000000099e61ea72015e79632f216fe6cb33d7899acb35b75c8303b763")},
+	{193000, newShaHashFromStr("000000000000059f452a5f7340de6682a977387c17010ff6e6c3bd83ca8b1317")},
+	{210000, newShaHashFromStr("000000000000048b95347e83192f69cf0366076336c639f9b7228e9ba171342e")},
+	{216116, newShaHashFromStr("00000000000001b4f4b433e81ee46494af945cf96014816a4e2370f11b23df4e")},
+	{225430, newShaHashFromStr("00000000000001c108384350f74090433e7fcf79a606b8e797f065b130575932")},
 }
 
-// checkpointDataTestNet contains checkpoint data for the test network.
-var checkpointDataTestNet = checkpointData{
-	checkpoints: []Checkpoint{
-		{546, newShaHashFromStr("000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70")},
-	},
-	checkpointsByHeight: nil, // Automatically generated in init.
+// testNet3Checkpoints are the checkpoints for the test network (version 3).
+var testNet3Checkpoints = []Checkpoint{
+	{546, newShaHashFromStr("000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70")},
 }
 
 // newShaHashFromStr converts the passed big-endian hex string into a
@@ -82,23 +84,139 @@ func (b *BlockChain) DisableCheckpoints(disable bool) {
 	b.noCheckpoints = disable
 }
 
-// checkpointData returns the appropriate checkpoint data set depending on the
-// network configured for the block chain.
+// checkpointData returns the checkpoint data set for the block chain.  This is
+// the data for the checkpoints in the network parameters unless additional
+// checkpoints were provided.
 func (b *BlockChain) checkpointData() *checkpointData {
-	switch b.btcnet {
-	case btcwire.TestNet3:
-		return &checkpointDataTestNet
-	case btcwire.MainNet:
-		fallthrough
-	default:
-		return &checkpointDataMainNet
+	return b.checkpoints
+}
+
+// newCheckpointData returns checkpoint data for the passed checkpoints.  The
+// checkpoints are copied and sorted by height so the caller is free to modify
+// the passed slice afterwards.
+func newCheckpointData(checkpoints []Checkpoint) *checkpointData {
+	data := checkpointData{
+		checkpoints:         make([]Checkpoint, len(checkpoints)),
+		checkpointsByHeight: make(map[int64]*Checkpoint),
 	}
+	copy(data.checkpoints, checkpoints)
+	sort.Sort(checkpointSorter(data.checkpoints))
+	for i := range data.checkpoints {
+		checkpoint := &data.checkpoints[i]
+		data.checkpointsByHeight[checkpoint.Height] = checkpoint
+	}
+	return &data
+}
+
+// checkpointSorter implements sort.Interface to allow a slice of checkpoints to
+// be sorted by height.
+type checkpointSorter []Checkpoint
+
+// Len returns the number of checkpoints in the slice.  It is part of the
+// sort.Interface implementation.
+func (s checkpointSorter) Len() int {
+	return len(s)
+}
+
+// Swap swaps the checkpoints at the passed indices.  It is part of the
+// sort.Interface implementation.
+func (s checkpointSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Less returns whether the checkpoint with index i should sort before the
+// checkpoint with index j.  It is part of the sort.Interface implementation.
+func (s checkpointSorter) Less(i, j int) bool {
+	return s[i].Height < s[j].Height
+}
+
+// mergeCheckpoints returns checkpoint data which contains the checkpoints from
+// the passed base data along with the passed additional checkpoints.  The
+// additional checkpoints must have a positive height and a hash, and must not
+// conflict with each other or the base checkpoints by having a different hash
+// for the same height.  Additional checkpoints which duplicate an existing one
+// are ignored.
+func mergeCheckpoints(base *checkpointData, extra []Checkpoint) (*checkpointData, error) {
+	merged := checkpointData{
+		checkpoints: make([]Checkpoint, 0,
+			len(base.checkpoints)+len(extra)),
+		checkpointsByHeight: make(map[int64]*Checkpoint),
+	}
+	merged.checkpoints = append(merged.checkpoints, base.checkpoints...)
+	byHeight := make(map[int64]*btcwire.ShaHash)
+	for _, checkpoint := range base.checkpoints {
+		byHeight[checkpoint.Height] = checkpoint.Hash
+	}
+
+	for _, checkpoint := range extra {
+		if checkpoint.Height <= 0 || checkpoint.Hash == nil {
+			return nil, fmt.Errorf("checkpoint at height %d is "+
+				"invalid", checkpoint.Height)
+		}
+		if hash, exists := byHeight[checkpoint.Height]; exists {
+			if !hash.IsEqual(checkpoint.Hash) {
+				return nil, fmt.Errorf("checkpoint %v at "+
+					"height %d conflicts with checkpoint %v",
+					checkpoint.Hash, checkpoint.Height,
+					hash)
+			}
+			continue
+		}
+		byHeight[checkpoint.Height] = checkpoint.Hash
+		merged.checkpoints = append(merged.checkpoints, checkpoint)
+	}
+
+	sort.Sort(checkpointSorter(merged.checkpoints))
+	for i := range merged.checkpoints {
+		checkpoint := &merged.checkpoints[i]
+		merged.checkpointsByHeight[checkpoint.Height] = checkpoint
+	}
+	return &merged, nil
+}
+
+// NewWithCheckpoints is the same as New except the passed checkpoints are used
+// in addition to the ones in the network parameters.  This allows operators to
+// pin recent blocks, for example from a configuration file, without
+// recompiling.  An error is also returned if any of the passed checkpoints are
+// invalid or conflict with each other or the checkpoints in the parameters.
+func NewWithCheckpoints(db btcdb.Db, params *Params, c chan *Notification, checkpoints []Checkpoint) (*BlockChain, error) {
+	b, err := New(db, params, c)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mergeCheckpoints(b.checkpoints, checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	b.checkpoints = data
+	return b, nil
+}
+
+// HasCheckpoints returns whether or not checkpoints are enabled and there are
+// checkpoints for the network the block chain was created for.
+func (b *BlockChain) HasCheckpoints() bool {
+	return !b.noCheckpoints && len(b.checkpointData().checkpoints) > 0
+}
+
+// Checkpoints returns a copy of the checkpoints for the network the block chain
+// was created for ordered from oldest to newest.  This allows callers such as a
+// sync manager to choose the targets for headers-first download and RPC
+// servers to report on them.  When checkpoints are disabled it will return nil.
+func (b *BlockChain) Checkpoints() []Checkpoint {
+	if !b.HasCheckpoints() {
+		return nil
+	}
+
+	checkpoints := b.checkpointData().checkpoints
+	result := make([]Checkpoint, len(checkpoints))
+	copy(result, checkpoints)
+	return result
 }
 
 // LatestCheckpoint returns the most recent checkpoint (regardless of whether it
 // is already known).  When checkpoints are disabled it will return nil.
 func (b *BlockChain) LatestCheckpoint() *Checkpoint {
-	if b.noCheckpoints {
+	if !b.HasCheckpoints() {
 		return nil
 	}
 
@@ -106,6 +224,41 @@ func (b *BlockChain) LatestCheckpoint() *Checkpoint {
 	return &checkpoints[len(checkpoints)-1]
 }
 
+// findNextCheckpoint returns the first checkpoint with a height after the
+// passed height.  It returns nil when checkpoints are disabled or there is no
+// such checkpoint.
+func (b *BlockChain) findNextCheckpoint(height int64) *Checkpoint {
+	if !b.HasCheckpoints() {
+		return nil
+	}
+
+	checkpoints := b.checkpointData().checkpoints
+	for i := range checkpoints {
+		if checkpoints[i].Height > height {
+			return &checkpoints[i]
+		}
+	}
+	return nil
+}
+
+// NextCheckpoint returns the first checkpoint after the end of the main chain.
+// This allows download logic to fetch the headers and blocks up to it with
+// relaxed validation and to advance the target as checkpoints are crossed.  It
+// returns nil when checkpoints are disabled or the main chain is already past
+// the latest checkpoint.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) NextCheckpoint() *Checkpoint {
+	b.chainLock.RLock()
+	height := int64(-1)
+	if b.bestChain != nil {
+		height = b.bestChain.height
+	}
+	b.chainLock.RUnlock()
+
+	return b.findNextCheckpoint(height)
+}
+
 // verifyCheckpoint returns whether the passed block height and hash combination
 // match the hard-coded checkpoint data.  It also returns true if there is no
 // checkpoint data for the passed block height.
@@ -123,11 +276,11 @@ func (b *BlockChain) verifyCheckpoint(height int64, hash *btcwire.ShaHash) bool
 	return checkpoint.Hash.IsEqual(hash)
 }
 
-// findClosestKnownCheckpoint finds the most recent checkpoint that is already
-// available in the downloaded portion of the block chain and returns the
-// associated block.  It returns nil if a checkpoint can't be found (this should
-// really only happen for blocks before the first checkpoint).
-func (b *BlockChain) findLatestKnownCheckpoint() (*btcutil.Block, error) {
+// latestKnownCheckpoint returns the most recent checkpoint that is already
+// available in the downloaded portion of the block chain.  It returns nil if a
+// checkpoint can't be found (this should really only happen for blocks before
+// the first checkpoint).
+func (b *BlockChain) latestKnownCheckpoint() (*Checkpoint, error) {
 	if b.noCheckpoints {
 		return nil, nil
 	}
@@ -138,16 +291,83 @@ func (b *BlockChain) findLatestKnownCheckpoint() (*btcutil.Block, error) {
 	clen := len(checkpoints)
 	for i := clen - 1; i >= 0; i-- {
 		if b.db.ExistsSha(checkpoints[i].Hash) {
-			block, err := b.db.FetchBlockBySha(checkpoints[i].Hash)
-			if err != nil {
-				return nil, err
-			}
-			return block, nil
+			return &checkpoints[i], nil
 		}
 	}
 	return nil, nil
 }
 
+// latestKnownCheckpointHeader finds the most recent checkpoint that is already
+// available in the downloaded portion of the block chain and returns the
+// associated block header.  It returns nil if a checkpoint can't be found.
+//
+// The header is cached since it is needed for every block and header which is
+// processed, including bogus ones, and fetching the full block from the
+// database each time would make flooding a node with them more effective.
+func (b *BlockChain) latestKnownCheckpointHeader() (*btcwire.BlockHeader, error) {
+	checkpoint, err := b.latestKnownCheckpoint()
+	if err != nil || checkpoint == nil {
+		return nil, err
+	}
+	if b.checkpointHeader != nil &&
+		b.checkpointHeaderHash.IsEqual(checkpoint.Hash) {
+
+		return b.checkpointHeader, nil
+	}
+
+	block, err := b.db.FetchBlockBySha(checkpoint.Hash)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	header := block.MsgBlock().Header
+	b.checkpointHeader = &header
+	b.checkpointHeaderHash = checkpoint.Hash
+	return &header, nil
+}
+
+// checkCheckpointConstraints finds the latest known checkpoint and performs
+// some additional checks on the passed block header based on it.  This
+// provides a few nice properties such as preventing forks from blocks before
+// the last checkpoint, rejecting easy to mine, but otherwise bogus, blocks that
+// could be used to eat memory, and ensuring expected (versus claimed) proof of
+// work requirements since the last checkpoint are met.
+func (b *BlockChain) checkCheckpointConstraints(header *btcwire.BlockHeader, blockHash *btcwire.ShaHash) error {
+	checkpointHeader, err := b.latestKnownCheckpointHeader()
+	if err != nil {
+		return err
+	}
+	if checkpointHeader == nil {
+		return nil
+	}
+
+	// Ensure the block timestamp is after the checkpoint timestamp.
+	checkpointTime := checkpointHeader.Timestamp
+	if header.Timestamp.Before(checkpointTime) {
+		str := fmt.Sprintf("block %v has timestamp %v before "+
+			"last checkpoint timestamp %v", blockHash,
+			header.Timestamp, checkpointTime)
+		return ruleError(ErrTimeTooOld, str)
+	}
+
+	// Even though the checks prior to now have already ensured the proof of
+	// work exceeds the claimed amount, the claimed amount is a field in the
+	// block header which could be forged.  This check ensures the proof of
+	// work is at least the minimum expected based on elapsed time since the
+	// last checkpoint and maximum adjustment allowed by the retarget rules.
+	duration := header.Timestamp.Sub(checkpointTime)
+	requiredTarget := CompactToBig(b.calcEasiestDifficulty(
+		checkpointHeader.Bits, duration))
+	currentTarget := CompactToBig(header.Bits)
+	if currentTarget.Cmp(requiredTarget) > 0 {
+		str := fmt.Sprintf("block target difficulty of %064x "+
+			"is too low when compared to the previous "+
+			"checkpoint", currentTarget)
+		return ruleError(ErrDifficultyTooLow, str)
+	}
+
+	return nil
+}
+
 // isNonstandardTransaction determines whether a transaction contains any
 // scripts which are not one of the standard types.
 func isNonstandardTransaction(tx *btcwire.MsgTx) bool {
@@ -175,6 +395,12 @@ func isNonstandardTransaction(tx *btcwire.MsgTx) bool {
 //    (due to the median time allowance this is not always the case)
 //  - The block must not contain any strange transaction such as those with
 //    nonstandard scripts
+//  - There must not be any known side chains which fork from the main chain
+//    within checkpointForkDistance blocks of the block since a fork nearby
+//    means the network had not settled on a single chain around it
+//
+// This allows operators and maintainers to identify candidates for new
+// checkpoints from a running node.
 func (b *BlockChain) IsCheckpointCandidate(block *btcutil.Block) (bool, error) {
 	// Checkpoints must be enabled.
 	if b.noCheckpoints {
@@ -183,7 +409,7 @@ func (b *BlockChain) IsCheckpointCandidate(block *btcutil.Block) (bool, error) {
 
 	blockHash, err := block.Sha()
 	if err != nil {
-		return false, err
+		return false, deserializationError(err)
 	}
 
 	// A checkpoint must be in the main chain.
@@ -196,7 +422,7 @@ func (b *BlockChain) IsCheckpointCandidate(block *btcutil.Block) (bool, error) {
 	blockHeight := block.Height()
 	_, mainChainHeight, err := b.db.NewestSha()
 	if err != nil {
-		return false, err
+		return false, dbError(err)
 	}
 	if blockHeight > (mainChainHeight - CheckpointConfirmations) {
 		return false, nil
@@ -206,17 +432,17 @@ func (b *BlockChain) IsCheckpointCandidate(block *btcutil.Block) (bool, error) {
 	prevHash := &block.MsgBlock().Header.PrevBlock
 	prevBlock, err := b.db.FetchBlockBySha(prevHash)
 	if err != nil {
-		return false, err
+		return false, dbError(err)
 	}
 
 	// Get the next block.
 	nextHash, err := b.db.FetchBlockShaByHeight(blockHeight + 1)
 	if err != nil {
-		return false, err
+		return false, dbError(err)
 	}
 	nextBlock, err := b.db.FetchBlockBySha(nextHash)
 	if err != nil {
-		return false, err
+		return false, dbError(err)
 	}
 
 	// A checkpoint must have timestamps for the block and the blocks on
@@ -237,22 +463,35 @@ func (b *BlockChain) IsCheckpointCandidate(block *btcutil.Block) (bool, error) {
 		}
 	}
 
+	// A checkpoint must not have any known forks nearby.
+	if b.hasNearbyFork(blockHeight) {
+		return false, nil
+	}
+
 	return true, nil
 }
 
-// init is called on package load.
-func init() {
-	// Generate the checkpoint by height maps from the checkpoint data
-	// when the package loads.
-	checkpointInitializeList := []*checkpointData{
-		&checkpointDataMainNet,
-		&checkpointDataTestNet,
-	}
-	for _, data := range checkpointInitializeList {
-		data.checkpointsByHeight = make(map[int64]*Checkpoint)
-		for i := range data.checkpoints {
-			checkpoint := &data.checkpoints[i]
-			data.checkpointsByHeight[checkpoint.Height] = checkpoint
+// hasNearbyFork returns whether or not any known side chain forks from the main
+// chain within checkpointForkDistance blocks of the passed height.  Only where
+// a side chain forks matters, so a long side chain which forked well before the
+// height does not count even when some of its blocks are near it.
+func (b *BlockChain) hasNearbyFork(height int64) bool {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	for _, node := range b.sideChainNodes() {
+		// Only the first block of each side chain builds on the main
+		// chain, at the point the side chain forks from it.
+		if node.parent == nil || !node.parent.inMainChain {
+			continue
+		}
+		distance := node.parent.height - height
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance <= checkpointForkDistance {
+			return true
 		}
 	}
+	return false
 }
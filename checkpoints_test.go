@@ -0,0 +1,246 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestNewWithCheckpoints ensures additional checkpoints are merged with the
+// compiled-in ones and conflicting checkpoints are rejected.
+func TestNewWithCheckpoints(t *testing.T) {
+	chain := newChain(t, nil, &btcchain.MainNetParams, nil)
+	builtin := chain.Checkpoints()
+	if len(builtin) == 0 {
+		t.Fatalf("Checkpoints: no compiled-in checkpoints")
+	}
+	latest := builtin[len(builtin)-1]
+
+	hash, _ := btcwire.NewShaHashFromStr("000000000000000000000000000000000" +
+		"0000000000000000000000000000001")
+	extra := []btcchain.Checkpoint{
+		{Height: latest.Height + 1000, Hash: hash},
+		{Height: latest.Height, Hash: latest.Hash},
+	}
+	chain, err := btcchain.NewWithCheckpoints(nil, &btcchain.MainNetParams, nil,
+		extra)
+	if err != nil {
+		t.Fatalf("NewWithCheckpoints: unexpected error %v", err)
+	}
+	checkpoints := chain.Checkpoints()
+	if len(checkpoints) != len(builtin)+1 {
+		t.Fatalf("Checkpoints: got %d checkpoints, want %d",
+			len(checkpoints), len(builtin)+1)
+	}
+	if got := chain.LatestCheckpoint(); got.Height != extra[0].Height {
+		t.Errorf("LatestCheckpoint: got height %d, want %d",
+			got.Height, extra[0].Height)
+	}
+
+	// A checkpoint which conflicts with a compiled-in one must be
+	// rejected.
+	conflicting := []btcchain.Checkpoint{
+		{Height: latest.Height, Hash: hash},
+	}
+	_, err = btcchain.NewWithCheckpoints(nil, &btcchain.MainNetParams, nil,
+		conflicting)
+	if err == nil {
+		t.Errorf("NewWithCheckpoints: expected error for conflicting " +
+			"checkpoint")
+	}
+}
+
+// TestReadCheckpoints ensures checkpoints read from an external source can be
+// used in place of the compiled-in ones.
+func TestReadCheckpoints(t *testing.T) {
+	data := `[
+		{"Height": 20, "Hash": "000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70"},
+		{"Height": 10, "Hash": "0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d"}
+	]`
+	checkpoints, err := btcchain.ReadCheckpoints(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadCheckpoints: unexpected error %v", err)
+	}
+	chain, err := btcchain.NewWithCustomCheckpoints(nil, &btcchain.MainNetParams,
+		nil, checkpoints)
+	if err != nil {
+		t.Fatalf("NewWithCustomCheckpoints: unexpected error %v", err)
+	}
+	got := chain.Checkpoints()
+	if len(got) != 2 || got[0].Height != 10 || got[1].Height != 20 {
+		t.Fatalf("Checkpoints: unexpected checkpoints %v", got)
+	}
+	if next := chain.NextCheckpoint(); next == nil || next.Height != 10 {
+		t.Errorf("NextCheckpoint: unexpected checkpoint %v", next)
+	}
+
+	// Malformed data must be rejected.
+	_, err = btcchain.ReadCheckpoints(strings.NewReader(`[{"Height": 1, ` +
+		`"Hash": "zz"}]`))
+	if err == nil {
+		t.Errorf("ReadCheckpoints: expected error for invalid hash")
+	}
+}
+
+// TestHasCheckpoints ensures HasCheckpoints and Checkpoints report the
+// checkpoints of the network unless they are disabled and that the returned
+// checkpoints are a copy.
+func TestHasCheckpoints(t *testing.T) {
+	hash, _ := btcwire.NewShaHashFromStr("000000000000000000000000000000000" +
+		"0000000000000000000000000000001")
+	custom := []btcchain.Checkpoint{{Height: 10, Hash: hash}}
+
+	tests := []struct {
+		name    string
+		params  *btcchain.Params
+		custom  []btcchain.Checkpoint
+		disable bool
+		want    []btcchain.Checkpoint
+	}{
+		{"main network", &btcchain.MainNetParams, nil, false,
+			btcchain.MainNetParams.Checkpoints},
+		{"disabled", &btcchain.MainNetParams, nil, true, nil},
+		{"no checkpoints", &btcchain.RegressionNetParams, nil, false,
+			nil},
+		{"custom checkpoints", &btcchain.RegressionNetParams, custom,
+			false, custom},
+		{"custom checkpoints disabled", &btcchain.RegressionNetParams,
+			custom, true, nil},
+	}
+
+	for i, test := range tests {
+		chain := newChain(t, nil, test.params, nil)
+		if test.custom != nil {
+			var err error
+			chain, err = btcchain.NewWithCustomCheckpoints(nil,
+				test.params, nil, test.custom)
+			if err != nil {
+				t.Errorf("NewWithCustomCheckpoints #%d (%s): "+
+					"unexpected error %v", i, test.name, err)
+				continue
+			}
+		}
+		chain.DisableCheckpoints(test.disable)
+
+		if got := chain.HasCheckpoints(); got != (test.want != nil) {
+			t.Errorf("HasCheckpoints #%d (%s): got %v, want %v", i,
+				test.name, got, test.want != nil)
+		}
+		got := chain.Checkpoints()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Checkpoints #%d (%s): got %v, want %v", i,
+				test.name, got, test.want)
+			continue
+		}
+
+		// Modifying the returned checkpoints must not affect the chain.
+		if len(got) > 0 {
+			got[0].Height++
+			if chain.Checkpoints()[0].Height != test.want[0].Height {
+				t.Errorf("Checkpoints #%d (%s): returned "+
+					"checkpoints are not a copy", i, test.name)
+			}
+		}
+	}
+}
+
+// TestHasNearbyFork ensures only side chains which fork from the main chain
+// near a checkpoint candidate prevent it from being a good checkpoint.
+func TestHasNearbyFork(t *testing.T) {
+	tests := []struct {
+		name         string
+		forkHeight   int64
+		sideChainLen int
+		height       int64
+		want         bool
+	}{
+		{"fork before within distance", 1000, 10, 1100, true},
+		{"fork after within distance", 1100, 1, 1000, true},
+		{"fork at the height", 1000, 1, 1000, true},
+		{"fork before beyond distance", 1000, 10, 1200, false},
+		{"fork after beyond distance", 1200, 5, 1000, false},
+		{"long side chain which forked beyond distance", 1000, 300,
+			1250, false},
+	}
+
+	for i, test := range tests {
+		got := btcchain.TstHasNearbyFork(test.forkHeight,
+			test.sideChainLen, test.height)
+		if got != test.want {
+			t.Errorf("hasNearbyFork #%d (%s): got %v, want %v", i,
+				test.name, got, test.want)
+		}
+	}
+}
+
+// TestForkTooOld ensures blocks and headers which fork the main chain before
+// the latest known checkpoint are rejected while those which fork after it or
+// before it is known are not.
+func TestForkTooOld(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 4)
+	params.Checkpoints = []btcchain.Checkpoint{
+		{Height: 3, Hash: blockHash(blocks[2])},
+	}
+
+	// The forks have the timestamp of the block after the checkpoint, so
+	// they are not rejected for being older than it.
+	sideTime := blocks[3].MsgBlock().Header.Timestamp
+	setTime := func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Header.Timestamp = sideTime
+	}
+
+	tests := []struct {
+		name      string
+		numBlocks int
+		parent    *btcutil.Block
+		valid     bool
+		wantCode  btcchain.ErrorCode
+	}{
+		{"fork before checkpoint", 4, blocks[0], false,
+			btcchain.ErrForkTooOld},
+		{"fork at checkpoint height", 4, blocks[1], false,
+			btcchain.ErrBadCheckpoint},
+		{"fork after checkpoint", 4, blocks[2], true, 0},
+		{"checkpoint not yet known", 2, g.genesis(), true, 0},
+	}
+
+	for i, test := range tests {
+		chain, _, teardown := newTestChain(t, "checkpointstest", &params,
+			nil)
+		processBlocks(t, chain, blocks[:test.numBlocks])
+
+		header := &g.nextBlock(test.parent, setTime).MsgBlock().Header
+		headerErr := chain.ProcessBlockHeader(header, btcchain.BFNone)
+		_, _, blockErr := chain.ProcessBlock(g.nextBlock(test.parent,
+			setTime))
+		teardown()
+
+		errs := map[string]error{
+			"ProcessBlockHeader": headerErr,
+			"ProcessBlock":       blockErr,
+		}
+		for funcName, err := range errs {
+			if test.valid {
+				if err != nil {
+					t.Errorf("%s #%d (%s): unexpected error %v",
+						funcName, i, test.name, err)
+				}
+				continue
+			}
+			rerr, ok := err.(btcchain.RuleError)
+			if !ok || rerr.ErrorCode != test.wantCode {
+				t.Errorf("%s #%d (%s): got %v, want %v", funcName,
+					i, test.name, err, test.wantCode)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/sqlite3"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// opTrueScript is a public key script which can be spent by anyone.  It is used
+// for the outputs of generated blocks so they can be spent without signatures.
+var opTrueScript = []byte{0x51}
+
+// newTestChain returns a block chain instance for the passed network parameters
+// backed by a new database with the passed name along with a function which
+// closes and removes the database.  The genesis block of the parameters is
+// inserted into the database, so blocks built on it can be processed right
+// away.
+func newTestChain(t *testing.T, dbName string, params *btcchain.Params, c chan *btcchain.Notification) (*btcchain.BlockChain, btcdb.Db, func()) {
+	dbPath := filepath.Join(os.TempDir(), dbName)
+	_ = os.Remove(dbPath)
+	db, err := btcdb.CreateDB("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Error creating db: %v", err)
+	}
+	teardown := func() {
+		db.Close()
+		os.Remove(dbPath)
+	}
+
+	chain, err := btcchain.New(db, params, c)
+	if err != nil {
+		teardown()
+		t.Fatalf("New: unexpected error %v", err)
+	}
+	if err := chain.InitGenesis(); err != nil {
+		teardown()
+		t.Fatalf("InitGenesis: unexpected error %v", err)
+	}
+	return chain, db, teardown
+}
+
+// newChain returns a block chain instance for the passed network parameters
+// backed by the passed database and fails the test when it can't be created.
+func newChain(t *testing.T, db btcdb.Db, params *btcchain.Params, c chan *btcchain.Notification) *btcchain.BlockChain {
+	chain, err := btcchain.New(db, params, c)
+	if err != nil {
+		t.Fatalf("New: unexpected error %v", err)
+	}
+	return chain
+}
+
+// blockGenerator creates blocks for the regression test network parameters,
+// which have a proof of work limit that allows blocks to be solved instantly.
+type blockGenerator struct {
+	params     *btcchain.Params
+	extraNonce uint64
+}
+
+// newBlockGenerator returns a block generator for the passed parameters.
+func newBlockGenerator(params *btcchain.Params) *blockGenerator {
+	return &blockGenerator{params: params}
+}
+
+// genesis returns the genesis block of the parameters of the generator.
+func (g *blockGenerator) genesis() *btcutil.Block {
+	block := btcutil.NewBlock(g.params.GenesisBlock, btcwire.ProtocolVersion)
+	block.SetHeight(0)
+	return block
+}
+
+// nextBlock returns a new solved block which builds on the passed block.  It
+// contains a coinbase which pays the full subsidy to opTrueScript and is made
+// unique by an extra nonce, so blocks built on the same parent differ.  The
+// passed functions are applied to the block before it is solved, which allows
+// transactions to be added or the block to be made invalid.
+func (g *blockGenerator) nextBlock(prev *btcutil.Block, mungers ...func(*btcwire.MsgBlock)) *btcutil.Block {
+	height := prev.Height() + 1
+	prevHash, _ := prev.Sha()
+	prevHeader := &prev.MsgBlock().Header
+
+	g.extraNonce++
+	var extraNonce [8]byte
+	binary.LittleEndian.PutUint64(extraNonce[:], g.extraNonce)
+	sigScript := append(btcchain.SerializeCoinbaseHeight(height),
+		extraNonce[:]...)
+	coinbase := btcwire.NewMsgTx()
+	coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{},
+		math.MaxUint32), sigScript))
+	coinbase.AddTxOut(btcwire.NewTxOut(btcchain.CalcBlockSubsidy(height,
+		g.params), opTrueScript))
+
+	msgBlock := &btcwire.MsgBlock{
+		Header: btcwire.BlockHeader{
+			Version:   4,
+			PrevBlock: *prevHash,
+			Timestamp: prevHeader.Timestamp.Add(g.params.TargetTimePerBlock),
+			Bits:      prevHeader.Bits,
+		},
+	}
+	msgBlock.AddTransaction(coinbase)
+	for _, munge := range mungers {
+		munge(msgBlock)
+	}
+
+	merkles := btcchain.BuildMerkleTreeStore(btcutil.NewBlock(msgBlock,
+		btcwire.ProtocolVersion))
+	msgBlock.Header.MerkleRoot = *merkles[len(merkles)-1]
+	g.solve(&msgBlock.Header)
+
+	block := btcutil.NewBlock(msgBlock, btcwire.ProtocolVersion)
+	block.SetHeight(height)
+	return block
+}
+
+// nextBlocks returns the passed number of blocks which each build on the one
+// before them starting from the passed block.
+func (g *blockGenerator) nextBlocks(prev *btcutil.Block, numBlocks int) []*btcutil.Block {
+	blocks := make([]*btcutil.Block, 0, numBlocks)
+	for i := 0; i < numBlocks; i++ {
+		prev = g.nextBlock(prev)
+		blocks = append(blocks, prev)
+	}
+	return blocks
+}
+
+// solve finds a nonce for the passed header which satisfies its proof of work.
+func (g *blockGenerator) solve(header *btcwire.BlockHeader) {
+	for nonce := uint32(0); ; nonce++ {
+		header.Nonce = nonce
+		hash, _ := header.BlockSha(btcwire.ProtocolVersion)
+		err := btcchain.CheckProofOfWork(&hash, header.Bits,
+			g.params.PowLimit)
+		if err == nil {
+			return
+		}
+	}
+}
+
+// spendTx returns a transaction which spends the output of the coinbase of the
+// passed block to opTrueScript, less the passed fee.
+func spendTx(block *btcutil.Block, fee int64) *btcwire.MsgTx {
+	coinbase := block.MsgBlock().Transactions[0]
+	coinbaseHash, _ := coinbase.TxSha()
+	tx := btcwire.NewMsgTx()
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&coinbaseHash, 0), nil))
+	tx.AddTxOut(btcwire.NewTxOut(coinbase.TxOut[0].Value-fee,
+		opTrueScript))
+	return tx
+}
+
+// processBlocks processes the passed blocks in order and fails the test when
+// any of them is not accepted.
+func processBlocks(t *testing.T, chain *btcchain.BlockChain, blocks []*btcutil.Block) {
+	for _, block := range blocks {
+		_, isOrphan, err := chain.ProcessBlock(block)
+		if err != nil {
+			hash, _ := block.Sha()
+			t.Fatalf("ProcessBlock (%v): unexpected error %v", hash,
+				err)
+		}
+		if isOrphan {
+			hash, _ := block.Sha()
+			t.Fatalf("ProcessBlock (%v): unexpected orphan", hash)
+		}
+	}
+}
+
+// blockHash returns the hash of the passed block.
+func blockHash(block *btcutil.Block) *btcwire.ShaHash {
+	hash, _ := block.Sha()
+	return hash
+}
+
+// checkBestBlock fails the test when the end of the main chain is not the
+// passed block.
+func checkBestBlock(t *testing.T, context string, chain *btcchain.BlockChain, want *btcutil.Block) {
+	hash, height := chain.BestBlock()
+	if hash == nil || !hash.IsEqual(blockHash(want)) ||
+		height != want.Height() {
+
+		t.Fatalf("%s: best block is %v (height %d), want %v "+
+			"(height %d)", context, hash, height, blockHash(want),
+			want.Height())
+	}
+}
+
+// checkRuleError fails the test when the passed error is not a rule error with
+// the passed error code.
+func checkRuleError(t *testing.T, context string, err error, want btcchain.ErrorCode) {
+	rerr, ok := err.(btcchain.RuleError)
+	if !ok || rerr.ErrorCode != want {
+		t.Fatalf("%s: got %v, want %v", context, err, want)
+	}
+}
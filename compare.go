@@ -0,0 +1,123 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// ChainComparison describes how the chain reported by another node relates to
+// the local main chain.  See CompareChain.
+type ChainComparison struct {
+	// ForkHash and ForkHeight identify the most recent block the local main
+	// chain has in common with the other chain.
+	ForkHash   *btcwire.ShaHash
+	ForkHeight int64
+
+	// LocalTip and LocalHeight identify the end of the local main chain.
+	LocalTip    *btcwire.ShaHash
+	LocalHeight int64
+
+	// RemoteTip is the tip of the other chain.
+	RemoteTip *btcwire.ShaHash
+
+	// RemoteWorkKnown indicates whether or not the amount of work in the
+	// other chain is known.  It is only known when the local chain knows
+	// about the tip of the other chain, either as a block or a header.
+	RemoteWorkKnown bool
+
+	// WorkCmp is -1, 0, or +1 depending on whether the local main chain has
+	// less, the same, or more work than the other chain.  It is only set
+	// when RemoteWorkKnown is true.
+	WorkCmp int
+}
+
+// IsForked returns whether or not the local main chain and the other chain
+// have diverged, meaning neither is simply an extension of the other.  The
+// local main chain extending the other chain is detected when the fork point is
+// the other chain's tip while the other way around is detected when it is the
+// local tip.
+func (c *ChainComparison) IsForked() bool {
+	return !c.ForkHash.IsEqual(c.LocalTip) && !c.ForkHash.IsEqual(c.RemoteTip)
+}
+
+// CompareChain compares the chain reported by another node, as described by the
+// hash of its tip and a block locator for it, to the local main chain.  The
+// locator is a list of block hashes from the other chain ordered from the tip
+// backwards, such as the one sent with a getblocks message.  The returned
+// comparison identifies where the chains diverge and which one has more work
+// when that can be determined.  This is intended for monitoring whether the
+// local node has ended up on a different chain than other nodes.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) CompareChain(remoteTip *btcwire.ShaHash, locator []*btcwire.ShaHash) (*ChainComparison, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return nil, fmt.Errorf("the main chain has not been " +
+			"initialized yet")
+	}
+
+	comparison := ChainComparison{
+		LocalTip:    b.bestChain.hash,
+		LocalHeight: b.bestChain.height,
+		RemoteTip:   remoteTip,
+	}
+
+	// The fork point is the most recent hash reported by the other node,
+	// starting with its tip, which is in the local main chain.  Since only
+	// main chain blocks are stored in the database, a block in the database
+	// is in the main chain.  All chains for a network share the genesis
+	// block, so fall back to it when nothing else matches.
+	hashes := append([]*btcwire.ShaHash{remoteTip}, locator...)
+	for _, hash := range hashes {
+		if hash == nil || !b.db.ExistsSha(hash) {
+			continue
+		}
+		block, err := b.db.FetchBlockBySha(hash)
+		if err != nil {
+			return nil, err
+		}
+		comparison.ForkHash = hash
+		comparison.ForkHeight = block.Height()
+		break
+	}
+	if comparison.ForkHash == nil {
+		genesisHash, err := b.db.FetchBlockShaByHeight(0)
+		if err != nil {
+			return nil, err
+		}
+		comparison.ForkHash = genesisHash
+		comparison.ForkHeight = 0
+	}
+
+	// When the tip of the other chain is in the local main chain, the local
+	// main chain either is the other chain or extends it.
+	if comparison.ForkHash.IsEqual(remoteTip) {
+		comparison.RemoteWorkKnown = true
+		if !remoteTip.IsEqual(b.bestChain.hash) {
+			comparison.WorkCmp = 1
+		}
+		return &comparison, nil
+	}
+
+	// Otherwise, the work for the other chain is only known when its tip is
+	// a known side chain block or header.
+	b.chainLock.RLock()
+	remoteNode, ok := b.index[*remoteTip]
+	if !ok {
+		remoteNode, ok = b.headerIndex[*remoteTip]
+	}
+	if ok {
+		comparison.RemoteWorkKnown = true
+		comparison.WorkCmp = b.bestChain.workSum.Cmp(remoteNode.workSum)
+	}
+	b.chainLock.RUnlock()
+
+	return &comparison, nil
+}
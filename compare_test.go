@@ -0,0 +1,102 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestCompareChain ensures CompareChain locates the fork point of another chain
+// from its tip and locator and compares the work of the chains when the tip of
+// the other chain is known.
+func TestCompareChain(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "comparetest", &params, nil)
+	defer teardown()
+
+	// The main chain is a1 <- a2 <- a3 and only the header of a4 is known.
+	// The side chain b2 <- b3 forks from a1.
+	g := newBlockGenerator(&params)
+	genesisHash := params.GenesisHash
+	mainBlocks := g.nextBlocks(g.genesis(), 4)
+	sideBlocks := g.nextBlocks(mainBlocks[0], 2)
+	processBlocks(t, chain, mainBlocks[:3])
+	processBlocks(t, chain, sideBlocks)
+	processHeaders(t, chain, mainBlocks[3:])
+	a1, a2, a3 := blockHash(mainBlocks[0]), blockHash(mainBlocks[1]),
+		blockHash(mainBlocks[2])
+	unknown := &btcwire.ShaHash{0x01}
+
+	tests := []struct {
+		name        string
+		remoteTip   *btcutil.Block
+		locator     []*btcwire.ShaHash
+		wantFork    *btcwire.ShaHash
+		wantHeight  int64
+		wantKnown   bool
+		wantWorkCmp int
+		wantForked  bool
+	}{
+		{"same chain", mainBlocks[2], []*btcwire.ShaHash{a2, a1,
+			genesisHash}, a3, 3, true, 0, false},
+		{"local chain extends remote", mainBlocks[1],
+			[]*btcwire.ShaHash{a1, genesisHash}, a2, 2, true, 1,
+			false},
+		{"remote chain extends local header", mainBlocks[3],
+			[]*btcwire.ShaHash{a3, a2, a1, genesisHash}, a3, 3, true,
+			-1, false},
+		{"known side chain", sideBlocks[1],
+			[]*btcwire.ShaHash{blockHash(sideBlocks[0]), a1,
+				genesisHash}, a1, 1, true, 0, true},
+		{"unknown chain", nil, []*btcwire.ShaHash{unknown, a1},
+			a1, 1, false, 0, true},
+		{"nothing in common", nil, nil, genesisHash, 0, false, 0,
+			true},
+	}
+
+	for i, test := range tests {
+		remoteTip := unknown
+		if test.remoteTip != nil {
+			remoteTip = blockHash(test.remoteTip)
+		}
+		comparison, err := chain.CompareChain(remoteTip, test.locator)
+		if err != nil {
+			t.Errorf("CompareChain #%d (%s): unexpected error %v", i,
+				test.name, err)
+			continue
+		}
+		if !comparison.ForkHash.IsEqual(test.wantFork) ||
+			comparison.ForkHeight != test.wantHeight {
+
+			t.Errorf("CompareChain #%d (%s): got fork %v (height "+
+				"%d), want %v (height %d)", i, test.name,
+				comparison.ForkHash, comparison.ForkHeight,
+				test.wantFork, test.wantHeight)
+		}
+		if !comparison.LocalTip.IsEqual(a3) ||
+			comparison.LocalHeight != 3 {
+
+			t.Errorf("CompareChain #%d (%s): got local tip %v "+
+				"(height %d), want %v (height 3)", i, test.name,
+				comparison.LocalTip, comparison.LocalHeight, a3)
+		}
+		if comparison.RemoteWorkKnown != test.wantKnown ||
+			comparison.WorkCmp != test.wantWorkCmp {
+
+			t.Errorf("CompareChain #%d (%s): got work known %v "+
+				"(cmp %d), want %v (cmp %d)", i, test.name,
+				comparison.RemoteWorkKnown, comparison.WorkCmp,
+				test.wantKnown, test.wantWorkCmp)
+		}
+		if comparison.IsForked() != test.wantForked {
+			t.Errorf("IsForked #%d (%s): got %v, want %v", i,
+				test.name, comparison.IsForked(),
+				test.wantForked)
+		}
+	}
+}
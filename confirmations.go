@@ -0,0 +1,115 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+const (
+	// maxTrackedReorgs is the maximum number of the most recent chain
+	// reorganizations which are tracked for the purposes of estimating how
+	// likely it is for a block at a given depth to be reorganized out of
+	// the main chain.
+	maxTrackedReorgs = 100
+
+	// maxSuggestedConfirmations is the maximum number of confirmations
+	// SuggestedConfirmations will ever suggest.
+	maxSuggestedConfirmations = 100
+
+	// reorgBaselineDecay is the factor by which the baseline probability
+	// of a block being reorganized out of the main chain drops with each
+	// additional confirmation.  See SuggestedConfirmations for details.
+	reorgBaselineDecay = 10.0
+)
+
+// trackedReorg describes a chain reorganization which was observed.
+type trackedReorg struct {
+	// depth is the number of blocks detached from the main chain.
+	depth int64
+
+	// blocksConnected is the number of blocks which had been connected to
+	// the main chain when the reorganization took place.
+	blocksConnected int64
+}
+
+// recordReorg tracks the depth (number of blocks detached from the main chain)
+// of a chain reorganization that just took place.  Only the most recent
+// maxTrackedReorgs reorganizations are kept.  The window the estimates are
+// based on starts right after the most recent one which was discarded, so it
+// covers exactly the blocks the tracked reorganizations took place in.
+func (b *BlockChain) recordReorg(depth int64) {
+	if len(b.recentReorgs) >= maxTrackedReorgs {
+		b.reorgWindowStart = b.recentReorgs[0].blocksConnected
+		copy(b.recentReorgs, b.recentReorgs[1:])
+		b.recentReorgs = b.recentReorgs[:len(b.recentReorgs)-1]
+	}
+	b.recentReorgs = append(b.recentReorgs, trackedReorg{
+		depth:           depth,
+		blocksConnected: b.blocksConnected,
+	})
+}
+
+// reorgProbability returns the estimated probability that a block with the
+// passed number of confirmations will be reorganized out of the main chain.
+// See SuggestedConfirmations for details.
+func (b *BlockChain) reorgProbability(confirmations int64) float64 {
+	baseline := 1.0
+	for i := int64(0); i < confirmations; i++ {
+		baseline /= reorgBaselineDecay
+	}
+
+	// Nothing has been observed yet, so only the baseline is available.
+	numBlocks := b.blocksConnected - b.reorgWindowStart
+	if numBlocks == 0 {
+		return baseline
+	}
+
+	// Determine the fraction of the blocks connected within the window
+	// of the tracked reorganizations which were followed by a
+	// reorganization at least as deep as the number of confirmations.
+	var numDeeper int64
+	for _, reorg := range b.recentReorgs {
+		if reorg.depth >= confirmations {
+			numDeeper++
+		}
+	}
+	observed := float64(numDeeper) / float64(numBlocks)
+	if observed > baseline {
+		return observed
+	}
+	return baseline
+}
+
+// SuggestedConfirmations returns the number of confirmations a payment of the
+// passed value (in satoshi) should be given before it is considered settled
+// such that the expected loss due to the payment being reversed by a chain
+// reorganization is no more than riskTolerance (also in satoshi).
+//
+// The probability that a payment with a given number of confirmations is
+// reversed is estimated from the most recent reorganizations observed by this
+// instance as the fraction of the blocks connected to the main chain during the
+// same period that were followed by a reorganization at least that deep.  Since
+// reorganizations are rare, and therefore unlikely to have been observed at
+// every depth of interest (particularly shortly after startup), the estimate is
+// never allowed to drop below a conservative baseline which starts at 1 and
+// drops by a factor of 10 with each confirmation.
+//
+// The result is always at least 1 and never more than 100.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) SuggestedConfirmations(value int64, riskTolerance int64) int64 {
+	if value <= 0 {
+		return 1
+	}
+
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	for confirmations := int64(1); confirmations < maxSuggestedConfirmations; confirmations++ {
+		expectedLoss := b.reorgProbability(confirmations) * float64(value)
+		if expectedLoss <= float64(riskTolerance) {
+			return confirmations
+		}
+	}
+
+	return maxSuggestedConfirmations
+}
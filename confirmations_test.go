@@ -0,0 +1,41 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"math"
+	"testing"
+)
+
+// TestReorgProbability ensures the estimated probability of a block being
+// reorganized out of the main chain only takes the blocks connected during the
+// window of the tracked reorganizations into account and never drops below the
+// baseline.
+func TestReorgProbability(t *testing.T) {
+	tests := []struct {
+		name           string
+		numReorgs      int
+		blocksPerReorg int64
+		depth          int64
+		confirmations  int64
+		want           float64
+	}{
+		{"nothing observed", 0, 0, 0, 1, 0.1},
+		{"fewer reorgs than tracked", 50, 10, 3, 2, 0.1},
+		{"more reorgs than tracked", 200, 10, 3, 2, 0.1},
+		{"deeper than observed", 200, 10, 3, 4, 0.0001},
+		{"rarer than baseline", 200, 10000, 3, 1, 0.1},
+	}
+
+	for i, test := range tests {
+		got := btcchain.TstReorgProbability(test.numReorgs,
+			test.blocksPerReorg, test.depth, test.confirmations)
+		if math.Abs(got-test.want) > test.want*1e-9 {
+			t.Errorf("reorgProbability #%d (%s): got %v, want %v", i,
+				test.name, got, test.want)
+		}
+	}
+}
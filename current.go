@@ -0,0 +1,61 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"time"
+)
+
+// maxTipAge is the maximum age of the block at the end of the main chain for
+// the chain to be considered current.
+const maxTipAge = time.Hour * 24
+
+// isCurrent returns whether or not the chain believes it is current.  See
+// IsCurrent for the criteria.
+//
+// This function MUST be called with the chain state lock held (for reads) or
+// while block processing is in progress.
+func (b *BlockChain) isCurrent() bool {
+	bestChain := b.bestChain
+	if bestChain == nil {
+		return false
+	}
+
+	// Not current if the main chain doesn't have the minimum amount of
+	// work the network is known to have.  Any chain which does not is
+	// either still syncing or not the real chain of the network.
+	minWork := b.chainParams.MinimumChainWork
+	if minWork != nil && bestChain.workSum.Cmp(minWork) < 0 {
+		return false
+	}
+
+	// Not current if the latest checkpoint hasn't been reached yet.
+	checkpoint := b.LatestCheckpoint()
+	if checkpoint != nil && bestChain.height < checkpoint.Height {
+		return false
+	}
+
+	// Not current if the end of the main chain is too old.
+	minTimestamp := b.timeSource.AdjustedTime().Add(-maxTipAge)
+	return !bestChain.timestamp.Before(minTimestamp)
+}
+
+// IsCurrent returns whether or not the chain believes it is current, as in it
+// has caught up with the rest of the network.  The chain is current when the
+// main chain has at least the MinimumChainWork of the network parameters, has
+// reached the latest checkpoint, and ends with a block from the last 24 hours.
+//
+// The minimum chain work in particular prevents a fresh node from believing it
+// is synced when it is fed a chain of recent blocks with little work.  Callers
+// should avoid actions such as relaying or mining on top of the chain until it
+// is current.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) IsCurrent() bool {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	return b.isCurrent()
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// TestIsCurrent ensures the chain is only considered current when the main
+// chain has the minimum chain work, has reached the latest checkpoint, and
+// ends with a recent block.
+func TestIsCurrent(t *testing.T) {
+	blockWork := btcchain.CalcWork(
+		btcchain.RegressionNetParams.GenesisBlock.Header.Bits)
+	checkpointHash := &btcwire.ShaHash{0x01}
+
+	tests := []struct {
+		name             string
+		recent           bool
+		minWorkBlocks    int64
+		checkpointHeight int64
+		want             bool
+	}{
+		{"recent tip", true, 0, 0, true},
+		{"old tip", false, 0, 0, false},
+		{"meets minimum chain work", true, 3, 0, true},
+		{"below minimum chain work", true, 100, 0, false},
+		{"old tip with minimum chain work", false, 3, 0, false},
+		{"checkpoint not reached", true, 0, 5, false},
+	}
+
+	for i, test := range tests {
+		params := btcchain.RegressionNetParams
+		if test.minWorkBlocks != 0 {
+			params.MinimumChainWork = new(big.Int).Mul(blockWork,
+				big.NewInt(test.minWorkBlocks))
+		}
+		if test.checkpointHeight != 0 {
+			params.Checkpoints = []btcchain.Checkpoint{
+				{Height: test.checkpointHeight, Hash: checkpointHash},
+			}
+		}
+		chain, _, teardown := newTestChain(t, "currenttest", &params,
+			nil)
+
+		// The recent blocks start an hour ago.
+		g := newBlockGenerator(&params)
+		first := g.nextBlock(g.genesis(), func(msgBlock *btcwire.MsgBlock) {
+			if test.recent {
+				msgBlock.Header.Timestamp = time.Unix(
+					time.Now().Add(-time.Hour).Unix(), 0)
+			}
+		})
+		processBlocks(t, chain, []*btcutil.Block{first})
+		processBlocks(t, chain, g.nextBlocks(first, 2))
+
+		got := chain.IsCurrent()
+		teardown()
+		if got != test.want {
+			t.Errorf("IsCurrent #%d (%s): got %v, want %v", i,
+				test.name, got, test.want)
+		}
+	}
+}
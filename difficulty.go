@@ -5,43 +5,11 @@
 package btcchain
 
 import (
-	"fmt"
 	"github.com/conformal/btcwire"
 	"math/big"
 	"time"
 )
 
-const (
-	// targetTimespan is the desired amount of time that should elapse
-	// before block difficulty requirement is examined to determine how
-	// it should be changed in order to maintain the desired block
-	// generation rate.
-	targetTimespan = time.Hour * 24 * 14
-
-	// targetSpacing is the desired amount of time to generate each block.
-	targetSpacing = time.Minute * 10
-
-	// blocksPerRetarget is the number of blocks between each difficulty
-	// retarget.  It is calculated based on the desired block generation
-	// rate.
-	blocksPerRetarget = int64(targetTimespan / targetSpacing)
-
-	// retargetAdjustmentFactor is the adjustment factor used to limit
-	// the minimum and maximum amount of adjustment that can occur between
-	// difficulty retargets.
-	retargetAdjustmentFactor = 4
-
-	// minRetargetTimespan is the minimum amount of adjustment that can
-	// occur between difficulty retargets.  It equates to 25% of the
-	// previous difficulty.
-	minRetargetTimespan = int64(targetTimespan / retargetAdjustmentFactor)
-
-	// maxRetargetTimespan is the maximum amount of adjustment that can
-	// occur between difficulty retargets.  It equates to 400% of the
-	// previous difficulty.
-	maxRetargetTimespan = int64(targetTimespan * retargetAdjustmentFactor)
-)
-
 var (
 	// bigOne is 1 represented as a big.Int.  It is defined here to avoid
 	// the overhead of creating it multiple times.
@@ -50,12 +18,33 @@ var (
 	// oneLsh256 is 1 shifted left 256 bits.  It is defined here to avoid
 	// the overhead of creating it multiple times.
 	oneLsh256 = new(big.Int).Lsh(bigOne, 256)
-
-	// powLimit is the highest proof of work value a bitcoin block can have.
-	// It is the value 2^224 - 1.
-	powLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 224), bigOne)
 )
 
+// minDifficultyBits is the compact representation of the target of the minimum
+// difficulty of the main network the difficulty ratio is relative to.
+const minDifficultyBits = 0x1d00ffff
+
+// blocksPerRetarget returns the number of blocks between each difficulty
+// retarget for the network.  It is calculated based on the desired block
+// generation rate.
+func (p *Params) blocksPerRetarget() int64 {
+	return int64(p.TargetTimespan / p.TargetTimePerBlock)
+}
+
+// minRetargetTimespan returns the minimum amount of adjustment that can occur
+// between difficulty retargets.  With the adjustment factor of the main
+// network it equates to 25% of the previous difficulty.
+func (p *Params) minRetargetTimespan() int64 {
+	return int64(p.TargetTimespan) / p.RetargetAdjustmentFactor
+}
+
+// maxRetargetTimespan returns the maximum amount of adjustment that can occur
+// between difficulty retargets.  With the adjustment factor of the main
+// network it equates to 400% of the previous difficulty.
+func (p *Params) maxRetargetTimespan() int64 {
+	return int64(p.TargetTimespan) * p.RetargetAdjustmentFactor
+}
+
 // ShaHashToBig converts a btcwire.ShaHash into a big.Int that can be used to
 // perform math comparisons.
 func ShaHashToBig(hash *btcwire.ShaHash) *big.Int {
@@ -164,7 +153,7 @@ func BigToCompact(n *big.Int) uint32 {
 	return compact
 }
 
-// calcWork calculates a work value from difficulty bits.  Bitcoin increases
+// CalcWork calculates a work value from difficulty bits.  Bitcoin increases
 // the difficulty for generating a block by decreasing the value which the
 // generated hash must be less than.  This difficulty target is stored in each
 // block header using a compact representation as described in the documenation
@@ -174,112 +163,60 @@ func BigToCompact(n *big.Int) uint32 {
 // accumulated must be the inverse of the difficulty.  Also, in order to avoid
 // potential division by zero and really small floating point numbers, add 1 to
 // the denominator and multiply the numerator by 2^256.
-func calcWork(bits uint32) *big.Rat {
-	// (1 << 256) / (difficultyNum + 1)
+//
+// The division is integer division, which is the same calculation bitcoind
+// uses, so the cumulative work of a chain is identical regardless of the
+// software computing it.  This makes it suitable for callers which need to
+// compare chains the same way this package does.
+func CalcWork(bits uint32) *big.Int {
+	// A negative or zero target is invalid and has no work.
 	difficultyNum := CompactToBig(bits)
+	if difficultyNum.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	// (1 << 256) / (difficultyNum + 1)
 	denominator := new(big.Int).Add(difficultyNum, bigOne)
-	return new(big.Rat).SetFrac(oneLsh256, denominator)
+	return new(big.Int).Div(oneLsh256, denominator)
+}
+
+// GetDifficultyRatio returns the proof of work difficulty of the passed
+// difficulty bits as a multiple of the minimum difficulty of the main network,
+// the bits of which are 0x1d00ffff.  This is the same value bitcoind reports
+// via RPC, such as getdifficulty and getblockheader, so the conversion is
+// identical for all callers.  It returns 0 for bits which do not encode a
+// positive target.
+func GetDifficultyRatio(bits uint32) float64 {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	// The difficulty is the minimum difficulty target divided by the
+	// target.  A rational number is used to avoid losing precision before
+	// the final conversion to a float.
+	ratio := new(big.Rat).SetFrac(CompactToBig(minDifficultyBits), target)
+	difficulty, _ := ratio.Float64()
+	return difficulty
 }
 
 // calcEasiestDifficulty calculates the easiest possible difficulty that a block
 // can have given starting difficulty bits and a duration.  It is mainly used to
 // verify that claimed proof of work by a block is sane as compared to a
 // known good checkpoint.
-func calcEasiestDifficulty(bits uint32, duration time.Duration) uint32 {
-	// Convert types used in the calculations below.
-	durationVal := int64(duration)
-	adjustmentFactor := big.NewInt(retargetAdjustmentFactor)
-
-	// TODO(davec): Testnet has special rules.
-
-	// Since easier difficulty equates to higher numbers, the easiest
-	// difficulty for a given duration is the largest value possible given
-	// the number of retargets for the duration and starting difficulty
-	// multiplied by the max adjustment factor.
-	newTarget := CompactToBig(bits)
-	for durationVal > 0 && newTarget.Cmp(powLimit) < 0 {
-		newTarget.Mul(newTarget, adjustmentFactor)
-		durationVal -= maxRetargetTimespan
-	}
-
-	// Limit new value to the proof of work limit.
-	if newTarget.Cmp(powLimit) > 0 {
-		newTarget.Set(powLimit)
-	}
-
-	return BigToCompact(newTarget)
+func (b *BlockChain) calcEasiestDifficulty(bits uint32, duration time.Duration) uint32 {
+	return b.retargeter().EasiestBits(b.chainParams, bits, duration)
 }
 
 // calcNextRequiredDifficulty calculates the required difficulty for the block
-// after the passed previous block node based on the difficulty retarget rules.
+// after the passed previous block node based on the difficulty retarget rules
+// of the network.
 func (b *BlockChain) calcNextRequiredDifficulty(lastNode *blockNode) (uint32, error) {
-	// Genesis block.
-	if lastNode == nil {
-		return BigToCompact(powLimit), nil
-	}
-
-	// Return the previous block's difficulty requirements if this block
-	// is not at a difficulty retarget interval.
-	if (lastNode.height+1)%blocksPerRetarget != 0 {
-		// TODO(davec): Testnet has special rules.
-		return lastNode.bits, nil
+	var lastRetargetNode *RetargetNode
+	if lastNode != nil {
+		lastRetargetNode = newRetargetNode(lastNode)
 	}
-
-	// Get the block node at the previous retarget (targetTimespan days
-	// worth of blocks).
-	firstNode := lastNode
-	for i := int64(0); i < blocksPerRetarget-1 && firstNode != nil; i++ {
-		// Get the previous block node.  This function is used over
-		// simply accessing firstNode.parent directly as it will
-		// dynamically create previous block nodes as needed.  This
-		// helps allow only the pieces of the chain that are needed
-		// to remain in memory.
-		var err error
-		firstNode, err = b.getPrevNodeFromNode(firstNode)
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	if firstNode == nil {
-		return 0, fmt.Errorf("unable to obtain previous retarget block")
-	}
-
-	// Limit the amount of adjustment that can occur to the previous
-	// difficulty.
-	actualTimespan := lastNode.timestamp.UnixNano() - firstNode.timestamp.UnixNano()
-	adjustedTimespan := actualTimespan
-	if actualTimespan < minRetargetTimespan {
-		adjustedTimespan = minRetargetTimespan
-	} else if actualTimespan > maxRetargetTimespan {
-		adjustedTimespan = maxRetargetTimespan
-	}
-
-	// Calculate new target difficulty as:
-	//  currentDifficulty * (adjustedTimespan / targetTimespan)
-	// The result uses integer division which means it will be slightly
-	// rounded down.  Bitcoind also uses integer division to calculate this
-	// result.
-	oldTarget := CompactToBig(lastNode.bits)
-	newTarget := new(big.Int).Mul(oldTarget, big.NewInt(adjustedTimespan))
-	newTarget.Div(newTarget, big.NewInt(int64(targetTimespan)))
-
-	// Limit new value to the proof of work limit.
-	if newTarget.Cmp(powLimit) > 0 {
-		newTarget.Set(powLimit)
-	}
-
-	// Log new target difficulty and return it.  The new target logging is
-	// intentionally converting the bits back to a number instead of using
-	// newTarget since conversion to the compact representation loses
-	// precision.
-	newTargetBits := BigToCompact(newTarget)
-	log.Debugf("Difficulty retarget at block height %d", lastNode.height+1)
-	log.Debugf("Old target %08x (%064x)", lastNode.bits, oldTarget)
-	log.Debugf("New target %08x (%064x)", newTargetBits, CompactToBig(newTargetBits))
-	log.Debugf("Actual timespan %v, adjusted timespan %v, target timespan %v",
-		time.Duration(actualTimespan), time.Duration(adjustedTimespan),
-		targetTimespan)
-
-	return newTargetBits, nil
+	history := chainRetargetHistory{b: b}
+	return b.retargeter().NextRequiredBits(b.chainParams, lastRetargetNode,
+		history)
 }
@@ -0,0 +1,57 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"math/big"
+	"testing"
+)
+
+// TestCalcWork ensures CalcWork calculates the same work values as bitcoind.
+func TestCalcWork(t *testing.T) {
+	tests := []struct {
+		bits uint32
+		work int64
+	}{
+		// The difficulty of the genesis block.
+		{0x1d00ffff, 0x100010001},
+		// The difficulty of block 100000.
+		{0x1b04864c, 0x38946224e37e},
+		// Negative and zero targets have no work.
+		{0x1d80ffff, 0},
+		{0x00000000, 0},
+	}
+
+	for _, test := range tests {
+		work := btcchain.CalcWork(test.bits)
+		if work.Cmp(big.NewInt(test.work)) != 0 {
+			t.Errorf("CalcWork (%08x): got %v, want %v", test.bits,
+				work, test.work)
+		}
+	}
+}
+
+// TestGetDifficultyRatio ensures GetDifficultyRatio reports the same difficulty
+// as bitcoind.
+func TestGetDifficultyRatio(t *testing.T) {
+	tests := []struct {
+		bits       uint32
+		difficulty float64
+	}{
+		{0x1d00ffff, 1},
+		{0x1b0404cb, 16307.420938523983},
+		{0x207fffff, 4.6565423739069247e-10},
+		{0x1d80ffff, 0},
+	}
+
+	for _, test := range tests {
+		difficulty := btcchain.GetDifficultyRatio(test.bits)
+		if difficulty != test.difficulty {
+			t.Errorf("GetDifficultyRatio (%08x): got %v, want %v",
+				test.bits, difficulty, test.difficulty)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// defaultDivergenceDepth is the default number of main chain blocks which must
+// not be shared by any of the remote tips before an NTConsensusDivergence
+// notification is sent.
+const defaultDivergenceDepth = 6
+
+// remoteTip houses the most recent tip reported by a source.
+type remoteTip struct {
+	hash   *btcwire.ShaHash
+	height int64
+}
+
+// ConsensusDivergence is the data sent with an NTConsensusDivergence
+// notification.  It indicates that none of the sources which reported their
+// tips via ObserveRemoteTip agree with the local main chain.
+type ConsensusDivergence struct {
+	// LocalTip and LocalHeight identify the end of the local main chain.
+	LocalTip    *btcwire.ShaHash
+	LocalHeight int64
+
+	// Depth is the minimum number of blocks at the end of the local main
+	// chain which are not part of the chain of any of the sources.
+	Depth int64
+
+	// NumSources is the number of sources which disagree with the local
+	// main chain.
+	NumSources int
+}
+
+// SetDivergenceDepth sets the number of blocks at the end of the local main
+// chain which must not be part of any of the chains reported via
+// ObserveRemoteTip before an NTConsensusDivergence notification is sent.  The
+// default is 6 blocks.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) SetDivergenceDepth(depth int64) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.divergenceDepth = depth
+}
+
+// ObserveRemoteTip records the tip reported by the source with the passed
+// identifier, such as a peer, and checks whether the local main chain is on a
+// different chain than all of the sources.  An NTConsensusDivergence
+// notification is sent when that is the case and the local main chain has
+// diverged by at least the depth set via SetDivergenceDepth.  It is only sent
+// again after the local main chain agrees with a source once more.  Use
+// RemoveSource to forget the tip of a source.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) ObserveRemoteTip(source string, hash *btcwire.ShaHash, height int64) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.remoteTips[source] = &remoteTip{hash: hash, height: height}
+	b.checkDivergence()
+}
+
+// remoteTipDivergence returns whether or not the local main chain contains the
+// passed remote tip or extends it and, when it doesn't, the number of blocks at
+// the end of the local main chain which are not part of the remote chain.  The
+// last return value is false when the remote tip is beyond the end of the local
+// main chain and not known, so it is impossible to tell.
+func (b *BlockChain) remoteTipDivergence(tip *remoteTip) (bool, int64, bool) {
+	// A remote tip at or before the end of the local main chain agrees
+	// when it's the main chain block at that height.  Otherwise, the chains
+	// forked before it.
+	bestChain := b.bestChain
+	if tip.height <= bestChain.height {
+		mainHash, err := b.db.FetchBlockShaByHeight(tip.height)
+		if err != nil {
+			return false, 0, false
+		}
+		if mainHash.IsEqual(tip.hash) {
+			return true, 0, true
+		}
+
+		// The fork point is known exactly when the remote tip is a
+		// known side chain block.
+		forkHeight := tip.height - 1
+		if node, ok := b.index[*tip.hash]; ok {
+			_, attachNodes := b.getReorganizeNodes(node)
+			if attachNodes.Len() > 0 {
+				first := attachNodes.Front().Value.(*blockNode)
+				forkHeight = first.height - 1
+			}
+		}
+		return false, bestChain.height - forkHeight, true
+	}
+
+	// A remote tip beyond the end of the local main chain can only be
+	// checked when it's a known block or header.
+	node, ok := b.index[*tip.hash]
+	if !ok {
+		node, ok = b.headerIndex[*tip.hash]
+	}
+	if !ok {
+		return false, 0, false
+	}
+	detachNodes, attachNodes := b.getReorganizeNodes(node)
+	if detachNodes.Len() == 0 {
+		return true, 0, true
+	}
+	forkHeight := bestChain.height - int64(detachNodes.Len())
+	if attachNodes.Len() > 0 {
+		forkHeight = attachNodes.Front().Value.(*blockNode).height - 1
+	}
+	return false, bestChain.height - forkHeight, true
+}
+
+// checkDivergence sends an NTConsensusDivergence notification when the local
+// main chain disagrees with all of the remote tips with a known status by at
+// least the configured depth.  It must be called with the process lock held.
+func (b *BlockChain) checkDivergence() {
+	if b.bestChain == nil {
+		return
+	}
+
+	var numDisagree int
+	minDepth := int64(-1)
+	for _, tip := range b.remoteTips {
+		agrees, depth, known := b.remoteTipDivergence(tip)
+		if !known {
+			continue
+		}
+		if agrees {
+			b.divergenceReported = false
+			return
+		}
+
+		numDisagree++
+		if minDepth == -1 || depth < minDepth {
+			minDepth = depth
+		}
+	}
+	if numDisagree == 0 || minDepth < b.divergenceDepth ||
+		b.divergenceReported {
+
+		return
+	}
+
+	log.Warnf("The main chain tip %v (height %d) has diverged from the "+
+		"tips of all %d sources by at least %d blocks", b.bestChain.hash,
+		b.bestChain.height, numDisagree, minDepth)
+	b.divergenceReported = true
+	divergence := ConsensusDivergence{
+		LocalTip:    b.bestChain.hash,
+		LocalHeight: b.bestChain.height,
+		Depth:       minDepth,
+		NumSources:  numDisagree,
+	}
+	b.sendNotification(NTConsensusDivergence, &divergence)
+}
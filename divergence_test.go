@@ -0,0 +1,96 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestObserveRemoteTip ensures an NTConsensusDivergence notification is sent
+// once all sources with a known tip disagree with the local main chain by at
+// least the divergence depth and that it is only sent again after a source
+// agrees once more.  The tests are run in order against the same chain.
+func TestObserveRemoteTip(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	c := make(chan *btcchain.Notification, 100)
+	chain, _, teardown := newTestChain(t, "divergencetest", &params, c)
+	defer teardown()
+	chain.SetDivergenceDepth(2)
+
+	// The main chain is a1 <- a2 <- a3 <- a4 and only the header of a5 is
+	// known.  The side chain b2 <- b3 forks from a1.
+	g := newBlockGenerator(&params)
+	mainBlocks := g.nextBlocks(g.genesis(), 5)
+	sideBlocks := g.nextBlocks(mainBlocks[0], 2)
+	processBlocks(t, chain, mainBlocks[:4])
+	processBlocks(t, chain, sideBlocks)
+	processHeaders(t, chain, mainBlocks[4:])
+	for len(c) > 0 {
+		<-c
+	}
+	unknown := &btcwire.ShaHash{0x01}
+
+	tests := []struct {
+		name        string
+		source      string
+		tip         *btcwire.ShaHash
+		height      int64
+		depth       int64
+		wantDepth   int64
+		wantSources int
+	}{
+		{"agrees at tip", "peer1", blockHash(mainBlocks[3]), 4, 0, 0, 0},
+		{"side chain", "peer1", blockHash(sideBlocks[1]), 3, 0, 3, 1},
+		{"unknown tip beyond end", "peer2", unknown, 10, 0, 0, 0},
+		{"agrees behind tip", "peer2", blockHash(mainBlocks[1]), 2, 0, 0,
+			0},
+		{"unknown tip before end", "peer2", unknown, 2, 0, 3, 2},
+		{"agrees with header", "peer2", blockHash(mainBlocks[4]), 5, 0,
+			0, 0},
+		{"shallow divergence", "peer2", unknown, 4, 0, 0, 0},
+		{"lower divergence depth", "peer2", unknown, 4, 1, 1, 2},
+	}
+
+	for i, test := range tests {
+		if test.depth != 0 {
+			chain.SetDivergenceDepth(test.depth)
+		}
+		chain.ObserveRemoteTip(test.source, test.tip, test.height)
+
+		var divergence *btcchain.ConsensusDivergence
+		for len(c) > 0 {
+			if n := <-c; n.Type == btcchain.NTConsensusDivergence {
+				divergence = n.Data.(*btcchain.ConsensusDivergence)
+			}
+		}
+		if test.wantDepth == 0 {
+			if divergence != nil {
+				t.Errorf("ObserveRemoteTip #%d (%s): unexpected "+
+					"notification %v", i, test.name,
+					divergence)
+			}
+			continue
+		}
+		if divergence == nil {
+			t.Errorf("ObserveRemoteTip #%d (%s): no notification",
+				i, test.name)
+			continue
+		}
+		if !divergence.LocalTip.IsEqual(blockHash(mainBlocks[3])) ||
+			divergence.LocalHeight != 4 ||
+			divergence.Depth != test.wantDepth ||
+			divergence.NumSources != test.wantSources {
+
+			t.Errorf("ObserveRemoteTip #%d (%s): got tip %v (height "+
+				"%d), depth %d, %d sources, want depth %d, %d "+
+				"sources", i, test.name, divergence.LocalTip,
+				divergence.LocalHeight, divergence.Depth,
+				divergence.NumSources, test.wantDepth,
+				test.wantSources)
+		}
+	}
+}
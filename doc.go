@@ -61,6 +61,31 @@ is by no means exhaustive:
    coins
  - Insert the block into the block database
 
+Block headers may also be processed on their own via ProcessBlockHeader ahead
+of the full blocks in order to support headers-first download.  Headers go
+through the subset of the above rules which only depend on the header, namely
+the proof of work, timestamp, checkpoint, and difficulty checks.  The header
+chain with the most cumulative work is tracked alongside the block chain and
+MissingBlocks reports which blocks still need to be downloaded, in the order
+they need to be processed, in order to catch the block chain up to it.
+
+Network Parameters
+
+The consensus rules which differ between networks, such as the genesis block,
+proof of work limit, difficulty retarget interval, coinbase maturity, subsidy
+halving interval, checkpoints, and soft fork activation heights, are defined by
+the Params passed to New.  MainNetParams and TestNet3Params are provided for
+the standard networks, and other networks can be supported by defining their
+own parameters.  RegressionNetParams provides a private network for testing
+software built on this package where the proof of work is trivial and never
+retargets, so blocks can be generated instantly.  Alternative networks with
+their own genesis block are supported as well since the genesis block of the
+parameters is inserted into an empty database when the first block is
+processed, which also ensures an existing database was created for the same
+network.  InitGenesis does the same up front.  Networks which
+retarget the difficulty differently than bitcoin can provide their own
+algorithm by implementing the Retargeter interface.
+
 Block Processing Example
 
 The following example program demonstrates processing a block.  This example
@@ -90,13 +115,18 @@ intentionally causes an error by attempting to process a duplicate block.
 
 		// Create a new BlockChain instance using the underlying database for
 		// the main bitcoin network and ignore notifications.
-		chain := btcchain.New(db, btcwire.MainNet, nil)
+		chain, err := btcchain.New(db, &btcchain.MainNetParams, nil)
+		if err != nil {
+			fmt.Printf("Failed to create chain: %v\n", err)
+			return
+		}
 
 		// Process a block.  For this example, we are going to intentionally
 		// cause an error by trying to process the genesis block which already
-		// exists.
+		// exists since it is inserted into the new database before the first
+		// block is processed.
 		block := btcutil.NewBlock(&btcwire.GenesisBlock, btcwire.ProtocolVersion)
-		err = chain.ProcessBlock(block)
+		_, _, err = chain.ProcessBlock(block)
 		if err != nil {
 			fmt.Printf("Failed to process block: %v\n", err)
 			return
@@ -110,13 +140,28 @@ calls or of type btcchain.RuleError.  This allows the caller to differentiate
 between unexpected errors, such as database errors, versus errors due to rule
 violations through type assertions.
 
+Each RuleError carries an ErrorCode which identifies the specific rule that was
+violated.  The BanScore method of the error provides a suggested misbehavior
+score for the peer which supplied the offending data, ranging from
+BanScoreNone for violations honest peers can trigger, such as a block timestamp
+which is slightly too far in the future, to BanScoreInstant for violations such
+as invalid proof of work.  Similarly, ErrToRejectErr provides the BIP0061 reject
+code and reason to send to the peer.
+
 Bitcoin Improvement Proposals
 
 This package includes spec changes outlined by the following BIPs:
 
+		BIP0009 (https://en.bitcoin.it/wiki/BIP_0009)
 		BIP0016 (https://en.bitcoin.it/wiki/BIP_0016)
 		BIP0030 (https://en.bitcoin.it/wiki/BIP_0030)
 		BIP0034 (https://en.bitcoin.it/wiki/BIP_0034)
+		BIP0061 (https://en.bitcoin.it/wiki/BIP_0061)
+		BIP0065 (https://en.bitcoin.it/wiki/BIP_0065)
+		BIP0066 (https://en.bitcoin.it/wiki/BIP_0066)
+		BIP0068 (https://en.bitcoin.it/wiki/BIP_0068)
+		BIP0112 (https://en.bitcoin.it/wiki/BIP_0112)
+		BIP0113 (https://en.bitcoin.it/wiki/BIP_0113)
 
 Other important information
 
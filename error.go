@@ -0,0 +1,386 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"strings"
+)
+
+// ErrorCode identifies a kind of rule violation.
+type ErrorCode int
+
+// These constants are used to identify a specific RuleError.
+const (
+	// ErrDuplicateBlock indicates a block with the same hash already
+	// exists.
+	ErrDuplicateBlock ErrorCode = iota
+
+	// ErrBlockTooBig indicates the serialized block weight exceeds the max
+	// allowed.
+	ErrBlockTooBig
+
+	// ErrTooManyTransactions indicates the block contains more
+	// transactions than the sanity limits allow.
+	ErrTooManyTransactions
+
+	// ErrTxTooBig indicates a transaction in the block is larger than the
+	// sanity limits allow.
+	ErrTxTooBig
+
+	// ErrBlockVersionTooOld indicates the block version is too old and is
+	// no longer accepted since the majority of the network has upgraded
+	// to a newer version.
+	ErrBlockVersionTooOld
+
+	// ErrTimeTooOld indicates the time is either before the median time of
+	// the last several blocks per the chain consensus rules or prior to the
+	// most recent checkpoint.
+	ErrTimeTooOld
+
+	// ErrTimeTooNew indicates the time is too far in the future as compared
+	// the current time.
+	ErrTimeTooNew
+
+	// ErrDifficultyTooLow indicates the difficulty for the block is lower
+	// than the difficulty required by the most recent checkpoint or, for
+	// orphan blocks, the end of the main chain.
+	ErrDifficultyTooLow
+
+	// ErrUnexpectedDifficulty indicates the specified bits do not align
+	// with the expected value either because it doesn't match the
+	// calculated value based on difficulty regarding the rules or it is
+	// out of the valid range.
+	ErrUnexpectedDifficulty
+
+	// ErrHighHash indicates the block does not hash to a value which is
+	// lower than the required target difficulty.
+	ErrHighHash
+
+	// ErrBadMerkleRoot indicates the calculated merkle root does not match
+	// the expected value.
+	ErrBadMerkleRoot
+
+	// ErrBadCheckpoint indicates a block that is expected to be at a
+	// checkpoint height does not match the expected one.
+	ErrBadCheckpoint
+
+	// ErrForkTooOld indicates a block is attempting to fork the block chain
+	// before the most recent checkpoint.
+	ErrForkTooOld
+
+	// ErrPrevBlockUnknown indicates the block header for the previous
+	// block of a processed header is not known.
+	ErrPrevBlockUnknown
+
+	// ErrNoTransactions indicates the block does not have at least one
+	// transaction.  A valid block must have at least the coinbase
+	// transaction.
+	ErrNoTransactions
+
+	// ErrNoTxInputs indicates a transaction does not have any inputs.  A
+	// valid transaction must have at least one input.
+	ErrNoTxInputs
+
+	// ErrNoTxOutputs indicates a transaction does not have any outputs.  A
+	// valid transaction must have at least one output.
+	ErrNoTxOutputs
+
+	// ErrBadTxOutValue indicates an output value for a transaction is
+	// invalid in some way such as being out of range.
+	ErrBadTxOutValue
+
+	// ErrDuplicateTxInputs indicates a transaction references the same
+	// input more than once.
+	ErrDuplicateTxInputs
+
+	// ErrBadTxInput indicates a transaction input is invalid in some way
+	// such as referencing a null previous output or an output index which
+	// does not exist.
+	ErrBadTxInput
+
+	// ErrMissingTx indicates a transaction referenced by an input is
+	// missing.
+	ErrMissingTx
+
+	// ErrUnfinalizedTx indicates a transaction has not been finalized.
+	// A valid block may only contain finalized transactions.
+	ErrUnfinalizedTx
+
+	// ErrDuplicateTx indicates a block contains an identical transaction
+	// (or at least two transactions which hash to the same value).  A
+	// valid block may only contain unique transactions.
+	ErrDuplicateTx
+
+	// ErrOverwriteTx indicates a block contains a transaction that has
+	// the same hash as a previous transaction which has not been fully
+	// spent.
+	ErrOverwriteTx
+
+	// ErrImmatureSpend indicates a transaction is attempting to spend a
+	// coinbase that has not yet reached the required maturity.
+	ErrImmatureSpend
+
+	// ErrDoubleSpend indicates a transaction is attempting to spend coins
+	// that have already been spent.
+	ErrDoubleSpend
+
+	// ErrSpendTooHigh indicates a transaction is attempting to spend more
+	// value than the sum of all of its inputs.
+	ErrSpendTooHigh
+
+	// ErrBadFees indicates the total fees for a block are invalid due to
+	// exceeding the maximum possible value.
+	ErrBadFees
+
+	// ErrTooManySigOps indicates the total number of signature operations
+	// for a transaction or block exceed the maximum allowed limits.
+	ErrTooManySigOps
+
+	// ErrFirstTxNotCoinbase indicates the first transaction in a block
+	// is not a coinbase transaction.
+	ErrFirstTxNotCoinbase
+
+	// ErrMultipleCoinbases indicates a block contains more than one
+	// coinbase transaction.
+	ErrMultipleCoinbases
+
+	// ErrBadCoinbaseScriptLen indicates the length of the signature script
+	// for a coinbase transaction is not within the valid range.
+	ErrBadCoinbaseScriptLen
+
+	// ErrBadCoinbaseValue indicates the amount of a coinbase value does
+	// not match the expected value of the subsidy plus the sum of all
+	// fees.
+	ErrBadCoinbaseValue
+
+	// ErrMissingCoinbaseHeight indicates the coinbase transaction for a
+	// block does not start with the serialized block height as required
+	// for version 2 and higher blocks.
+	ErrMissingCoinbaseHeight
+
+	// ErrBadCoinbaseHeight indicates the serialized block height in the
+	// coinbase transaction for version 2 and higher blocks does not match
+	// the expected value.
+	ErrBadCoinbaseHeight
+
+	// ErrNotStrictDER indicates a signature is not strictly DER encoded
+	// as required by BIP0066.
+	ErrNotStrictDER
+
+	// ErrUnsatisfiedLockTime indicates an OP_CHECKLOCKTIMEVERIFY or
+	// OP_CHECKSEQUENCEVERIFY opcode is not satisfied by the spending
+	// transaction.
+	ErrUnsatisfiedLockTime
+
+	// ErrSequenceLockNotMet indicates the relative lock time of a
+	// transaction as defined by BIP0068 has not passed.
+	ErrSequenceLockNotMet
+
+	// ErrScriptValidation indicates the result of executing a transaction
+	// script failed.  The error covers any failure when executing scripts
+	// such as signature verification failures and execution past the end
+	// of the stack.
+	ErrScriptValidation
+
+	// ErrInvalidAncestorBlock indicates one of the ancestors of the block
+	// was found to violate the rules or was marked invalid via
+	// InvalidateBlock, so the block can never be valid.
+	ErrInvalidAncestorBlock
+)
+
+// Map of ErrorCode values back to their constant names for pretty printing.
+var errorCodeStrings = map[ErrorCode]string{
+	ErrDuplicateBlock:        "ErrDuplicateBlock",
+	ErrBlockTooBig:           "ErrBlockTooBig",
+	ErrTooManyTransactions:   "ErrTooManyTransactions",
+	ErrTxTooBig:              "ErrTxTooBig",
+	ErrBlockVersionTooOld:    "ErrBlockVersionTooOld",
+	ErrTimeTooOld:            "ErrTimeTooOld",
+	ErrTimeTooNew:            "ErrTimeTooNew",
+	ErrDifficultyTooLow:      "ErrDifficultyTooLow",
+	ErrUnexpectedDifficulty:  "ErrUnexpectedDifficulty",
+	ErrHighHash:              "ErrHighHash",
+	ErrBadMerkleRoot:         "ErrBadMerkleRoot",
+	ErrBadCheckpoint:         "ErrBadCheckpoint",
+	ErrForkTooOld:            "ErrForkTooOld",
+	ErrPrevBlockUnknown:      "ErrPrevBlockUnknown",
+	ErrNoTransactions:        "ErrNoTransactions",
+	ErrNoTxInputs:            "ErrNoTxInputs",
+	ErrNoTxOutputs:           "ErrNoTxOutputs",
+	ErrBadTxOutValue:         "ErrBadTxOutValue",
+	ErrDuplicateTxInputs:     "ErrDuplicateTxInputs",
+	ErrBadTxInput:            "ErrBadTxInput",
+	ErrMissingTx:             "ErrMissingTx",
+	ErrUnfinalizedTx:         "ErrUnfinalizedTx",
+	ErrDuplicateTx:           "ErrDuplicateTx",
+	ErrOverwriteTx:           "ErrOverwriteTx",
+	ErrImmatureSpend:         "ErrImmatureSpend",
+	ErrDoubleSpend:           "ErrDoubleSpend",
+	ErrSpendTooHigh:          "ErrSpendTooHigh",
+	ErrBadFees:               "ErrBadFees",
+	ErrTooManySigOps:         "ErrTooManySigOps",
+	ErrFirstTxNotCoinbase:    "ErrFirstTxNotCoinbase",
+	ErrMultipleCoinbases:     "ErrMultipleCoinbases",
+	ErrBadCoinbaseScriptLen:  "ErrBadCoinbaseScriptLen",
+	ErrBadCoinbaseValue:      "ErrBadCoinbaseValue",
+	ErrMissingCoinbaseHeight: "ErrMissingCoinbaseHeight",
+	ErrBadCoinbaseHeight:     "ErrBadCoinbaseHeight",
+	ErrNotStrictDER:          "ErrNotStrictDER",
+	ErrUnsatisfiedLockTime:   "ErrUnsatisfiedLockTime",
+	ErrSequenceLockNotMet:    "ErrSequenceLockNotMet",
+	ErrScriptValidation:      "ErrScriptValidation",
+	ErrInvalidAncestorBlock:  "ErrInvalidAncestorBlock",
+}
+
+// String returns the ErrorCode as a human-readable name.
+func (e ErrorCode) String() string {
+	if s := errorCodeStrings[e]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// These constants define the suggested ban scores returned by BanScore.  They
+// follow the convention used by bitcoind where an accumulated score of
+// BanScoreInstant or more results in the peer being banned.
+const (
+	// BanScoreNone is the score for violations which honest peers can
+	// trigger, for example by relaying a block which was valid for them
+	// but not yet for us due to clock differences.
+	BanScoreNone = 0
+
+	// BanScoreLow is the score for violations which are unusual for an
+	// honest peer, but not conclusive evidence of misbehavior.
+	BanScoreLow = 10
+
+	// BanScoreInstant is the score for violations which can only be
+	// triggered deliberately or by broken software, such as a block with
+	// invalid proof of work.
+	BanScoreInstant = 100
+)
+
+// errorCodeBanScores houses the suggested ban score of each error code.  Error
+// codes which are not listed have a score of BanScoreInstant.
+var errorCodeBanScores = map[ErrorCode]uint32{
+	// The block may have simply been received from more than one peer.
+	ErrDuplicateBlock: BanScoreNone,
+
+	// Peers whose clocks are slightly off, or which have not seen the same
+	// blocks, can disagree about these without either being at fault.
+	ErrTimeTooOld:         BanScoreNone,
+	ErrTimeTooNew:         BanScoreNone,
+	ErrBlockVersionTooOld: BanScoreNone,
+	ErrImmatureSpend:      BanScoreNone,
+
+	// These are more likely to be caused by the peer being on a stale
+	// chain than by deliberate misbehavior.
+	ErrPrevBlockUnknown: BanScoreLow,
+	ErrUnfinalizedTx:    BanScoreLow,
+}
+
+// BanScore returns the suggested ban score for a peer which provided data which
+// was rejected with the error code.  It allows a peer to peer layer to apply
+// penalties in proportion to the severity of the violation instead of treating
+// every rule violation the same.  See BanScoreNone, BanScoreLow, and
+// BanScoreInstant.
+func (e ErrorCode) BanScore() uint32 {
+	if score, ok := errorCodeBanScores[e]; ok {
+		return score
+	}
+	return BanScoreInstant
+}
+
+// RuleError identifies a rule violation.  It is used to indicate that
+// processing of a block or transaction failed due to one of the many validation
+// rules.  The caller can use type assertions to determine if a failure was
+// specifically due to a rule violation and access the ErrorCode field to
+// ascertain the specific reason for the rule violation.
+type RuleError struct {
+	ErrorCode   ErrorCode // Describes the kind of error
+	Description string    // Human readable description of the issue
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+// BanScore returns the suggested ban score for a peer which provided data which
+// was rejected with the error.  See ErrorCode.BanScore.
+func (e RuleError) BanScore() uint32 {
+	return e.ErrorCode.BanScore()
+}
+
+// ruleError creates a RuleError given a set of arguments.
+func ruleError(c ErrorCode, desc string) RuleError {
+	return RuleError{ErrorCode: c, Description: desc}
+}
+
+// contextError returns the passed error with the passed context, such as the
+// block or transaction being processed, prepended to its description.  The type
+// of the error is preserved so callers can still use type assertions to
+// determine the kind of failure.  Errors which already start with the context
+// are returned unchanged, so the same context is never added twice when an
+// error passes through multiple layers which each add it.  ErrInterrupted is
+// also returned unchanged so it can still be compared against.
+func contextError(err error, context string) error {
+	if err == nil || err == ErrInterrupted {
+		return err
+	}
+	prefix := context + ": "
+	if strings.HasPrefix(err.Error(), prefix) {
+		return err
+	}
+
+	switch e := err.(type) {
+	case RuleError:
+		e.Description = prefix + e.Description
+		return e
+	case DatabaseError:
+		e.context = prefix + e.context
+		return e
+	case DeserializationError:
+		e.context = prefix + e.context
+		return e
+	case QuotaError:
+		return QuotaError(prefix + string(e))
+	case ResourceError:
+		return ResourceError(prefix + string(e))
+	case ReorgDepthError:
+		e.context = prefix + e.context
+		return e
+	}
+	return fmt.Errorf("%s%v", prefix, err)
+}
+
+// blockContext returns the context used for errors which occur while
+// processing the block with the passed hash and height.  A negative height
+// means the height is not known.
+func blockContext(hash *btcwire.ShaHash, height int64) string {
+	if height < 0 {
+		return fmt.Sprintf("block %v", hash)
+	}
+	return fmt.Sprintf("block %v (height %d)", hash, height)
+}
+
+// nodeError returns the passed error with the hash and height of the block for
+// the passed node added as context.  See contextError.
+func nodeError(err error, node *blockNode) error {
+	return contextError(err, blockContext(node.hash, node.height))
+}
+
+// txContext returns the context used for errors which occur while validating
+// the transaction with the passed hash.
+func txContext(txHash *btcwire.ShaHash) string {
+	return fmt.Sprintf("transaction %v", txHash)
+}
+
+// txInContext returns the context used for errors which occur while validating
+// the input at the passed index of the transaction with the passed hash.
+func txInContext(txHash *btcwire.ShaHash, txInIndex int) string {
+	return fmt.Sprintf("transaction %v input %d", txHash, txInIndex)
+}
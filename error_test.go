@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"testing"
+)
+
+// TestErrorCodeStringer tests the stringized output for the ErrorCode type.
+func TestErrorCodeStringer(t *testing.T) {
+	tests := []struct {
+		in   btcchain.ErrorCode
+		want string
+	}{
+		{btcchain.ErrDuplicateBlock, "ErrDuplicateBlock"},
+		{btcchain.ErrHighHash, "ErrHighHash"},
+		{btcchain.ErrScriptValidation, "ErrScriptValidation"},
+		{0xffff, "Unknown ErrorCode (65535)"},
+	}
+
+	for i, test := range tests {
+		result := test.in.String()
+		if result != test.want {
+			t.Errorf("String #%d\n got: %s want: %s", i, result,
+				test.want)
+			continue
+		}
+	}
+}
+
+// TestBanScore tests the suggested ban scores of rule errors.
+func TestBanScore(t *testing.T) {
+	tests := []struct {
+		code btcchain.ErrorCode
+		want uint32
+	}{
+		{btcchain.ErrHighHash, btcchain.BanScoreInstant},
+		{btcchain.ErrBadMerkleRoot, btcchain.BanScoreInstant},
+		{btcchain.ErrTimeTooNew, btcchain.BanScoreNone},
+		{btcchain.ErrDuplicateBlock, btcchain.BanScoreNone},
+		{btcchain.ErrPrevBlockUnknown, btcchain.BanScoreLow},
+	}
+
+	for i, test := range tests {
+		err := btcchain.RuleError{ErrorCode: test.code}
+		if score := err.BanScore(); score != test.want {
+			t.Errorf("BanScore #%d (%v) got: %d want: %d", i,
+				test.code, score, test.want)
+		}
+	}
+}
+
+// TestErrToRejectErr tests the reject codes and reasons for errors.
+func TestErrToRejectErr(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   btcchain.RejectCode
+		reason string
+		ok     bool
+	}{
+		{btcchain.RuleError{ErrorCode: btcchain.ErrDuplicateBlock},
+			btcchain.RejectDuplicate, "duplicate", true},
+		{btcchain.RuleError{ErrorCode: btcchain.ErrBlockVersionTooOld},
+			btcchain.RejectObsolete, "bad-version", true},
+		{btcchain.RuleError{ErrorCode: btcchain.ErrBadCheckpoint},
+			btcchain.RejectCheckpoint, "checkpoint mismatch", true},
+		{btcchain.RuleError{ErrorCode: btcchain.ErrBadTxInput},
+			btcchain.RejectInvalid, "bad-txns-input-invalid", true},
+		{btcchain.DatabaseError{}, 0, "", false},
+		{nil, 0, "", false},
+	}
+
+	for i, test := range tests {
+		code, reason, ok := btcchain.ErrToRejectErr(test.err)
+		if code != test.code || reason != test.reason || ok != test.ok {
+			t.Errorf("ErrToRejectErr #%d got: (%v, %q, %v) want: "+
+				"(%v, %q, %v)", i, code, reason, ok, test.code,
+				test.reason, test.ok)
+		}
+	}
+}
+
+// TestContextError ensures adding context to errors preserves their type and
+// does not add the same context twice.
+func TestContextError(t *testing.T) {
+	ruleErr := btcchain.RuleError{
+		ErrorCode:   btcchain.ErrHighHash,
+		Description: "high hash",
+	}
+	err := btcchain.TstContextError(ruleErr, "block 1")
+	err = btcchain.TstContextError(err, "block 1")
+	gotRuleErr, ok := err.(btcchain.RuleError)
+	if !ok {
+		t.Fatalf("TstContextError: unexpected error type %T", err)
+	}
+	if gotRuleErr.ErrorCode != btcchain.ErrHighHash {
+		t.Errorf("TstContextError: unexpected error code %v",
+			gotRuleErr.ErrorCode)
+	}
+	want := "block 1: high hash"
+	if err.Error() != want {
+		t.Errorf("TstContextError: got %q want %q", err.Error(), want)
+	}
+
+	if got := btcchain.TstContextError(nil, "block 1"); got != nil {
+		t.Errorf("TstContextError: unexpected error for nil - got %v",
+			got)
+	}
+	err = btcchain.TstContextError(btcchain.ErrInterrupted, "block 1")
+	if err != btcchain.ErrInterrupted {
+		t.Errorf("TstContextError: ErrInterrupted was modified - got %v",
+			err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// hasExtensionData returns whether or not the serialized form of the passed
+// block contains data beyond what is understood by btcwire at the protocol
+// version of the block.  Decoding and validation are left entirely to btcwire
+// and the normal rules, so any such data is simply carried along with the
+// block.  This allows blocks relayed using wire format extensions from newer
+// protocol versions to be accepted while still noting that they were present.
+func hasExtensionData(block *btcutil.Block) bool {
+	serializedBlock, err := block.Bytes()
+	if err != nil {
+		return false
+	}
+
+	var size byteCounter
+	err = block.MsgBlock().BtcEncode(&size, block.ProtocolVersion())
+	if err != nil {
+		return false
+	}
+
+	return len(serializedBlock) > int(size)
+}
+
+// HasExtensionData returns whether or not the serialized form of the block
+// identified by the passed hash contained data which is not understood at the
+// protocol version it was decoded with.  Such blocks are validated using only
+// the data which is understood, so this provides a way for the caller to detect
+// that the network has started using a wire format this package does not know
+// about.  An error is returned when the block is not in the block index.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) HasExtensionData(hash *btcwire.ShaHash) (bool, error) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	node, exists := b.index[*hash]
+	if !exists {
+		return false, fmt.Errorf("block %v is not in the block index",
+			hash)
+	}
+	return node.hasExtensionData, nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// ExternalChainError identifies the first block which failed validation in a
+// call to ValidateExternalChain along with the reason.
+type ExternalChainError struct {
+	// Index is the zero-based position of the block in the stream.
+	Index int64
+
+	// Hash is the hash of the block.  It is nil when the block could not
+	// be read.
+	Hash *btcwire.ShaHash
+
+	// Err is the reason the block failed validation.
+	Err error
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *ExternalChainError) Error() string {
+	if e.Hash == nil {
+		return fmt.Sprintf("block #%d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("block #%d (%v): %v", e.Index, e.Hash, e.Err)
+}
+
+// readExternalBlock reads the next block from the passed reader in the format
+// used by bootstrap files and the block files of bitcoind.  Each block is
+// prefixed by the network magic and its serialized length, both 32-bit little
+// endian values.  It returns io.EOF when there are no more blocks.
+func readExternalBlock(r io.Reader, btcnet btcwire.BitcoinNet) (*btcutil.Block, error) {
+	var magic uint32
+	err := binary.Read(r, binary.LittleEndian, &magic)
+	if err != nil {
+		return nil, err
+	}
+	if magic != uint32(btcnet) {
+		return nil, fmt.Errorf("network magic %08x does not match "+
+			"expected %08x", magic, uint32(btcnet))
+	}
+
+	var blockLen uint32
+	err = binary.Read(r, binary.LittleEndian, &blockLen)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if blockLen > btcwire.MaxBlockPayload {
+		return nil, fmt.Errorf("block length of %d exceeds max "+
+			"allowed length of %d", blockLen, btcwire.MaxBlockPayload)
+	}
+
+	serializedBlock := make([]byte, blockLen)
+	_, err = io.ReadFull(r, serializedBlock)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return btcutil.NewBlockFromBytes(serializedBlock, btcwire.ProtocolVersion)
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF since it indicates a
+// truncated block once some of the block has been read.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ValidateExternalChain reads the blocks from the passed reader and validates
+// them without modifying any existing chain.  This is useful for vetting
+// bootstrap files or archived chain data before importing them.  The blocks
+// must be in the format used by bootstrap files and the block files of
+// bitcoind, which is the network magic of the passed parameters and serialized
+// length of each block, both 32-bit little endian values, followed by the
+// serialized block.
+//
+// Each block must connect to the block before it in the stream and have a
+// valid proof of work.  When a scratch database is provided, the blocks are
+// also fully validated by connecting them to a throwaway chain backed by it
+// just as ProcessBlock would.  The scratch database must either be empty apart
+// from the genesis block or contain the chain the stream continues.  It is
+// modified, so it should be discarded afterwards.
+//
+// It returns the number of blocks which passed validation.  The first failure,
+// including a block which could not be read, is reported as an
+// *ExternalChainError.
+func ValidateExternalChain(r io.Reader, params *Params, scratchDb btcdb.Db) (int64, error) {
+	var chain *BlockChain
+	if scratchDb != nil {
+		chain = New(scratchDb, params, nil)
+	}
+
+	var numBlocks int64
+	var prevHash *btcwire.ShaHash
+	for {
+		block, err := readExternalBlock(r, params.Net)
+		if err == io.EOF {
+			return numBlocks, nil
+		}
+		if err != nil {
+			return numBlocks, &ExternalChainError{Index: numBlocks, Err: err}
+		}
+		blockHash, err := block.Sha()
+		if err != nil {
+			return numBlocks, &ExternalChainError{Index: numBlocks, Err: err}
+		}
+		chainErr := &ExternalChainError{Index: numBlocks, Hash: blockHash}
+
+		// Ensure the block connects to the previous block in the
+		// stream and has a valid proof of work.
+		header := &block.MsgBlock().Header
+		if prevHash != nil && !header.PrevBlock.IsEqual(prevHash) {
+			chainErr.Err = fmt.Errorf("previous block %v does not "+
+				"match the preceding block %v", &header.PrevBlock,
+				prevHash)
+			return numBlocks, chainErr
+		}
+		err = CheckProofOfWork(blockHash, header.Bits, params.PowLimit)
+		if err != nil {
+			chainErr.Err = err
+			return numBlocks, chainErr
+		}
+		prevHash = blockHash
+
+		// Fully validate the block by connecting it to the throwaway
+		// chain when requested.  Blocks which are already in the
+		// scratch database, such as the genesis block, are skipped.
+		if chain != nil && !scratchDb.ExistsSha(blockHash) {
+			isMainChain, isOrphan, err := chain.ProcessBlock(block)
+			if err == nil && isOrphan {
+				err = fmt.Errorf("previous block %v is not known",
+					&header.PrevBlock)
+			} else if err == nil && !isMainChain {
+				err = fmt.Errorf("block does not extend the main " +
+					"chain of the scratch database")
+			}
+			if err != nil {
+				chainErr.Err = err
+				return numBlocks, chainErr
+			}
+		}
+
+		numBlocks++
+	}
+}
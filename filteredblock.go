@@ -0,0 +1,177 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// TxFilter describes a filter which selects the transactions of a block that
+// are relevant to a client, such as a BIP0037 bloom filter loaded by an SPV
+// peer.  Implementations are free to update their state as transactions are
+// matched, as BIP0037 bloom filters do when adding the outpoints of matched
+// transactions, since transactions are always presented in block order.
+type TxFilter interface {
+	// MatchTx returns whether or not the passed transaction, which has the
+	// passed hash, matches the filter.
+	MatchTx(tx *btcwire.MsgTx, txHash *btcwire.ShaHash) bool
+}
+
+// PartialMerkleTree houses a BIP0037 partial merkle tree which proves the
+// inclusion of a subset of the transactions in a block while only providing
+// the hashes needed to reconstruct the merkle root.
+type PartialMerkleTree struct {
+	// NumTransactions is the total number of transactions in the block.
+	NumTransactions uint32
+
+	// Hashes are the hashes encountered during a depth-first traversal
+	// of the tree in the order they were encountered.
+	Hashes []*btcwire.ShaHash
+
+	// Flags are the bits determining how the tree is traversed with one
+	// bit per node visited during a depth-first traversal of the tree,
+	// packed least significant bit first.
+	Flags []byte
+}
+
+// partialMerkleTreeBuilder houses the state used while building a partial
+// merkle tree.
+type partialMerkleTreeBuilder struct {
+	txHashes []*btcwire.ShaHash
+	matches  []bool
+	tree     PartialMerkleTree
+	numBits  int
+}
+
+// treeWidth returns the number of nodes at the passed height of the tree where
+// height 0 is the level of the transactions.
+func (p *partialMerkleTreeBuilder) treeWidth(height uint) int {
+	return (len(p.txHashes) + (1 << height) - 1) >> height
+}
+
+// calcHash returns the hash of the node at the passed height and position.  A
+// node with no right child is calculated by hashing the left child with
+// itself.
+func (p *partialMerkleTreeBuilder) calcHash(height uint, pos int) *btcwire.ShaHash {
+	if height == 0 {
+		return p.txHashes[pos]
+	}
+
+	left := p.calcHash(height-1, pos*2)
+	right := left
+	if pos*2+1 < p.treeWidth(height-1) {
+		right = p.calcHash(height-1, pos*2+1)
+	}
+	return hashMerkleBranches(left, right)
+}
+
+// addFlag appends the passed flag bit to the flags of the tree.
+func (p *partialMerkleTreeBuilder) addFlag(flag bool) {
+	if p.numBits%8 == 0 {
+		p.tree.Flags = append(p.tree.Flags, 0)
+	}
+	if flag {
+		p.tree.Flags[p.numBits/8] |= 1 << uint(p.numBits%8)
+	}
+	p.numBits++
+}
+
+// traverseAndBuild performs a depth-first traversal of the tree from the node
+// at the passed height and position.  The hash of a node is only included when
+// it is a transaction or none of the transactions below it matched, in which
+// case there is no need to descend any further.
+func (p *partialMerkleTreeBuilder) traverseAndBuild(height uint, pos int) {
+	// Determine whether this node is the parent of at least one matched
+	// transaction.
+	isParent := false
+	end := (pos + 1) << height
+	if end > len(p.txHashes) {
+		end = len(p.txHashes)
+	}
+	for i := pos << height; i < end; i++ {
+		if p.matches[i] {
+			isParent = true
+			break
+		}
+	}
+	p.addFlag(isParent)
+
+	if height == 0 || !isParent {
+		p.tree.Hashes = append(p.tree.Hashes, p.calcHash(height, pos))
+		return
+	}
+
+	p.traverseAndBuild(height-1, pos*2)
+	if pos*2+1 < p.treeWidth(height-1) {
+		p.traverseAndBuild(height-1, pos*2+1)
+	}
+}
+
+// NewPartialMerkleTree returns a BIP0037 partial merkle tree which proves the
+// inclusion of the passed transaction hashes that have their corresponding
+// entries in the passed matches set.
+func NewPartialMerkleTree(txHashes []*btcwire.ShaHash, matches []bool) *PartialMerkleTree {
+	p := partialMerkleTreeBuilder{
+		txHashes: txHashes,
+		matches:  matches,
+		tree: PartialMerkleTree{
+			NumTransactions: uint32(len(txHashes)),
+		},
+	}
+	if len(txHashes) == 0 {
+		return &p.tree
+	}
+
+	// Calculate the height of the tree and traverse it from the root.
+	var height uint
+	for p.treeWidth(height) > 1 {
+		height++
+	}
+	p.traverseAndBuild(height, 0)
+
+	return &p.tree
+}
+
+// FilteredBlock houses the portion of a block which is relevant to a client as
+// determined by a TxFilter.  It provides the data needed to serve a BIP0037
+// merkleblock message followed by the matched transactions.
+type FilteredBlock struct {
+	Header       btcwire.BlockHeader
+	Tree         *PartialMerkleTree
+	Transactions []*btcwire.MsgTx
+}
+
+// FilterBlock applies the passed filter to the transactions of the main chain
+// block identified by the passed hash.  It returns the matched transactions
+// along with a partial merkle tree which proves their inclusion in the block.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) FilterBlock(hash *btcwire.ShaHash, filter TxFilter) (*FilteredBlock, error) {
+	// Only main chain blocks are stored in the database.
+	b.chainLock.RLock()
+	block, err := b.db.FetchBlockBySha(hash)
+	b.chainLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	txHashes, err := block.TxShas()
+	if err != nil {
+		return nil, err
+	}
+
+	msgBlock := block.MsgBlock()
+	matches := make([]bool, len(txHashes))
+	filtered := FilteredBlock{Header: msgBlock.Header}
+	for i, tx := range msgBlock.Transactions {
+		if filter.MatchTx(tx, txHashes[i]) {
+			matches[i] = true
+			filtered.Transactions = append(filtered.Transactions, tx)
+		}
+	}
+	filtered.Tree = NewPartialMerkleTree(txHashes, matches)
+
+	return &filtered, nil
+}
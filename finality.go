@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// FinalizedBlock is the data sent with an NTBlockFinalized notification.  It
+// identifies a main chain block which has reached the confirmation depth set
+// via SetFinalityDepth.
+type FinalizedBlock struct {
+	Hash   *btcwire.ShaHash
+	Height int64
+
+	// Depth is the number of main chain blocks built on top of the block,
+	// including the block itself.
+	Depth int64
+}
+
+// SetFinalityDepth enables NTBlockFinalized notifications for main chain
+// blocks once they reach the passed number of confirmations.  Applications
+// which anchor data to the block chain can use them to only act on blocks that
+// are practically final.  A depth of zero, which is the default, disables the
+// notifications.
+//
+// Each block is reported exactly once, even across restarts, provided the
+// caller persists the hash of the last block it was notified about and passes
+// it back here after a restart.  The blocks which became final after it in the
+// meantime are reported right away when the end of the main chain is already
+// known and otherwise once the next block is connected.  Passing a nil hash
+// means no block has been reported yet, in which case the blocks which are
+// already final are not reported.
+//
+// Only blocks at heights after the last reported block are reported, so when a
+// reorganization replaces blocks which were already reported, which requires
+// it to be at least as deep as the finality depth, the replacing blocks are not
+// reported and a warning is logged instead.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetFinalityDepth(depth int64, lastFinalized *btcwire.ShaHash) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.finalityDepth = depth
+	b.finalizedHeight = -1
+	b.finalizedHash = btcwire.ShaHash{}
+	b.lastFinalized = lastFinalized
+	b.finalityResolved = false
+	if depth > 0 && b.bestChain != nil {
+		b.resolveFinalizedBlock(b.bestChain.height)
+		b.reportFinalizedBlocks(b.bestChain)
+	}
+}
+
+// resolveFinalizedBlock sets the last reported block to the one passed to
+// SetFinalityDepth.  When there is none or it is no longer in the main chain,
+// the blocks which are final as of the end of the main chain at the passed
+// height are considered reported instead.
+func (b *BlockChain) resolveFinalizedBlock(bestHeight int64) {
+	b.finalityResolved = true
+	if b.lastFinalized != nil {
+		height, err := b.mainChainHeight(b.lastFinalized)
+		if err == nil {
+			b.finalizedHeight = height
+			b.finalizedHash = *b.lastFinalized
+			return
+		}
+		log.Warnf("Last finalized block %v is not in the main chain: "+
+			"%v", b.lastFinalized, err)
+	}
+
+	b.finalizedHeight = bestHeight - b.finalityDepth + 1
+	if b.finalizedHeight < 0 {
+		b.finalizedHeight = -1
+	}
+}
+
+// mainChainHeight returns the height of the main chain block with the passed
+// hash.  An error is returned when the block is not in the main chain.
+func (b *BlockChain) mainChainHeight(hash *btcwire.ShaHash) (int64, error) {
+	if node, ok := b.index[*hash]; ok {
+		if !node.inMainChain {
+			return 0, fmt.Errorf("block %v is on a side chain", hash)
+		}
+		return node.height, nil
+	}
+
+	// Only main chain blocks are stored in the database.
+	block, err := b.db.FetchBlockBySha(hash)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return block.Height(), nil
+}
+
+// reportFinalizedBlocks sends an NTBlockFinalized notification for the block
+// which reached the finality depth by connecting the passed node, if any.  The
+// passed node must be the end of the main chain.
+func (b *BlockChain) reportFinalizedBlocks(node *blockNode) {
+	if b.finalityDepth <= 0 {
+		return
+	}
+
+	// Resolve the last reported block once the main chain is known.  The
+	// blocks which were final before the passed node was connected are
+	// the ones which were already final.
+	if !b.finalityResolved {
+		b.resolveFinalizedBlock(node.height - 1)
+	}
+
+	finalHeight := node.height - b.finalityDepth + 1
+	if finalHeight < 0 {
+		return
+	}
+	if finalHeight <= b.finalizedHeight {
+		// The block at the height was replaced by a reorganization
+		// after it was reported.
+		if finalHeight == b.finalizedHeight {
+			finalNode, err := b.ancestorNode(node, finalHeight)
+			if err == nil && !finalNode.hash.IsEqual(&b.finalizedHash) {
+				log.Warnf("Reorganization replaced finalized "+
+					"block %v at height %d", &b.finalizedHash,
+					finalHeight)
+			}
+		}
+		return
+	}
+
+	// Report every block which became final since the last one.  There is
+	// normally only one, but there may be more after the depth changed.
+	var finalNodes []*blockNode
+	finalNode, err := b.ancestorNode(node, finalHeight)
+	for err == nil && finalNode.height > b.finalizedHeight {
+		finalNodes = append(finalNodes, finalNode)
+		if finalNode.height == 0 {
+			break
+		}
+		finalNode, err = b.getPrevNodeFromNode(finalNode)
+	}
+	if err != nil {
+		log.Warnf("Unable to determine finalized blocks: %v", err)
+		return
+	}
+
+	for i := len(finalNodes) - 1; i >= 0; i-- {
+		finalNode := finalNodes[i]
+		b.finalizedHeight = finalNode.height
+		b.finalizedHash = *finalNode.hash
+		b.sendNotification(NTBlockFinalized, &FinalizedBlock{
+			Hash:   finalNode.hash,
+			Height: finalNode.height,
+			Depth:  node.height - finalNode.height + 1,
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// TestFinalityAfterRestart ensures the blocks which became final after the last
+// reported one are reported exactly once when a chain is created again for the
+// same database.
+func TestFinalityAfterRestart(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, db, teardown := newTestChain(t, "finalitytest", &params, nil)
+	defer teardown()
+
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 5)
+	processBlocks(t, chain, blocks[:4])
+
+	// With a depth of 2, the block at height 3 is final as of the end of
+	// the main chain and the one at height 4 becomes final once the block
+	// at height 5 is connected.
+	tests := []struct {
+		name          string
+		lastFinalized *btcwire.ShaHash
+		wantHeights   []int64
+	}{
+		{"nothing reported yet", nil, []int64{4}},
+		{"reported before the restart", blockHash(blocks[0]),
+			[]int64{2, 3, 4}},
+		{"reported up to date", blockHash(blocks[2]), []int64{4}},
+		{"unknown last reported block", blockHash(g.nextBlock(blocks[0])),
+			[]int64{4}},
+	}
+
+	for i, test := range tests {
+		c := make(chan *btcchain.Notification, 100)
+		restarted := newChain(t, db, &params, c)
+		restarted.SetFinalityDepth(2, test.lastFinalized)
+		processBlocks(t, restarted, []*btcutil.Block{blocks[4]})
+
+		var gotHeights []int64
+		for len(c) > 0 {
+			n := <-c
+			if n.Type != btcchain.NTBlockFinalized {
+				continue
+			}
+			finalized := n.Data.(*btcchain.FinalizedBlock)
+			gotHeights = append(gotHeights, finalized.Height)
+		}
+		if !reflect.DeepEqual(gotHeights, test.wantHeights) {
+			t.Errorf("SetFinalityDepth #%d (%s): got finalized "+
+				"heights %v, want %v", i, test.name, gotHeights,
+				test.wantHeights)
+		}
+
+		// Remove the block again so the next case starts from the same
+		// end of the main chain.
+		if err := db.DropAfterBlockBySha(blockHash(blocks[3])); err != nil {
+			t.Fatalf("DropAfterBlockBySha: unexpected error %v", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// InitGenesis prepares the backing database for use with the network
+// parameters the chain was created with.  When the database is empty, the
+// genesis block from the parameters is inserted so blocks of an alternative
+// network, which start from a genesis block of their own, can be built on top
+// of it.  Otherwise the genesis block in the database must be the one in the
+// parameters.  This prevents a database created for one network from being
+// extended with the blocks of another, which would otherwise only be noticed
+// once a block fails to connect.
+//
+// This is done automatically before the first block is processed, so calling
+// it is optional.  It allows a mismatched database to be detected at startup.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) InitGenesis() error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	return b.initGenesis()
+}
+
+// initGenesis is the implementation of InitGenesis.  The database is only
+// checked until it succeeds once.  It must be called with the process lock
+// held.
+func (b *BlockChain) initGenesis() error {
+	if b.genesisChecked {
+		return nil
+	}
+
+	genesisHash := b.chainParams.GenesisHash
+	_, height, err := b.db.NewestSha()
+	if err != nil {
+		return dbError(err)
+	}
+
+	// Insert the genesis block into an empty database.
+	if height < 0 {
+		block := btcutil.NewBlock(b.chainParams.GenesisBlock,
+			btcwire.ProtocolVersion)
+		block.SetHeight(0)
+		_, err := b.db.InsertBlock(block)
+		if err != nil {
+			return dbError(err)
+		}
+		log.Infof("Inserted genesis block %v for network %s",
+			genesisHash, b.chainParams.Name)
+		b.genesisChecked = true
+		return nil
+	}
+
+	dbGenesisHash, err := b.db.FetchBlockShaByHeight(0)
+	if err != nil {
+		return dbError(err)
+	}
+	if !dbGenesisHash.IsEqual(genesisHash) {
+		return fmt.Errorf("the genesis block %v in the database does "+
+			"not match the genesis block %v of network %s",
+			dbGenesisHash, genesisHash, b.chainParams.Name)
+	}
+	b.genesisChecked = true
+	return nil
+}
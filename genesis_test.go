@@ -0,0 +1,65 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGenesisCheck ensures the genesis block of the network is inserted into
+// an empty database when the first block is processed and that a database for
+// another network is rejected then without InitGenesis being called.
+func TestGenesisCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		dbParams  *btcchain.Params
+		wantError bool
+	}{
+		{"empty database", nil, false},
+		{"same network", &btcchain.RegressionNetParams, false},
+		{"mismatched genesis", &btcchain.MainNetParams, true},
+	}
+
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	block := g.nextBlock(g.genesis())
+	for i, test := range tests {
+		dbPath := filepath.Join(os.TempDir(), "genesistest")
+		_ = os.Remove(dbPath)
+		db, err := btcdb.CreateDB("sqlite", dbPath)
+		if err != nil {
+			t.Fatalf("Error creating db: %v", err)
+		}
+
+		// Prepare the database for the network it is for.
+		if test.dbParams != nil {
+			err := newChain(t, db, test.dbParams, nil).InitGenesis()
+			if err != nil {
+				t.Errorf("InitGenesis #%d (%s): unexpected error %v",
+					i, test.name, err)
+			}
+		}
+
+		chain := newChain(t, db, &params, nil)
+		isMainChain, _, err := chain.ProcessBlock(block)
+		if test.wantError {
+			if _, ok := err.(btcchain.RuleError); ok || err == nil {
+				t.Errorf("ProcessBlock #%d (%s): got %v, want a "+
+					"genesis mismatch error", i, test.name, err)
+			}
+		} else if err != nil || !isMainChain {
+			t.Errorf("ProcessBlock #%d (%s): got main chain %v, "+
+				"error %v, want main chain", i, test.name,
+				isMainChain, err)
+		}
+
+		db.Close()
+		os.Remove(dbPath)
+	}
+}
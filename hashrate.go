@@ -0,0 +1,83 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// EstimateNetworkHashesPerSecond returns the estimated number of hashes per
+// second the network performed while generating the blockCount main chain
+// blocks after the one at startHeight.  It is the work of those blocks divided
+// by the time elapsed between the earliest and latest timestamps of the window,
+// which includes the block at startHeight since its timestamp marks when work
+// on the next block began.  This is the value reported by the getnetworkhashps
+// RPC.
+//
+// Block timestamps are only loosely constrained, so longer windows provide more
+// accurate estimates.  Zero is returned when the timestamps do not span any
+// time at all.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) EstimateNetworkHashesPerSecond(startHeight, blockCount int64) (int64, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return 0, fmt.Errorf("no main chain blocks are available")
+	}
+	if blockCount <= 0 {
+		return 0, fmt.Errorf("the number of blocks %d must be positive",
+			blockCount)
+	}
+	endHeight := startHeight + blockCount
+	if startHeight < 0 || endHeight > b.bestChain.height {
+		return 0, fmt.Errorf("blocks %d-%d are outside of the main chain "+
+			"range 0-%d", startHeight, endHeight, b.bestChain.height)
+	}
+
+	// Find the last block of the window.
+	endNode := b.bestChain
+	for endNode.height > endHeight {
+		var err error
+		endNode, err = b.getPrevNodeFromNode(endNode)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Find the first block of the window while keeping track of the
+	// earliest and latest timestamps since they are not guaranteed to be
+	// in order.
+	startNode := endNode
+	minTimestamp := endNode.timestamp
+	maxTimestamp := endNode.timestamp
+	for startNode.height > startHeight {
+		var err error
+		startNode, err = b.getPrevNodeFromNode(startNode)
+		if err != nil {
+			return 0, err
+		}
+		if startNode.timestamp.Before(minTimestamp) {
+			minTimestamp = startNode.timestamp
+		} else if startNode.timestamp.After(maxTimestamp) {
+			maxTimestamp = startNode.timestamp
+		}
+	}
+
+	elapsed := int64(maxTimestamp.Sub(minTimestamp).Seconds())
+	if elapsed <= 0 {
+		return 0, nil
+	}
+
+	// The work sums of both nodes include the work of the blocks before
+	// the window, so the difference is the work of the window alone.
+	work := new(big.Int).Sub(endNode.workSum, startNode.workSum)
+
+	hashesPerSec := work.Div(work, big.NewInt(elapsed))
+	return hashesPerSec.Int64(), nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+// TestEstimateNetworkHashesPerSecond ensures the network hash rate is estimated
+// from the work of the blocks in the requested window and the time spanned by
+// the earliest and latest timestamps in it, even when they are out of order.
+func TestEstimateNetworkHashesPerSecond(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "hashratetest", &params, nil)
+	defer teardown()
+
+	// The timestamps of the blocks are the passed number of seconds after
+	// the genesis block.  The third block is before the second and the
+	// last two blocks have the same timestamp.
+	genesisTime := params.GenesisBlock.Header.Timestamp
+	offsets := []int64{1, 3, 2, 4, 6, 6}
+	g := newBlockGenerator(&params)
+	blocks := []*btcutil.Block{g.genesis()}
+	for i, offset := range offsets {
+		timestamp := genesisTime.Add(time.Duration(offset) * time.Second)
+		blocks = append(blocks, g.nextBlock(blocks[i],
+			func(msgBlock *btcwire.MsgBlock) {
+				msgBlock.Header.Timestamp = timestamp
+			}))
+	}
+	processBlocks(t, chain, blocks[1:])
+	blockWork := btcchain.CalcWork(params.GenesisBlock.Header.Bits).Int64()
+
+	tests := []struct {
+		name        string
+		startHeight int64
+		blockCount  int64
+		wantElapsed int64
+	}{
+		{"whole chain", 0, 5, 6},
+		{"out of order timestamps", 1, 3, 3},
+		{"last block before first", 2, 1, 1},
+		{"no time elapsed", 5, 1, 0},
+	}
+
+	for i, test := range tests {
+		var want int64
+		if test.wantElapsed > 0 {
+			want = test.blockCount * blockWork / test.wantElapsed
+		}
+		got, err := chain.EstimateNetworkHashesPerSecond(
+			test.startHeight, test.blockCount)
+		if err != nil {
+			t.Errorf("EstimateNetworkHashesPerSecond #%d (%s): "+
+				"unexpected error %v", i, test.name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("EstimateNetworkHashesPerSecond #%d (%s): got "+
+				"%d, want %d", i, test.name, got, want)
+		}
+	}
+
+	// Windows which are empty or not entirely in the main chain are
+	// rejected.
+	errTests := []struct {
+		name        string
+		startHeight int64
+		blockCount  int64
+	}{
+		{"no blocks", 1, 0},
+		{"before genesis", -1, 2},
+		{"after the end of the main chain", 5, 2},
+	}
+	for i, test := range errTests {
+		_, err := chain.EstimateNetworkHashesPerSecond(test.startHeight,
+			test.blockCount)
+		if err == nil {
+			t.Errorf("EstimateNetworkHashesPerSecond #%d (%s): "+
+				"expected error", i, test.name)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"math"
+)
+
+// headerPruneInterval is the number of blocks the height below which headers
+// can no longer become part of the main chain must advance by before the
+// header index is pruned again.  See pruneHeaderIndex.
+const headerPruneInterval = 144
+
+// newHeaderNode returns a new block node for the given block header and hash.
+// Like newBlockNode, it is completely disconnected from the chain and the
+// workSum value is just the work for the passed header.
+func newHeaderNode(header *btcwire.BlockHeader, hash *btcwire.ShaHash) *blockNode {
+	node := blockNode{
+		hash:      hash,
+		workSum:   CalcWork(header.Bits),
+		version:   header.Version,
+		bits:      header.Bits,
+		timestamp: header.Timestamp,
+	}
+	return &node
+}
+
+// headerExists determines whether a block header with the given hash is already
+// known either because the full block is part of the block chain or the header
+// has previously been processed.
+func (b *BlockChain) headerExists(hash *btcwire.ShaHash) bool {
+	if _, ok := b.headerIndex[*hash]; ok {
+		return true
+	}
+	return b.blockExists(hash)
+}
+
+// getPrevNodeFromHeader returns a block node for the block previous to the
+// passed block header.  The previous block may either be in the block chain or
+// only have had its header processed.  The returned node will be nil if the
+// previous block is not known.
+func (b *BlockChain) getPrevNodeFromHeader(header *btcwire.BlockHeader) (*blockNode, error) {
+	prevHash := &header.PrevBlock
+	if node, ok := b.headerIndex[*prevHash]; ok {
+		return node, nil
+	}
+	if node, ok := b.index[*prevHash]; ok {
+		return node, nil
+	}
+	if !b.db.ExistsSha(prevHash) {
+		return nil, nil
+	}
+
+	// Dynamically load the previous block from the block database, create
+	// a new block node for it, and update the memory chain accordingly.
+	return b.loadBlockNode(prevHash)
+}
+
+// ProcessBlockHeader validates the passed block header and, when it is valid,
+// adds it to an index of block headers for which the full block is not yet
+// available.  This allows the caller to download and validate the headers for
+// a chain before downloading the much larger blocks, and to cheaply reject
+// bogus chains before committing any resources to them.
+//
+// The checks performed include the proof of work, the difficulty, the
+// timestamp, and the checkpoints.  Headers which have already been processed
+// or which belong to blocks that are already in the block chain are ignored.
+// Unlike ProcessBlock, there is no orphan handling, so the header for the
+// previous block must already be known.  Headers which fork from the main chain
+// before the latest known checkpoint or the last finalized block are pruned as
+// the main chain grows.
+//
+// The flags modify the behavior of this function as follows:
+//  - BFNoPoWCheck: The check to ensure the block hash is less than the target
+//    difficulty is not performed.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ProcessBlockHeader(header *btcwire.BlockHeader, flags BehaviorFlags) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	return b.processBlockHeader(header, flags)
+}
+
+// processBlockHeader is the implementation of ProcessBlockHeader.  It must be
+// called with the process lock held.
+func (b *BlockChain) processBlockHeader(header *btcwire.BlockHeader, flags BehaviorFlags) error {
+	hash, err := header.BlockSha(btcwire.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+	log.Tracef("Processing block header %v", &hash)
+
+	// Nothing more to do if the header is already known.
+	if b.headerExists(&hash) {
+		return nil
+	}
+
+	// Perform preliminary sanity checks on the header.
+	err = checkBlockHeaderSanity(header, &hash, b.chainParams.PowLimit,
+		b.timeSource, flags)
+	if err != nil {
+		return err
+	}
+
+	// Perform some additional checks based on the latest known
+	// checkpoint.
+	err = b.checkCheckpointConstraints(header, &hash)
+	if err != nil {
+		return err
+	}
+
+	// The header for the previous block must already be known since there
+	// is no orphan handling for headers.
+	prevNode, err := b.getPrevNodeFromHeader(header)
+	if err != nil {
+		return err
+	}
+	if prevNode == nil {
+		str := fmt.Sprintf("previous block %v for block header %v is "+
+			"unknown", &header.PrevBlock, &hash)
+		return ruleError(ErrPrevBlockUnknown, str)
+	}
+
+	// Perform the checks which depend on the position of the header within
+	// the block chain.
+	err = b.checkBlockHeaderContext(header, &hash, prevNode)
+	if err != nil {
+		return err
+	}
+
+	// Don't hold more headers than the resource limits allow.
+	maxHeaders := b.resourceLimits.MaxHeaders
+	if maxHeaders > 0 && len(b.headerIndex) >= maxHeaders {
+		str := fmt.Sprintf("holding block header %v would exceed the "+
+			"max allowed number of headers of %d", &hash, maxHeaders)
+		return ResourceError(str)
+	}
+
+	// Create a new node for the header and add it to the header index.
+	// Note that the node is intentionally not added as a child of the
+	// previous node since the children of block chain nodes are used to
+	// select the best chain and only ever refer to nodes which have a full
+	// block.
+	node := newHeaderNode(header, &hash)
+	node.parent = prevNode
+	node.height = prevNode.height + 1
+	node.workSum.Add(prevNode.workSum, node.workSum)
+	b.chainLock.Lock()
+	b.headerIndex[hash] = node
+	if b.bestHeader == nil || node.workSum.Cmp(b.bestHeader.workSum) > 0 {
+		b.bestHeader = node
+	}
+	b.chainLock.Unlock()
+
+	log.Debugf("Accepted block header %v (height %d)", &hash, node.height)
+	return nil
+}
+
+// headerForkHeight returns the height of the main chain block the chain of the
+// passed header node forks from.  The fork heights of the nodes which are
+// walked are added to the passed map so they are only determined once when
+// called for every node in the header index.  The maximum height is returned
+// when the fork can't be determined.  It must be called with the chain lock
+// held for reads.
+func (b *BlockChain) headerForkHeight(node *blockNode, forkHeights map[*blockNode]int64) int64 {
+	forkHeight := int64(math.MaxInt64)
+	var walked []*blockNode
+	for n := node; n != nil; n = n.parent {
+		if height, ok := forkHeights[n]; ok {
+			forkHeight = height
+			break
+		}
+
+		// The header nodes for blocks which were accepted since are
+		// replaced by the block nodes in the block index.
+		if indexNode, ok := b.index[*n.hash]; ok && indexNode.inMainChain {
+			forkHeight = n.height
+			break
+		}
+		walked = append(walked, n)
+	}
+	for _, n := range walked {
+		forkHeights[n] = forkHeight
+	}
+	return forkHeight
+}
+
+// pruneHeaderIndex removes the header nodes which fork from the main chain
+// before the latest known checkpoint or the last finalized block from the
+// header index, since they can no longer become part of the main chain.
+// Without this, the header index would grow without bound with the headers of
+// stale chains.  Since it requires a pass over the entire header index, it is
+// only done once the height advanced by headerPruneInterval blocks since the
+// last time.  It must be called with the chain lock held for writes.
+func (b *BlockChain) pruneHeaderIndex() error {
+	pruneHeight := int64(-1)
+	if b.finalityDepth > 0 {
+		pruneHeight = b.finalizedHeight
+	}
+	checkpoint, err := b.latestKnownCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil && checkpoint.Height > pruneHeight {
+		pruneHeight = checkpoint.Height
+	}
+	if pruneHeight < b.headerPruneHeight+headerPruneInterval {
+		return nil
+	}
+	b.headerPruneHeight = pruneHeight
+
+	forkHeights := make(map[*blockNode]int64)
+	bestHeaderPruned := false
+	for hash, node := range b.headerIndex {
+		if b.headerForkHeight(node, forkHeights) < pruneHeight {
+			delete(b.headerIndex, hash)
+			if node == b.bestHeader {
+				bestHeaderPruned = true
+			}
+		}
+	}
+	log.Debugf("Pruned block headers which fork from the main chain "+
+		"before height %d, %d remain", pruneHeight, len(b.headerIndex))
+
+	// Select the remaining header node with the most cumulative work when
+	// the best one was pruned.
+	if bestHeaderPruned {
+		b.bestHeader = nil
+		for _, node := range b.headerIndex {
+			if b.bestHeader == nil ||
+				node.workSum.Cmp(b.bestHeader.workSum) > 0 {
+
+				b.bestHeader = node
+			}
+		}
+	}
+	return nil
+}
+
+// BestHeader returns the hash and height of the block header at the end of the
+// chain with the most cumulative work known to this instance.  This includes
+// headers processed via ProcessBlockHeader for which the full block is not yet
+// available, so the caller can compare it against BestBlock to determine how
+// far block download is lagging behind.  A nil hash is returned when no blocks
+// or headers have been processed yet.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) BestHeader() (*btcwire.ShaHash, int64) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	best := b.bestChain
+	if b.bestHeader != nil && (best == nil ||
+		b.bestHeader.workSum.Cmp(best.workSum) > 0) {
+
+		best = b.bestHeader
+	}
+	if best == nil {
+		return nil, 0
+	}
+	return best.hash, best.height
+}
+
+// BestBlock returns the hash and height of the block at the end of the main
+// chain.  Unlike BestHeader, this only considers blocks which have been fully
+// validated, so the difference between the two heights is the number of blocks
+// which still need to be downloaded and validated.  A nil hash is returned when
+// no blocks have been processed yet.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) BestBlock() (*btcwire.ShaHash, int64) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	if b.bestChain == nil {
+		return nil, 0
+	}
+	return b.bestChain.hash, b.bestChain.height
+}
+
+// ProcessBlockHeaders processes the passed block headers, which are expected to
+// be in forwards order such as those received in a headers message, via
+// ProcessBlockHeader.  Processing stops at the first header which fails to
+// validate.  It returns the number of headers which were processed
+// successfully along with the error, if any, for the header which failed.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ProcessBlockHeaders(headers []*btcwire.BlockHeader, flags BehaviorFlags) (int, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	for i, header := range headers {
+		err := b.processBlockHeader(header, flags)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(headers), nil
+}
+
+// missingBlockNodes returns the header nodes for all of the blocks which are
+// needed to extend the main chain towards the header chain with the most
+// cumulative work in the order the blocks must be connected.  It must be called
+// with the chain lock held for reads.
+func (b *BlockChain) missingBlockNodes() []*blockNode {
+	if b.bestHeader == nil {
+		return nil
+	}
+	if b.bestChain != nil && b.bestHeader.workSum.Cmp(b.bestChain.workSum) <= 0 {
+		return nil
+	}
+
+	// Walk backwards from the best header until reaching a node for which
+	// the full block is available.  Header nodes are removed from the
+	// header index once their block is accepted.
+	var reversed []*blockNode
+	for node := b.bestHeader; node != nil; node = node.parent {
+		if _, ok := b.headerIndex[*node.hash]; !ok {
+			break
+		}
+		reversed = append(reversed, node)
+	}
+
+	// Put the oldest nodes first since they are the ones which must be
+	// connected first.
+	nodes := make([]*blockNode, len(reversed))
+	for i, node := range reversed {
+		nodes[len(reversed)-1-i] = node
+	}
+	return nodes
+}
+
+// MissingBlocks returns the hashes of up to maxBlocks blocks for which only the
+// header is known and which are needed to extend the main chain towards the
+// header chain with the most cumulative work.  The hashes are in the order the
+// blocks must be connected, so the caller can request them in the returned
+// order and process them as they arrive without creating orphans.
+//
+// No hashes are returned when the main chain already has at least as much work
+// as the best known header chain.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) MissingBlocks(maxBlocks int) []*btcwire.ShaHash {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	if maxBlocks <= 0 {
+		return nil
+	}
+	nodes := b.missingBlockNodes()
+	if len(nodes) > maxBlocks {
+		nodes = nodes[:maxBlocks]
+	}
+	hashes := make([]*btcwire.ShaHash, 0, len(nodes))
+	for _, node := range nodes {
+		hashes = append(hashes, node.hash)
+	}
+	return hashes
+}
+
+// BlockRequest identifies a block which needs to be downloaded.  See
+// DownloadWindow.
+type BlockRequest struct {
+	Hash   *btcwire.ShaHash
+	Height int64
+}
+
+// DownloadWindow returns the blocks a downloader should be fetching next in
+// order to extend the main chain towards the header chain with the most
+// cumulative work.  It centralizes the download ordering logic so it does not
+// need to be duplicated by every sync manager.
+//
+// The window contains up to windowSize blocks starting with the first block
+// which is needed to extend the main chain.  It is prioritized in the order the
+// blocks must be connected, so the first entry is always the block which is
+// holding up progress.  A downloader which fetches blocks from multiple
+// sources in parallel should therefore keep requesting every block in the
+// window which is not already in flight and, when the first entry has been in
+// flight for too long, request it from a different source to avoid stalling.
+//
+// The window never extends beyond the next checkpoint.  This ensures the blocks
+// up to the checkpoint, which do not need their scripts validated, are
+// downloaded before any blocks after it.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) DownloadWindow(windowSize int) []BlockRequest {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	if windowSize <= 0 {
+		return nil
+	}
+	nodes := b.missingBlockNodes()
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	// Find the next checkpoint after the block before the first missing
+	// block, if any.
+	nextCheckpoint := b.findNextCheckpoint(nodes[0].height - 1)
+
+	window := make([]BlockRequest, 0, windowSize)
+	for _, node := range nodes {
+		if len(window) >= windowSize {
+			break
+		}
+		if nextCheckpoint != nil && node.height > nextCheckpoint.Height {
+			break
+		}
+		window = append(window, BlockRequest{
+			Hash:   node.hash,
+			Height: node.height,
+		})
+	}
+	return window
+}
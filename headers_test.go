@@ -0,0 +1,317 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+// processHeaders processes the headers of the passed blocks in order and fails
+// the test when any of them is not accepted.
+func processHeaders(t *testing.T, chain *btcchain.BlockChain, blocks []*btcutil.Block) {
+	for _, block := range blocks {
+		err := chain.ProcessBlockHeader(&block.MsgBlock().Header,
+			btcchain.BFNone)
+		if err != nil {
+			t.Fatalf("ProcessBlockHeader (%v): unexpected error %v",
+				blockHash(block), err)
+		}
+	}
+}
+
+// TestProcessBlockHeader ensures ProcessBlockHeader accepts valid headers
+// which build on known blocks or headers, ignores known headers, and rejects
+// headers which fail the proof of work, difficulty, or timestamp checks or
+// whose previous block is unknown.
+func TestProcessBlockHeader(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "headerstest1", &params, nil)
+	defer teardown()
+
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 4)
+	processBlocks(t, chain, blocks[:2])
+	tip := blocks[1]
+
+	// wrongBits is the header of a block which builds on the tip with a
+	// higher difficulty than expected, which its hash does not meet.
+	wrongBits := blocks[2].MsgBlock().Header
+	wrongBits.Bits = 0x1d00ffff
+	tooOld := g.nextBlock(tip, func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Header.Timestamp = params.GenesisBlock.Header.Timestamp
+	})
+	tooNew := g.nextBlock(tip, func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Header.Timestamp = time.Now().Add(24 * time.Hour)
+	})
+
+	tests := []struct {
+		name     string
+		header   *btcwire.BlockHeader
+		flags    btcchain.BehaviorFlags
+		valid    bool
+		wantCode btcchain.ErrorCode
+	}{
+		{"unknown previous block", &blocks[3].MsgBlock().Header,
+			btcchain.BFNone, false, btcchain.ErrPrevBlockUnknown},
+		{"hash above target", &wrongBits, btcchain.BFNone, false,
+			btcchain.ErrHighHash},
+		{"unexpected difficulty", &wrongBits, btcchain.BFNoPoWCheck,
+			false, btcchain.ErrUnexpectedDifficulty},
+		{"timestamp too old", &tooOld.MsgBlock().Header, btcchain.BFNone,
+			false, btcchain.ErrTimeTooOld},
+		{"timestamp too new", &tooNew.MsgBlock().Header, btcchain.BFNone,
+			false, btcchain.ErrTimeTooNew},
+		{"extends main chain", &blocks[2].MsgBlock().Header,
+			btcchain.BFNone, true, 0},
+		{"already known", &blocks[2].MsgBlock().Header,
+			btcchain.BFNone, true, 0},
+		{"extends header", &blocks[3].MsgBlock().Header,
+			btcchain.BFNone, true, 0},
+		{"block already known", &blocks[0].MsgBlock().Header,
+			btcchain.BFNone, true, 0},
+	}
+
+	for i, test := range tests {
+		err := chain.ProcessBlockHeader(test.header, test.flags)
+		if test.valid {
+			if err != nil {
+				t.Errorf("ProcessBlockHeader #%d (%s): unexpected "+
+					"error %v", i, test.name, err)
+			}
+			continue
+		}
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != test.wantCode {
+			t.Errorf("ProcessBlockHeader #%d (%s): got %v, want %v",
+				i, test.name, err, test.wantCode)
+		}
+	}
+
+	// The headers are known, but the blocks are still missing.
+	hash, height := chain.BestHeader()
+	if !hash.IsEqual(blockHash(blocks[3])) || height != 4 {
+		t.Errorf("BestHeader: got %v (height %d), want %v (height 4)",
+			hash, height, blockHash(blocks[3]))
+	}
+	checkBestBlock(t, "ProcessBlockHeader", chain, tip)
+}
+
+// TestPruneHeaderIndex ensures the headers of chains which fork from the main
+// chain before the last finalized block are pruned from the header index while
+// the headers which extend the main chain are kept.
+func TestPruneHeaderIndex(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "headerstest2", &params, nil)
+	defer teardown()
+	chain.SetFinalityDepth(1, nil)
+
+	// Build a main chain of 145 blocks and a stale chain which forks from
+	// its first block.  Only the headers of the stale chain are processed.
+	g := newBlockGenerator(&params)
+	mainBlocks := g.nextBlocks(g.genesis(), 145)
+	staleBlocks := g.nextBlocks(mainBlocks[0], 3)
+	processBlocks(t, chain, mainBlocks[:5])
+	processHeaders(t, chain, staleBlocks[:2])
+
+	// Connect blocks until the header index is pruned, with the headers of
+	// the last few blocks processed ahead of them.
+	processBlocks(t, chain, mainBlocks[5:142])
+	processHeaders(t, chain, mainBlocks[142:])
+	processBlocks(t, chain, mainBlocks[142:144])
+
+	// The stale headers are gone, so a header which builds on them is no
+	// longer connected to anything.
+	err := chain.ProcessBlockHeader(&staleBlocks[2].MsgBlock().Header,
+		btcchain.BFNone)
+	checkRuleError(t, "ProcessBlockHeader", err,
+		btcchain.ErrPrevBlockUnknown)
+
+	// The header which extends the main chain is still there.
+	missing := chain.MissingBlocks(10)
+	if len(missing) != 1 || !missing[0].IsEqual(blockHash(mainBlocks[144])) {
+		t.Errorf("MissingBlocks: got %v, want [%v]", missing,
+			blockHash(mainBlocks[144]))
+	}
+	hash, height := chain.BestHeader()
+	if !hash.IsEqual(blockHash(mainBlocks[144])) || height != 145 {
+		t.Errorf("BestHeader: got %v (height %d), want %v (height 145)",
+			hash, height, blockHash(mainBlocks[144]))
+	}
+}
+
+// TestProcessBlockHeaders ensures ProcessBlockHeaders processes headers until
+// the first one which fails to validate and reports how many were processed.
+func TestProcessBlockHeaders(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "headerstest3", &params, nil)
+	defer teardown()
+
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 6)
+	processBlocks(t, chain, blocks[:2])
+
+	// badHeader is the header of the fifth block with a difficulty its
+	// hash does not meet.
+	badHeader := blocks[4].MsgBlock().Header
+	badHeader.Bits = 0x1d00ffff
+	headers := make([]*btcwire.BlockHeader, 0, len(blocks))
+	for _, block := range blocks {
+		headers = append(headers, &block.MsgBlock().Header)
+	}
+
+	tests := []struct {
+		name     string
+		headers  []*btcwire.BlockHeader
+		want     int
+		wantCode btcchain.ErrorCode
+		valid    bool
+	}{
+		{"no headers", nil, 0, 0, true},
+		{"stops at invalid header", []*btcwire.BlockHeader{headers[2],
+			headers[3], &badHeader, headers[5]}, 2,
+			btcchain.ErrHighHash, false},
+		{"unknown previous block", headers[5:], 0,
+			btcchain.ErrPrevBlockUnknown, false},
+		{"known blocks and headers", headers, 6, 0, true},
+	}
+
+	for i, test := range tests {
+		n, err := chain.ProcessBlockHeaders(test.headers, btcchain.BFNone)
+		if n != test.want {
+			t.Errorf("ProcessBlockHeaders #%d (%s): got %d processed, "+
+				"want %d", i, test.name, n, test.want)
+		}
+		if test.valid {
+			if err != nil {
+				t.Errorf("ProcessBlockHeaders #%d (%s): unexpected "+
+					"error %v", i, test.name, err)
+			}
+			continue
+		}
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != test.wantCode {
+			t.Errorf("ProcessBlockHeaders #%d (%s): got %v, want %v",
+				i, test.name, err, test.wantCode)
+		}
+	}
+
+	hash, height := chain.BestHeader()
+	if !hash.IsEqual(blockHash(blocks[5])) || height != 6 {
+		t.Errorf("BestHeader: got %v (height %d), want %v (height 6)",
+			hash, height, blockHash(blocks[5]))
+	}
+}
+
+// TestMissingBlocks ensures MissingBlocks returns the blocks needed to extend
+// the main chain towards the best header chain in connect order, limited to
+// the requested number, and nothing once the main chain has as much work.
+func TestMissingBlocks(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "headerstest4", &params, nil)
+	defer teardown()
+
+	// The main chain is a1 <- a2 and the headers extend it to a6.  The
+	// headers of a shorter chain which forks from a1 are known as well.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 6)
+	sideBlocks := g.nextBlocks(blocks[0], 3)
+	processBlocks(t, chain, blocks[:2])
+	processHeaders(t, chain, blocks[2:])
+	processHeaders(t, chain, sideBlocks)
+
+	tests := []struct {
+		name      string
+		numBlocks int
+		maxBlocks int
+		want      []*btcutil.Block
+	}{
+		{"no blocks requested", 2, 0, nil},
+		{"limited", 2, 2, blocks[2:4]},
+		{"all missing blocks", 2, 10, blocks[2:]},
+		{"part of the blocks connected", 3, 10, blocks[3:]},
+		{"all blocks connected", 6, 10, nil},
+	}
+
+	numProcessed := 2
+	for i, test := range tests {
+		processBlocks(t, chain, blocks[numProcessed:test.numBlocks])
+		numProcessed = test.numBlocks
+		hashes := chain.MissingBlocks(test.maxBlocks)
+		if len(hashes) != len(test.want) {
+			t.Errorf("MissingBlocks #%d (%s): got %d hashes, want %d",
+				i, test.name, len(hashes), len(test.want))
+			continue
+		}
+		for j, hash := range hashes {
+			if !hash.IsEqual(blockHash(test.want[j])) {
+				t.Errorf("MissingBlocks #%d (%s): got hash %v at "+
+					"index %d, want %v", i, test.name, hash, j,
+					blockHash(test.want[j]))
+			}
+		}
+	}
+}
+
+// TestDownloadWindow ensures DownloadWindow returns the blocks needed to extend
+// the main chain in connect order, limited to the window size, and does not
+// extend beyond the next checkpoint.
+func TestDownloadWindow(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 6)
+
+	tests := []struct {
+		name       string
+		checkpoint bool
+		numBlocks  int
+		windowSize int
+		want       []*btcutil.Block
+	}{
+		{"no window", false, 1, 0, nil},
+		{"limited by window size", false, 1, 2, blocks[1:3]},
+		{"all missing blocks", false, 1, 10, blocks[1:]},
+		{"limited by checkpoint", true, 1, 10, blocks[1:4]},
+		{"window size before checkpoint", true, 1, 2, blocks[1:3]},
+		{"past checkpoint", true, 4, 10, blocks[4:]},
+		{"all blocks connected", true, 6, 10, nil},
+	}
+
+	for i, test := range tests {
+		// The checkpoint is at the fourth block.
+		params.Checkpoints = nil
+		if test.checkpoint {
+			params.Checkpoints = []btcchain.Checkpoint{
+				{Height: 4, Hash: blockHash(blocks[3])},
+			}
+		}
+		chain, _, teardown := newTestChain(t, "headerstest5", &params,
+			nil)
+		processBlocks(t, chain, blocks[:test.numBlocks])
+		processHeaders(t, chain, blocks[test.numBlocks:])
+
+		window := chain.DownloadWindow(test.windowSize)
+		teardown()
+		if len(window) != len(test.want) {
+			t.Errorf("DownloadWindow #%d (%s): got %d blocks, want %d",
+				i, test.name, len(window), len(test.want))
+			continue
+		}
+		for j, req := range window {
+			want := test.want[j]
+			if !req.Hash.IsEqual(blockHash(want)) ||
+				req.Height != want.Height() {
+
+				t.Errorf("DownloadWindow #%d (%s): got %v (height "+
+					"%d) at index %d, want %v (height %d)", i,
+					test.name, req.Hash, req.Height, j,
+					blockHash(want), want.Height())
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// Indexer is the interface optional indexes, such as transaction, address, and
+// filter indexes, implement in order to be kept in sync with the main chain.
+//
+// Each indexer must record its own tip atomically with the index data it
+// updates for each block.  This allows the chain to detect an index which has
+// diverged from the main chain, for example due to a crash between the chain
+// and the index being updated, and roll it back or forward as needed.
+type Indexer interface {
+	// Name returns a human-readable name for the index.
+	Name() string
+
+	// Tip returns the hash and height of the most recent block the index
+	// reflects.  It must return the genesis block for a new index.
+	Tip() (*btcwire.ShaHash, int64, error)
+
+	// ConnectBlock updates the index for the passed block which was
+	// connected to the end of the main chain and records the block as the
+	// new tip of the index.
+	ConnectBlock(block *btcutil.Block) error
+
+	// DisconnectBlock removes the passed block, which is the tip of the
+	// index, from the index and records its parent as the new tip.
+	DisconnectBlock(block *btcutil.Block) error
+}
+
+// indexerState houses an indexer along with whether or not it is in sync with
+// the main chain.
+type indexerState struct {
+	indexer Indexer
+	inSync  bool
+}
+
+// AddIndexer adds the passed indexer to the set of indexes which are updated as
+// blocks are connected to and disconnected from the main chain.  The index is
+// first brought in sync with the main chain by rolling it back to the point it
+// forks from the main chain, if needed, and then rolling it forward to the end
+// of the main chain.  This is typically done on startup to recover from an
+// index which diverged from the chain due to a crash.
+//
+// Should the index fail to update for a block later on, it is no longer
+// updated until it is brought back in sync with SyncIndexers.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete and no blocks can be processed
+// until it completes.
+func (b *BlockChain) AddIndexer(indexer Indexer) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	state := &indexerState{indexer: indexer}
+	b.indexers = append(b.indexers, state)
+	return b.syncIndexer(state)
+}
+
+// SyncIndexers attempts to bring all of the indexes which are no longer in sync
+// with the main chain back in sync.  See AddIndexer for details.
+//
+// This function is safe for concurrent access, however no blocks can be
+// processed until it completes.
+func (b *BlockChain) SyncIndexers() error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	for _, state := range b.indexers {
+		if state.inSync {
+			continue
+		}
+		err := b.syncIndexer(state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isMainChainBlock returns whether or not the block with the passed hash is in
+// the main chain at the passed height according to the database.
+func (b *BlockChain) isMainChainBlock(hash *btcwire.ShaHash, height int64) bool {
+	mainHash, err := b.db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return false
+	}
+	return mainHash.IsEqual(hash)
+}
+
+// syncIndexer rolls the index for the passed state back to the point it forks
+// from the main chain and then forward to the end of the main chain.
+func (b *BlockChain) syncIndexer(state *indexerState) error {
+	indexer := state.indexer
+	tipHash, tipHeight, err := indexer.Tip()
+	if err != nil {
+		return err
+	}
+
+	// Roll the index back until its tip is in the main chain.  The blocks
+	// which are no longer in the main chain are only available when they
+	// are still in the side chain block cache or directory, so the index
+	// needs to be rebuilt if they have been lost, such as after a crash.
+	for !b.isMainChainBlock(tipHash, tipHeight) {
+		block, exists := b.blockCache[*tipHash]
+		if !exists {
+			block, err = b.loadStoredBlock(tipHash)
+			if err != nil {
+				return err
+			}
+			exists = block != nil
+		}
+		if !exists {
+			return fmt.Errorf("unable to roll back the %s index since "+
+				"its tip %v is not in the main chain and is no "+
+				"longer available -- the index must be rebuilt",
+				indexer.Name(), tipHash)
+		}
+		log.Infof("Rolling back the %s index from block %v (height "+
+			"%d)", indexer.Name(), tipHash, tipHeight)
+		err := indexer.DisconnectBlock(block)
+		if err != nil {
+			return err
+		}
+
+		tipHash, tipHeight, err = indexer.Tip()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Roll the index forward to the end of the main chain.
+	_, bestHeight, err := b.db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if tipHeight < bestHeight {
+		log.Infof("Catching up the %s index from height %d to %d",
+			indexer.Name(), tipHeight, bestHeight)
+	}
+	for height := tipHeight + 1; height <= bestHeight; height++ {
+		block, err := b.fetchMainChainBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		err = indexer.ConnectBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	state.inSync = true
+	return nil
+}
+
+// connectIndexers updates all of the indexes which are in sync with the main
+// chain with the passed block which was just connected to it.  An index which
+// fails to update is no longer updated until it is brought back in sync, which
+// is possible since it records its own tip.
+func (b *BlockChain) connectIndexers(block *btcutil.Block) {
+	for _, state := range b.indexers {
+		if !state.inSync {
+			continue
+		}
+		err := state.indexer.ConnectBlock(block)
+		if err != nil {
+			log.Errorf("Failed to update the %s index: %v -- it "+
+				"will no longer be updated until it is synced",
+				state.indexer.Name(), err)
+			state.inSync = false
+		}
+	}
+}
+
+// disconnectIndexers updates all of the indexes which are in sync with the main
+// chain to remove the passed block which was just disconnected from it.  See
+// connectIndexers for how failures are handled.
+func (b *BlockChain) disconnectIndexers(block *btcutil.Block) {
+	for _, state := range b.indexers {
+		if !state.inSync {
+			continue
+		}
+		err := state.indexer.DisconnectBlock(block)
+		if err != nil {
+			log.Errorf("Failed to update the %s index: %v -- it "+
+				"will no longer be updated until it is synced",
+				state.indexer.Name(), err)
+			state.inSync = false
+		}
+	}
+}
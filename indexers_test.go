@@ -0,0 +1,90 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"testing"
+)
+
+// checkIndexerTip fails the test when the tip of the passed indexer is not the
+// passed block.
+func checkIndexerTip(t *testing.T, context string, indexer *testIndexer, want *btcutil.Block) {
+	if !indexer.tipHash.IsEqual(blockHash(want)) ||
+		indexer.tipHeight != want.Height() {
+
+		t.Errorf("%s: index tip is %v (height %d), want %v (height "+
+			"%d)", context, indexer.tipHash, indexer.tipHeight,
+			blockHash(want), want.Height())
+	}
+}
+
+// TestAddIndexer ensures indexes are brought in sync with the main chain when
+// they are added, no matter whether they are new, behind, or on a block which
+// was reorganized out of the main chain, and that an index which failed to
+// update is brought back in sync by SyncIndexers.
+func TestAddIndexer(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "indexerstest", &params, nil)
+	defer teardown()
+
+	// The main chain a1 <- a2 <- a3 is reorganized to b2 <- b3 <- b4,
+	// which forks from a1.
+	g := newBlockGenerator(&params)
+	genesis := g.genesis()
+	mainBlocks := g.nextBlocks(genesis, 3)
+	sideBlocks := g.nextBlocks(mainBlocks[0], 3)
+	processBlocks(t, chain, mainBlocks)
+	processBlocks(t, chain, sideBlocks)
+
+	tests := []struct {
+		name    string
+		tip     *btcutil.Block
+		wantErr bool
+	}{
+		{"new index", genesis, false},
+		{"index behind", mainBlocks[0], false},
+		{"index on detached block", mainBlocks[2], false},
+		{"index on unknown block", g.nextBlock(mainBlocks[2]), true},
+	}
+
+	for i, test := range tests {
+		indexer := &testIndexer{tipHash: blockHash(test.tip),
+			tipHeight: test.tip.Height()}
+		err := chain.AddIndexer(indexer)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("AddIndexer #%d (%s): expected error", i,
+					test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("AddIndexer #%d (%s): unexpected error %v", i,
+				test.name, err)
+			continue
+		}
+		checkIndexerTip(t, test.name, indexer, sideBlocks[2])
+	}
+
+	// An index which fails to update stops being updated until it is
+	// synced again.
+	indexer := &testIndexer{tipHash: blockHash(genesis)}
+	if err := chain.AddIndexer(indexer); err != nil {
+		t.Fatalf("AddIndexer: unexpected error %v", err)
+	}
+	indexer.connectErr = errors.New("connect failure")
+	blocks := g.nextBlocks(sideBlocks[2], 2)
+	processBlocks(t, chain, blocks[:1])
+	indexer.connectErr = nil
+	processBlocks(t, chain, blocks[1:])
+	checkIndexerTip(t, "failed index", indexer, sideBlocks[2])
+	if err := chain.SyncIndexers(); err != nil {
+		t.Fatalf("SyncIndexers: unexpected error %v", err)
+	}
+	checkIndexerTip(t, "SyncIndexers", indexer, blocks[1])
+}
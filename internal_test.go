@@ -12,24 +12,290 @@ interface.  The functions are only exported while the tests are being run.
 package btcchain
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
 	"time"
 )
 
-// TstCheckBlockSanity makes the internal checkBlockSanity function available to
-// the test package.
-func TstCheckBlockSanity(block *btcutil.Block) error {
-	return checkBlockSanity(block)
+// TstTimeSorter makes the internal timeSorter type available to the test
+// package.
+func TstTimeSorter(times []time.Time) timeSorter {
+	return timeSorter(times)
+}
+
+// TstContextError makes the internal contextError function available to the
+// test package.
+func TstContextError(err error, context string) error {
+	return contextError(err, context)
+}
+
+// tstVersionChain builds an in-memory chain with a block for each of the passed
+// versions on top of the genesis block of the passed parameters and returns a
+// chain instance for the parameters along with the last node.  The blocks are
+// the target time per block apart starting at the passed time.
+func tstVersionChain(params *Params, start time.Time, versions []uint32) (*BlockChain, *blockNode) {
+	b, _ := New(nil, params, nil)
+	node := &blockNode{
+		hash:      params.GenesisHash,
+		height:    0,
+		version:   params.GenesisBlock.Header.Version,
+		timestamp: params.GenesisBlock.Header.Timestamp,
+	}
+	for i, version := range versions {
+		var hash btcwire.ShaHash
+		binary.LittleEndian.PutUint64(hash[:], uint64(i+1))
+		node = &blockNode{
+			parent:    node,
+			hash:      &hash,
+			height:    node.height + 1,
+			version:   version,
+			timestamp: start.Add(time.Duration(i) * params.TargetTimePerBlock),
+		}
+	}
+	return b, node
+}
+
+// TstThresholdState returns the state of the deployment with the passed id for
+// the block after the last one of a chain built by tstVersionChain.
+func TstThresholdState(params *Params, deploymentID int, start time.Time, versions []uint32) (ThresholdState, error) {
+	b, node := tstVersionChain(params, start, versions)
+	return b.thresholdState(node, deploymentID)
+}
+
+// TstIsCSVActive returns whether or not the relative lock time rules apply to
+// the block after the last one of a chain built by tstVersionChain.
+func TstIsCSVActive(params *Params, start time.Time, versions []uint32) (bool, error) {
+	b, node := tstVersionChain(params, start, versions)
+	return b.isCSVActive(node)
 }
 
-// TstSetCoinbaseMaturity makes the ability to set the coinbase maturity
+// TstUndoSpendJournalEntry updates the passed transaction store by undoing the
+// passed block using the spend journal entry which is created for it when it is
+// connected at its height.
+func TstUndoSpendJournalEntry(txStore TxStore, block *btcutil.Block) error {
+	hash, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	node := &blockNode{hash: hash, height: block.Height()}
+	undoSpendJournalEntry(txStore, newSpendJournalEntry(node, block))
+	return nil
+}
+
+// TstDisconnectTransactions makes the internal disconnectTransactions function
 // available to the test package.
-func TstSetCoinbaseMaturity(maturity int64) {
-	coinbaseMaturity = maturity
+func TstDisconnectTransactions(txStore TxStore, block *btcutil.Block) error {
+	return disconnectTransactions(txStore, block)
 }
 
-// TstTimeSorter makes the internal timeSorter type available to the test
-// package.
-func TstTimeSorter(times []time.Time) timeSorter {
-	return timeSorter(times)
+// TstWriteReorgJournal writes a reorganization journal to the passed path the
+// same way a reorganization to the passed fork point which detaches and
+// attaches the passed blocks does before modifying the chain.
+func TstWriteReorgJournal(path string, forkHash *btcwire.ShaHash, detachBlocks, attachBlocks []*btcutil.Block) error {
+	b := BlockChain{reorgJournalPath: path}
+	return b.writeReorgJournal(forkHash, detachBlocks, attachBlocks)
+}
+
+// TstHasNearbyFork returns whether or not hasNearbyFork finds a fork near the
+// passed height in a chain with a side chain of the passed length which forks
+// from the main chain block at the passed height.
+func TstHasNearbyFork(forkHeight int64, sideChainLen int, height int64) bool {
+	b, _ := New(nil, &RegressionNetParams, nil)
+	var node *blockNode
+	for i := int64(0); i <= forkHeight+int64(sideChainLen); i++ {
+		var hash btcwire.ShaHash
+		binary.LittleEndian.PutUint64(hash[:], uint64(i+1))
+		node = &blockNode{
+			parent:      node,
+			hash:        &hash,
+			height:      i,
+			inMainChain: i <= forkHeight,
+		}
+		b.index[hash] = node
+		if !node.inMainChain {
+			b.blockCache[hash] = nil
+		}
+	}
+	return b.hasNearbyFork(height)
+}
+
+// TstIsBIP0030Redundant returns whether or not the BIP0030 check is skipped for
+// a block at the passed height on a chain which contains the BIP0034
+// activation block at the passed activation height.
+func TstIsBIP0030Redundant(activationHeight, height int64) bool {
+	var activationHash btcwire.ShaHash
+	activationHash[0] = 0x34
+	params := RegressionNetParams
+	params.BIP0034Height = activationHeight
+	params.BIP0034Hash = &activationHash
+	b, _ := New(nil, &params, nil)
+
+	activationNode := &blockNode{
+		hash:   &activationHash,
+		height: activationHeight,
+	}
+	node := &blockNode{
+		parent: activationNode,
+		hash:   &btcwire.ShaHash{},
+		height: height,
+	}
+	if height == activationHeight {
+		node = activationNode
+	}
+	return b.isBIP0030Redundant(node)
+}
+
+// TstReorgProbability returns the estimated probability that a block with the
+// passed number of confirmations is reorganized out of the main chain after
+// the passed number of reorganizations of the passed depth were each observed
+// after the passed number of blocks was connected.
+func TstReorgProbability(numReorgs int, blocksPerReorg, depth, confirmations int64) float64 {
+	b, _ := New(nil, &RegressionNetParams, nil)
+	for i := 0; i < numReorgs; i++ {
+		b.blocksConnected += blocksPerReorg
+		b.recordReorg(depth)
+	}
+	return b.reorgProbability(confirmations)
+}
+
+// TstBlockCacheBytes returns the running total of the size of the blocks in
+// the side chain block cache along with the total calculated from the blocks.
+func (b *BlockChain) TstBlockCacheBytes() (int64, int64) {
+	var total int64
+	for _, block := range b.blockCache {
+		total += blockSize(block)
+	}
+	return b.blockCacheBytes, total
+}
+
+// TstIsBlockCached returns whether the block identified by the passed hash is
+// held in the side chain block cache.
+func (b *BlockChain) TstIsBlockCached(hash *btcwire.ShaHash) bool {
+	_, exists := b.blockCache[*hash]
+	return exists
+}
+
+// TstCreateDeferredNodes creates the block nodes from a loaded block index
+// which would otherwise only be created once they are needed and returns how
+// many were created.
+func (b *BlockChain) TstCreateDeferredNodes() int {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	numCreated := 0
+	for b.loadDeferredParent(b.root) != nil {
+		numCreated++
+	}
+	return numCreated
+}
+
+// TstTraceScript executes the scripts of the passed input with btcscript one
+// opcode at a time while following along with the scriptStepper which enforces
+// the rules btcscript does not support.  It returns an error describing the
+// first opcode at which the position of the stepper differs from the program
+// counter of btcscript, or at which the stepper and btcscript disagree on
+// whether the opcode is executed.  Opcodes which are not executed leave the
+// stack untouched, executed conditionals pop their condition, and executed
+// push opcodes push a single item, which is how the latter is observed.
+// Nothing is traced when btcscript refuses to execute the scripts.
+func TstTraceScript(input *ScriptInput, flags ScriptFlags) error {
+	engine, err := newScriptEngine(input, flags)
+	if err != nil {
+		return nil
+	}
+	s := newScriptStepper(engine, input, flags)
+	for step := 0; ; step++ {
+		pc, err := engine.DisasmPC()
+		if err != nil {
+			return fmt.Errorf("step %d: DisasmPC: %v", step, err)
+		}
+		var scriptIdx, scriptOff int
+		_, err = fmt.Sscanf(pc, "%x:%x:", &scriptIdx, &scriptOff)
+		if err != nil {
+			return fmt.Errorf("step %d: unexpected program "+
+				"counter %q", step, pc)
+		}
+		pop := s.current()
+		if pop == nil || scriptIdx != s.scriptIdx ||
+			scriptOff != s.scriptOff {
+
+			return fmt.Errorf("step %d: btcscript is at %q, "+
+				"stepper is at %02x:%04x", step, pc,
+				s.scriptIdx, s.scriptOff)
+		}
+
+		executing := s.executing()
+		cond := condSkip
+		if pop.opcode == btcscript.OP_IF ||
+			pop.opcode == btcscript.OP_NOTIF {
+
+			cond = s.branchCondition(pop)
+		}
+		lastInScript := s.scriptOff == len(s.scripts[s.scriptIdx])-1
+
+		before := engine.GetStack()
+		done, err := engine.Step()
+		if err != nil || done {
+			return nil
+		}
+
+		// btcscript may replace the stack when it moves on to the
+		// next script, so the effect of the last opcode of each script
+		// is not observable.
+		if !lastInScript {
+			err := tstCheckStackChange(pop, executing, before,
+				engine.GetStack())
+			if err != nil {
+				return fmt.Errorf("step %d (%s): %v", step, pc,
+					err)
+			}
+		}
+		s.advance(pop, cond)
+	}
+}
+
+// tstCheckStackChange returns an error when the change from the passed stack
+// before btcscript executed the passed opcode to the passed stack after it
+// does not match whether the stepper considers the opcode executed.
+func tstCheckStackChange(pop *parsedOpcode, executing bool, before, after [][]byte) error {
+	switch {
+	case pop.opcode == btcscript.OP_ELSE ||
+		pop.opcode == btcscript.OP_ENDIF:
+
+		return nil
+
+	case !executing:
+		unchanged := len(before) == len(after)
+		for i := 0; unchanged && i < len(before); i++ {
+			unchanged = bytes.Equal(before[i], after[i])
+		}
+		if !unchanged {
+			return fmt.Errorf("opcode %#x changed the stack from "+
+				"%x to %x, but the stepper considers it "+
+				"skipped", pop.opcode, before, after)
+		}
+
+	case pop.opcode == btcscript.OP_IF ||
+		pop.opcode == btcscript.OP_NOTIF:
+
+		if len(after) != len(before)-1 {
+			return fmt.Errorf("conditional %#x changed the stack "+
+				"depth from %d to %d, but the stepper "+
+				"considers it executed", pop.opcode,
+				len(before), len(after))
+		}
+
+	case pop.opcode <= btcscript.OP_16:
+		if len(after) != len(before)+1 {
+			return fmt.Errorf("push opcode %#x changed the stack "+
+				"depth from %d to %d, but the stepper "+
+				"considers it executed", pop.opcode,
+				len(before), len(after))
+		}
+	}
+	return nil
 }
@@ -0,0 +1,47 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"errors"
+)
+
+// ErrInterrupted is the error returned by long-running operations which were
+// stopped early because the interrupt channel set via SetInterrupt was closed.
+// The chain is left in a consistent state when it is returned.
+var ErrInterrupted = errors.New("operation interrupted")
+
+// SetInterrupt sets a channel which, once closed, causes long-running
+// operations to stop early with ErrInterrupted.  This allows a node which is
+// shutting down to do so promptly instead of waiting for operations such as
+// the validation of the blocks of a deep reorganization, the processing of a
+// long series of orphans, VerifyChain, or FetchBlockSpends to complete.  It
+// should be set before processing any blocks and the channel closed on
+// shutdown.
+//
+// Operations are only stopped at points where the chain is consistent.  In
+// particular, once a reorganization starts disconnecting blocks, it runs to
+// completion.  Orphans which were not processed due to an interrupt remain in
+// the orphan pool until they expire.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetInterrupt(interrupt <-chan struct{}) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.interrupt = interrupt
+}
+
+// interruptRequested returns whether or not the interrupt channel set via
+// SetInterrupt has been closed.
+func (b *BlockChain) interruptRequested() bool {
+	select {
+	case <-b.interrupt:
+		return true
+	default:
+	}
+	return false
+}
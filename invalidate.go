@@ -0,0 +1,286 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// maxInvalidBlocks is the maximum number of blocks which failed validation that
+// are remembered.  Once the limit is reached, the oldest ones are forgotten.
+const maxInvalidBlocks = 1000
+
+// blockStatus is a bit field describing the validation state of a block node.
+type blockStatus uint8
+
+const (
+	// statusValidateFailed indicates the block failed validation or was
+	// marked invalid via InvalidateBlock.
+	statusValidateFailed blockStatus = 1 << iota
+
+	// statusInvalidAncestor indicates one of the ancestors of the block is
+	// invalid.
+	statusInvalidAncestor
+)
+
+// knownInvalid returns whether the status indicates the block is invalid either
+// because of the block itself or one of its ancestors.
+func (s blockStatus) knownInvalid() bool {
+	return s&(statusValidateFailed|statusInvalidAncestor) != 0
+}
+
+// markInvalidDescendants marks all of the nodes which build on the passed node
+// as having an invalid ancestor.  It must be called with the chain lock held
+// for writes.
+func markInvalidDescendants(node *blockNode) {
+	for _, child := range node.children {
+		child.status |= statusInvalidAncestor
+		markInvalidDescendants(child)
+	}
+}
+
+// markBlockInvalid remembers that the passed block failed validation with the
+// passed rule error so it and the blocks which build on it are rejected without
+// validating them again.  The node for the block, if any, and the nodes which
+// build on it are marked invalid as well.  Blocks which were rejected because
+// they build on a block which was marked invalid via InvalidateBlock are not
+// remembered since that block may be reconsidered.
+func (b *BlockChain) markBlockInvalid(hash, prevHash *btcwire.ShaHash, ruleErr RuleError) {
+	if ruleErr.ErrorCode == ErrInvalidAncestorBlock {
+		if _, ok := b.invalidBlocks[*prevHash]; !ok {
+			return
+		}
+	}
+
+	if node, ok := b.index[*hash]; ok {
+		b.chainLock.Lock()
+		node.status |= statusValidateFailed
+		markInvalidDescendants(node)
+		b.chainLock.Unlock()
+	}
+
+	if _, ok := b.invalidBlocks[*hash]; ok {
+		return
+	}
+	if len(b.invalidBlockOrder) >= maxInvalidBlocks {
+		delete(b.invalidBlocks, b.invalidBlockOrder[0])
+		b.invalidBlockOrder = b.invalidBlockOrder[1:]
+	}
+	b.invalidBlocks[*hash] = ruleErr
+	b.invalidBlockOrder = append(b.invalidBlockOrder, *hash)
+}
+
+// forgetInvalidBlock removes the block with the passed hash from the blocks
+// which are remembered to have failed validation.
+func (b *BlockChain) forgetInvalidBlock(hash *btcwire.ShaHash) {
+	if _, ok := b.invalidBlocks[*hash]; !ok {
+		return
+	}
+	delete(b.invalidBlocks, *hash)
+	for i := range b.invalidBlockOrder {
+		if b.invalidBlockOrder[i].IsEqual(hash) {
+			b.invalidBlockOrder = append(b.invalidBlockOrder[:i],
+				b.invalidBlockOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// checkKnownInvalid returns the rule error the passed block failed validation
+// with when it, or the block it builds on, is remembered to be invalid.  See
+// markBlockInvalid.
+func (b *BlockChain) checkKnownInvalid(hash, prevHash *btcwire.ShaHash) error {
+	if ruleErr, ok := b.invalidBlocks[*hash]; ok {
+		return ruleErr
+	}
+	if _, ok := b.invalidBlocks[*prevHash]; ok {
+		str := fmt.Sprintf("previous block %v is known to be invalid",
+			prevHash)
+		return ruleError(ErrInvalidAncestorBlock, str)
+	}
+	return nil
+}
+
+// lookupNode returns the block node for the block with the passed hash, which
+// must either be in memory or part of the main chain, in which case it is
+// loaded from the database.
+func (b *BlockChain) lookupNode(hash *btcwire.ShaHash) (*blockNode, error) {
+	if node, ok := b.index[*hash]; ok {
+		return node, nil
+	}
+	if b.bestChain == nil || !b.db.ExistsSha(hash) {
+		return nil, fmt.Errorf("block %v is not known", hash)
+	}
+
+	block, err := b.db.FetchBlockBySha(hash)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	node, err := b.ancestorNode(b.bestChain, block.Height())
+	if err != nil {
+		return nil, err
+	}
+	if !node.hash.IsEqual(hash) {
+		return nil, fmt.Errorf("block %v is not in the main chain", hash)
+	}
+	return node, nil
+}
+
+// bestValidNode returns the node with the most cumulative work which is not
+// known to be invalid out of the end of the main chain and the side chain
+// blocks.  The end of the main chain wins ties.
+func (b *BlockChain) bestValidNode() *blockNode {
+	best := b.bestChain
+	for _, node := range b.sideChainNodes() {
+		if node.status.knownInvalid() {
+			continue
+		}
+		if node.workSum.Cmp(best.workSum) > 0 {
+			best = node
+		}
+	}
+	return best
+}
+
+// reorganizeToBestValidChain reorganizes the chain such that the end of the
+// valid chain with the most cumulative work becomes the end of the main chain
+// when it isn't already.  When a block which would be attached violates the
+// rules, it is marked invalid along with the blocks which build on it and the
+// next best valid chain is tried instead.  A rule violation which does not rule
+// out the best valid chain is returned along with the hash of the side chain
+// block which could not be reached since the main chain might be left with
+// less work than that chain.
+func (b *BlockChain) reorganizeToBestValidChain() error {
+	for {
+		best := b.bestValidNode()
+		if best == b.bestChain {
+			return nil
+		}
+
+		detachNodes, attachNodes := b.getReorganizeNodes(best)
+		err := b.reorganizeChain(detachNodes, attachNodes)
+		if _, ok := err.(RuleError); !ok {
+			return err
+		}
+		log.Warnf("Unable to reorganize to side chain block %v: %v",
+			best.hash, err)
+
+		// The block which violated the rules was marked invalid by
+		// reorganizeChain, which rules out the chain ending with the
+		// best node.  Give up when it wasn't so this can't loop
+		// forever.
+		if !best.status.knownInvalid() {
+			str := fmt.Sprintf("unable to reorganize to side chain "+
+				"block %v", best.hash)
+			return contextError(err, str)
+		}
+	}
+}
+
+// InvalidateBlock marks the block with the passed hash and all of the blocks
+// which build on it as invalid regardless of whether or not they follow the
+// rules.  When the block is part of the main chain, it is disconnected along
+// with the blocks after it and the chain is reorganized to the valid chain with
+// the most cumulative work.  The blocks remain disconnected when that fails,
+// and the error says which side chain block could not be reached.  New blocks
+// which build on an invalid block are rejected with ErrInvalidAncestorBlock.
+//
+// It is intended for manually steering the chain away from a block, such as
+// when recovering from a consensus incident or testing fork handling, so the
+// limit set via SetMaxReorgDepth does not apply.  The genesis block can't be
+// invalidated.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) InvalidateBlock(hash *btcwire.ShaHash) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	node, err := b.lookupNode(hash)
+	if err != nil {
+		return err
+	}
+	if node.hash.IsEqual(b.chainParams.GenesisHash) {
+		return fmt.Errorf("the genesis block can't be invalidated")
+	}
+
+	log.Infof("Invalidating block %v (height %d)", node.hash, node.height)
+	b.chainLock.Lock()
+	node.status |= statusValidateFailed
+	markInvalidDescendants(node)
+	b.chainLock.Unlock()
+
+	// Nothing more to do when the block is on a side chain since none of
+	// the blocks which are now invalid are part of the main chain.
+	if !node.inMainChain {
+		return nil
+	}
+
+	// Disconnect the block and all of the blocks after it from the main
+	// chain and then switch to the best valid chain, which might be a side
+	// chain that now has more work than what is left of the main chain.
+	prevNode, err := b.getPrevNodeFromNode(node)
+	if err != nil {
+		return err
+	}
+	detachNodes, attachNodes := b.getReorganizeNodes(prevNode)
+	err = b.reorganizeChain(detachNodes, attachNodes)
+	if err != nil {
+		return err
+	}
+	return b.reorganizeToBestValidChain()
+}
+
+// clearInvalidDescendants clears the invalid status of all of the nodes which
+// build on the passed node and forgets that they failed validation.  It must be
+// called with the chain lock held for writes.
+func (b *BlockChain) clearInvalidDescendants(node *blockNode) {
+	for _, child := range node.children {
+		child.status &^= statusValidateFailed | statusInvalidAncestor
+		b.forgetInvalidBlock(child.hash)
+		b.clearInvalidDescendants(child)
+	}
+}
+
+// ReconsiderBlock clears the invalid status of the block with the passed hash
+// and all of the blocks which build on it, such as after they were marked
+// invalid via InvalidateBlock or failed validation, and reorganizes the chain
+// to the valid chain with the most cumulative work, which might now be one of
+// them.  The blocks are validated again when they are connected to the main
+// chain.  An error is returned when the block builds on a block which is still
+// invalid since that block needs to be reconsidered instead.  A block which is
+// only remembered to have failed validation, without a node in memory, is
+// simply forgotten so it is validated again when it is next processed.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) ReconsiderBlock(hash *btcwire.ShaHash) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	node, err := b.lookupNode(hash)
+	if err != nil {
+		if _, ok := b.invalidBlocks[*hash]; ok {
+			log.Infof("Reconsidering block %v", hash)
+			b.forgetInvalidBlock(hash)
+			return nil
+		}
+		return err
+	}
+	if node.parent != nil && node.parent.status.knownInvalid() {
+		return fmt.Errorf("block %v builds on invalid block %v",
+			node.hash, node.parent.hash)
+	}
+
+	log.Infof("Reconsidering block %v (height %d)", node.hash, node.height)
+	b.chainLock.Lock()
+	node.status &^= statusValidateFailed | statusInvalidAncestor
+	b.forgetInvalidBlock(node.hash)
+	b.clearInvalidDescendants(node)
+	b.chainLock.Unlock()
+
+	return b.reorganizeToBestValidChain()
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+// overpayCoinbase makes the coinbase of a generated block pay more than the
+// subsidy, which is only detected once the block is connected.
+func overpayCoinbase(msgBlock *btcwire.MsgBlock) {
+	msgBlock.Transactions[0].TxOut[0].Value++
+}
+
+// timeTooNew makes the timestamp of a generated block too far in the future,
+// which fails the sanity checks.
+func timeTooNew(msgBlock *btcwire.MsgBlock) {
+	msgBlock.Header.Timestamp = time.Unix(time.Now().Add(24*time.Hour).Unix(),
+		0)
+}
+
+// TestKnownInvalidBlocks ensures blocks which failed validation, and the blocks
+// which build on them, are rejected when they are submitted again and that
+// blocks which fail the sanity checks are not remembered.
+func TestKnownInvalidBlocks(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "knowninvalidtest", &params, nil)
+	defer teardown()
+
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 2)
+	processBlocks(t, chain, blocks)
+
+	// The invalid block is rejected when it is first processed and again
+	// when it is resubmitted.
+	bad := g.nextBlock(blocks[1], overpayCoinbase)
+	for i := 0; i < 2; i++ {
+		_, _, err := chain.ProcessBlock(bad)
+		checkRuleError(t, "ProcessBlock (invalid block)", err,
+			btcchain.ErrBadCoinbaseValue)
+	}
+	checkBestBlock(t, "invalid block", chain, blocks[1])
+
+	// Blocks which build on the invalid block are rejected along with the
+	// blocks which build on them in turn.
+	child := g.nextBlock(bad)
+	_, _, err := chain.ProcessBlock(child)
+	checkRuleError(t, "ProcessBlock (child)", err,
+		btcchain.ErrInvalidAncestorBlock)
+	_, _, err = chain.ProcessBlock(g.nextBlock(child))
+	checkRuleError(t, "ProcessBlock (grandchild)", err,
+		btcchain.ErrInvalidAncestorBlock)
+
+	// A block which builds on the invalid block but fails the sanity checks
+	// is rejected for failing them every time rather than remembered.
+	junk := g.nextBlock(bad, timeTooNew)
+	for i := 0; i < 2; i++ {
+		_, _, err := chain.ProcessBlock(junk)
+		checkRuleError(t, "ProcessBlock (junk)", err,
+			btcchain.ErrTimeTooNew)
+	}
+
+	// Reconsidering the invalid block, which never had a node since it
+	// failed to connect, forgets it so new blocks which build on it are
+	// treated as orphans again.
+	err = chain.ReconsiderBlock(blockHash(bad))
+	if err != nil {
+		t.Fatalf("ReconsiderBlock: unexpected error %v", err)
+	}
+	_, isOrphan, err := chain.ProcessBlock(g.nextBlock(bad))
+	if err != nil || !isOrphan {
+		t.Fatalf("ProcessBlock (child after reconsider): got orphan %v, "+
+			"error %v, want orphan", isOrphan, err)
+	}
+}
+
+// TestInvalidateBlock ensures invalidating a main chain block reorganizes the
+// chain to the best valid chain, skipping side chains which turn out to be
+// invalid, that invalidating a side chain block leaves the main chain alone
+// while rejecting blocks which build on it, and that the genesis block can't be
+// invalidated.
+func TestInvalidateBlock(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "invalidateblocktest", &params,
+		nil)
+	defer teardown()
+
+	// Create a main chain of four blocks along with two side chains which
+	// fork after the first block:
+	//
+	//   genesis -> a1 -> a2 -> a3 -> a4
+	//                \-> b2 -> b3
+	//                \-> c2 -> c3 (invalid) -> c4
+	//
+	// The c side chain has the same work as the main chain, so it is not
+	// validated until the chain is reorganized to it.
+	g := newBlockGenerator(&params)
+	mainBlocks := g.nextBlocks(g.genesis(), 4)
+	a1 := mainBlocks[0]
+	b2 := g.nextBlock(a1)
+	b3 := g.nextBlock(b2)
+	c2 := g.nextBlock(a1)
+	c3 := g.nextBlock(c2, overpayCoinbase)
+	c4 := g.nextBlock(c3)
+	processBlocks(t, chain, mainBlocks)
+	processBlocks(t, chain, []*btcutil.Block{c2, c3, c4, b2, b3})
+	checkBestBlock(t, "initial chain", chain, mainBlocks[3])
+
+	// Invalidating a side chain block leaves the main chain unchanged and
+	// blocks which build on it are rejected.
+	if err := chain.InvalidateBlock(blockHash(b3)); err != nil {
+		t.Fatalf("InvalidateBlock (side chain): unexpected error %v", err)
+	}
+	checkBestBlock(t, "invalidate side chain", chain, mainBlocks[3])
+	_, _, err := chain.ProcessBlock(g.nextBlock(b3))
+	checkRuleError(t, "ProcessBlock (builds on invalidated)", err,
+		btcchain.ErrInvalidAncestorBlock)
+	if err := chain.ReconsiderBlock(blockHash(b3)); err != nil {
+		t.Fatalf("ReconsiderBlock (side chain): unexpected error %v", err)
+	}
+
+	// Invalidating a main chain block disconnects it and the blocks after
+	// it.  The c side chain has the most work, but fails to connect, so
+	// the chain ends up on the b side chain instead.
+	if err := chain.InvalidateBlock(blockHash(mainBlocks[1])); err != nil {
+		t.Fatalf("InvalidateBlock (main chain): unexpected error %v", err)
+	}
+	checkBestBlock(t, "invalidate main chain", chain, b3)
+	_, _, err = chain.ProcessBlock(g.nextBlock(c4))
+	checkRuleError(t, "ProcessBlock (builds on invalid side chain)", err,
+		btcchain.ErrInvalidAncestorBlock)
+
+	// The genesis block can't be invalidated.
+	if err := chain.InvalidateBlock(params.GenesisHash); err == nil {
+		t.Fatalf("InvalidateBlock (genesis): expected error")
+	}
+	checkBestBlock(t, "invalidate genesis", chain, b3)
+}
+
+// TestReconsiderBlock ensures reconsidering a main chain block which was
+// invalidated restores the chain which ended with the original tip.
+func TestReconsiderBlock(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "reconsiderblocktest", &params,
+		nil)
+	defer teardown()
+
+	// Create a main chain of three blocks along with a shorter side chain
+	// which forks after the first block.
+	g := newBlockGenerator(&params)
+	mainBlocks := g.nextBlocks(g.genesis(), 3)
+	sideBlock := g.nextBlock(mainBlocks[0])
+	processBlocks(t, chain, mainBlocks)
+	processBlocks(t, chain, []*btcutil.Block{sideBlock})
+	tip := mainBlocks[2]
+	checkBestBlock(t, "initial chain", chain, tip)
+
+	invalidHash := blockHash(mainBlocks[1])
+	if err := chain.InvalidateBlock(invalidHash); err != nil {
+		t.Fatalf("InvalidateBlock: unexpected error %v", err)
+	}
+	checkBestBlock(t, "invalidate", chain, sideBlock)
+
+	// Reconsidering a block which builds on the invalid block is not
+	// allowed since the invalid block has to be reconsidered instead.
+	if err := chain.ReconsiderBlock(blockHash(tip)); err == nil {
+		t.Fatalf("ReconsiderBlock (descendant): expected error")
+	}
+
+	if err := chain.ReconsiderBlock(invalidHash); err != nil {
+		t.Fatalf("ReconsiderBlock: unexpected error %v", err)
+	}
+	checkBestBlock(t, "reconsider", chain, tip)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// SanityLimits houses the limits on the size of transactions and the number of
+// transactions in a block which are enforced by the context free block sanity
+// checks.  They are parameters of the chain so networks used for research can
+// explore different limits.  See SetSanityLimits.
+type SanityLimits struct {
+	// MaxTxSize is the maximum serialized size of a transaction in bytes.
+	MaxTxSize int
+
+	// MaxTxPerBlock is the maximum number of transactions a block may
+	// contain.
+	MaxTxPerBlock int
+}
+
+// DefaultSanityLimits are the sanity limits of the bitcoin networks.  Neither a
+// transaction nor the number of transactions in a block may exceed the maximum
+// block payload.
+var DefaultSanityLimits = SanityLimits{
+	MaxTxSize:     btcwire.MaxBlockPayload,
+	MaxTxPerBlock: btcwire.MaxBlockPayload,
+}
+
+// SetSanityLimits sets the limits on the size of transactions and the number of
+// transactions in a block which are enforced for blocks processed by the chain.
+// The default is DefaultSanityLimits, which must not be changed for the bitcoin
+// networks.  Note that btcwire still limits the size of messages read from and
+// written to the network regardless of the limits.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetSanityLimits(limits SanityLimits) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.sanityLimits = limits
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"math"
+)
+
+const (
+	// opCheckLockTimeVerify is the opcode BIP0065 redefined from OP_NOP2
+	// to OP_CHECKLOCKTIMEVERIFY.
+	opCheckLockTimeVerify = 0xb1
+
+	// opCheckSequenceVerify is the opcode BIP0112 redefined from OP_NOP3
+	// to OP_CHECKSEQUENCEVERIFY.
+	opCheckSequenceVerify = 0xb2
+
+	// maxLockTimeNumLen is the maximum number of bytes a lock time operand
+	// can be.  It is larger than the usual limit of 4 bytes for script
+	// numbers so lock times can represent all the values of a uint32.
+	maxLockTimeNumLen = 5
+)
+
+// lockTimeOperand returns the operand of a lock time opcode, which is the
+// item on the top of the passed stack interpreted as a script number of up to
+// maxLockTimeNumLen bytes.
+func lockTimeOperand(stack [][]byte) (int64, error) {
+	if len(stack) == 0 {
+		str := "lock time opcode executed with an empty stack"
+		return 0, ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	data := stack[len(stack)-1]
+	if len(data) > maxLockTimeNumLen {
+		str := fmt.Sprintf("script number of %d bytes exceeds max "+
+			"allowed length of %d", len(data), maxLockTimeNumLen)
+		return 0, ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	return scriptNum(data), nil
+}
+
+// verifyLockTime ensures an OP_CHECKLOCKTIMEVERIFY opcode executed with the
+// passed stack, whose last item is the top, is satisfied by the input at the
+// passed index of the passed transaction as defined by BIP0065.
+func verifyLockTime(tx *btcwire.MsgTx, txInIdx int, stack [][]byte) error {
+	lockTime, err := lockTimeOperand(stack)
+	if err != nil {
+		return err
+	}
+
+	// The lock time must not be negative.
+	if lockTime < 0 {
+		str := fmt.Sprintf("negative lock time %d", lockTime)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+
+	// The lock time must be the same type as the lock time of the
+	// transaction, either a block height or a timestamp, and must not be
+	// after it.
+	txLockTime := int64(tx.LockTime)
+	threshold := int64(lockTimeThreshold)
+	if (txLockTime < threshold) != (lockTime < threshold) {
+		str := fmt.Sprintf("mismatched lock time types -- tx lock "+
+			"time %d, script lock time %d", txLockTime, lockTime)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	if lockTime > txLockTime {
+		str := fmt.Sprintf("script lock time %d is after the "+
+			"transaction lock time %d", lockTime, txLockTime)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+
+	// The lock time of the transaction is ignored when the input is final,
+	// so it must not be.
+	if tx.TxIn[txInIdx].Sequence == math.MaxUint32 {
+		str := "transaction input is finalized which disables its " +
+			"lock time"
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	return nil
+}
+
+// verifySequence ensures an OP_CHECKSEQUENCEVERIFY opcode executed with the
+// passed stack, whose last item is the top, is satisfied by the input at the
+// passed index of the passed transaction as defined by BIP0112.
+func verifySequence(tx *btcwire.MsgTx, txInIdx int, stack [][]byte) error {
+	sequence, err := lockTimeOperand(stack)
+	if err != nil {
+		return err
+	}
+
+	// The sequence must not be negative.  The opcode behaves as a no-op
+	// when the disable flag is set.
+	if sequence < 0 {
+		str := fmt.Sprintf("negative sequence %d", sequence)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	if sequence&sequenceLockTimeDisabled != 0 {
+		return nil
+	}
+
+	// Relative lock times only apply to transactions with a version of at
+	// least 2 and inputs which don't disable them.
+	if tx.Version < 2 {
+		str := fmt.Sprintf("transaction version %d does not support "+
+			"relative lock times", tx.Version)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	txSequence := int64(tx.TxIn[txInIdx].Sequence)
+	if txSequence&sequenceLockTimeDisabled != 0 {
+		str := "transaction input has relative lock times disabled"
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+
+	// The relative lock time must be the same type as the one of the
+	// input, either blocks or seconds, and must not be after it.
+	typeMask := int64(sequenceLockTimeIsSeconds | sequenceLockTimeMask)
+	maskedSequence := sequence & typeMask
+	maskedTxSequence := txSequence & typeMask
+	if (maskedSequence < sequenceLockTimeIsSeconds) !=
+		(maskedTxSequence < sequenceLockTimeIsSeconds) {
+
+		str := fmt.Sprintf("mismatched relative lock time types -- "+
+			"input sequence %d, script sequence %d", txSequence,
+			sequence)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	if maskedSequence > maskedTxSequence {
+		str := fmt.Sprintf("script relative lock time %d is after the "+
+			"input relative lock time %d", maskedSequence,
+			maskedTxSequence)
+		return ruleError(ErrUnsatisfiedLockTime, str)
+	}
+	return nil
+}
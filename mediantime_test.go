@@ -0,0 +1,71 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMedianTime tests the median time calculation of the MedianTimeSource
+// returned by NewMedianTime.
+func TestMedianTime(t *testing.T) {
+	tests := []struct {
+		in   []int64
+		want int64
+	}{
+		// Not enough samples to update the offset.
+		{in: []int64{}, want: 0},
+		{in: []int64{-14, 15, 12, 5}, want: 0},
+
+		// Odd number of samples uses the median.
+		{in: []int64{-14, 15, 12, 5, 9}, want: 9},
+		{in: []int64{-5, -4, -3, -2, -1}, want: -3},
+
+		// Even number of samples keeps the previous offset.
+		{in: []int64{-5, -4, -3, -2, -1, 10}, want: -3},
+
+		// A median beyond the max allowed offset results in no offset.
+		{in: []int64{4201, 4202, 4203, 4204, 4205}, want: 0},
+
+		// Duplicate sources are ignored.
+		{in: []int64{1, 1, 1, 1, 1}, want: 0},
+	}
+
+	for i, test := range tests {
+		filter := btcchain.NewMedianTime()
+		for j, offset := range test.in {
+			id := strconv.Itoa(j)
+			if i == len(tests)-1 {
+				id = "same"
+			}
+			now := time.Unix(time.Now().Unix(), 0)
+			tOffset := now.Add(time.Duration(offset) * time.Second)
+			filter.AddTimeSample(id, tOffset)
+		}
+
+		// Allow a one second difference since the local clock may
+		// advance while the samples are added.
+		gotOffset := filter.Offset()
+		wantOffset := time.Duration(test.want) * time.Second
+		if gotOffset != wantOffset && gotOffset != wantOffset-time.Second {
+			t.Errorf("Offset #%d: unexpected offset -- got %v, "+
+				"want %v", i, gotOffset, wantOffset)
+			continue
+		}
+
+		adjustedTime := filter.AdjustedTime()
+		now := time.Unix(time.Now().Unix(), 0)
+		wantAdjusted := now.Add(gotOffset)
+		if adjustedTime.Sub(wantAdjusted) > time.Second ||
+			wantAdjusted.Sub(adjustedTime) > time.Second {
+
+			t.Errorf("AdjustedTime #%d: unexpected time -- got %v, "+
+				"want %v", i, adjustedTime, wantAdjusted)
+		}
+	}
+}
@@ -71,21 +71,39 @@ func hashMerkleBranches(left *btcwire.ShaHash, right *btcwire.ShaHash) *btcwire.
 func BuildMerkleTreeStore(block *btcutil.Block) []*btcwire.ShaHash {
 	numTransactions := len(block.MsgBlock().Transactions)
 
-	// Calculate how many entries are required to hold the binary merkle
-	// tree as a linear array and create an array of that size.
-	nextPoT := nextPowerOfTwo(numTransactions)
-	arraySize := nextPoT*2 - 1
-	merkles := make([]*btcwire.ShaHash, arraySize)
-
-	// Create the base transaction shas and populate the array with them.
+	// Create the base transaction shas.
+	txHashes := make([]*btcwire.ShaHash, numTransactions)
 	for i := 0; i < numTransactions; i++ {
 		// Ignore the error since the only reason TxSha can fail is
 		// if the index is out of range which is impossible here due
 		// to using a loop over the existing transactions.
 		sha, _ := block.TxSha(i)
-		merkles[i] = sha
+		txHashes[i] = sha
+	}
+
+	return BuildMerkleTreeStoreFromHashes(txHashes)
+}
+
+// BuildMerkleTreeStoreFromHashes is the same as BuildMerkleTreeStore except it
+// creates the merkle tree from the passed transaction hashes rather than a
+// block.  This allows callers such as mining code to build the merkle tree for
+// a set of transactions, such as a block template with a modified coinbase,
+// without creating a block first.  It returns nil when no hashes are passed.
+func BuildMerkleTreeStoreFromHashes(txHashes []*btcwire.ShaHash) []*btcwire.ShaHash {
+	numTransactions := len(txHashes)
+	if numTransactions == 0 {
+		return nil
 	}
 
+	// Calculate how many entries are required to hold the binary merkle
+	// tree as a linear array and create an array of that size.
+	nextPoT := nextPowerOfTwo(numTransactions)
+	arraySize := nextPoT*2 - 1
+	merkles := make([]*btcwire.ShaHash, arraySize)
+
+	// Populate the array with the base transaction shas.
+	copy(merkles, txHashes)
+
 	// Start the array offset after the last transaction and adjusted to the
 	// next power of two.
 	offset := nextPoT
@@ -112,3 +130,15 @@ func BuildMerkleTreeStore(block *btcutil.Block) []*btcwire.ShaHash {
 
 	return merkles
 }
+
+// CalcMerkleRoot returns the merkle root for the passed transaction hashes
+// using the same tree semantics as BuildMerkleTreeStore, including hashing the
+// last node of a level with itself when there is no right node to pair it
+// with.  It returns nil when no hashes are passed.
+func CalcMerkleRoot(txHashes []*btcwire.ShaHash) *btcwire.ShaHash {
+	merkles := BuildMerkleTreeStoreFromHashes(txHashes)
+	if len(merkles) == 0 {
+		return nil
+	}
+	return merkles[len(merkles)-1]
+}
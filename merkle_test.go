@@ -11,7 +11,7 @@ import (
 	"testing"
 )
 
-// TestMerkle tests the BuildMerkleTreeStore API.
+// TestMerkle tests the BuildMerkleTreeStore and CalcMerkleRoot APIs.
 func TestMerkle(t *testing.T) {
 	block := btcutil.NewBlock(&Block100000, btcwire.ProtocolVersion)
 	merkles := btcchain.BuildMerkleTreeStore(block)
@@ -21,4 +21,105 @@ func TestMerkle(t *testing.T) {
 		t.Errorf("BuildMerkleTreeStore: merkle root mismatch - "+
 			"got %v, want %v", calculatedMerkleRoot, wantMerkle)
 	}
+
+	txHashes, err := block.TxShas()
+	if err != nil {
+		t.Errorf("TxShas: %v", err)
+		return
+	}
+	calculatedMerkleRoot = btcchain.CalcMerkleRoot(txHashes)
+	if !wantMerkle.IsEqual(calculatedMerkleRoot) {
+		t.Errorf("CalcMerkleRoot: merkle root mismatch - "+
+			"got %v, want %v", calculatedMerkleRoot, wantMerkle)
+	}
+}
+
+// TestMerkleBranch ensures the merkle branches returned by MerkleBranch for
+// each transaction of a block lead to the merkle root of the block.
+func TestMerkleBranch(t *testing.T) {
+	block := btcutil.NewBlock(&Block100000, btcwire.ProtocolVersion)
+	txHashes, err := block.TxShas()
+	if err != nil {
+		t.Errorf("TxShas: %v", err)
+		return
+	}
+
+	wantMerkle := &Block100000.Header.MerkleRoot
+	for i, txHash := range txHashes {
+		branch := btcchain.MerkleBranch(txHashes, i)
+
+		// Hash the transaction up the tree with the branch.
+		var buf [btcwire.HashSize * 2]byte
+		hash := txHash
+		for level, sibling := range branch {
+			if i>>uint(level)&1 == 0 {
+				copy(buf[:btcwire.HashSize], hash.Bytes())
+				copy(buf[btcwire.HashSize:], sibling.Bytes())
+			} else {
+				copy(buf[:btcwire.HashSize], sibling.Bytes())
+				copy(buf[btcwire.HashSize:], hash.Bytes())
+			}
+			hash, _ = btcwire.NewShaHash(btcwire.DoubleSha256(buf[:]))
+		}
+		if !wantMerkle.IsEqual(hash) {
+			t.Errorf("MerkleBranch #%d: merkle root mismatch - "+
+				"got %v, want %v", i, hash, wantMerkle)
+		}
+	}
+
+	if branch := btcchain.MerkleBranch(txHashes, len(txHashes)); branch != nil {
+		t.Errorf("MerkleBranch: expected nil branch for out of range "+
+			"index - got %v", branch)
+	}
+}
+
+// TestPartialMerkleTree ensures NewPartialMerkleTree produces the expected
+// hashes and flags for a few simple sets of matches.
+func TestPartialMerkleTree(t *testing.T) {
+	block := btcutil.NewBlock(&Block100000, btcwire.ProtocolVersion)
+	txHashes, err := block.TxShas()
+	if err != nil {
+		t.Errorf("TxShas: %v", err)
+		return
+	}
+
+	// Nothing matched, so only the merkle root is needed.
+	tree := btcchain.NewPartialMerkleTree(txHashes, make([]bool, len(txHashes)))
+	if len(tree.Hashes) != 1 ||
+		!tree.Hashes[0].IsEqual(&Block100000.Header.MerkleRoot) {
+		t.Errorf("NewPartialMerkleTree: unexpected hashes for no "+
+			"matches - got %v", tree.Hashes)
+	}
+	if len(tree.Flags) != 1 || tree.Flags[0] != 0x00 {
+		t.Errorf("NewPartialMerkleTree: unexpected flags for no "+
+			"matches - got %x", tree.Flags)
+	}
+
+	// Everything matched, so every node is visited and all of the
+	// transaction hashes are needed.
+	matches := make([]bool, len(txHashes))
+	for i := range matches {
+		matches[i] = true
+	}
+	tree = btcchain.NewPartialMerkleTree(txHashes, matches)
+	if len(tree.Hashes) != len(txHashes) {
+		t.Errorf("NewPartialMerkleTree: unexpected number of hashes "+
+			"for all matches - got %d, want %d", len(tree.Hashes),
+			len(txHashes))
+	}
+	for i, hash := range tree.Hashes {
+		if i < len(txHashes) && !hash.IsEqual(txHashes[i]) {
+			t.Errorf("NewPartialMerkleTree: hash #%d mismatch - "+
+				"got %v, want %v", i, hash, txHashes[i])
+		}
+	}
+	if len(tree.Flags) != 1 || tree.Flags[0] != 0x7f {
+		t.Errorf("NewPartialMerkleTree: unexpected flags for all "+
+			"matches - got %x, want 7f", tree.Flags)
+	}
+	if tree.NumTransactions != uint32(len(txHashes)) {
+		t.Errorf("NewPartialMerkleTree: unexpected number of "+
+			"transactions - got %d, want %d", tree.NumTransactions,
+			len(txHashes))
+	}
 }
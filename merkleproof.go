@@ -0,0 +1,94 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// MerkleBranch returns the merkle branch which proves the transaction at the
+// passed index of the passed transaction hashes is committed to by their merkle
+// root.  The branch consists of the sibling hash at each level of the merkle
+// tree starting with the level of the transaction hashes.  The index of the
+// transaction determines which side each sibling is on: when bit n of the index
+// is set, the nth hash in the branch goes on the left.  It returns nil when the
+// index is out of range.
+func MerkleBranch(txHashes []*btcwire.ShaHash, txIndex int) []*btcwire.ShaHash {
+	if txIndex < 0 || txIndex >= len(txHashes) {
+		return nil
+	}
+
+	// Walk the levels of the merkle tree from the bottom up collecting the
+	// sibling of the node on the path from the transaction to the root.
+	// See BuildMerkleTreeStore for how the tree is laid out.  A node with
+	// no right sibling is hashed with itself, so it is its own sibling.
+	merkles := BuildMerkleTreeStoreFromHashes(txHashes)
+	branch := make([]*btcwire.ShaHash, 0)
+	levelOffset := 0
+	index := txIndex
+	for width := nextPowerOfTwo(len(txHashes)); width > 1; width /= 2 {
+		sibling := merkles[levelOffset+(index^1)]
+		if sibling == nil {
+			sibling = merkles[levelOffset+index]
+		}
+		branch = append(branch, sibling)
+
+		levelOffset += width
+		index /= 2
+	}
+
+	return branch
+}
+
+// MerkleProof houses the information needed to prove a transaction is included
+// in a block to clients which only have the block header, such as SPV clients.
+type MerkleProof struct {
+	// BlockHash is the hash of the block the transaction is in.
+	BlockHash *btcwire.ShaHash
+
+	// TxIndex is the position of the transaction within the block.
+	TxIndex int
+
+	// Branch is the merkle branch for the transaction as described by
+	// MerkleBranch.
+	Branch []*btcwire.ShaHash
+}
+
+// TxMerkleProof returns a merkle proof that the transaction identified by the
+// passed transaction hash is included in the main chain block identified by the
+// passed block hash.  An error is returned if the block is not in the main
+// chain or the transaction is not in the block.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) TxMerkleProof(blockHash, txHash *btcwire.ShaHash) (*MerkleProof, error) {
+	// Only main chain blocks are stored in the database.
+	b.chainLock.RLock()
+	block, err := b.db.FetchBlockBySha(blockHash)
+	b.chainLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	txHashes, err := block.TxShas()
+	if err != nil {
+		return nil, err
+	}
+	for i, hash := range txHashes {
+		if !hash.IsEqual(txHash) {
+			continue
+		}
+
+		proof := MerkleProof{
+			BlockHash: blockHash,
+			TxIndex:   i,
+			Branch:    MerkleBranch(txHashes, i),
+		}
+		return &proof, nil
+	}
+
+	return nil, fmt.Errorf("transaction %v is not in block %v", txHash,
+		blockHash)
+}
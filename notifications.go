@@ -6,6 +6,8 @@ package btcchain
 
 import (
 	"fmt"
+	"github.com/conformal/btcwire"
+	"math/big"
 )
 
 // NotificationType represents the type of a notification message.
@@ -13,9 +15,9 @@ type NotificationType int
 
 // Constants for the type of a notification message.
 const (
-	// NTOrphanBlock indicates an orphan block was processed and the
-	// associated block hash is the root of all known orphans which should
-	// be used to request the missing blocks.
+	// NTOrphanBlock indicates an orphan block was added to the orphan
+	// pool.  The associated data includes the hash of the missing ancestor
+	// which should be used to request the missing blocks.
 	NTOrphanBlock NotificationType = iota
 
 	// NTBlockAccepted indicates the associated block was accepted into
@@ -30,15 +32,71 @@ const (
 	// NTBlockDisconnected indicates the associated block was disconnected
 	// from the main chain.
 	NTBlockDisconnected
+
+	// NTUnknownVersion indicates that a significant portion of the most
+	// recent blocks in the main chain have a version which is newer than
+	// any this package knows about.  This typically means the network has
+	// been upgraded and the software should be updated.
+	NTUnknownVersion
+
+	// NTReorganization indicates the main chain was reorganized.  It is
+	// sent after all of the NTBlockDisconnected and NTBlockConnected
+	// notifications for the blocks involved and describes which
+	// transactions are no longer confirmed and which are newly confirmed
+	// as a result.
+	NTReorganization
+
+	// NTSignatureEncoding indicates the signatures in a block which was
+	// connected to the main chain were scanned for encodings which are not
+	// canonical.  It is only sent when enabled via
+	// EnableSignatureEncodingScan.
+	NTSignatureEncoding
+
+	// NTPreReorgWarning indicates a block was added to a side chain which
+	// does not have enough work to become the main chain yet, but would
+	// with one more block.  Services which act on confirmations may wish
+	// to pause until the fork resolves.
+	NTPreReorgWarning
+
+	// NTConsensusDivergence indicates the main chain has diverged from the
+	// chains of all of the sources which reported their tips via
+	// ObserveRemoteTip.  This typically means the local node is following
+	// a different set of consensus rules than the rest of the network.
+	NTConsensusDivergence
+
+	// NTBlockFinalized indicates a main chain block reached the
+	// confirmation depth set via SetFinalityDepth.  It is sent at most
+	// once per block.
+	NTBlockFinalized
+
+	// NTOrphanProcessed indicates a block which was an orphan was
+	// processed after its parent was accepted.  Since the orphans which
+	// depend on a block are processed along with it, this reports whether
+	// each of them was accepted as there is no caller to return it to.
+	NTOrphanProcessed
+
+	// NTReorgDepthExceeded indicates a side chain gained more work than
+	// the main chain, but was not switched to since the reorganization
+	// would be deeper than the limit set via SetMaxReorgDepth.  It calls
+	// for the attention of an operator.
+	NTReorgDepthExceeded
 )
 
 // notificationTypeStrings is a map of notification types back to their constant
 // names for pretty printing.
 var notificationTypeStrings = map[NotificationType]string{
-	NTOrphanBlock:       "NTOrphanBlock",
-	NTBlockAccepted:     "NTBlockAccepted",
-	NTBlockConnected:    "NTBlockConnected",
-	NTBlockDisconnected: "NTBlockDisconnected",
+	NTOrphanBlock:         "NTOrphanBlock",
+	NTBlockAccepted:       "NTBlockAccepted",
+	NTBlockConnected:      "NTBlockConnected",
+	NTBlockDisconnected:   "NTBlockDisconnected",
+	NTUnknownVersion:      "NTUnknownVersion",
+	NTReorganization:      "NTReorganization",
+	NTSignatureEncoding:   "NTSignatureEncoding",
+	NTPreReorgWarning:     "NTPreReorgWarning",
+	NTConsensusDivergence: "NTConsensusDivergence",
+	NTBlockFinalized:      "NTBlockFinalized",
+	NTOrphanProcessed:     "NTOrphanProcessed",
+	NTReorgDepthExceeded:  "NTReorgDepthExceeded",
 }
 
 // String returns the NotificationType in human-readable form.
@@ -53,13 +111,51 @@ func (n NotificationType) String() string {
 // over the notification channel provided during the call to New and consists
 // of a notification type as well as associated data that depends on the type as
 // follows:
-// 	- NTOrphanBlock:       *btcwire.ShaHash
-// 	- NTBlockAccepted:     *btcutil.Block
-// 	- NTBlockConnected:    *btcutil.Block
-// 	- NTBlockDisconnected: *btcutil.Block
+//   - NTOrphanBlock:         *OrphanNotification
+//   - NTBlockAccepted:       *btcutil.Block
+//   - NTBlockConnected:      *btcutil.Block
+//   - NTBlockDisconnected:   *btcutil.Block
+//   - NTUnknownVersion:      *UnknownVersionWarning
+//   - NTReorganization:      *ReorgTxDiff
+//   - NTSignatureEncoding:   *SignatureEncodingReport
+//   - NTPreReorgWarning:     *PreReorgWarning
+//   - NTConsensusDivergence: *ConsensusDivergence
+//   - NTBlockFinalized:      *FinalizedBlock
+//   - NTOrphanProcessed:     *OrphanResult
+//   - NTReorgDepthExceeded:  *ReorgDepthExceeded
+//
+// Notifications are sent while block processing is in progress, so the code
+// servicing the notification channel must not call any functions which wait
+// for block processing to complete, such as SupplyAtHeight, or it will
+// deadlock.  The read-only queries, such as RelayFeeFloor, do not wait and are
+// safe to call.
+//
+// Syncing is set when the chain was not current, as reported by IsCurrent, at
+// the time the notification was sent.  This allows the caller to, for example,
+// avoid relaying blocks while the chain is catching up.
 type Notification struct {
-	Type NotificationType
-	Data interface{}
+	Type    NotificationType
+	Data    interface{}
+	Syncing bool
+}
+
+// UnknownVersionWarning is the data sent with an NTUnknownVersion
+// notification.  It describes how many of the most recent blocks in the main
+// chain have a version which is newer than any this package knows about.
+type UnknownVersionWarning struct {
+	// Hash and Height identify the block which caused the warning.
+	Hash   *btcwire.ShaHash
+	Height int64
+
+	// NumUnknown is the number of blocks out of the NumChecked most recent
+	// blocks which have an unknown version.
+	NumUnknown uint64
+	NumChecked uint64
+
+	// Supermajority is set when enough blocks have an unknown version that
+	// new rules are very likely in effect as opposed to only a majority of
+	// the network running newer software.
+	Supermajority bool
 }
 
 // sendNotification sends a notification with the passed type and data if the
@@ -71,6 +167,63 @@ func (b *BlockChain) sendNotification(typ NotificationType, data interface{}) {
 	}
 
 	// Generate and send the notification.
-	n := Notification{Type: typ, Data: data}
+	n := Notification{Type: typ, Data: data, Syncing: !b.isCurrent()}
 	b.notifications <- &n
 }
+
+// TipUpdate describes the end of the main chain after it changed.  Syncing is
+// set when the chain was not current as reported by IsCurrent.  See TipChan for
+// details.
+type TipUpdate struct {
+	Hash    *btcwire.ShaHash
+	Height  int64
+	WorkSum *big.Int
+	Syncing bool
+}
+
+// TipChan returns a channel which is sent an update describing the new end of
+// the main chain each time it changes.  This is intended for consumers which
+// prefer to select on channels, such as long polling requests, as opposed to
+// servicing every notification.
+//
+// Updates are coalesced so the chain never blocks waiting on the consumer.  In
+// other words, when the consumer has not yet received a previous update by the
+// time the end of the main chain changes again, the stale update is discarded
+// in favor of the newer one.  Consequently, the most recent update is always
+// available on the returned channel, but not every intermediate update is
+// necessarily delivered.
+func (b *BlockChain) TipChan() <-chan TipUpdate {
+	return b.tipUpdates
+}
+
+// sendTipUpdate sends an update describing the current end of the main chain
+// to the channel returned by TipChan, replacing any update which has not been
+// received yet.
+func (b *BlockChain) sendTipUpdate() {
+	if b.bestChain == nil {
+		return
+	}
+
+	// A copy of the work sum is made since the work sums of nodes are
+	// updated in place when previous nodes are dynamically loaded.
+	update := TipUpdate{
+		Hash:    b.bestChain.hash,
+		Height:  b.bestChain.height,
+		WorkSum: new(big.Int).Set(b.bestChain.workSum),
+		Syncing: !b.isCurrent(),
+	}
+	for {
+		select {
+		case b.tipUpdates <- update:
+			return
+		default:
+		}
+
+		// Discard the stale update the consumer hasn't received yet
+		// to make room for the new one.
+		select {
+		case <-b.tipUpdates:
+		default:
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"sort"
+	"time"
+)
+
+// OrphanInfo describes a block in the orphan pool.  See Orphans.
+type OrphanInfo struct {
+	Hash     *btcwire.ShaHash
+	PrevHash *btcwire.ShaHash
+
+	// Received is the time the orphan was added to the orphan pool and
+	// Size is its serialized size in bytes.
+	Received time.Time
+	Size     int64
+}
+
+// OrphanNotification is the data sent with an NTOrphanBlock notification.  It
+// describes a block which was added to the orphan pool.
+type OrphanNotification struct {
+	Hash     *btcwire.ShaHash
+	PrevHash *btcwire.ShaHash
+
+	// MissingAncestor is the hash of the earliest ancestor of the orphan
+	// which is neither in the block chain nor the orphan pool.  It is the
+	// block to request, such as via a getblocks message with a locator for
+	// the main chain, in order for the orphan to be connected.  It is the
+	// same as PrevHash unless the parent is an orphan as well.  See
+	// GetOrphanRoot.
+	MissingAncestor *btcwire.ShaHash
+}
+
+// OrphanResult is the data sent with an NTOrphanProcessed notification.  It
+// describes the result of processing a block which was an orphan until its
+// parent was accepted.
+type OrphanResult struct {
+	Hash *btcwire.ShaHash
+
+	// IsMainChain is set when the block was added to the main chain as
+	// opposed to a side chain.
+	IsMainChain bool
+
+	// Err is the RuleError the block was rejected with, or nil when it
+	// was accepted.  A block is rejected with ErrInvalidAncestorBlock when
+	// it builds on a rejected orphan.
+	Err error
+}
+
+// orphanInfoSorter implements sort.Interface to allow a slice of orphan info
+// to be sorted by the time the orphans were received.
+type orphanInfoSorter []OrphanInfo
+
+// Len returns the number of orphans in the slice.  It is part of the
+// sort.Interface implementation.
+func (s orphanInfoSorter) Len() int {
+	return len(s)
+}
+
+// Swap swaps the orphans at the passed indices.  It is part of the
+// sort.Interface implementation.
+func (s orphanInfoSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Less returns whether the orphan with index i was received before the orphan
+// with index j.  It is part of the sort.Interface implementation.
+func (s orphanInfoSorter) Less(i, j int) bool {
+	return s[i].Received.Before(s[j].Received)
+}
+
+// discardOrphanDescendants removes all of the orphans which build on the passed
+// rejected block from the orphan pool since they can never be valid.  An
+// NTOrphanProcessed notification is sent for each of them.
+func (b *BlockChain) discardOrphanDescendants(hash *btcwire.ShaHash) {
+	discardHashes := []*btcwire.ShaHash{hash}
+	for len(discardHashes) > 0 {
+		discardHash := discardHashes[0]
+		discardHashes[0] = nil
+		discardHashes = discardHashes[1:]
+
+		// A copy of the orphans is iterated since removing them
+		// modifies the slice in the previous orphan index.
+		orphans := make([]*orphanBlock, len(b.prevOrphans[*discardHash]))
+		copy(orphans, b.prevOrphans[*discardHash])
+		for _, orphan := range orphans {
+			orphanHash, _ := orphan.block.Sha()
+			b.removeOrphanBlock(orphan)
+
+			str := fmt.Sprintf("orphan block %v builds on rejected "+
+				"block %v", orphanHash, hash)
+			log.Debugf("Discarding %s", str)
+			ruleErr := ruleError(ErrInvalidAncestorBlock, str)
+			b.markBlockInvalid(orphanHash, discardHash, ruleErr)
+			b.sendNotification(NTOrphanProcessed, &OrphanResult{
+				Hash: orphanHash,
+				Err:  ruleErr,
+			})
+			discardHashes = append(discardHashes, orphanHash)
+		}
+	}
+}
+
+// checkOrphanDifficulty ensures the difficulty claimed by the passed orphan
+// block header is plausible when compared to the end of the main chain.  Since
+// the parent of an orphan is unknown, its required difficulty can't be
+// calculated, so without this check only the proof of work limit and the
+// latest checkpoint bound the work needed to create orphans.  Creating lots of
+// orphans could otherwise be cheap long after the checkpoint, once the
+// difficulty has risen far above its value as of it.
+//
+// The claimed difficulty must be at least the easiest one the retarget rules
+// allow given the difficulty of the end of the main chain and the time elapsed
+// since.  Unlike the checkpoint, the end of the main chain is not final, so a
+// block on a valid chain which forked from it long ago and has not caught up
+// yet can fail the check.  For this reason, a ResourceError is returned rather
+// than a RuleError, so the block is not held as an orphan without the block or
+// its source being considered invalid.
+func (b *BlockChain) checkOrphanDifficulty(header *btcwire.BlockHeader, blockHash *btcwire.ShaHash) error {
+	if b.bestChain == nil {
+		return nil
+	}
+
+	duration := header.Timestamp.Sub(b.bestChain.timestamp)
+	requiredTarget := CompactToBig(b.calcEasiestDifficulty(
+		b.bestChain.bits, duration))
+	currentTarget := CompactToBig(header.Bits)
+	if currentTarget.Cmp(requiredTarget) > 0 {
+		str := fmt.Sprintf("orphan block %v target difficulty of %064x "+
+			"is too low when compared to the end of the main chain "+
+			"to hold it until its parent is known", blockHash,
+			currentTarget)
+		return ResourceError(str)
+	}
+
+	return nil
+}
+
+// GetOrphanRoot returns the hash of the earliest missing ancestor of the passed
+// orphan block, which is found by following the previous block hashes of the
+// orphan pool until reaching a block which is not an orphan.  It is the block
+// that needs to be requested, such as via a getblocks message, in order for the
+// orphan and all of the other orphans between them to be connected.  The passed
+// hash itself is returned when it is not an orphan.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) GetOrphanRoot(hash *btcwire.ShaHash) *btcwire.ShaHash {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	return b.getOrphanRoot(hash)
+}
+
+// IsKnownOrphan returns whether the passed hash is currently a known orphan.
+// Keep in mind that only a limited number of orphans are held onto for a
+// limited amount of time, so this function must not be used as an absolute way
+// to test if a block is an orphan block.  A full block (as opposed to just its
+// hash) must be passed to ProcessBlock for that purpose.  However, calling
+// ProcessBlock with an orphan that already exists results in an error, so this
+// function provides a mechanism for a caller to intelligently detect *recent*
+// duplicate orphans and react accordingly.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) IsKnownOrphan(hash *btcwire.ShaHash) bool {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	_, exists := b.orphans[*hash]
+	return exists
+}
+
+// HaveBlock returns whether or not the chain instance has the block represented
+// by the passed hash in some form, which includes blocks in the main chain, on
+// side chains, and in the orphan pool.  Callers handling block inventory can
+// use it to avoid requesting blocks they already have.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) HaveBlock(hash *btcwire.ShaHash) bool {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if _, exists := b.orphans[*hash]; exists {
+		return true
+	}
+	return b.blockExists(hash)
+}
+
+// Orphans returns information about the blocks which are currently in the
+// orphan pool ordered from the oldest to the most recently received.  It is
+// intended for diagnosing why the chain is not making progress, such as an
+// ever growing number of orphans waiting on the same missing ancestor.  See
+// GetOrphanRoot.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) Orphans() []OrphanInfo {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	orphans := make([]OrphanInfo, 0, len(b.orphans))
+	for hash, oBlock := range b.orphans {
+		hash := hash
+		prevHash := oBlock.block.MsgBlock().Header.PrevBlock
+		orphans = append(orphans, OrphanInfo{
+			Hash:     &hash,
+			PrevHash: &prevHash,
+			Received: oBlock.received,
+			Size:     oBlock.size,
+		})
+	}
+	sort.Sort(orphanInfoSorter(orphans))
+	return orphans
+}
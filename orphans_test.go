@@ -0,0 +1,184 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// processOrphans processes the passed blocks in order and fails the test when
+// any of them is not accepted as an orphan.
+func processOrphans(t *testing.T, chain *btcchain.BlockChain, blocks []*btcutil.Block) {
+	for _, block := range blocks {
+		_, isOrphan, err := chain.ProcessBlock(block)
+		if err != nil {
+			t.Fatalf("ProcessBlock (%v): unexpected error %v",
+				blockHash(block), err)
+		}
+		if !isOrphan {
+			t.Fatalf("ProcessBlock (%v): expected orphan",
+				blockHash(block))
+		}
+	}
+}
+
+// TestGetOrphanRoot ensures GetOrphanRoot follows the orphan pool back to the
+// earliest missing ancestor of an orphan and returns the passed hash for blocks
+// which are not orphans.
+func TestGetOrphanRoot(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "orphanstest1", &params, nil)
+	defer teardown()
+
+	// The main chain is a1 <- a2 and a4 <- a5 are orphans since a3 is
+	// missing.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 5)
+	processBlocks(t, chain, blocks[:2])
+	processOrphans(t, chain, blocks[3:])
+	unknown := &btcwire.ShaHash{0x01}
+
+	tests := []struct {
+		name string
+		hash *btcwire.ShaHash
+		want *btcwire.ShaHash
+	}{
+		{"orphan with a missing parent", blockHash(blocks[3]),
+			blockHash(blocks[2])},
+		{"orphan with an orphan parent", blockHash(blocks[4]),
+			blockHash(blocks[2])},
+		{"main chain block", blockHash(blocks[1]), blockHash(blocks[1])},
+		{"missing block", blockHash(blocks[2]), blockHash(blocks[2])},
+		{"unknown block", unknown, unknown},
+	}
+
+	for i, test := range tests {
+		got := chain.GetOrphanRoot(test.hash)
+		if !got.IsEqual(test.want) {
+			t.Errorf("GetOrphanRoot #%d (%s): got %v, want %v", i,
+				test.name, got, test.want)
+		}
+	}
+
+	// The orphans are connected once the missing block is processed.
+	processBlocks(t, chain, blocks[2:3])
+	checkBestBlock(t, "GetOrphanRoot", chain, blocks[4])
+	got := chain.GetOrphanRoot(blockHash(blocks[4]))
+	if !got.IsEqual(blockHash(blocks[4])) {
+		t.Errorf("GetOrphanRoot (connected): got %v, want %v", got,
+			blockHash(blocks[4]))
+	}
+}
+
+// TestHaveBlock ensures IsKnownOrphan only reports blocks in the orphan pool
+// while HaveBlock reports blocks in the main chain, on side chains, and in the
+// orphan pool.
+func TestHaveBlock(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "orphanstest2", &params, nil)
+	defer teardown()
+
+	// The main chain is a1 <- a2, b2 is a side chain block which forks from
+	// a1, and a4 is an orphan since a3 is missing.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 4)
+	sideBlock := g.nextBlock(blocks[0])
+	processBlocks(t, chain, blocks[:2])
+	processBlocks(t, chain, []*btcutil.Block{sideBlock})
+	processOrphans(t, chain, blocks[3:])
+
+	tests := []struct {
+		name       string
+		hash       *btcwire.ShaHash
+		wantOrphan bool
+		wantHave   bool
+	}{
+		{"genesis block", params.GenesisHash, false, true},
+		{"main chain block", blockHash(blocks[1]), false, true},
+		{"side chain block", blockHash(sideBlock), false, true},
+		{"orphan", blockHash(blocks[3]), true, true},
+		{"missing block", blockHash(blocks[2]), false, false},
+		{"unknown block", &btcwire.ShaHash{0x01}, false, false},
+	}
+
+	for i, test := range tests {
+		if got := chain.IsKnownOrphan(test.hash); got != test.wantOrphan {
+			t.Errorf("IsKnownOrphan #%d (%s): got %v, want %v", i,
+				test.name, got, test.wantOrphan)
+		}
+		if got := chain.HaveBlock(test.hash); got != test.wantHave {
+			t.Errorf("HaveBlock #%d (%s): got %v, want %v", i,
+				test.name, got, test.wantHave)
+		}
+	}
+}
+
+// TestOrphans ensures Orphans describes the blocks in the orphan pool in the
+// order they were received.  The tests are run in order against the same
+// chain.
+func TestOrphans(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "orphanstest3", &params, nil)
+	defer teardown()
+
+	// The main chain is a1 and the rest of the blocks are orphans until a2
+	// is processed.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 4)
+	processBlocks(t, chain, blocks[:1])
+
+	tests := []struct {
+		name    string
+		process []*btcutil.Block
+		want    []*btcutil.Block
+	}{
+		{"no orphans", nil, nil},
+		{"orphan with a missing parent", blocks[3:], blocks[3:]},
+		{"parent of an orphan", blocks[2:3],
+			[]*btcutil.Block{blocks[3], blocks[2]}},
+		{"connected orphans", blocks[1:2], nil},
+	}
+
+	for i, test := range tests {
+		for _, block := range test.process {
+			_, _, err := chain.ProcessBlock(block)
+			if err != nil {
+				t.Fatalf("ProcessBlock #%d (%s): unexpected "+
+					"error %v", i, test.name, err)
+			}
+		}
+
+		orphans := chain.Orphans()
+		if len(orphans) != len(test.want) {
+			t.Errorf("Orphans #%d (%s): got %d orphans, want %d", i,
+				test.name, len(orphans), len(test.want))
+			continue
+		}
+		for j, orphan := range orphans {
+			want := test.want[j]
+			serialized, _ := want.Bytes()
+			prevHash := &want.MsgBlock().Header.PrevBlock
+			if !orphan.Hash.IsEqual(blockHash(want)) ||
+				!orphan.PrevHash.IsEqual(prevHash) ||
+				orphan.Size != int64(len(serialized)) {
+
+				t.Errorf("Orphans #%d (%s): got %v (previous %v, "+
+					"size %d) at index %d, want %v (previous "+
+					"%v, size %d)", i, test.name, orphan.Hash,
+					orphan.PrevHash, orphan.Size, j,
+					blockHash(want), prevHash,
+					len(serialized))
+			}
+			if j > 0 && orphan.Received.Before(orphans[j-1].Received) {
+				t.Errorf("Orphans #%d (%s): orphan %d was received "+
+					"before the one before it", i, test.name, j)
+			}
+		}
+	}
+	checkBestBlock(t, "Orphans", chain, blocks[3])
+}
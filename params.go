@@ -0,0 +1,310 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"math"
+	"math/big"
+	"time"
+)
+
+var (
+	// mainPowLimit is the highest proof of work value a block can have for
+	// the main network.  It is the value 2^224 - 1.
+	mainPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 224), bigOne)
+
+	// regressionPowLimit is the highest proof of work value a block can
+	// have for the regression test network.  It is the value 2^255 - 1,
+	// which nearly every hash satisfies.
+	regressionPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 255), bigOne)
+)
+
+// ConsensusDeployment defines the bit a deployment signaled for via version
+// bits uses along with the range of median times past during which it may be
+// signaled for as defined by BIP0009.
+type ConsensusDeployment struct {
+	// BitNumber is the bit of the block version which signals for the
+	// deployment.
+	BitNumber uint8
+
+	// StartTime is the median time past, in seconds since the unix epoch,
+	// after which the deployment may be signaled for.
+	StartTime int64
+
+	// ExpireTime is the median time past, in seconds since the unix epoch,
+	// after which the deployment fails if it has not locked in.
+	ExpireTime int64
+}
+
+// Params defines the parameters of a network which determine the consensus
+// rules the block chain enforces.  The parameters for the standard networks
+// are provided by MainNetParams and TestNet3Params, however callers may define
+// their own in order to use this package for other networks.
+type Params struct {
+	// Name is a human-readable identifier for the network.
+	Name string
+
+	// Net is the magic bytes which identify the network.
+	Net btcwire.BitcoinNet
+
+	// GenesisBlock and GenesisHash are the first block of the block chain
+	// and its hash.
+	GenesisBlock *btcwire.MsgBlock
+	GenesisHash  *btcwire.ShaHash
+
+	// PowLimit is the highest proof of work value a block can have.
+	PowLimit *big.Int
+
+	// BaseSubsidy is the starting subsidy amount for mined blocks in
+	// satoshi and SubsidyHalvingInterval is the interval of blocks at
+	// which it is halved.  A halving interval of zero means the subsidy is
+	// never halved.
+	BaseSubsidy            int64
+	SubsidyHalvingInterval int64
+
+	// SubsidyFunc, when set, returns the subsidy for the block at the
+	// passed height in place of the halving schedule defined by the above
+	// fields.  It allows networks with other subsidy schedules to use
+	// this package.  See CalcBlockSubsidy.
+	SubsidyFunc func(height int64) int64
+
+	// CoinbaseMaturity is the number of blocks required before newly mined
+	// coins can be spent.
+	CoinbaseMaturity int64
+
+	// TargetTimespan is the desired amount of time that should elapse
+	// before the block difficulty requirement is examined to determine
+	// how it should be changed in order to maintain the desired block
+	// generation rate.
+	TargetTimespan time.Duration
+
+	// TargetTimePerBlock is the desired amount of time to generate each
+	// block.
+	TargetTimePerBlock time.Duration
+
+	// RetargetAdjustmentFactor is the adjustment factor used to limit the
+	// minimum and maximum amount of adjustment that can occur between
+	// difficulty retargets.
+	RetargetAdjustmentFactor int64
+
+	// PowNoRetargeting disables difficulty retargeting, so every block
+	// must have the same difficulty as the genesis block.
+	PowNoRetargeting bool
+
+	// Retargeter is the difficulty retarget algorithm of the network.  The
+	// algorithm of bitcoin, which uses the above retarget parameters, is
+	// used when it is nil.  See NewBitcoinRetargeter.
+	Retargeter Retargeter
+
+	// MaxBlockWeight is the maximum weight a block is allowed to have and
+	// MaxBlockSigOps is the maximum number of signature operations it
+	// may contain.  See BlockWeight and CountSigOps.
+	MaxBlockWeight int64
+	MaxBlockSigOps int
+
+	// MinimumChainWork is the cumulative work the main chain must have
+	// before the chain is considered current.  It is typically the work of
+	// the main chain of the network at the time of a release so a chain
+	// with less work is known to either be incomplete or fake.  No
+	// minimum is enforced when it is nil.  See IsCurrent.
+	MinimumChainWork *big.Int
+
+	// Checkpoints are the known good blocks of the block chain ordered
+	// from oldest to newest.  See Checkpoint.
+	Checkpoints []Checkpoint
+
+	// These fields define the number of blocks out of the most recent
+	// BlockUpgradeNumToCheck blocks which must have a new block version
+	// for the rules which come with it to be enforced and for older
+	// versions to be rejected.  This applies to the soft forks defined by
+	// BIP0034, BIP0065, and BIP0066.
+	BlockEnforceNumRequired uint64
+	BlockRejectNumRequired  uint64
+	BlockUpgradeNumToCheck  uint64
+
+	// BIP0034Height and BIP0034Hash identify the first block which was
+	// required to have the serialized block height in its coinbase.  The
+	// rule is enforced for all blocks after it regardless of the versions
+	// of the blocks before them.  A height of zero means there is no such
+	// block, so the rule only applies based on the block versions.
+	BIP0034Height int64
+	BIP0034Hash   *btcwire.ShaHash
+
+	// CSVHeight is the height of the first block for which the relative
+	// lock time rules defined by BIP0068, BIP0112, and BIP0113 are
+	// enforced.  A height of zero means they are enforced once the
+	// DeploymentCSV deployment is active via version bits instead.
+	CSVHeight int64
+
+	// RuleChangeActivationThreshold is the number of blocks in a retarget
+	// interval which must signal for a deployment for it to lock in as
+	// defined by BIP0009.
+	RuleChangeActivationThreshold int64
+
+	// Deployments are the deployments signaled for via version bits
+	// indexed by the deployment constants such as DeploymentCSV.
+	Deployments [numDeployments]ConsensusDeployment
+}
+
+// MainNetParams defines the parameters for the main network.
+var MainNetParams = Params{
+	Name:                     "mainnet",
+	Net:                      btcwire.MainNet,
+	GenesisBlock:             &btcwire.GenesisBlock,
+	GenesisHash:              &btcwire.GenesisHash,
+	PowLimit:                 mainPowLimit,
+	BaseSubsidy:              50 * satoshiPerBitcoin,
+	SubsidyHalvingInterval:   210000,
+	CoinbaseMaturity:         100,
+	TargetTimespan:           time.Hour * 24 * 14,
+	TargetTimePerBlock:       time.Minute * 10,
+	RetargetAdjustmentFactor: 4,
+	MaxBlockWeight:           MaxBlockWeight,
+	MaxBlockSigOps:           maxSigOpsPerBlock,
+	Checkpoints:              mainNetCheckpoints,
+
+	// 75% to enforce and 95% to reject.
+	BlockEnforceNumRequired: 750,
+	BlockRejectNumRequired:  950,
+	BlockUpgradeNumToCheck:  1000,
+
+	BIP0034Height: 227931,
+	BIP0034Hash: newShaHashFromStr("000000000000024b89b42a942fe0d9fe" +
+		"a3bb44ab7bd1b19115dd6a759c0808b8"),
+	CSVHeight: 419328,
+
+	// 95% of the blocks in a retarget interval.
+	RuleChangeActivationThreshold: 1916,
+	Deployments: [numDeployments]ConsensusDeployment{
+		DeploymentCSV: {0, 1462060800, 1493596800},
+	},
+}
+
+// TestNet3Params defines the parameters for the test network (version 3).
+var TestNet3Params = Params{
+	Name:                     "testnet3",
+	Net:                      btcwire.TestNet3,
+	GenesisBlock:             &btcwire.TestNet3GenesisBlock,
+	GenesisHash:              &btcwire.TestNet3GenesisHash,
+	PowLimit:                 mainPowLimit,
+	BaseSubsidy:              50 * satoshiPerBitcoin,
+	SubsidyHalvingInterval:   210000,
+	CoinbaseMaturity:         100,
+	TargetTimespan:           time.Hour * 24 * 14,
+	TargetTimePerBlock:       time.Minute * 10,
+	RetargetAdjustmentFactor: 4,
+	MaxBlockWeight:           MaxBlockWeight,
+	MaxBlockSigOps:           maxSigOpsPerBlock,
+	Checkpoints:              testNet3Checkpoints,
+
+	// 51% to enforce and 75% to reject.
+	BlockEnforceNumRequired: 51,
+	BlockRejectNumRequired:  75,
+	BlockUpgradeNumToCheck:  100,
+
+	BIP0034Height: 21111,
+	BIP0034Hash: newShaHashFromStr("0000000023b3a96d3484e5abb3755c41" +
+		"3e7d41500f8e2a5c3f0dd01299cd8ef8"),
+	CSVHeight: 770112,
+
+	// 75% of the blocks in a retarget interval.
+	RuleChangeActivationThreshold: 1512,
+	Deployments: [numDeployments]ConsensusDeployment{
+		DeploymentCSV: {0, 1456790400, 1493596800},
+	},
+}
+
+// RegressionNetParams defines the parameters for the regression test network.
+// It is intended for instant local block generation by integration tests, so
+// the difficulty never retargets from the trivial proof of work of its genesis
+// block, coinbases mature after a single block, and the subsidy halves every
+// 150 blocks.  Version bits deployments may be signaled for at any time and
+// there are no checkpoints.  Not to be confused with the test network (version
+// 3), which is a public network.
+var RegressionNetParams = Params{
+	Name:                     "regtest",
+	Net:                      btcwire.TestNet,
+	GenesisBlock:             &btcwire.TestNetGenesisBlock,
+	GenesisHash:              &btcwire.TestNetGenesisHash,
+	PowLimit:                 regressionPowLimit,
+	BaseSubsidy:              50 * satoshiPerBitcoin,
+	SubsidyHalvingInterval:   150,
+	CoinbaseMaturity:         1,
+	TargetTimespan:           time.Hour * 24 * 14,
+	TargetTimePerBlock:       time.Minute * 10,
+	RetargetAdjustmentFactor: 4,
+	PowNoRetargeting:         true,
+	MaxBlockWeight:           MaxBlockWeight,
+	MaxBlockSigOps:           maxSigOpsPerBlock,
+	Checkpoints:              nil,
+
+	// 51% to enforce and 75% to reject.
+	BlockEnforceNumRequired: 51,
+	BlockRejectNumRequired:  75,
+	BlockUpgradeNumToCheck:  100,
+
+	// BIP0034 and the relative lock time rules only apply based on block
+	// versions and version bits respectively.
+	BIP0034Height: 0,
+	BIP0034Hash:   nil,
+	CSVHeight:     0,
+
+	// 75% of the blocks in a retarget interval.
+	RuleChangeActivationThreshold: 1512,
+	Deployments: [numDeployments]ConsensusDeployment{
+		DeploymentCSV: {0, 0, math.MaxInt64},
+	},
+}
+
+// Params returns the network parameters the block chain was created with.  The
+// returned parameters must not be modified.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) Params() *Params {
+	return b.chainParams
+}
+
+// validate returns an error when the parameters are missing a field the block
+// chain can't operate without or have a value which would make the consensus
+// calculations, such as the number of blocks per retarget interval, divide by
+// zero.
+func (p *Params) validate() error {
+	switch {
+	case p.GenesisBlock == nil || p.GenesisHash == nil:
+		return fmt.Errorf("the genesis block of network %s is not set",
+			p.Name)
+
+	case p.PowLimit == nil || p.PowLimit.Sign() <= 0:
+		return fmt.Errorf("the proof of work limit of network %s must "+
+			"be positive", p.Name)
+
+	case p.BaseSubsidy <= 0 && p.SubsidyFunc == nil:
+		return fmt.Errorf("the base subsidy of network %s must be "+
+			"positive", p.Name)
+
+	case p.TargetTimePerBlock <= 0:
+		return fmt.Errorf("the target time per block of network %s "+
+			"must be positive", p.Name)
+
+	case p.TargetTimespan < p.TargetTimePerBlock:
+		return fmt.Errorf("the target timespan of network %s must be "+
+			"at least the target time per block", p.Name)
+
+	case p.RetargetAdjustmentFactor <= 0 && p.Retargeter == nil:
+		return fmt.Errorf("the retarget adjustment factor of network "+
+			"%s must be positive", p.Name)
+
+	case p.MaxBlockWeight <= 0:
+		return fmt.Errorf("the max block weight of network %s must be "+
+			"positive", p.Name)
+
+	case p.MaxBlockSigOps <= 0:
+		return fmt.Errorf("the max signature operations per block of "+
+			"network %s must be positive", p.Name)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"testing"
+)
+
+// TestInvalidParams ensures chain parameters which would break the consensus
+// calculations are rejected when creating a chain.
+func TestInvalidParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(params *btcchain.Params)
+	}{
+		{
+			name: "zero max block weight",
+			modify: func(params *btcchain.Params) {
+				params.MaxBlockWeight = 0
+			},
+		},
+		{
+			name: "zero base subsidy",
+			modify: func(params *btcchain.Params) {
+				params.BaseSubsidy = 0
+			},
+		},
+		{
+			name: "zero target time per block",
+			modify: func(params *btcchain.Params) {
+				params.TargetTimePerBlock = 0
+			},
+		},
+		{
+			name: "no genesis block",
+			modify: func(params *btcchain.Params) {
+				params.GenesisBlock = nil
+			},
+		},
+	}
+
+	for i, test := range tests {
+		params := btcchain.MainNetParams
+		test.modify(&params)
+		_, err := btcchain.New(nil, &params, nil)
+		if err == nil {
+			t.Errorf("New #%d (%s): expected error", i, test.name)
+		}
+		_, err = btcchain.NewWithCustomCheckpoints(nil, &params, nil, nil)
+		if err == nil {
+			t.Errorf("NewWithCustomCheckpoints #%d (%s): expected error",
+				i, test.name)
+		}
+	}
+
+	// The parameters of the standard networks must all be usable.
+	for _, params := range []*btcchain.Params{&btcchain.MainNetParams,
+		&btcchain.TestNet3Params, &btcchain.RegressionNetParams} {
+
+		_, err := btcchain.NewWithCustomCheckpoints(nil, params, nil, nil)
+		if err != nil {
+			t.Errorf("NewWithCustomCheckpoints (%s): unexpected error %v",
+				params.Name, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// PreReorgWarning is the data sent with an NTPreReorgWarning notification.  It
+// identifies a side chain which would cause the main chain to be reorganized if
+// one more block extending it were to be accepted.
+type PreReorgWarning struct {
+	// ForkHash and ForkHeight identify the main chain block the side chain
+	// branches from.
+	ForkHash   *btcwire.ShaHash
+	ForkHeight int64
+
+	// SideTip and SideHeight identify the end of the side chain.
+	SideTip    *btcwire.ShaHash
+	SideHeight int64
+
+	// MainTip and MainHeight identify the end of the main chain.
+	MainTip    *btcwire.ShaHash
+	MainHeight int64
+}
+
+// warnPendingReorg sends an NTPreReorgWarning notification when the passed
+// node, which was just added to a side chain without enough work to become the
+// main chain, is close enough that the next block extending it would.  The
+// work of the next block is assumed to be the same as the work of the node
+// since the difficulty rarely changes from one block to the next.
+func (b *BlockChain) warnPendingReorg(node *blockNode) {
+	nextWorkSum := new(big.Int).Add(node.workSum, CalcWork(node.bits))
+	if nextWorkSum.Cmp(b.bestChain.workSum) <= 0 {
+		return
+	}
+
+	// The fork point is the parent of the first node which would be
+	// attached to the main chain.
+	_, attachNodes := b.getReorganizeNodes(node)
+	if attachNodes.Len() == 0 {
+		return
+	}
+	forkNode := attachNodes.Front().Value.(*blockNode).parent
+	if forkNode == nil {
+		return
+	}
+
+	log.Infof("Side chain block %v (height %d) is one block away from "+
+		"reorganizing the main chain at fork point %v", node.hash,
+		node.height, forkNode.hash)
+	warning := PreReorgWarning{
+		ForkHash:   forkNode.hash,
+		ForkHeight: forkNode.height,
+		SideTip:    node.hash,
+		SideHeight: node.height,
+		MainTip:    b.bestChain.hash,
+		MainHeight: b.bestChain.height,
+	}
+	b.sendNotification(NTPreReorgWarning, &warning)
+}
@@ -10,15 +10,105 @@ import (
 	"github.com/conformal/btcwire"
 )
 
-// RuleError identifies a rule violation.  It is used to indicate that
-// processing of a block or transaction failed due to one of the many validation
-// rules.  The caller can use type assertions to determine if a failure was
-// specifically due to a rule violation.
-type RuleError string
+// BehaviorFlags is a bitmask defining tweaks to the normal behavior when
+// performing chain processing and consensus rules checks.
+type BehaviorFlags uint32
+
+const (
+	// BFNoPoWCheck may be set to indicate the proof of work check which
+	// ensures a block hashes to a value less than the required target will
+	// not be performed.
+	BFNoPoWCheck BehaviorFlags = 1 << iota
+
+	// BFNone is a convenience value to specifically indicate no flags.
+	BFNone BehaviorFlags = 0
+)
+
+// DatabaseError identifies a failure of the backing database while processing
+// a block.  It says nothing about the validity of the block, so the block may
+// be processed again once the database issue is resolved.
+type DatabaseError struct {
+	Err error
+
+	// context describes what was being processed when the error occurred.
+	// See contextError.
+	context string
+}
+
+// Error satisfies the error interface to print human-readable errors.
+func (e DatabaseError) Error() string {
+	return fmt.Sprintf("%sdatabase error: %v", e.context, e.Err)
+}
+
+// dbError wraps the passed error returned by the backing database in a
+// DatabaseError.  It returns nil for a nil error.
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(DatabaseError); ok {
+		return err
+	}
+	return DatabaseError{Err: err}
+}
+
+// DeserializationError identifies a block or transaction which could not be
+// serialized or deserialized, such as when calculating its hash.  It typically
+// means the data is malformed rather than that it violates a rule.
+type DeserializationError struct {
+	Err error
+
+	// context describes what was being processed when the error occurred.
+	// See contextError.
+	context string
+}
 
 // Error satisfies the error interface to print human-readable errors.
-func (e RuleError) Error() string {
-	return string(e)
+func (e DeserializationError) Error() string {
+	return fmt.Sprintf("%sdeserialization error: %v", e.context, e.Err)
+}
+
+// deserializationError wraps the passed error returned from serializing or
+// deserializing data in a DeserializationError.  It returns nil for a nil
+// error.
+func deserializationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(DeserializationError); ok {
+		return err
+	}
+	return DeserializationError{Err: err}
+}
+
+// claimedHeight returns the height claimed by the passed block, which is one
+// more than the previous block it references, or -1 if that block is not
+// known.
+func (b *BlockChain) claimedHeight(block *btcutil.Block) int64 {
+	prevHash := &block.MsgBlock().Header.PrevBlock
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	if prevNode, ok := b.index[*prevHash]; ok {
+		return prevNode.height + 1
+	}
+	if prevNode, ok := b.headerIndex[*prevHash]; ok {
+		return prevNode.height + 1
+	}
+	return -1
+}
+
+// blockError returns the passed error with the hash and claimed height of the
+// passed block added as context.  See contextError.
+func (b *BlockChain) blockError(err error, block *btcutil.Block) error {
+	if err == nil {
+		return nil
+	}
+	blockHash, shaErr := block.Sha()
+	if shaErr != nil {
+		return err
+	}
+	return contextError(err, blockContext(blockHash, b.claimedHeight(block)))
 }
 
 // blockExists determines whether a block with the given hash exists either in
@@ -36,20 +126,41 @@ func (b *BlockChain) blockExists(hash *btcwire.ShaHash) bool {
 // processOrphans determines if there are any orphans which depend on the passed
 // block hash (they are no longer orphans if true) and potentially accepts them.
 // It repeats the process for the newly accepted blocks (to detect further
-// orphans which may no longer be orphans) until there are no more.
+// orphans which may no longer be orphans) until there are no more.  The blocks
+// to process are kept in a queue as opposed to recursing so long chains of
+// orphans, which are common when catching up after downtime, don't grow the
+// stack.
+//
+// The result of each orphan is sent as an NTOrphanProcessed notification.  An
+// orphan which violates the rules is discarded along with the orphans which
+// build on it without affecting the others, so only errors which don't say
+// anything about the validity of the orphans, such as a DatabaseError, are
+// returned.
 func (b *BlockChain) processOrphans(hash *btcwire.ShaHash) error {
 	processHashes := []*btcwire.ShaHash{hash}
 	for len(processHashes) > 0 {
 		// Pop the first hash to process from the slice.
 		processHash := processHashes[0]
+		processHashes[0] = nil
 		processHashes = processHashes[1:]
 
 		// Look up all orphans that are parented by the block we just
 		// accepted.  This will typically only be one, but it could
 		// be multiple if multiple blocks are mined and broadcast
 		// around the same time.  The one with the most proof of work
-		// will eventually win out.
-		for _, orphan := range b.prevOrphans[*processHash] {
+		// will eventually win out.  A copy of the orphans is iterated
+		// since removing them modifies the slice in the previous orphan
+		// index.
+		orphans := make([]*orphanBlock, len(b.prevOrphans[*processHash]))
+		copy(orphans, b.prevOrphans[*processHash])
+		for _, orphan := range orphans {
+			// Stop processing orphans when interrupted.  The
+			// remaining ones stay in the orphan pool until they
+			// expire.
+			if b.interruptRequested() {
+				return ErrInterrupted
+			}
+
 			// Remove the orphan from the orphan pool.
 			// It's safe to ignore the error on Sha since the hash
 			// is already cached.
@@ -57,10 +168,24 @@ func (b *BlockChain) processOrphans(hash *btcwire.ShaHash) error {
 			b.removeOrphanBlock(orphan)
 
 			// Potentially accept the block into the block chain.
-			err := b.maybeAcceptBlock(orphan.block)
+			isMainChain, err := b.maybeAcceptBlock(orphan.block)
+			if ruleErr, ok := err.(RuleError); ok {
+				b.markBlockInvalid(orphanHash, processHash, ruleErr)
+				b.recordRejectedBlock(orphan.block, "", ruleErr)
+				b.sendNotification(NTOrphanProcessed, &OrphanResult{
+					Hash: orphanHash,
+					Err:  b.blockError(err, orphan.block),
+				})
+				b.discardOrphanDescendants(orphanHash)
+				continue
+			}
 			if err != nil {
-				return err
+				return b.blockError(err, orphan.block)
 			}
+			b.sendNotification(NTOrphanProcessed, &OrphanResult{
+				Hash:        orphanHash,
+				IsMainChain: isMainChain,
+			})
 
 			// Add this block to the list of blocks to process so
 			// any orphan blocks that depend on this block are
@@ -75,91 +200,149 @@ func (b *BlockChain) processOrphans(hash *btcwire.ShaHash) error {
 // the block chain.  It includes functionality such as rejecting duplicate
 // blocks, ensuring blocks follow all rules, orphan handling, and insertion into
 // the block chain along with best chain selection and reorganization.
-func (b *BlockChain) ProcessBlock(block *btcutil.Block) error {
+//
+// It returns whether or not the block ended up on the main chain and whether or
+// not it is an orphan.  A block which is neither on the main chain nor an
+// orphan was accepted onto a side chain.  Note that a reorganization caused by
+// processing orphans which depend on the block is not reflected in the return
+// values, only where the passed block itself ended up.
+//
+// The type of the returned error indicates the kind of failure.  A RuleError
+// means the block violates the consensus rules and is the only kind which
+// implies the block, and hence whoever provided it, is bad.  A DatabaseError
+// means the backing database failed and a DeserializationError means the block
+// data could not be encoded or decoded.  A QuotaError or ResourceError means
+// the block was not processed due to the configured limits.  A ReorgDepthError
+// means the block was added to a side chain which was not switched to since the
+// reorganization would be deeper than the limit set via SetMaxReorgDepth.
+//
+// The descriptions of the returned errors include the hash and height of the
+// block which caused them, along with the transaction and input when the error
+// is specific to one.  Since processing a block may also connect or disconnect
+// other blocks, such as during a reorganization or when orphans are accepted,
+// this is not necessarily the passed block.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ProcessBlock(block *btcutil.Block) (bool, bool, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	isMainChain, isOrphan, err := b.processBlock(block)
+	if ruleErr, ok := err.(RuleError); ok {
+		b.recordRejectedBlock(block, "", ruleErr)
+	}
+	return isMainChain, isOrphan, b.blockError(err, block)
+}
+
+// processBlock is the implementation of ProcessBlock.  It must be called with
+// the process lock held.
+func (b *BlockChain) processBlock(block *btcutil.Block) (bool, bool, error) {
 	blockHash, err := block.Sha()
 	if err != nil {
-		return err
+		return false, false, deserializationError(err)
 	}
 	log.Debugf("Processing block %v", blockHash)
 
+	// Make sure the database is for the network of the chain and contains
+	// its genesis block before the first block is processed.
+	err = b.initGenesis()
+	if err != nil {
+		return false, false, err
+	}
+
+	// Discard the orphans whose parents have not arrived in time since
+	// they are unlikely to ever be useful.
+	b.removeExpiredOrphans()
+
+	// Reject blocks which are already known to be invalid, or build on one
+	// that is, without validating them again.  A block which builds on an
+	// invalid block is only remembered once its proof of work and sanity
+	// have been verified, so junk can't be used to flush the blocks which
+	// are remembered.
+	prevHash := &block.MsgBlock().Header.PrevBlock
+	err = b.checkKnownInvalid(blockHash, prevHash)
+	if err != nil {
+		ruleErr, ok := err.(RuleError)
+		if ok && ruleErr.ErrorCode == ErrInvalidAncestorBlock {
+			err := CheckBlockSanity(block, b.chainParams,
+				b.timeSource, &b.sanityLimits)
+			if err != nil {
+				return false, false, err
+			}
+			b.markBlockInvalid(blockHash, prevHash, ruleErr)
+		}
+		return false, false, err
+	}
+
 	// The block must not already exist in the main chain or side chains.
 	if b.blockExists(blockHash) {
 		str := fmt.Sprintf("already have block %v", blockHash)
-		return RuleError(str)
+		return false, false, ruleError(ErrDuplicateBlock, str)
 	}
 
 	// The block must not already exist as an orphan.
 	if _, exists := b.orphans[*blockHash]; exists {
 		str := fmt.Sprintf("already have block (orphan) %v", blockHash)
-		return RuleError(str)
+		return false, false, ruleError(ErrDuplicateBlock, str)
 	}
 
-	// Perform preliminary sanity checks on the block and its transactions.
-	err = checkBlockSanity(block)
+	// Don't process blocks which would exceed the resource limits.
+	err = b.checkBlockAdmission(block)
 	if err != nil {
-		return err
+		return false, false, err
 	}
 
-	// Find the latest known checkpoint and perform some additional checks
-	// based on the checkpoint.  This provides a few nice properties such as
-	// preventing forks from blocks before the last checkpoint, rejecting
-	// easy to mine, but otherwise bogus, blocks that could be used to eat
-	// memory, and ensuring expected (versus claimed) proof of work
-	// requirements since the last checkpoint are met.
-	blockHeader := block.MsgBlock().Header
-	checkpointBlock, err := b.findLatestKnownCheckpoint()
+	// Perform preliminary sanity checks on the block and its transactions.
+	err = CheckBlockSanity(block, b.chainParams, b.timeSource,
+		&b.sanityLimits)
 	if err != nil {
-		return err
+		return false, false, err
 	}
-	if checkpointBlock != nil {
-		// Ensure the block timestamp is after the checkpoint timestamp.
-		checkpointHeader := checkpointBlock.MsgBlock().Header
-		checkpointTime := checkpointHeader.Timestamp
-		if blockHeader.Timestamp.Before(checkpointTime) {
-			str := fmt.Sprintf("block %v has timestamp %v before "+
-				"last checkpoint timestamp %v", blockHash,
-				blockHeader.Timestamp, checkpointTime)
-			return RuleError(str)
-		}
 
-		// Even though the checks prior to now have already ensured the
-		// proof of work exceeds the claimed amount, the claimed amount
-		// is a field in the block header which could be forged.  This
-		// check ensures the proof of work is at least the minimum
-		// expected based on elapsed time since the last checkpoint and
-		// maximum adjustment allowed by the retarget rules.
-		duration := blockHeader.Timestamp.Sub(checkpointTime)
-		requiredTarget := CompactToBig(calcEasiestDifficulty(
-			checkpointHeader.Bits, duration))
-		currentTarget := CompactToBig(blockHeader.Bits)
-		if currentTarget.Cmp(requiredTarget) > 0 {
-			str := fmt.Sprintf("block target difficulty of %064x "+
-				"is too low when compared to the previous "+
-				"checkpoint", currentTarget)
-			return RuleError(str)
-		}
+	// Perform some additional checks based on the latest known
+	// checkpoint.
+	blockHeader := &block.MsgBlock().Header
+	err = b.checkCheckpointConstraints(blockHeader, blockHash)
+	if err != nil {
+		return false, false, err
 	}
 
-	// Handle orphan blocks.
-	prevHash := &blockHeader.PrevBlock
+	// Handle orphan blocks.  The proof of work and sanity of the block
+	// have already been verified above, so anyone attempting to fill the
+	// orphan pool with junk must at least do the work the claimed
+	// difficulty requires, which needs to be plausible as well.
 	if !prevHash.IsEqual(zeroHash) && !b.blockExists(prevHash) {
+		err := b.checkOrphanDifficulty(blockHeader, blockHash)
+		if err != nil {
+			return false, false, err
+		}
+
 		// Add the orphan block to the orphan pool.
 		log.Infof("Adding orphan block %v", blockHash)
-		b.addOrphanBlock(block)
+		err = b.addOrphanBlock(block)
+		if err != nil {
+			return false, false, err
+		}
 
-		// Get the hash for the head of the orphaned block chain for
-		// this block and notify the caller so it can request missing
-		// blocks.
-		orphanRoot := b.getOrphanRoot(prevHash)
-		b.sendNotification(NTOrphanBlock, orphanRoot)
-		return nil
+		// Get the hash of the missing ancestor at the head of the
+		// orphaned block chain for this block and notify the caller so
+		// it can request the missing blocks right away.
+		b.sendNotification(NTOrphanBlock, &OrphanNotification{
+			Hash:            blockHash,
+			PrevHash:        prevHash,
+			MissingAncestor: b.getOrphanRoot(prevHash),
+		})
+		return false, true, nil
 	}
 
 	// The block has passed all context independent checks and appears sane
 	// enough to potentially accept it into the block chain.
-	err = b.maybeAcceptBlock(block)
+	isMainChain, err := b.maybeAcceptBlock(block)
+	if ruleErr, ok := err.(RuleError); ok {
+		b.markBlockInvalid(blockHash, prevHash, ruleErr)
+	}
 	if err != nil {
-		return err
+		return false, false, err
 	}
 
 	// Accept any orphan blocks that depend on this block (they are no
@@ -167,9 +350,9 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block) error {
 	// no more.
 	err = b.processOrphans(blockHash)
 	if err != nil {
-		return err
+		return false, false, err
 	}
 
 	log.Debugf("Accepted block %v", blockHash)
-	return nil
+	return isMainChain, false, nil
 }
@@ -0,0 +1,186 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"time"
+)
+
+// quotaInterval is the interval over which the number of blocks processed for
+// a source is limited by SourceQuota.MaxBlocksPerMinute.
+const quotaInterval = time.Minute
+
+// QuotaError identifies a block which was not processed because the source it
+// came from exceeded its processing quota.  Unlike a RuleError, it does not
+// mean the block is invalid.
+type QuotaError string
+
+// Error satisfies the error interface to print human-readable errors.
+func (e QuotaError) Error() string {
+	return string(e)
+}
+
+// SourceQuota defines the processing budget for blocks from a single source,
+// such as a peer, when they are processed via ProcessBlockFromSource.  A zero
+// value for either field means there is no limit.
+type SourceQuota struct {
+	// MaxBlocksPerMinute is the maximum number of blocks from the source
+	// which will be processed within any one minute period.
+	MaxBlocksPerMinute int
+
+	// MaxSideChainBytes is the maximum total serialized size of the blocks
+	// from the source which are held in memory on side chains.
+	MaxSideChainBytes int64
+}
+
+// sourceUsage tracks the resources used by the blocks from a single source.
+type sourceUsage struct {
+	// processed houses the times blocks from the source were processed
+	// within the last quotaInterval.
+	processed []time.Time
+
+	// sideChainBlocks houses the serialized size of each block from the
+	// source which was added to a side chain.  Entries are removed once
+	// the block is no longer held in the side chain block cache.
+	sideChainBlocks map[btcwire.ShaHash]int64
+}
+
+// SetSourceQuota sets the processing budget for blocks from the source with
+// the passed identifier.  The identifier is opaque to this package and only
+// needs to be consistent with the one passed to ProcessBlockFromSource.  The
+// default quota is used for sources which do not have a quota set.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) SetSourceQuota(source string, quota SourceQuota) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.sourceQuotas[source] = quota
+}
+
+// SetDefaultSourceQuota sets the processing budget for blocks from sources
+// which do not have a quota set via SetSourceQuota.  There is no limit by
+// default.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) SetDefaultSourceQuota(quota SourceQuota) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.defaultQuota = quota
+}
+
+// RemoveSource discards the quota, usage, and remote tip tracked for the source
+// with the passed identifier.  It should be called once the source, such as a
+// disconnected peer, will no longer provide blocks.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) RemoveSource(source string) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	delete(b.sourceQuotas, source)
+	delete(b.sourceUsages, source)
+	delete(b.remoteTips, source)
+}
+
+// sideChainBytes returns the total serialized size of the blocks from the
+// passed source usage which are currently held on side chains.  Blocks which
+// have since been connected to the main chain or otherwise discarded from the
+// side chains are no longer counted.
+func (b *BlockChain) sideChainBytes(usage *sourceUsage) int64 {
+	var total int64
+	for hash, size := range usage.sideChainBlocks {
+		if !b.haveSideChainBlock(&hash) {
+			delete(usage.sideChainBlocks, hash)
+			continue
+		}
+		total += size
+	}
+	return total
+}
+
+// ProcessBlockFromSource is the same as ProcessBlock except it enforces the
+// processing quota for the source with the passed identifier.  A QuotaError is
+// returned without processing the block when the source has exceeded its
+// quota.  This provides a backstop against a single source monopolizing the
+// resources used for validation.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ProcessBlockFromSource(block *btcutil.Block, source string) (bool, bool, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	quota, ok := b.sourceQuotas[source]
+	if !ok {
+		quota = b.defaultQuota
+	}
+	usage, ok := b.sourceUsages[source]
+	if !ok {
+		usage = &sourceUsage{
+			sideChainBlocks: make(map[btcwire.ShaHash]int64),
+		}
+		b.sourceUsages[source] = usage
+	}
+
+	// Forget about blocks which were processed before the current quota
+	// interval.
+	now := time.Now()
+	cutoff := now.Add(-quotaInterval)
+	for len(usage.processed) > 0 && usage.processed[0].Before(cutoff) {
+		usage.processed = usage.processed[1:]
+	}
+
+	// Enforce the limit on the number of blocks processed per interval.
+	if quota.MaxBlocksPerMinute > 0 &&
+		len(usage.processed) >= quota.MaxBlocksPerMinute {
+
+		str := fmt.Sprintf("source %q exceeded its quota of %d "+
+			"blocks per minute", source, quota.MaxBlocksPerMinute)
+		return false, false, QuotaError(str)
+	}
+
+	// Enforce the limit on the total size of side chain blocks when the
+	// block would not extend the main chain.
+	serializedBlock, err := block.Bytes()
+	if err != nil {
+		return false, false, err
+	}
+	blockSize := int64(len(serializedBlock))
+	prevHash := &block.MsgBlock().Header.PrevBlock
+	extendsMainChain := b.bestChain == nil || prevHash.IsEqual(b.bestChain.hash)
+	if quota.MaxSideChainBytes > 0 && !extendsMainChain {
+		sideChainBytes := b.sideChainBytes(usage)
+		if sideChainBytes+blockSize > quota.MaxSideChainBytes {
+			str := fmt.Sprintf("source %q exceeded its quota of %d "+
+				"side chain bytes", source,
+				quota.MaxSideChainBytes)
+			return false, false, QuotaError(str)
+		}
+	}
+
+	usage.processed = append(usage.processed, now)
+	isMainChain, isOrphan, err := b.processBlock(block)
+	if err != nil {
+		if ruleErr, ok := err.(RuleError); ok {
+			b.recordRejectedBlock(block, source, ruleErr)
+		}
+		return false, false, b.blockError(err, block)
+	}
+
+	// Keep track of the block when it ended up on a side chain.  It's
+	// safe to ignore the error on Sha since it's already cached.
+	blockHash, _ := block.Sha()
+	if !isMainChain && !isOrphan {
+		if b.haveSideChainBlock(blockHash) {
+			usage.sideChainBlocks[*blockHash] = blockSize
+		}
+	}
+
+	return isMainChain, isOrphan, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"testing"
+)
+
+// TestSourceQuota ensures blocks from a source are rejected with a QuotaError
+// once the source exceeds its quota, whether it was set for the source or as
+// the default, and that removing the source resets its usage.
+func TestSourceQuota(t *testing.T) {
+	tests := []struct {
+		name         string
+		dbName       string
+		quota        btcchain.SourceQuota
+		isDefault    bool
+		sideChain    bool
+		wantAccepted int
+	}{
+		{
+			name:         "blocks per minute",
+			dbName:       "quotatest1",
+			quota:        btcchain.SourceQuota{MaxBlocksPerMinute: 2},
+			wantAccepted: 2,
+		},
+		{
+			name:         "default blocks per minute",
+			dbName:       "quotatest2",
+			quota:        btcchain.SourceQuota{MaxBlocksPerMinute: 1},
+			isDefault:    true,
+			wantAccepted: 1,
+		},
+		{
+			name:         "side chain bytes",
+			dbName:       "quotatest3",
+			quota:        btcchain.SourceQuota{MaxSideChainBytes: 200},
+			sideChain:    true,
+			wantAccepted: 1,
+		},
+		{
+			name:         "main chain blocks are not side chain bytes",
+			dbName:       "quotatest4",
+			quota:        btcchain.SourceQuota{MaxSideChainBytes: 200},
+			wantAccepted: 3,
+		},
+	}
+
+	for i, test := range tests {
+		params := btcchain.RegressionNetParams
+		chain, _, teardown := newTestChain(t, test.dbName, &params,
+			nil)
+		defer teardown()
+		if test.isDefault {
+			chain.SetDefaultSourceQuota(test.quota)
+		} else {
+			chain.SetSourceQuota("peer", test.quota)
+		}
+
+		// The blocks from the source either extend the main chain or
+		// are on a side chain which forks from its first block.
+		g := newBlockGenerator(&params)
+		mainBlocks := g.nextBlocks(g.genesis(), 3)
+		blocks := mainBlocks
+		if test.sideChain {
+			processBlocks(t, chain, mainBlocks)
+			blocks = g.nextBlocks(mainBlocks[0], 3)
+		}
+
+		// The block after the accepted ones is rejected until the
+		// source is removed, which resets its usage.
+		processed := blocks
+		if test.wantAccepted < len(blocks) {
+			processed = blocks[:test.wantAccepted+1]
+		}
+		for j, block := range processed {
+			_, _, err := chain.ProcessBlockFromSource(block, "peer")
+			if j < test.wantAccepted {
+				if err != nil {
+					t.Fatalf("ProcessBlockFromSource #%d (%s) "+
+						"block %d: unexpected error %v", i,
+						test.name, j, err)
+				}
+				continue
+			}
+			if _, ok := err.(btcchain.QuotaError); !ok {
+				t.Fatalf("ProcessBlockFromSource #%d (%s) block "+
+					"%d: got %v, want a QuotaError", i,
+					test.name, j, err)
+			}
+			chain.RemoveSource("peer")
+			_, _, err = chain.ProcessBlockFromSource(block, "peer")
+			if err != nil {
+				t.Fatalf("ProcessBlockFromSource #%d (%s) block "+
+					"%d after RemoveSource: unexpected error %v",
+					i, test.name, j, err)
+			}
+		}
+
+		wantBest := processed[len(processed)-1]
+		if test.sideChain {
+			wantBest = mainBlocks[len(mainBlocks)-1]
+		}
+		checkBestBlock(t, test.name, chain, wantBest)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+)
+
+// RejectCode represents a numeric value by which a remote peer indicates why a
+// message was rejected as defined by BIP0061.
+type RejectCode uint8
+
+// These constants define the reject codes defined by BIP0061.
+const (
+	RejectMalformed       RejectCode = 0x01
+	RejectInvalid         RejectCode = 0x10
+	RejectObsolete        RejectCode = 0x11
+	RejectDuplicate       RejectCode = 0x12
+	RejectNonstandard     RejectCode = 0x40
+	RejectDust            RejectCode = 0x41
+	RejectInsufficientFee RejectCode = 0x42
+	RejectCheckpoint      RejectCode = 0x43
+)
+
+// Map of RejectCode values back to their constant names for pretty printing.
+var rejectCodeStrings = map[RejectCode]string{
+	RejectMalformed:       "REJECT_MALFORMED",
+	RejectInvalid:         "REJECT_INVALID",
+	RejectObsolete:        "REJECT_OBSOLETE",
+	RejectDuplicate:       "REJECT_DUPLICATE",
+	RejectNonstandard:     "REJECT_NONSTANDARD",
+	RejectDust:            "REJECT_DUST",
+	RejectInsufficientFee: "REJECT_INSUFFICIENTFEE",
+	RejectCheckpoint:      "REJECT_CHECKPOINT",
+}
+
+// String returns the RejectCode in human-readable form.
+func (code RejectCode) String() string {
+	if s, ok := rejectCodeStrings[code]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown RejectCode (%d)", uint8(code))
+}
+
+// rejectInfo houses the reject code and short reason sent to a peer for an
+// error code.
+type rejectInfo struct {
+	code   RejectCode
+	reason string
+}
+
+// errorCodeRejects houses the reject code and reason of each error code.  The
+// reasons are the same as the ones used by bitcoind where there is an
+// equivalent so the reject messages are the same regardless of which software
+// the peer is running.  Error codes which cover more than one of the bitcoind
+// reasons, such as ErrBadTxInput which is used for both null previous outputs
+// and output indexes which do not exist, use a more general reason instead.
+var errorCodeRejects = map[ErrorCode]rejectInfo{
+	ErrDuplicateBlock:        {RejectDuplicate, "duplicate"},
+	ErrBlockTooBig:           {RejectInvalid, "bad-blk-length"},
+	ErrTooManyTransactions:   {RejectInvalid, "bad-blk-length"},
+	ErrTxTooBig:              {RejectInvalid, "bad-txns-oversize"},
+	ErrBlockVersionTooOld:    {RejectObsolete, "bad-version"},
+	ErrTimeTooOld:            {RejectInvalid, "time-too-old"},
+	ErrTimeTooNew:            {RejectInvalid, "time-too-new"},
+	ErrDifficultyTooLow:      {RejectInvalid, "bad-diffbits"},
+	ErrUnexpectedDifficulty:  {RejectInvalid, "bad-diffbits"},
+	ErrHighHash:              {RejectInvalid, "high-hash"},
+	ErrBadMerkleRoot:         {RejectInvalid, "bad-txnmrklroot"},
+	ErrBadCheckpoint:         {RejectCheckpoint, "checkpoint mismatch"},
+	ErrForkTooOld:            {RejectCheckpoint, "bad-fork-prior-to-checkpoint"},
+	ErrPrevBlockUnknown:      {RejectInvalid, "bad-prevblk"},
+	ErrNoTransactions:        {RejectInvalid, "bad-blk-length"},
+	ErrNoTxInputs:            {RejectInvalid, "bad-txns-vin-empty"},
+	ErrNoTxOutputs:           {RejectInvalid, "bad-txns-vout-empty"},
+	ErrBadTxOutValue:         {RejectInvalid, "bad-txns-vout-value"},
+	ErrDuplicateTxInputs:     {RejectInvalid, "bad-txns-inputs-duplicate"},
+	ErrBadTxInput:            {RejectInvalid, "bad-txns-input-invalid"},
+	ErrMissingTx:             {RejectInvalid, "bad-txns-inputs-missingorspent"},
+	ErrUnfinalizedTx:         {RejectInvalid, "bad-txns-nonfinal"},
+	ErrDuplicateTx:           {RejectInvalid, "bad-txns-duplicate"},
+	ErrOverwriteTx:           {RejectInvalid, "bad-txns-BIP30"},
+	ErrImmatureSpend:         {RejectInvalid, "bad-txns-premature-spend-of-coinbase"},
+	ErrDoubleSpend:           {RejectInvalid, "bad-txns-inputs-missingorspent"},
+	ErrSpendTooHigh:          {RejectInvalid, "bad-txns-in-belowout"},
+	ErrBadFees:               {RejectInvalid, "bad-txns-fee-outofrange"},
+	ErrTooManySigOps:         {RejectInvalid, "bad-blk-sigops"},
+	ErrFirstTxNotCoinbase:    {RejectInvalid, "bad-cb-missing"},
+	ErrMultipleCoinbases:     {RejectInvalid, "bad-cb-multiple"},
+	ErrBadCoinbaseScriptLen:  {RejectInvalid, "bad-cb-length"},
+	ErrBadCoinbaseValue:      {RejectInvalid, "bad-cb-amount"},
+	ErrMissingCoinbaseHeight: {RejectInvalid, "bad-cb-height"},
+	ErrBadCoinbaseHeight:     {RejectInvalid, "bad-cb-height"},
+	ErrNotStrictDER:          {RejectInvalid, "mandatory-script-verify-flag-failed"},
+	ErrUnsatisfiedLockTime:   {RejectInvalid, "mandatory-script-verify-flag-failed"},
+	ErrSequenceLockNotMet:    {RejectInvalid, "bad-txns-nonfinal"},
+	ErrScriptValidation:      {RejectInvalid, "mandatory-script-verify-flag-failed"},
+	ErrInvalidAncestorBlock:  {RejectInvalid, "bad-prevblk"},
+}
+
+// RejectCode returns the BIP0061 reject code for a message which was rejected
+// with the error code.
+func (e ErrorCode) RejectCode() RejectCode {
+	if info, ok := errorCodeRejects[e]; ok {
+		return info.code
+	}
+	return RejectInvalid
+}
+
+// RejectReason returns the short reason sent along with the reject code for a
+// message which was rejected with the error code.
+func (e ErrorCode) RejectReason() string {
+	if info, ok := errorCodeRejects[e]; ok {
+		return info.reason
+	}
+	return "invalid"
+}
+
+// ErrToRejectErr examines the passed error returned by this package and returns
+// the BIP0061 reject code and reason which should be sent to the peer which
+// provided the rejected block or transaction.  This allows the caller to send
+// accurate reject messages without matching on the text of the error.
+//
+// Only a RuleError results in a reject message since the other errors, such as
+// a DatabaseError, say nothing about the validity of the data.  The final
+// return value is false for all other errors, including nil.
+func ErrToRejectErr(err error) (RejectCode, string, bool) {
+	ruleErr, ok := err.(RuleError)
+	if !ok {
+		return 0, "", false
+	}
+	return ruleErr.ErrorCode.RejectCode(), ruleErr.ErrorCode.RejectReason(),
+		true
+}
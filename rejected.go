@@ -0,0 +1,213 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"time"
+)
+
+// maxRejectedBlocks is the maximum number of rejected blocks which are kept
+// track of.  Once the limit is reached, the oldest records are discarded.
+const maxRejectedBlocks = 1000
+
+// RejectedBlock describes a block which was rejected for violating a rule.
+type RejectedBlock struct {
+	// Hash is the hash of the rejected block.
+	Hash *btcwire.ShaHash
+
+	// Height is the height the block would have had based on the previous
+	// block it references or -1 if the previous block is not known.
+	Height int64
+
+	// ErrorCode identifies the rule the block violated.
+	ErrorCode ErrorCode
+
+	// Reason describes the rule violation the block was rejected for.
+	Reason string
+
+	// Source identifies where the block came from as passed to
+	// ProcessBlockFromSource.  It is empty for blocks passed to
+	// ProcessBlock.
+	Source string
+
+	// Time is when the block was rejected.
+	Time time.Time
+}
+
+// rejectedBlockRecord is the form a RejectedBlock is stored in on disk.  The
+// hash is stored as a string so the records are human readable.
+type rejectedBlockRecord struct {
+	Hash      string
+	Height    int64
+	ErrorCode ErrorCode
+	Reason    string
+	Source    string
+	Time      time.Time
+}
+
+// SetRejectedBlockLog sets the file rejected blocks are recorded to so they
+// persist across restarts.  Any records already in the file are loaded and
+// made available via RejectedBlocks.  New records are appended to the file and
+// it is periodically rewritten to keep it from growing without bound.  Passing
+// an empty path stops recording rejected blocks to a file.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetRejectedBlockLog(path string) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.rejectLogPath = path
+	b.rejectLogLines = 0
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Load the records from the file, keeping only the most recent ones
+	// when there are too many.
+	var rejected []RejectedBlock
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record rejectedBlockRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			log.Warnf("Skipping malformed record in rejected block "+
+				"log %s: %v", path, err)
+			continue
+		}
+		hash, err := btcwire.NewShaHashFromStr(record.Hash)
+		if err != nil {
+			log.Warnf("Skipping malformed record in rejected block "+
+				"log %s: %v", path, err)
+			continue
+		}
+
+		rejected = append(rejected, RejectedBlock{
+			Hash:      hash,
+			Height:    record.Height,
+			ErrorCode: record.ErrorCode,
+			Reason:    record.Reason,
+			Source:    record.Source,
+			Time:      record.Time,
+		})
+		if len(rejected) > maxRejectedBlocks {
+			rejected = rejected[1:]
+		}
+		b.rejectLogLines++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	b.chainLock.Lock()
+	b.rejectedBlocks = rejected
+	b.chainLock.Unlock()
+	return nil
+}
+
+// writeRejectedBlockLog writes the passed rejected blocks to the rejected block
+// log.  When rewrite is set, the existing contents of the log are replaced,
+// otherwise the blocks are appended to it.
+func (b *BlockChain) writeRejectedBlockLog(rejected []RejectedBlock, rewrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if rewrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(b.rejectLogPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, r := range rejected {
+		record := rejectedBlockRecord{
+			Hash:      r.Hash.String(),
+			Height:    r.Height,
+			ErrorCode: r.ErrorCode,
+			Reason:    r.Reason,
+			Source:    r.Source,
+			Time:      r.Time,
+		}
+		serialized, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		w.Write(serialized)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
+
+// recordRejectedBlock adds the passed block, which was rejected from the passed
+// source for the passed rule error, to the rejected blocks.  It must be called
+// with the process lock held.
+func (b *BlockChain) recordRejectedBlock(block *btcutil.Block, source string, ruleErr RuleError) {
+	// It's safe to ignore the error on Sha since it's already cached.
+	blockHash, _ := block.Sha()
+	rejected := RejectedBlock{
+		Hash:      blockHash,
+		Height:    b.claimedHeight(block),
+		ErrorCode: ruleErr.ErrorCode,
+		Reason:    ruleErr.Description,
+		Source:    source,
+		Time:      time.Now(),
+	}
+
+	b.chainLock.Lock()
+	b.rejectedBlocks = append(b.rejectedBlocks, rejected)
+	if len(b.rejectedBlocks) > maxRejectedBlocks {
+		b.rejectedBlocks = b.rejectedBlocks[1:]
+	}
+	b.chainLock.Unlock()
+
+	if b.rejectLogPath == "" {
+		return
+	}
+
+	// Append the record to the log unless it has grown to twice the number
+	// of records that are kept, in which case it is rewritten with only
+	// those records.
+	var err error
+	if b.rejectLogLines >= maxRejectedBlocks*2 {
+		allRejected := b.RejectedBlocks()
+		err = b.writeRejectedBlockLog(allRejected, true)
+		b.rejectLogLines = len(allRejected)
+	} else {
+		err = b.writeRejectedBlockLog([]RejectedBlock{rejected}, false)
+		b.rejectLogLines++
+	}
+	if err != nil {
+		log.Warnf("Unable to write to rejected block log %s: %v",
+			b.rejectLogPath, err)
+	}
+}
+
+// RejectedBlocks returns the most recent blocks which were rejected for
+// violating a rule, ordered from oldest to newest.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) RejectedBlocks() []RejectedBlock {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	rejected := make([]RejectedBlock, len(b.rejectedBlocks))
+	copy(rejected, b.rejectedBlocks)
+	return rejected
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRejectedBlockLog ensures rejected blocks are recorded along with the
+// error code of the rule they violated and the records are loaded from the
+// rejected block log again after a restart.
+func TestRejectedBlockLog(t *testing.T) {
+	logPath := filepath.Join(os.TempDir(), "rejectedtest.log")
+	_ = os.Remove(logPath)
+	defer os.Remove(logPath)
+
+	params := btcchain.RegressionNetParams
+	chain, db, teardown := newTestChain(t, "rejectedtest", &params, nil)
+	defer teardown()
+	if err := chain.SetRejectedBlockLog(logPath); err != nil {
+		t.Fatalf("SetRejectedBlockLog: unexpected error %v", err)
+	}
+
+	g := newBlockGenerator(&params)
+	prev := g.nextBlock(g.genesis())
+	processBlocks(t, chain, []*btcutil.Block{prev})
+	block := g.nextBlock(prev, func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Header.Timestamp = time.Now().Add(24 * time.Hour)
+	})
+	_, _, err := chain.ProcessBlock(block)
+	checkRuleError(t, "ProcessBlock", err, btcchain.ErrTimeTooNew)
+
+	// Load the records with a new chain instance as would be done after a
+	// restart.
+	restarted := newChain(t, db, &params, nil)
+	if err := restarted.SetRejectedBlockLog(logPath); err != nil {
+		t.Fatalf("SetRejectedBlockLog: unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		chain *btcchain.BlockChain
+	}{
+		{"recorded", chain},
+		{"loaded", restarted},
+	}
+	for i, test := range tests {
+		rejected := test.chain.RejectedBlocks()
+		if len(rejected) != 1 {
+			t.Errorf("RejectedBlocks #%d (%s): got %d records, want 1",
+				i, test.name, len(rejected))
+			continue
+		}
+		r := rejected[0]
+		if !r.Hash.IsEqual(blockHash(block)) || r.Height != 2 ||
+			r.ErrorCode != btcchain.ErrTimeTooNew || r.Reason == "" {
+
+			t.Errorf("RejectedBlocks #%d (%s): got %v (height %d, "+
+				"code %v, reason %q), want %v (height 2, code %v)",
+				i, test.name, r.Hash, r.Height, r.ErrorCode,
+				r.Reason, blockHash(block), btcchain.ErrTimeTooNew)
+		}
+	}
+}
@@ -58,12 +58,17 @@ func TestReorganization(t *testing.T) {
 
 	// Since we're not dealing with the real block chain, disable
 	// checkpoints and set the coinbase maturity to 1.
-	blockChain := btcchain.New(db, btcwire.MainNet, nil)
+	params := btcchain.MainNetParams
+	params.CoinbaseMaturity = 1
+	blockChain, err := btcchain.New(db, &params, nil)
+	if err != nil {
+		t.Errorf("New: %v", err)
+		return
+	}
 	blockChain.DisableCheckpoints(true)
-	btcchain.TstSetCoinbaseMaturity(1)
 
 	for i := 1; i < len(blocks); i++ {
-		err = blockChain.ProcessBlock(blocks[i])
+		_, _, err = blockChain.ProcessBlock(blocks[i])
 		if err != nil {
 			t.Errorf("ProcessBlock fail on block %v: %v\n", i, err)
 			return
@@ -0,0 +1,183 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// ReorgTx identifies a transaction which is part of a ReorgTxDiff.
+type ReorgTx struct {
+	Hash *btcwire.ShaHash
+	Tx   *btcwire.MsgTx
+
+	// BlockHash is the hash of the block the transaction is in on the
+	// branch it belongs to.
+	BlockHash *btcwire.ShaHash
+}
+
+// ReorgTxDiff is the data sent with an NTReorganization notification.  It
+// describes the transactions which changed confirmation status as the result of
+// a reorganization of the main chain.
+type ReorgTxDiff struct {
+	// ForkHash is the hash of the common ancestor of the old and new
+	// branches.  OldTip and NewTip are the hashes of the ends of the main
+	// chain before and after the reorganization respectively.
+	ForkHash *btcwire.ShaHash
+	OldTip   *btcwire.ShaHash
+	NewTip   *btcwire.ShaHash
+
+	// Unconfirmed houses the transactions which were in the blocks of the
+	// old branch, but are not in any of the blocks of the new branch.
+	// These include the coinbases of the old branch.
+	Unconfirmed []ReorgTx
+
+	// Confirmed houses the transactions which are in the blocks of the new
+	// branch, but were not in any of the blocks of the old branch.
+	Confirmed []ReorgTx
+}
+
+// collectReorgTxns returns all of the transactions in the passed blocks along
+// with a set of their hashes.  The blocks must be in forwards order, so the
+// returned transactions are in the order they appear in the chain.
+func collectReorgTxns(blocks []*btcutil.Block) ([]ReorgTx, map[btcwire.ShaHash]struct{}, error) {
+	var txns []ReorgTx
+	hashes := make(map[btcwire.ShaHash]struct{})
+	for _, block := range blocks {
+		blockHash, err := block.Sha()
+		if err != nil {
+			return nil, nil, err
+		}
+		txShas, err := block.TxShas()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, tx := range block.MsgBlock().Transactions {
+			txns = append(txns, ReorgTx{
+				Hash:      txShas[i],
+				Tx:        tx,
+				BlockHash: blockHash,
+			})
+			hashes[*txShas[i]] = struct{}{}
+		}
+	}
+	return txns, hashes, nil
+}
+
+// calcReorgTxDiff returns a ReorgTxDiff describing a reorganization which
+// replaced the passed old branch blocks with the passed new branch blocks.
+// Both sets of blocks must be in forwards order (the block that comes directly
+// after the fork point first).
+func calcReorgTxDiff(forkHash *btcwire.ShaHash, oldBlocks, newBlocks []*btcutil.Block) (*ReorgTxDiff, error) {
+	oldTxns, oldHashes, err := collectReorgTxns(oldBlocks)
+	if err != nil {
+		return nil, err
+	}
+	newTxns, newHashes, err := collectReorgTxns(newBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := ReorgTxDiff{ForkHash: forkHash}
+	if len(oldBlocks) > 0 {
+		diff.OldTip, _ = oldBlocks[len(oldBlocks)-1].Sha()
+	}
+	if len(newBlocks) > 0 {
+		diff.NewTip, _ = newBlocks[len(newBlocks)-1].Sha()
+	}
+	for _, tx := range oldTxns {
+		if _, exists := newHashes[*tx.Hash]; !exists {
+			diff.Unconfirmed = append(diff.Unconfirmed, tx)
+		}
+	}
+	for _, tx := range newTxns {
+		if _, exists := oldHashes[*tx.Hash]; !exists {
+			diff.Confirmed = append(diff.Confirmed, tx)
+		}
+	}
+	return &diff, nil
+}
+
+// calcResurrectTxns returns the transactions from the passed reorganization
+// diff which are candidates to be returned to a memory pool.  These are the
+// transactions which are no longer confirmed, excluding coinbases, those which
+// conflict with transactions confirmed by the new branch, and any which spend
+// outputs of excluded transactions.
+//
+// The transactions are returned in dependency order, meaning any transaction
+// which spends an output of another returned transaction comes after it.  This
+// follows from the unconfirmed transactions being in the order they appeared
+// in the old branch.
+func calcResurrectTxns(diff *ReorgTxDiff) []ReorgTx {
+	// Collect all of the outputs spent by the newly confirmed
+	// transactions.  Any transaction from the old branch which spends one
+	// of them is now a double spend.
+	spent := make(map[btcwire.OutPoint]struct{})
+	for _, reorgTx := range diff.Confirmed {
+		for _, txIn := range reorgTx.Tx.TxIn {
+			spent[txIn.PreviousOutpoint] = struct{}{}
+		}
+	}
+
+	excluded := make(map[btcwire.ShaHash]struct{})
+	txns := make([]ReorgTx, 0, len(diff.Unconfirmed))
+	for _, reorgTx := range diff.Unconfirmed {
+		exclude := IsCoinBase(reorgTx.Tx)
+		for _, txIn := range reorgTx.Tx.TxIn {
+			if exclude {
+				break
+			}
+			if _, ok := spent[txIn.PreviousOutpoint]; ok {
+				exclude = true
+			}
+			if _, ok := excluded[txIn.PreviousOutpoint.Hash]; ok {
+				exclude = true
+			}
+		}
+		if exclude {
+			excluded[*reorgTx.Hash] = struct{}{}
+			continue
+		}
+		txns = append(txns, reorgTx)
+	}
+	return txns
+}
+
+// SetResurrectChan provides a channel which is sent the transactions from the
+// blocks disconnected by each reorganization of the main chain that are ready
+// to be accepted into a memory pool again.  Coinbases, transactions which
+// conflict with the new main chain, and transactions which depend on any of
+// those are not included.  The transactions are sent in dependency order.  See
+// calcResurrectTxns for details.
+//
+// Nothing is sent for reorganizations which do not leave any transactions to
+// resurrect.  Much like the notification channel provided to New, the caller
+// must service the channel since sends to it block.  Passing nil disables the
+// feed.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetResurrectChan(c chan []ReorgTx) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.resurrectTxns = c
+}
+
+// sendResurrectTxns sends the transactions from the passed reorganization diff
+// which should be returned to a memory pool to the channel provided via
+// SetResurrectChan, if any.
+func (b *BlockChain) sendResurrectTxns(diff *ReorgTxDiff) {
+	if b.resurrectTxns == nil {
+		return
+	}
+
+	txns := calcResurrectTxns(diff)
+	if len(txns) == 0 {
+		return
+	}
+	b.resurrectTxns <- txns
+}
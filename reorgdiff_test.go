@@ -0,0 +1,157 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// reorgTxHashes returns the hashes of the passed reorganization transactions.
+func reorgTxHashes(txns []btcchain.ReorgTx) []btcwire.ShaHash {
+	var hashes []btcwire.ShaHash
+	for _, reorgTx := range txns {
+		hashes = append(hashes, *reorgTx.Hash)
+	}
+	return hashes
+}
+
+// msgTxHashes returns the hashes of the passed transactions.
+func msgTxHashes(txns ...*btcwire.MsgTx) []btcwire.ShaHash {
+	var hashes []btcwire.ShaHash
+	for _, tx := range txns {
+		hash, _ := tx.TxSha()
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// TestReorgTxDiff ensures reorganizations report the transactions which changed
+// confirmation status and that only the unconfirmed transactions which neither
+// conflict with nor depend on a conflict with the new branch are resurrected.
+func TestReorgTxDiff(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+
+	// The main chain is a1 <- a2 <- a3 where a3 spends the coinbases of a1
+	// and a2 along with an output created in the same block.  The side
+	// chains fork from a2 and are two blocks long.
+	mainBlocks := g.nextBlocks(g.genesis(), 2)
+	txA := spendTx(mainBlocks[0], 1000)
+	txAHash, _ := txA.TxSha()
+	txB := btcwire.NewMsgTx()
+	txB.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&txAHash, 0), nil))
+	txB.AddTxOut(btcwire.NewTxOut(txA.TxOut[0].Value-1000, opTrueScript))
+	txC := spendTx(mainBlocks[1], 1000)
+	conflictTx := spendTx(mainBlocks[0], 2000)
+	mainBlocks = append(mainBlocks, g.nextBlock(mainBlocks[1],
+		func(msgBlock *btcwire.MsgBlock) {
+			msgBlock.AddTransaction(txA)
+			msgBlock.AddTransaction(txB)
+			msgBlock.AddTransaction(txC)
+		}))
+	mainCoinbase := mainBlocks[2].MsgBlock().Transactions[0]
+
+	tests := []struct {
+		name          string
+		sideTxns      []*btcwire.MsgTx
+		wantUnconfirm []btcwire.ShaHash
+		wantConfirm   []btcwire.ShaHash
+		wantResurrect []btcwire.ShaHash
+	}{
+		{
+			name:          "all transactions confirmed again",
+			sideTxns:      []*btcwire.MsgTx{txA, txB, txC},
+			wantUnconfirm: msgTxHashes(mainCoinbase),
+		},
+		{
+			name:          "no transactions confirmed again",
+			wantUnconfirm: msgTxHashes(mainCoinbase, txA, txB, txC),
+			wantResurrect: msgTxHashes(txA, txB, txC),
+		},
+		{
+			name:          "conflict and its descendant",
+			sideTxns:      []*btcwire.MsgTx{conflictTx},
+			wantUnconfirm: msgTxHashes(mainCoinbase, txA, txB, txC),
+			wantConfirm:   msgTxHashes(conflictTx),
+			wantResurrect: msgTxHashes(txC),
+		},
+		{
+			name:          "some transactions confirmed again",
+			sideTxns:      []*btcwire.MsgTx{txA, txB},
+			wantUnconfirm: msgTxHashes(mainCoinbase, txC),
+			wantResurrect: msgTxHashes(txC),
+		},
+	}
+
+	for i, test := range tests {
+		c := make(chan *btcchain.Notification, 100)
+		chain, _, teardown := newTestChain(t, "reorgdifftest", &params, c)
+		resurrectChan := make(chan []btcchain.ReorgTx, 1)
+		chain.SetResurrectChan(resurrectChan)
+
+		sideBlocks := []*btcutil.Block{g.nextBlock(mainBlocks[1],
+			func(msgBlock *btcwire.MsgBlock) {
+				for _, tx := range test.sideTxns {
+					msgBlock.AddTransaction(tx)
+				}
+			})}
+		sideBlocks = append(sideBlocks, g.nextBlock(sideBlocks[0]))
+		processBlocks(t, chain, mainBlocks)
+		processBlocks(t, chain, sideBlocks)
+		checkBestBlock(t, test.name, chain, sideBlocks[1])
+
+		var diff *btcchain.ReorgTxDiff
+		for len(c) > 0 {
+			if n := <-c; n.Type == btcchain.NTReorganization {
+				diff = n.Data.(*btcchain.ReorgTxDiff)
+			}
+		}
+		if diff == nil {
+			teardown()
+			t.Errorf("NTReorganization #%d (%s): no notification", i,
+				test.name)
+			continue
+		}
+
+		if !diff.ForkHash.IsEqual(blockHash(mainBlocks[1])) ||
+			!diff.OldTip.IsEqual(blockHash(mainBlocks[2])) ||
+			!diff.NewTip.IsEqual(blockHash(sideBlocks[1])) {
+
+			t.Errorf("NTReorganization #%d (%s): got fork %v, old "+
+				"tip %v, new tip %v", i, test.name,
+				diff.ForkHash, diff.OldTip, diff.NewTip)
+		}
+		got := reorgTxHashes(diff.Unconfirmed)
+		if !reflect.DeepEqual(got, test.wantUnconfirm) {
+			t.Errorf("NTReorganization #%d (%s): got unconfirmed %v, "+
+				"want %v", i, test.name, got, test.wantUnconfirm)
+		}
+
+		// The coinbases of the new branch are always newly confirmed.
+		wantConfirm := msgTxHashes(sideBlocks[0].MsgBlock().Transactions[0])
+		wantConfirm = append(wantConfirm, test.wantConfirm...)
+		wantConfirm = append(wantConfirm,
+			msgTxHashes(sideBlocks[1].MsgBlock().Transactions[0])...)
+		got = reorgTxHashes(diff.Confirmed)
+		if !reflect.DeepEqual(got, wantConfirm) {
+			t.Errorf("NTReorganization #%d (%s): got confirmed %v, "+
+				"want %v", i, test.name, got, wantConfirm)
+		}
+
+		got = nil
+		if len(resurrectChan) > 0 {
+			got = reorgTxHashes(<-resurrectChan)
+		}
+		if !reflect.DeepEqual(got, test.wantResurrect) {
+			t.Errorf("SetResurrectChan #%d (%s): got %v, want %v", i,
+				test.name, got, test.wantResurrect)
+		}
+		teardown()
+	}
+}
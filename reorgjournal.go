@@ -0,0 +1,340 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"os"
+)
+
+// reorgJournalVersion is the version of the reorganization journal format
+// written by writeReorgJournal.  Version 2 added the blocks to detach.
+const reorgJournalVersion = 2
+
+// serializedReorgJournalHeader is the fixed size information at the start of a
+// reorganization journal.  It is followed by the length and serialized bytes of
+// each of the blocks to detach and then each of the blocks to attach, both in
+// forwards order.
+type serializedReorgJournalHeader struct {
+	Version   uint32
+	ForkHash  btcwire.ShaHash
+	NumDetach uint32
+	NumAttach uint32
+}
+
+// SetReorgJournal sets the file reorganizations of the main chain are journaled
+// to so a crash in the middle of one can be recovered from.  Before the first
+// block of a reorganization is disconnected, the fork point along with the
+// blocks to disconnect and connect are written to the file.  It is removed once
+// the reorganization is complete.  Passing an empty path stops journaling
+// reorganizations.
+//
+// When the file already exists, the reorganization it describes was interrupted
+// and is completed the same way as any other reorganization by disconnecting
+// the remaining blocks after the fork point from the main chain and connecting
+// the journaled blocks.  The blocks were fully validated before the
+// reorganization started, so they are not validated again.  The caller is
+// notified of the blocks which are connected and disconnected and so are the
+// optional indexes.  Journaled blocks which were already disconnected before
+// the crash are added to the side chains, so indexes which still include them
+// can be rolled back when they are added with AddIndexer.
+//
+// For this reason, it must be called right after the chain is created, before
+// any indexes are added or blocks are processed.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetReorgJournal(path string) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.root != nil {
+		return fmt.Errorf("the reorganization journal can only be set " +
+			"before any blocks are processed")
+	}
+
+	b.reorgJournalPath = path
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	forkHash, detachBlocks, attachBlocks, err := readReorgJournal(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read reorganization journal %s: %v",
+			path, err)
+	}
+
+	err = b.recoverReorg(forkHash, detachBlocks, attachBlocks)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// readJournalBlocks reads the passed number of length prefixed serialized
+// blocks of a reorganization journal from the passed reader.
+func readJournalBlocks(r io.Reader, numBlocks uint32) ([]*btcutil.Block, error) {
+	blocks := make([]*btcutil.Block, 0, numBlocks)
+	for i := uint32(0); i < numBlocks; i++ {
+		var size uint32
+		err := binary.Read(r, binary.LittleEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+		if size > btcwire.MaxBlockPayload {
+			return nil, fmt.Errorf("block of %d bytes exceeds the "+
+				"max of %d", size, btcwire.MaxBlockPayload)
+		}
+		serializedBlock := make([]byte, size)
+		_, err = io.ReadFull(r, serializedBlock)
+		if err != nil {
+			return nil, err
+		}
+		block, err := btcutil.NewBlockFromBytes(serializedBlock,
+			btcwire.ProtocolVersion)
+		if err != nil {
+			return nil, deserializationError(err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// readReorgJournal reads a reorganization journal written by writeReorgJournal
+// from the passed reader.  It returns the hash of the fork point along with the
+// blocks to detach and attach in forwards order.
+func readReorgJournal(r io.Reader) (*btcwire.ShaHash, []*btcutil.Block, []*btcutil.Block, error) {
+	br := bufio.NewReader(r)
+	var header serializedReorgJournalHeader
+	err := binary.Read(br, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if header.Version != reorgJournalVersion {
+		return nil, nil, nil, fmt.Errorf("unsupported version %d",
+			header.Version)
+	}
+
+	detachBlocks, err := readJournalBlocks(br, header.NumDetach)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	attachBlocks, err := readJournalBlocks(br, header.NumAttach)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	forkHash := header.ForkHash
+	return &forkHash, detachBlocks, attachBlocks, nil
+}
+
+// writeJournalBlocks writes the passed blocks to the passed writer prefixed by
+// their lengths.
+func writeJournalBlocks(w io.Writer, blocks []*btcutil.Block) error {
+	for _, block := range blocks {
+		serializedBlock, err := block.Bytes()
+		if err != nil {
+			return err
+		}
+		size := uint32(len(serializedBlock))
+		err = binary.Write(w, binary.LittleEndian, size)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(serializedBlock)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReorgJournal writes a journal for a reorganization to the passed fork
+// point which detaches and attaches the passed blocks to the reorganization
+// journal file.  The journal is written to a temporary file which is then
+// renamed, so the file is either complete or does not exist.
+func (b *BlockChain) writeReorgJournal(forkHash *btcwire.ShaHash, detachBlocks, attachBlocks []*btcutil.Block) error {
+	tmpPath := b.reorgJournalPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0644)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	header := serializedReorgJournalHeader{
+		Version:   reorgJournalVersion,
+		ForkHash:  *forkHash,
+		NumDetach: uint32(len(detachBlocks)),
+		NumAttach: uint32(len(attachBlocks)),
+	}
+	err = binary.Write(bw, binary.LittleEndian, &header)
+	if err == nil {
+		err = writeJournalBlocks(bw, detachBlocks)
+	}
+	if err == nil {
+		err = writeJournalBlocks(bw, attachBlocks)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, b.reorgJournalPath)
+}
+
+// removeReorgJournal removes the reorganization journal file once the
+// reorganization it describes is complete.
+func (b *BlockChain) removeReorgJournal() {
+	err := os.Remove(b.reorgJournalPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Unable to remove reorganization journal %s: %v",
+			b.reorgJournalPath, err)
+	}
+}
+
+// recoverReorg completes an interrupted reorganization to the passed fork point
+// which detaches and attaches the passed blocks.  The end of the main chain is
+// loaded from the database and the blocks after the fork point which are still
+// in it are disconnected with disconnectBlock, followed by connecting the
+// blocks to attach which are not in it yet with connectBlock, so the optional
+// indexes and the caller are notified the same way as for any other
+// reorganization.
+func (b *BlockChain) recoverReorg(forkHash *btcwire.ShaHash, detachBlocks, attachBlocks []*btcutil.Block) error {
+	newestHash, _, err := b.db.NewestSha()
+	if err != nil {
+		return dbError(err)
+	}
+	tip, err := b.loadBlockNode(newestHash)
+	if err != nil {
+		return err
+	}
+	b.chainLock.Lock()
+	b.bestChain = tip
+	b.chainLock.Unlock()
+
+	// Find how many of the blocks to attach were connected before the
+	// crash.  Nothing after the fork point needs to be disconnected when
+	// the end of the main chain is one of them.
+	numConnected := 0
+	for i, block := range attachBlocks {
+		blockHash, err := block.Sha()
+		if err != nil {
+			return deserializationError(err)
+		}
+		if blockHash.IsEqual(newestHash) {
+			numConnected = i + 1
+			break
+		}
+	}
+
+	// Disconnect the blocks to detach which are still in the main chain.
+	// Only journaled blocks may be disconnected, which also makes sure the
+	// fork point is in the main chain.
+	if numConnected == 0 {
+		toDetach := make(map[btcwire.ShaHash]struct{})
+		for _, block := range detachBlocks {
+			blockHash, err := block.Sha()
+			if err != nil {
+				return deserializationError(err)
+			}
+			toDetach[*blockHash] = struct{}{}
+		}
+		for !b.bestChain.hash.IsEqual(forkHash) {
+			node := b.bestChain
+			if _, ok := toDetach[*node.hash]; !ok {
+				return fmt.Errorf("block %v at the end of the "+
+					"main chain is not one of the journaled "+
+					"blocks to disconnect", node.hash)
+			}
+			block, err := b.db.FetchBlockBySha(node.hash)
+			if err != nil {
+				return dbError(err)
+			}
+			log.Infof("Recovering interrupted reorganization by "+
+				"disconnecting block %v", node.hash)
+			err = b.disconnectBlock(node, block)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Load the fork point, which is still missing when some of the blocks
+	// to attach were already connected.
+	forkNode := b.bestChain
+	for !forkNode.hash.IsEqual(forkHash) {
+		forkNode, err = b.getPrevNodeFromNode(forkNode)
+		if err != nil {
+			return err
+		}
+		if forkNode == nil {
+			return fmt.Errorf("fork point %v of the journaled "+
+				"reorganization is not in the main chain", forkHash)
+		}
+	}
+
+	// Connect the remaining blocks to attach.
+	for _, block := range attachBlocks[numConnected:] {
+		prevNode := b.bestChain
+		block.SetHeight(prevNode.height + 1)
+		node := newBlockNode(block)
+		node.parent = prevNode
+		node.workSum.Add(prevNode.workSum, node.workSum)
+		log.Infof("Recovering interrupted reorganization by connecting "+
+			"block %v", node.hash)
+		err := b.connectBlock(node, block, nil)
+		if err != nil {
+			return err
+		}
+		prevNode.children = append(prevNode.children, node)
+	}
+
+	// Add the blocks to detach which were disconnected before the crash to
+	// the side chains.  Those which were disconnected above already are.
+	parent := forkNode
+	for _, block := range detachBlocks {
+		blockHash, _ := block.Sha()
+		if node, ok := b.index[*blockHash]; ok {
+			parent = node
+			continue
+		}
+
+		block.SetHeight(parent.height + 1)
+		node := newBlockNode(block)
+		node.parent = parent
+		node.workSum.Add(parent.workSum, node.workSum)
+		b.chainLock.Lock()
+		parent.children = append(parent.children, node)
+		b.index[*blockHash] = node
+		b.depNodes[*parent.hash] = append(b.depNodes[*parent.hash], node)
+		b.cacheSideChainBlock(blockHash, block)
+		b.chainLock.Unlock()
+		parent = node
+	}
+	return nil
+}
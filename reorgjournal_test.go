@@ -0,0 +1,184 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testIndexer is an Indexer which only keeps track of its tip.  Connecting a
+// block fails with connectErr when it is set.
+type testIndexer struct {
+	tipHash    *btcwire.ShaHash
+	tipHeight  int64
+	connectErr error
+}
+
+// Name returns the name of the index.  It is part of the btcchain.Indexer
+// interface.
+func (idx *testIndexer) Name() string {
+	return "test"
+}
+
+// Tip returns the most recent block the index reflects.  It is part of the
+// btcchain.Indexer interface.
+func (idx *testIndexer) Tip() (*btcwire.ShaHash, int64, error) {
+	return idx.tipHash, idx.tipHeight, nil
+}
+
+// ConnectBlock makes the passed block the tip of the index.  It is part of the
+// btcchain.Indexer interface.
+func (idx *testIndexer) ConnectBlock(block *btcutil.Block) error {
+	if idx.connectErr != nil {
+		return idx.connectErr
+	}
+	idx.tipHash = blockHash(block)
+	idx.tipHeight++
+	return nil
+}
+
+// DisconnectBlock makes the parent of the passed block the tip of the index.
+// It is part of the btcchain.Indexer interface.
+func (idx *testIndexer) DisconnectBlock(block *btcutil.Block) error {
+	prevHash := block.MsgBlock().Header.PrevBlock
+	idx.tipHash = &prevHash
+	idx.tipHeight--
+	return nil
+}
+
+// TestReorgJournalRecovery ensures a reorganization which was interrupted at
+// any point after it was journaled is completed by SetReorgJournal through the
+// same connect and disconnect paths as any other reorganization, so the caller
+// is notified and indexes which were updated before the crash can be brought
+// back in sync with the main chain.
+func TestReorgJournalRecovery(t *testing.T) {
+	// The main chain is a1 <- a2 <- a3 and the reorganization detaches a2
+	// and a3 in favor of b2 <- b3 <- b4.  The crash leaves the database at
+	// a different point of the reorganization in each case.
+	tests := []struct {
+		name          string
+		crash         func(db btcdb.Db, a, b []*btcutil.Block) error
+		wantConnected int
+	}{
+		{
+			name: "before disconnecting",
+			crash: func(db btcdb.Db, a, b []*btcutil.Block) error {
+				return nil
+			},
+			wantConnected: 3,
+		},
+		{
+			name: "part way through disconnecting",
+			crash: func(db btcdb.Db, a, b []*btcutil.Block) error {
+				return db.DropAfterBlockBySha(blockHash(a[1]))
+			},
+			wantConnected: 3,
+		},
+		{
+			name: "between disconnecting and connecting",
+			crash: func(db btcdb.Db, a, b []*btcutil.Block) error {
+				return db.DropAfterBlockBySha(blockHash(a[0]))
+			},
+			wantConnected: 3,
+		},
+		{
+			name: "part way through connecting",
+			crash: func(db btcdb.Db, a, b []*btcutil.Block) error {
+				err := db.DropAfterBlockBySha(blockHash(a[0]))
+				if err != nil {
+					return err
+				}
+				_, err = db.InsertBlock(b[0])
+				return err
+			},
+			wantConnected: 2,
+		},
+	}
+
+	journalPath := filepath.Join(os.TempDir(), "reorgjournaltest.journal")
+	defer os.Remove(journalPath)
+	for i, test := range tests {
+		params := btcchain.RegressionNetParams
+		chain, db, teardown := newTestChain(t, "reorgjournaltest",
+			&params, nil)
+
+		g := newBlockGenerator(&params)
+		mainBlocks := g.nextBlocks(g.genesis(), 3)
+		sideBlocks := g.nextBlocks(mainBlocks[0], 3)
+		processBlocks(t, chain, mainBlocks)
+
+		err := btcchain.TstWriteReorgJournal(journalPath,
+			blockHash(mainBlocks[0]), mainBlocks[1:], sideBlocks)
+		if err != nil {
+			teardown()
+			t.Fatalf("writeReorgJournal #%d (%s): unexpected error %v",
+				i, test.name, err)
+		}
+		if err := test.crash(db, mainBlocks, sideBlocks); err != nil {
+			teardown()
+			t.Fatalf("crash #%d (%s): unexpected error %v", i,
+				test.name, err)
+		}
+
+		// Recover with a new chain instance as would be done after a
+		// restart.
+		c := make(chan *btcchain.Notification, 100)
+		recovered, err := btcchain.New(db, &params, c)
+		if err != nil {
+			teardown()
+			t.Fatalf("New #%d (%s): unexpected error %v", i,
+				test.name, err)
+		}
+		if err := recovered.SetReorgJournal(journalPath); err != nil {
+			teardown()
+			t.Fatalf("SetReorgJournal #%d (%s): unexpected error %v",
+				i, test.name, err)
+		}
+		checkBestBlock(t, test.name, recovered, sideBlocks[2])
+		if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+			t.Errorf("SetReorgJournal #%d (%s): journal was not "+
+				"removed", i, test.name)
+		}
+
+		numConnected := 0
+		for len(c) > 0 {
+			if n := <-c; n.Type == btcchain.NTBlockConnected {
+				numConnected++
+			}
+		}
+		if numConnected != test.wantConnected {
+			t.Errorf("SetReorgJournal #%d (%s): got %d connected "+
+				"notifications, want %d", i, test.name,
+				numConnected, test.wantConnected)
+		}
+
+		// An index which was updated for the old main chain before the
+		// crash is rolled back and then forward to the new one.
+		indexer := &testIndexer{tipHash: blockHash(mainBlocks[2]),
+			tipHeight: 3}
+		if err := recovered.AddIndexer(indexer); err != nil {
+			t.Errorf("AddIndexer #%d (%s): unexpected error %v", i,
+				test.name, err)
+		} else if !indexer.tipHash.IsEqual(blockHash(sideBlocks[2])) ||
+			indexer.tipHeight != 4 {
+
+			t.Errorf("AddIndexer #%d (%s): index tip is %v (height "+
+				"%d), want %v (height 4)", i, test.name,
+				indexer.tipHash, indexer.tipHeight,
+				blockHash(sideBlocks[2]))
+		}
+
+		// New blocks extend the recovered main chain.
+		processBlocks(t, recovered, []*btcutil.Block{
+			g.nextBlock(sideBlocks[2])})
+		teardown()
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// ReorgDepthError identifies a block which was not added to the main chain
+// because doing so would reorganize more blocks than allowed by the limit set
+// via SetMaxReorgDepth.  Unlike a RuleError, it does not mean the block is
+// invalid.  The block is kept on a side chain, so the reorganization happens
+// when a block extending the side chain is processed after the limit is raised.
+type ReorgDepthError struct {
+	Depth    int64
+	MaxDepth int64
+
+	// context describes what was being processed when the error occurred.
+	// See contextError.
+	context string
+}
+
+// Error satisfies the error interface to print human-readable errors.
+func (e ReorgDepthError) Error() string {
+	return fmt.Sprintf("%sreorganization of %d blocks exceeds the maximum "+
+		"depth of %d", e.context, e.Depth, e.MaxDepth)
+}
+
+// ReorgDepthExceeded is the data sent with an NTReorgDepthExceeded
+// notification.  It identifies a side chain with more work than the main chain
+// which was not switched to because the reorganization would be too deep.
+type ReorgDepthExceeded struct {
+	// ForkHash and ForkHeight identify the main chain block the side chain
+	// branches from.
+	ForkHash   *btcwire.ShaHash
+	ForkHeight int64
+
+	// SideTip and SideHeight identify the end of the side chain.
+	SideTip    *btcwire.ShaHash
+	SideHeight int64
+
+	// MainTip and MainHeight identify the end of the main chain.
+	MainTip    *btcwire.ShaHash
+	MainHeight int64
+
+	// Depth is the number of main chain blocks the reorganization would
+	// have disconnected and MaxDepth is the limit it exceeded.
+	Depth    int64
+	MaxDepth int64
+}
+
+// SetMaxReorgDepth sets the maximum number of main chain blocks a
+// reorganization may disconnect.  A side chain which would require a deeper
+// reorganization to become the main chain is kept as a side chain instead, a
+// ReorgDepthError is returned for the block which gave it the most work, and an
+// NTReorgDepthExceeded notification is sent so an operator can decide whether
+// to follow it.  A depth of zero, which is the default, disables the limit.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetMaxReorgDepth(depth int64) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.maxReorgDepth = depth
+}
+
+// checkReorgDepth ensures reorganizing the main chain by disconnecting the
+// passed nodes in order to make the passed node the end of the main chain does
+// not exceed the maximum reorganization depth.  An NTReorgDepthExceeded
+// notification is sent when it does.
+func (b *BlockChain) checkReorgDepth(node *blockNode, detachNodes *list.List) error {
+	depth := int64(detachNodes.Len())
+	if b.maxReorgDepth <= 0 || depth <= b.maxReorgDepth {
+		return nil
+	}
+
+	forkNode := detachNodes.Back().Value.(*blockNode).parent
+	log.Warnf("Refusing to reorganize %d blocks to side chain block %v "+
+		"(height %d) which exceeds the maximum depth of %d", depth,
+		node.hash, node.height, b.maxReorgDepth)
+	alarm := ReorgDepthExceeded{
+		SideTip:    node.hash,
+		SideHeight: node.height,
+		MainTip:    b.bestChain.hash,
+		MainHeight: b.bestChain.height,
+		Depth:      depth,
+		MaxDepth:   b.maxReorgDepth,
+	}
+	if forkNode != nil {
+		alarm.ForkHash = forkNode.hash
+		alarm.ForkHeight = forkNode.height
+	}
+	b.sendNotification(NTReorgDepthExceeded, &alarm)
+
+	return ReorgDepthError{Depth: depth, MaxDepth: b.maxReorgDepth}
+}
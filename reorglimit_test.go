@@ -0,0 +1,92 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"testing"
+)
+
+// TestMaxReorgDepth ensures a side chain which would require a reorganization
+// deeper than the limit stays a side chain, that a ReorgDepthError is returned
+// and an NTReorgDepthExceeded notification is sent for it, and that the
+// reorganization happens once the limit is raised.
+func TestMaxReorgDepth(t *testing.T) {
+	// The main chain is a1 <- a2 <- a3 and the side chain b2 <- b3 <- b4
+	// forks from a1, so b4 requires a reorganization of 2 blocks.
+	tests := []struct {
+		name      string
+		dbName    string
+		maxDepth  int64
+		wantError bool
+	}{
+		{"no limit", "reorglimittest1", 0, false},
+		{"limit at depth", "reorglimittest2", 2, false},
+		{"limit below depth", "reorglimittest3", 1, true},
+	}
+
+	for i, test := range tests {
+		params := btcchain.RegressionNetParams
+		c := make(chan *btcchain.Notification, 100)
+		chain, _, teardown := newTestChain(t, test.dbName, &params, c)
+		defer teardown()
+		chain.SetMaxReorgDepth(test.maxDepth)
+
+		g := newBlockGenerator(&params)
+		mainBlocks := g.nextBlocks(g.genesis(), 3)
+		sideBlocks := g.nextBlocks(mainBlocks[0], 4)
+		processBlocks(t, chain, mainBlocks)
+		processBlocks(t, chain, sideBlocks[:2])
+		for len(c) > 0 {
+			<-c
+		}
+
+		_, _, err := chain.ProcessBlock(sideBlocks[2])
+		if !test.wantError {
+			if err != nil {
+				t.Fatalf("ProcessBlock #%d (%s): unexpected error "+
+					"%v", i, test.name, err)
+			}
+			checkBestBlock(t, test.name, chain, sideBlocks[2])
+			continue
+		}
+
+		if _, ok := err.(btcchain.ReorgDepthError); !ok {
+			t.Fatalf("ProcessBlock #%d (%s): got %v, want a "+
+				"ReorgDepthError", i, test.name, err)
+		}
+		checkBestBlock(t, test.name, chain, mainBlocks[2])
+		if !chain.HaveBlock(blockHash(sideBlocks[2])) {
+			t.Errorf("HaveBlock #%d (%s): side chain block is not "+
+				"known", i, test.name)
+		}
+
+		var alarm *btcchain.ReorgDepthExceeded
+		for len(c) > 0 {
+			n := <-c
+			if n.Type == btcchain.NTReorgDepthExceeded {
+				alarm = n.Data.(*btcchain.ReorgDepthExceeded)
+			}
+		}
+		if alarm == nil {
+			t.Fatalf("ProcessBlock #%d (%s): no NTReorgDepthExceeded "+
+				"notification", i, test.name)
+		}
+		if !alarm.ForkHash.IsEqual(blockHash(mainBlocks[0])) ||
+			!alarm.SideTip.IsEqual(blockHash(sideBlocks[2])) ||
+			!alarm.MainTip.IsEqual(blockHash(mainBlocks[2])) ||
+			alarm.Depth != 2 || alarm.MaxDepth != test.maxDepth {
+
+			t.Errorf("NTReorgDepthExceeded #%d (%s): got %+v", i,
+				test.name, alarm)
+		}
+
+		// The side chain becomes the main chain once the limit is
+		// raised and it is extended.
+		chain.SetMaxReorgDepth(2)
+		processBlocks(t, chain, sideBlocks[3:])
+		checkBestBlock(t, test.name, chain, sideBlocks[3])
+	}
+}
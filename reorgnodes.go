@@ -0,0 +1,80 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// ReorgBlocks describes the blocks which would be disconnected from and
+// connected to the main chain in order to reorganize the chain to a given
+// block.  See GetReorganizeBlocks.
+type ReorgBlocks struct {
+	// ForkHash and ForkHeight identify the main chain block which would
+	// become the end of the main chain after disconnecting the blocks.
+	ForkHash   *btcwire.ShaHash
+	ForkHeight int64
+
+	// Detach houses the hashes of the main chain blocks which would be
+	// disconnected starting from the end of the main chain.
+	Detach []*btcwire.ShaHash
+
+	// Attach houses the hashes of the blocks which would be connected
+	// starting from the block directly after the fork point.
+	Attach []*btcwire.ShaHash
+
+	// WorkCmp is -1, 0, or +1 depending on whether the chain ending with
+	// the block has less, the same, or more work than the main chain.  A
+	// reorganization only takes place on its own when it has more.
+	WorkCmp int
+}
+
+// GetReorganizeBlocks returns the blocks which would be disconnected from and
+// connected to the main chain if the chain were reorganized such that the
+// block with the passed hash became the end of the main chain, without
+// performing the reorganization.  The block may be on a side chain, part of the
+// main chain, or a header processed via ProcessBlockHeader.  This is intended
+// for evaluating fork scenarios, such as by mining pools and monitoring tools.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) GetReorganizeBlocks(hash *btcwire.ShaHash) (*ReorgBlocks, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return nil, fmt.Errorf("the main chain has not been " +
+			"initialized yet")
+	}
+	node, ok := b.headerIndex[*hash]
+	if !ok {
+		var err error
+		node, err = b.lookupNode(hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	detachNodes, attachNodes := b.getReorganizeNodes(node)
+	reorg := ReorgBlocks{
+		ForkHash:   b.bestChain.hash,
+		ForkHeight: b.bestChain.height,
+		Detach:     make([]*btcwire.ShaHash, 0, detachNodes.Len()),
+		Attach:     make([]*btcwire.ShaHash, 0, attachNodes.Len()),
+		WorkCmp:    node.workSum.Cmp(b.bestChain.workSum),
+	}
+	for e := detachNodes.Front(); e != nil; e = e.Next() {
+		n := e.Value.(*blockNode)
+		reorg.Detach = append(reorg.Detach, n.hash)
+		reorg.ForkHash = n.parent.hash
+		reorg.ForkHeight = n.parent.height
+	}
+	for e := attachNodes.Front(); e != nil; e = e.Next() {
+		n := e.Value.(*blockNode)
+		reorg.Attach = append(reorg.Attach, n.hash)
+	}
+	return &reorg, nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// blockHashes returns the hashes of the passed blocks.
+func blockHashes(blocks ...*btcutil.Block) []*btcwire.ShaHash {
+	hashes := make([]*btcwire.ShaHash, 0, len(blocks))
+	for _, block := range blocks {
+		hashes = append(hashes, blockHash(block))
+	}
+	return hashes
+}
+
+// TestGetReorganizeBlocks ensures GetReorganizeBlocks returns the blocks which
+// would be disconnected and connected to make a side chain block, a main chain
+// block, or a header-only block the end of the main chain.
+func TestGetReorganizeBlocks(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "reorgnodestest", &params, nil)
+	defer teardown()
+
+	// The main chain is a1 <- a2 <- a3 <- a4, the side chain b2 <- b3
+	// forks from a1, and only the header of a5 is known.
+	g := newBlockGenerator(&params)
+	a := g.nextBlocks(g.genesis(), 5)
+	b := g.nextBlocks(a[0], 2)
+	processBlocks(t, chain, a[:4])
+	processBlocks(t, chain, b)
+	err := chain.ProcessBlockHeader(&a[4].MsgBlock().Header, btcchain.BFNone)
+	if err != nil {
+		t.Fatalf("ProcessBlockHeader: unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		block *btcutil.Block
+		want  btcchain.ReorgBlocks
+	}{
+		{
+			name:  "side chain",
+			block: b[1],
+			want: btcchain.ReorgBlocks{
+				ForkHash:   blockHash(a[0]),
+				ForkHeight: 1,
+				Detach:     blockHashes(a[3], a[2], a[1]),
+				Attach:     blockHashes(b[0], b[1]),
+				WorkCmp:    -1,
+			},
+		},
+		{
+			name:  "main chain ancestor",
+			block: a[1],
+			want: btcchain.ReorgBlocks{
+				ForkHash:   blockHash(a[1]),
+				ForkHeight: 2,
+				Detach:     blockHashes(a[3], a[2]),
+				Attach:     blockHashes(),
+				WorkCmp:    -1,
+			},
+		},
+		{
+			name:  "end of the main chain",
+			block: a[3],
+			want: btcchain.ReorgBlocks{
+				ForkHash:   blockHash(a[3]),
+				ForkHeight: 4,
+				Detach:     blockHashes(),
+				Attach:     blockHashes(),
+				WorkCmp:    0,
+			},
+		},
+		{
+			name:  "header only",
+			block: a[4],
+			want: btcchain.ReorgBlocks{
+				ForkHash:   blockHash(a[3]),
+				ForkHeight: 4,
+				Detach:     blockHashes(),
+				Attach:     blockHashes(a[4]),
+				WorkCmp:    1,
+			},
+		},
+	}
+
+	for i, test := range tests {
+		got, err := chain.GetReorganizeBlocks(blockHash(test.block))
+		if err != nil {
+			t.Errorf("GetReorganizeBlocks #%d (%s): unexpected error "+
+				"%v", i, test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("GetReorganizeBlocks #%d (%s): got %+v, want %+v",
+				i, test.name, *got, test.want)
+		}
+	}
+}
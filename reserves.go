@@ -0,0 +1,134 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// ReservesStatement describes a set of unspent outputs and their total value
+// as of a specific main chain block.  It is produced by ProveReserves.
+type ReservesStatement struct {
+	// BlockHash and Height identify the main chain block the outputs were
+	// verified to be unspent as of.
+	BlockHash *btcwire.ShaHash
+	Height    int64
+
+	// OutPoints are the verified outputs in the order they were passed.
+	OutPoints []btcwire.OutPoint
+
+	// Total is the sum of the values of the outputs in satoshi.
+	Total int64
+}
+
+// Digest returns the double sha256 of the serialized statement.  The statement
+// is serialized as the block hash, the height, the number of outputs, each of
+// the outputs as a hash and index, and finally the total, with all integers in
+// little endian.  Anyone with the same statement can recalculate the digest in
+// order to verify it was not modified after it was published.
+func (s *ReservesStatement) Digest() *btcwire.ShaHash {
+	var buf bytes.Buffer
+	buf.Write(s.BlockHash.Bytes())
+	binary.Write(&buf, binary.LittleEndian, s.Height)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(s.OutPoints)))
+	for _, outPoint := range s.OutPoints {
+		buf.Write(outPoint.Hash.Bytes())
+		binary.Write(&buf, binary.LittleEndian, outPoint.Index)
+	}
+	binary.Write(&buf, binary.LittleEndian, s.Total)
+
+	// Ignore the error since NewShaHash can't fail due to the fact
+	// DoubleSha256 always returns a []byte of the right size.
+	digest, _ := btcwire.NewShaHash(btcwire.DoubleSha256(buf.Bytes()))
+	return digest
+}
+
+// fetchUnspentOutputValue returns the value of the passed output when it is
+// unspent as of the end of the main chain.  An error is returned when the
+// output does not exist or is spent.
+func (b *BlockChain) fetchUnspentOutputValue(outPoint *btcwire.OutPoint) (int64, error) {
+	txReplies, err := b.db.FetchTxBySha(&outPoint.Hash)
+	if err != nil && err != btcdb.TxShaMissing {
+		return 0, err
+	}
+
+	// There can be several transactions with the same hash in the main
+	// chain (see BIP0030), in which case the most recent one is the one
+	// which can be spent.
+	var txReply *btcdb.TxListReply
+	for _, reply := range txReplies {
+		if reply.Err != nil {
+			continue
+		}
+		if txReply == nil || reply.Height > txReply.Height {
+			txReply = reply
+		}
+	}
+	if txReply == nil {
+		return 0, fmt.Errorf("output %v:%d does not exist in the main "+
+			"chain", outPoint.Hash, outPoint.Index)
+	}
+	if outPoint.Index >= uint32(len(txReply.Tx.TxOut)) {
+		return 0, fmt.Errorf("transaction %v does not have an output "+
+			"at index %d", outPoint.Hash, outPoint.Index)
+	}
+	if txReply.TxSpent[outPoint.Index] {
+		return 0, fmt.Errorf("output %v:%d is spent", outPoint.Hash,
+			outPoint.Index)
+	}
+
+	return txReply.Tx.TxOut[outPoint.Index].Value, nil
+}
+
+// ProveReserves verifies all of the passed outputs are unspent as of the end of
+// the main chain and returns a statement of their total value.  This is
+// intended for proof of reserves workflows where an operator claims a set of
+// outputs and the claim needs to be checked against the chain.  An error is
+// returned if any of the outputs do not exist, are spent, or are passed more
+// than once.
+//
+// Note that this only verifies the outputs are unspent.  Proving control of
+// them, such as by signing a message with the associated keys, is left to the
+// caller.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) ProveReserves(outPoints []btcwire.OutPoint) (*ReservesStatement, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return nil, fmt.Errorf("the main chain has not been " +
+			"initialized yet")
+	}
+
+	statement := ReservesStatement{
+		BlockHash: b.bestChain.hash,
+		Height:    b.bestChain.height,
+		OutPoints: make([]btcwire.OutPoint, 0, len(outPoints)),
+	}
+	seen := make(map[btcwire.OutPoint]struct{}, len(outPoints))
+	for i := range outPoints {
+		outPoint := &outPoints[i]
+		if _, ok := seen[*outPoint]; ok {
+			return nil, fmt.Errorf("output %v:%d is included more "+
+				"than once", outPoint.Hash, outPoint.Index)
+		}
+		seen[*outPoint] = struct{}{}
+
+		value, err := b.fetchUnspentOutputValue(outPoint)
+		if err != nil {
+			return nil, err
+		}
+		statement.OutPoints = append(statement.OutPoints, *outPoint)
+		statement.Total += value
+	}
+
+	return &statement, nil
+}
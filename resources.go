@@ -0,0 +1,230 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"time"
+)
+
+// ResourceError identifies a block or header which was not processed because
+// doing so would exceed the resource limits set via SetResourceLimits or, for
+// orphan blocks, because the difficulty they claim is implausible.  Unlike a
+// RuleError, it does not mean the block or header is invalid.
+type ResourceError string
+
+// Error satisfies the error interface to print human-readable errors.
+func (e ResourceError) Error() string {
+	return string(e)
+}
+
+// ResourceLimits defines caps on the memory used by the block chain.  A zero
+// value for any field means the package default is used, which is no limit
+// apart from the number and age of orphan blocks and the number of spend
+// journal blocks.  See SetResourceLimits.
+type ResourceLimits struct {
+	// MaxSideChainDepth is the maximum number of blocks below the end of
+	// the main chain a side chain block may be at and still be held in
+	// memory.  Blocks which would be deeper are rejected and those which
+	// become deeper as the main chain grows are discarded along with any
+	// blocks which build on them.  This also limits how deep a
+	// reorganization can be.
+	MaxSideChainDepth int64
+
+	// MaxOrphanBlocks is the maximum number of orphan blocks held in
+	// memory and MaxOrphanBytes is the maximum total serialized size in
+	// bytes of them.  The oldest orphans are discarded to make room for
+	// new ones and an orphan larger than MaxOrphanBytes on its own is
+	// rejected.  Since orphans are held before their parents are known,
+	// anyone can create them, so these limits prevent them from being
+	// used to exhaust memory.
+	MaxOrphanBlocks int
+	MaxOrphanBytes  int64
+
+	// MaxOrphanAge is the maximum amount of time an orphan block is held
+	// in memory while waiting for its parent.  Orphans which have been
+	// held for longer are discarded as blocks are processed.
+	MaxOrphanAge time.Duration
+
+	// MaxHeaders is the maximum number of headers without a block which
+	// are held in memory.  Headers beyond it are rejected until blocks are
+	// processed for them.
+	MaxHeaders int
+
+	// MaxSpendJournalBlocks is the maximum number of the most recent main
+	// chain blocks whose spent outputs are kept in memory.  It limits how
+	// far back FetchUtxoAtHeight and FetchBlockSpends can use the journal.
+	MaxSpendJournalBlocks int
+
+	// MaxMemory is the maximum total serialized size in bytes of the
+	// blocks held in memory as orphans or on side chains.  Blocks which
+	// would need to be held in memory beyond it are rejected without being
+	// processed unless side chain blocks persisted via
+	// SetSideChainBlockDir can be evicted from memory to make room.  Blocks
+	// which extend the main chain are always admitted since they are not
+	// held in memory once connected.
+	MaxMemory int64
+}
+
+// EmbeddedResourceLimits is a constrained profile intended for embedded and
+// mobile devices which still perform full validation.  Since block nodes only
+// contain header data and main chain blocks are never held in memory, the
+// memory used is bounded by these limits plus the block index and the
+// transactions of the block being validated.  Reorganizations deeper than 6
+// blocks and headers-first synchronization more than a retarget interval ahead
+// of the blocks are not supported with it.
+var EmbeddedResourceLimits = ResourceLimits{
+	MaxSideChainDepth:     6,
+	MaxOrphanBlocks:       10,
+	MaxOrphanBytes:        4 * 1024 * 1024,
+	MaxHeaders:            2016,
+	MaxSpendJournalBlocks: 144,
+	MaxMemory:             16 * 1024 * 1024,
+}
+
+// SetResourceLimits sets the caps on the memory used by the block chain.  It is
+// typically used with EmbeddedResourceLimits.  Side chain blocks which are
+// deeper than the new limit are discarded immediately while the other limits
+// apply as new blocks and headers are processed.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetResourceLimits(limits ResourceLimits) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.resourceLimits = limits
+	b.pruneSideChains()
+}
+
+// orphanLimit returns the maximum number of orphan blocks to hold.
+func (b *BlockChain) orphanLimit() int {
+	if b.resourceLimits.MaxOrphanBlocks > 0 {
+		return b.resourceLimits.MaxOrphanBlocks
+	}
+	return maxOrphanBlocks
+}
+
+// orphanAge returns the maximum amount of time to hold orphan blocks.
+func (b *BlockChain) orphanAge() time.Duration {
+	if b.resourceLimits.MaxOrphanAge > 0 {
+		return b.resourceLimits.MaxOrphanAge
+	}
+	return maxOrphanAge
+}
+
+// spendJournalLimit returns the maximum number of blocks to keep in the spend
+// journal.
+func (b *BlockChain) spendJournalLimit() int {
+	if b.resourceLimits.MaxSpendJournalBlocks > 0 {
+		return b.resourceLimits.MaxSpendJournalBlocks
+	}
+	return maxSpendJournalBlocks
+}
+
+// heldBlockBytes returns the total serialized size of the blocks held in memory
+// as orphans or on side chains.  Both totals are kept up to date as blocks are
+// added and removed, so this does not need to look at the blocks.
+func (b *BlockChain) heldBlockBytes() int64 {
+	return b.orphanBytes + b.blockCacheBytes
+}
+
+// checkBlockAdmission returns a ResourceError when processing the passed block
+// would exceed the resource limits.  Blocks which extend the end of the main
+// chain are always admitted.
+func (b *BlockChain) checkBlockAdmission(block *btcutil.Block) error {
+	limits := &b.resourceLimits
+	prevHash := &block.MsgBlock().Header.PrevBlock
+	if b.bestChain == nil || prevHash.IsEqual(b.bestChain.hash) {
+		return nil
+	}
+
+	// Reject side chain blocks which would be too deep to hold.
+	if prevNode, ok := b.index[*prevHash]; ok && limits.MaxSideChainDepth > 0 {
+		depth := b.bestChain.height - (prevNode.height + 1)
+		if depth > limits.MaxSideChainDepth {
+			str := fmt.Sprintf("side chain block at depth %d exceeds "+
+				"the max allowed depth of %d", depth,
+				limits.MaxSideChainDepth)
+			return ResourceError(str)
+		}
+	}
+
+	// Reject blocks which would exceed the memory ceiling unless enough
+	// side chain blocks which are persisted to the side chain block
+	// directory can be evicted from memory to make room for them.
+	if limits.MaxMemory > 0 {
+		serializedBlock, err := block.Bytes()
+		if err != nil {
+			return err
+		}
+		excess := b.heldBlockBytes() + int64(len(serializedBlock)) -
+			limits.MaxMemory
+		if excess > 0 {
+			excess -= b.evictSideChainBlocks(excess)
+		}
+		if excess > 0 {
+			str := fmt.Sprintf("holding block would exceed the max "+
+				"allowed memory of %d bytes", limits.MaxMemory)
+			return ResourceError(str)
+		}
+	}
+
+	return nil
+}
+
+// removeSideChainNode removes the passed side chain node along with all of the
+// nodes which build on it from memory.  It must be called with the chain lock
+// held for writes.
+func (b *BlockChain) removeSideChainNode(node *blockNode) {
+	for _, child := range node.children {
+		b.removeSideChainNode(child)
+	}
+	node.children = nil
+
+	b.uncacheSideChainBlock(node.hash)
+	delete(b.index, *node.hash)
+	if node.parent != nil {
+		prevHash := node.parent.hash
+		node.parent.children = removeChildNode(node.parent.children, node)
+		b.depNodes[*prevHash] = removeChildNode(b.depNodes[*prevHash], node)
+		if len(b.depNodes[*prevHash]) == 0 {
+			delete(b.depNodes, *prevHash)
+		}
+	}
+}
+
+// pruneSideChains discards the side chain blocks which are deeper than the max
+// allowed side chain depth along with the blocks which build on them.
+func (b *BlockChain) pruneSideChains() {
+	maxDepth := b.resourceLimits.MaxSideChainDepth
+	if maxDepth <= 0 || b.bestChain == nil {
+		return
+	}
+
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	for _, node := range b.sideChainNodes() {
+		// Skip nodes which were already removed along with a side chain
+		// they build on.
+		if _, ok := b.index[*node.hash]; !ok {
+			continue
+		}
+		if b.bestChain.height-node.height <= maxDepth {
+			continue
+		}
+
+		// Remove the side chain starting from its deepest block so no
+		// blocks which build on a discarded block are left behind.
+		for node.parent != nil && !node.parent.inMainChain {
+			node = node.parent
+		}
+		log.Debugf("Discarding side chain starting with block %v "+
+			"(height %d)", node.hash, node.height)
+		b.removeSideChainNode(node)
+	}
+}
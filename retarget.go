@@ -0,0 +1,229 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"math/big"
+	"time"
+)
+
+// RetargetNode describes a block in the chain for the purposes of calculating
+// the difficulty of the blocks after it.
+type RetargetNode struct {
+	Hash      *btcwire.ShaHash
+	Height    int64
+	Bits      uint32
+	Timestamp time.Time
+
+	// node is the block node the retarget node was created from.  It is
+	// used to find the previous blocks.
+	node *blockNode
+}
+
+// newRetargetNode returns a retarget node for the passed block node.
+func newRetargetNode(node *blockNode) *RetargetNode {
+	return &RetargetNode{
+		Hash:      node.hash,
+		Height:    node.height,
+		Bits:      node.bits,
+		Timestamp: node.timestamp,
+		node:      node,
+	}
+}
+
+// RetargetHistory provides access to the blocks before a retarget node so a
+// Retargeter can examine as many of them as its algorithm requires.
+type RetargetHistory interface {
+	// PrevNode returns the block before the passed one.  It returns nil
+	// when the passed block is the genesis block.
+	PrevNode(node *RetargetNode) (*RetargetNode, error)
+}
+
+// Retargeter defines an interface for the difficulty retarget algorithm of a
+// network.  It allows networks with different retarget windows or algorithms,
+// such as retargeting after every block, to use this package.  The algorithm is
+// selected by the Retargeter of the network parameters and is the Bitcoin one
+// returned by NewBitcoinRetargeter when that is nil.
+type Retargeter interface {
+	// NextRequiredBits returns the difficulty bits the block after the
+	// passed last block must have.  The last block is nil when the next
+	// block is the genesis block.  Algorithms which depend on the blocks
+	// before the last one, such as the last retarget block and the
+	// timestamps since, fetch them from the passed history.
+	NextRequiredBits(params *Params, lastNode *RetargetNode, history RetargetHistory) (uint32, error)
+
+	// EasiestBits returns the easiest difficulty bits a block may have
+	// when the passed duration has elapsed since a block with the passed
+	// difficulty bits.  It is used to reject headers which claim less
+	// work than possible since the latest checkpoint.
+	EasiestBits(params *Params, bits uint32, duration time.Duration) uint32
+}
+
+// bitcoinRetargeter provides an implementation of the Retargeter interface
+// using the difficulty retarget rules of bitcoin.
+type bitcoinRetargeter struct{}
+
+// Ensure the bitcoinRetargeter type implements the Retargeter interface.
+var _ Retargeter = bitcoinRetargeter{}
+
+// NextRequiredBits calculates the required difficulty for the block after the
+// passed last block.  The difficulty only changes every blocksPerRetarget
+// blocks, based on the time it took to generate the previous interval of
+// blocks, unless retargeting is disabled for the network.
+//
+// This is part of the Retargeter interface implementation.
+func (bitcoinRetargeter) NextRequiredBits(params *Params, lastNode *RetargetNode, history RetargetHistory) (uint32, error) {
+	powLimit := params.PowLimit
+	targetTimespan := params.TargetTimespan
+	blocksPerRetarget := params.blocksPerRetarget()
+
+	// Genesis block.
+	if lastNode == nil {
+		return BigToCompact(powLimit), nil
+	}
+
+	// Return the previous block's difficulty requirements if this block
+	// is not at a difficulty retarget interval or retargeting is disabled.
+	if params.PowNoRetargeting ||
+		(lastNode.Height+1)%blocksPerRetarget != 0 {
+
+		// TODO(davec): Testnet has special rules.
+		return lastNode.Bits, nil
+	}
+
+	// Get the block node at the previous retarget (targetTimespan days
+	// worth of blocks).
+	firstNode := lastNode
+	for i := int64(0); i < blocksPerRetarget-1 && firstNode != nil; i++ {
+		var err error
+		firstNode, err = history.PrevNode(firstNode)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if firstNode == nil {
+		return 0, fmt.Errorf("unable to obtain previous retarget block")
+	}
+
+	// Limit the amount of adjustment that can occur to the previous
+	// difficulty.
+	actualTimespan := lastNode.Timestamp.UnixNano() - firstNode.Timestamp.UnixNano()
+	adjustedTimespan := actualTimespan
+	if minTimespan := params.minRetargetTimespan(); actualTimespan < minTimespan {
+		adjustedTimespan = minTimespan
+	} else if maxTimespan := params.maxRetargetTimespan(); actualTimespan > maxTimespan {
+		adjustedTimespan = maxTimespan
+	}
+
+	// Calculate new target difficulty as:
+	//  currentDifficulty * (adjustedTimespan / targetTimespan)
+	// The result uses integer division which means it will be slightly
+	// rounded down.  Bitcoind also uses integer division to calculate this
+	// result.
+	oldTarget := CompactToBig(lastNode.Bits)
+	newTarget := new(big.Int).Mul(oldTarget, big.NewInt(adjustedTimespan))
+	newTarget.Div(newTarget, big.NewInt(int64(targetTimespan)))
+
+	// Limit new value to the proof of work limit.
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+
+	// Log new target difficulty and return it.  The new target logging is
+	// intentionally converting the bits back to a number instead of using
+	// newTarget since conversion to the compact representation loses
+	// precision.
+	newTargetBits := BigToCompact(newTarget)
+	log.Debugf("Difficulty retarget at block height %d", lastNode.Height+1)
+	log.Debugf("Old target %08x (%064x)", lastNode.Bits, oldTarget)
+	log.Debugf("New target %08x (%064x)", newTargetBits, CompactToBig(newTargetBits))
+	log.Debugf("Actual timespan %v, adjusted timespan %v, target timespan %v",
+		time.Duration(actualTimespan), time.Duration(adjustedTimespan),
+		targetTimespan)
+
+	return newTargetBits, nil
+}
+
+// EasiestBits calculates the easiest possible difficulty that a block can have
+// given starting difficulty bits and a duration.  It is the starting difficulty
+// multiplied by the max adjustment factor for every retarget which could have
+// occurred during the duration.
+//
+// This is part of the Retargeter interface implementation.
+func (bitcoinRetargeter) EasiestBits(params *Params, bits uint32, duration time.Duration) uint32 {
+	// The difficulty never changes when retargeting is disabled.
+	if params.PowNoRetargeting {
+		return bits
+	}
+
+	// Convert types used in the calculations below.
+	durationVal := int64(duration)
+	adjustmentFactor := big.NewInt(params.RetargetAdjustmentFactor)
+	maxRetargetTimespan := params.maxRetargetTimespan()
+	powLimit := params.PowLimit
+
+	// TODO(davec): Testnet has special rules.
+
+	// Since easier difficulty equates to higher numbers, the easiest
+	// difficulty for a given duration is the largest value possible given
+	// the number of retargets for the duration and starting difficulty
+	// multiplied by the max adjustment factor.
+	newTarget := CompactToBig(bits)
+	for durationVal > 0 && newTarget.Cmp(powLimit) < 0 {
+		newTarget.Mul(newTarget, adjustmentFactor)
+		durationVal -= maxRetargetTimespan
+	}
+
+	// Limit new value to the proof of work limit.
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+
+	return BigToCompact(newTarget)
+}
+
+// NewBitcoinRetargeter returns the Retargeter implementing the difficulty
+// retarget rules of bitcoin, which is used when the network parameters do not
+// specify one.  Alternative retargeters may wrap it, for instance to only
+// change the rules after a given height.
+func NewBitcoinRetargeter() Retargeter {
+	return bitcoinRetargeter{}
+}
+
+// chainRetargetHistory provides an implementation of the RetargetHistory
+// interface backed by the block nodes of a chain.
+type chainRetargetHistory struct {
+	b *BlockChain
+}
+
+// PrevNode returns the block before the passed one.  The previous block node
+// is obtained with getPrevNodeFromNode over simply accessing the parent
+// directly as it will dynamically create previous block nodes as needed.  This
+// helps allow only the pieces of the chain that are needed to remain in
+// memory.
+//
+// This is part of the RetargetHistory interface implementation.
+func (h chainRetargetHistory) PrevNode(node *RetargetNode) (*RetargetNode, error) {
+	if node.node == nil {
+		return nil, fmt.Errorf("retarget node %v is not from the chain",
+			node.Hash)
+	}
+	prevNode, err := h.b.getPrevNodeFromNode(node.node)
+	if err != nil || prevNode == nil {
+		return nil, err
+	}
+	return newRetargetNode(prevNode), nil
+}
+
+// retargeter returns the difficulty retarget algorithm of the network.
+func (b *BlockChain) retargeter() Retargeter {
+	if b.chainParams.Retargeter != nil {
+		return b.chainParams.Retargeter
+	}
+	return bitcoinRetargeter{}
+}
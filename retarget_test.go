@@ -0,0 +1,94 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"testing"
+	"time"
+)
+
+// testRetargetHistory provides a RetargetHistory for a chain of blocks which
+// are spaced evenly in time.
+type testRetargetHistory struct {
+	bits    uint32
+	spacing time.Duration
+	start   time.Time
+}
+
+// node returns the retarget node at the passed height.
+func (h *testRetargetHistory) node(height int64) *btcchain.RetargetNode {
+	return &btcchain.RetargetNode{
+		Height:    height,
+		Bits:      h.bits,
+		Timestamp: h.start.Add(time.Duration(height) * h.spacing),
+	}
+}
+
+// PrevNode returns the block before the passed one.
+func (h *testRetargetHistory) PrevNode(node *btcchain.RetargetNode) (*btcchain.RetargetNode, error) {
+	if node.Height == 0 {
+		return nil, nil
+	}
+	return h.node(node.Height - 1), nil
+}
+
+// TestBitcoinRetargeter ensures the bitcoin retarget algorithm only changes the
+// difficulty at retarget intervals and adjusts it by the expected amount.
+func TestBitcoinRetargeter(t *testing.T) {
+	retargeter := btcchain.NewBitcoinRetargeter()
+	params := &btcchain.MainNetParams
+	history := &testRetargetHistory{
+		bits:    0x1b0404cb,
+		spacing: params.TargetTimePerBlock,
+		start:   time.Unix(1300000000, 0),
+	}
+
+	// The difficulty must not change between retarget intervals.
+	bits, err := retargeter.NextRequiredBits(params, history.node(2014),
+		history)
+	if err != nil {
+		t.Fatalf("NextRequiredBits: unexpected error %v", err)
+	}
+	if bits != history.bits {
+		t.Errorf("NextRequiredBits: got %08x want %08x", bits,
+			history.bits)
+	}
+
+	// Blocks generated much slower than the target rate must result in a
+	// lower difficulty which is limited to a quarter of the previous one.
+	history.spacing = time.Hour
+	bits, err = retargeter.NextRequiredBits(params, history.node(2015),
+		history)
+	if err != nil {
+		t.Fatalf("NextRequiredBits: unexpected error %v", err)
+	}
+	if want := uint32(0x1b10132c); bits != want {
+		t.Errorf("NextRequiredBits: got %08x want %08x", bits, want)
+	}
+
+	// Blocks generated much faster than the target rate must result in a
+	// higher difficulty which is limited to four times the previous one.
+	history.spacing = time.Second
+	bits, err = retargeter.NextRequiredBits(params, history.node(2015),
+		history)
+	if err != nil {
+		t.Fatalf("NextRequiredBits: unexpected error %v", err)
+	}
+	if want := uint32(0x1b010132); bits != want {
+		t.Errorf("NextRequiredBits: got %08x want %08x", bits, want)
+	}
+
+	// The difficulty must never change when retargeting is disabled.
+	bits, err = retargeter.NextRequiredBits(&btcchain.RegressionNetParams,
+		history.node(2015), history)
+	if err != nil {
+		t.Fatalf("NextRequiredBits: unexpected error %v", err)
+	}
+	if bits != history.bits {
+		t.Errorf("NextRequiredBits: got %08x want %08x", bits,
+			history.bits)
+	}
+}
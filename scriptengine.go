@@ -0,0 +1,107 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+)
+
+// ScriptInput describes a transaction input whose script is to be verified.
+type ScriptInput struct {
+	// Tx is the spending transaction and TxInIndex is the index of the
+	// input within it.
+	Tx        *btcwire.MsgTx
+	TxInIndex int
+
+	// PkScript is the public key script of the output the input spends.
+	PkScript []byte
+
+	// ProtocolVersion is the protocol version the transaction was decoded
+	// with.
+	ProtocolVersion uint32
+}
+
+// ScriptEngine defines an interface for verifying the scripts of transaction
+// inputs.  It allows alternative script engines, such as instrumented ones or
+// those for other chains, to be used in place of btcscript.  See
+// NewWithScriptEngine.
+//
+// VerifyScript is called concurrently from multiple goroutines, so
+// implementations must be safe for concurrent access and must enforce all of
+// the rules indicated by the flags.
+type ScriptEngine interface {
+	// VerifyScript returns an error when the signature script of the
+	// passed input does not satisfy the public key script it spends under
+	// the rules defined by the passed flags.
+	VerifyScript(input *ScriptInput, flags ScriptFlags) error
+}
+
+// BatchScriptEngine is an optional interface a ScriptEngine may implement to
+// verify all of the inputs of a block at once instead of being called for each
+// input from a pool of goroutines.  This allows engines to do their own
+// scheduling, such as batching the signature checks, while still validating in
+// parallel.
+type BatchScriptEngine interface {
+	ScriptEngine
+
+	// VerifyScripts returns an error when the script of any of the passed
+	// inputs is not valid under the rules defined by the passed flags.
+	VerifyScripts(inputs []*ScriptInput, flags ScriptFlags) error
+}
+
+// btcscriptEngine provides an implementation of the ScriptEngine interface
+// which is backed by btcscript.
+type btcscriptEngine struct{}
+
+// Ensure the btcscriptEngine type implements the ScriptEngine interface.
+var _ ScriptEngine = btcscriptEngine{}
+
+// VerifyScript executes the scripts of the passed input with btcscript.  When
+// the flags enable rules which btcscript does not support, the scripts are
+// executed one opcode at a time so the rules are enforced as the opcodes they
+// apply to are executed.  See executeScript.
+//
+// This function is safe for concurrent access and is part of the ScriptEngine
+// interface implementation.
+func (btcscriptEngine) VerifyScript(input *ScriptInput, flags ScriptFlags) error {
+	engine, err := newScriptEngine(input, flags)
+	if err != nil {
+		return err
+	}
+	if flags&stepRuleFlags == 0 {
+		return engine.Execute()
+	}
+	return executeScript(engine, input, flags)
+}
+
+// newScriptEngine returns a btcscript engine which executes the scripts of the
+// passed input with the BIP0016 rules enabled when the passed flags include
+// them.
+func newScriptEngine(input *ScriptInput, flags ScriptFlags) (*btcscript.Script, error) {
+	txIn := input.Tx.TxIn[input.TxInIndex]
+	return btcscript.NewScript(txIn.SignatureScript, input.PkScript,
+		input.TxInIndex, input.Tx, input.ProtocolVersion,
+		flags&ScriptBip16 == ScriptBip16)
+}
+
+// NewBtcscriptEngine returns the ScriptEngine backed by btcscript which is used
+// by chains created with New.  Alternative engines may wrap it, for instance to
+// gather statistics.
+func NewBtcscriptEngine() ScriptEngine {
+	return btcscriptEngine{}
+}
+
+// NewWithScriptEngine is the same as New except the scripts of transaction
+// inputs are verified with the passed script engine instead of btcscript.
+func NewWithScriptEngine(db btcdb.Db, params *Params, c chan *Notification, engine ScriptEngine) (*BlockChain, error) {
+	b, err := New(db, params, c)
+	if err != nil {
+		return nil, err
+	}
+	b.scriptEngine = engine
+	return b, nil
+}
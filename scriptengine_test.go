@@ -0,0 +1,559 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"errors"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+	"testing"
+)
+
+// lockTimeTx returns a transaction with a lock time of 100 and a single input
+// with the passed signature script which does not disable the lock time.
+func lockTimeTx(sigScript []byte) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx()
+	tx.LockTime = 100
+	tx.AddTxIn(&btcwire.TxIn{
+		PreviousOutpoint: btcwire.OutPoint{Index: 0},
+		SignatureScript:  sigScript,
+		Sequence:         0,
+	})
+	tx.AddTxOut(btcwire.NewTxOut(0, []byte{0x51}))
+	return tx
+}
+
+// TestCheckLockTimeVerify ensures OP_CHECKLOCKTIMEVERIFY is enforced by the
+// btcscript engine when it is executed, using the operand which is actually on
+// the stack at that point.
+func TestCheckLockTimeVerify(t *testing.T) {
+	tests := []struct {
+		name      string
+		sigScript []byte
+		pkScript  []byte
+		flags     btcchain.ScriptFlags
+		wantErr   bool
+	}{
+		{
+			// <100> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE
+			name:     "satisfied lock time",
+			pkScript: []byte{0x01, 0x64, 0xb1, 0x75, 0x51},
+			flags:    btcchain.ScriptVerifyCLTV,
+			wantErr:  false,
+		},
+		{
+			// <200> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE
+			name:     "lock time after the transaction",
+			pkScript: []byte{0x02, 0xc8, 0x00, 0xb1, 0x75, 0x51},
+			flags:    btcchain.ScriptVerifyCLTV,
+			wantErr:  true,
+		},
+		{
+			// <200> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE
+			name:     "not enforced without the flag",
+			pkScript: []byte{0x02, 0xc8, 0x00, 0xb1, 0x75, 0x51},
+			flags:    0,
+			wantErr:  false,
+		},
+		{
+			// OP_FALSE OP_IF <200> OP_CHECKLOCKTIMEVERIFY OP_DROP
+			// OP_ENDIF OP_TRUE
+			name: "branch which is not executed",
+			pkScript: []byte{0x00, 0x63, 0x02, 0xc8, 0x00, 0xb1, 0x75,
+				0x68, 0x51},
+			flags:   btcchain.ScriptVerifyCLTV,
+			wantErr: false,
+		},
+		{
+			// OP_TRUE OP_IF <100> OP_ELSE <200> OP_ENDIF
+			// OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE
+			name: "operand from the branch which is executed",
+			pkScript: []byte{0x51, 0x63, 0x01, 0x64, 0x67, 0x02, 0xc8,
+				0x00, 0x68, 0xb1, 0x75, 0x51},
+			flags:   btcchain.ScriptVerifyCLTV,
+			wantErr: false,
+		},
+		{
+			// OP_FALSE OP_IF OP_TRUE OP_ELSE <200>
+			// OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE OP_ENDIF
+			name: "else branch which is executed",
+			pkScript: []byte{0x00, 0x63, 0x51, 0x67, 0x02, 0xc8, 0x00,
+				0xb1, 0x75, 0x51, 0x68},
+			flags:   btcchain.ScriptVerifyCLTV,
+			wantErr: true,
+		},
+		{
+			// <200> | OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE
+			name:      "operand from the signature script",
+			sigScript: []byte{0x02, 0xc8, 0x00},
+			pkScript:  []byte{0xb1, 0x75, 0x51},
+			flags:     btcchain.ScriptVerifyCLTV,
+			wantErr:   true,
+		},
+		{
+			// <100> OP_1 OP_ADD OP_CHECKLOCKTIMEVERIFY OP_DROP
+			// OP_TRUE
+			name: "computed operand",
+			pkScript: []byte{0x01, 0x64, 0x51, 0x93, 0xb1, 0x75,
+				0x51},
+			flags:   btcchain.ScriptVerifyCLTV,
+			wantErr: true,
+		},
+		{
+			// OP_CHECKLOCKTIMEVERIFY OP_TRUE
+			name:     "empty stack",
+			pkScript: []byte{0xb1, 0x51},
+			flags:    btcchain.ScriptVerifyCLTV,
+			wantErr:  true,
+		},
+	}
+
+	engine := btcchain.NewBtcscriptEngine()
+	for i, test := range tests {
+		input := btcchain.ScriptInput{
+			Tx:              lockTimeTx(test.sigScript),
+			TxInIndex:       0,
+			PkScript:        test.pkScript,
+			ProtocolVersion: btcwire.ProtocolVersion,
+		}
+		err := engine.VerifyScript(&input, test.flags)
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("VerifyScript #%d (%s): unexpected error %v",
+					i, test.name, err)
+			}
+			continue
+		}
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != btcchain.ErrUnsatisfiedLockTime {
+			t.Errorf("VerifyScript #%d (%s): got %v, want %v", i,
+				test.name, err, btcchain.ErrUnsatisfiedLockTime)
+		}
+	}
+}
+
+// TestCheckSequenceVerify ensures OP_CHECKSEQUENCEVERIFY is enforced by the
+// btcscript engine when it is executed, using the operand which is actually on
+// the stack at that point.
+func TestCheckSequenceVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  uint32
+		pkScript []byte
+		flags    btcchain.ScriptFlags
+		wantErr  bool
+	}{
+		{
+			// <10> OP_CHECKSEQUENCEVERIFY OP_DROP OP_TRUE
+			name:     "satisfied relative lock time",
+			version:  2,
+			pkScript: []byte{0x5a, 0xb2, 0x75, 0x51},
+			flags:    btcchain.ScriptVerifyCSV,
+			wantErr:  false,
+		},
+		{
+			// <11> OP_CHECKSEQUENCEVERIFY OP_DROP OP_TRUE
+			name:     "relative lock time after the input",
+			version:  2,
+			pkScript: []byte{0x5b, 0xb2, 0x75, 0x51},
+			flags:    btcchain.ScriptVerifyCSV,
+			wantErr:  true,
+		},
+		{
+			// <10> OP_CHECKSEQUENCEVERIFY OP_DROP OP_TRUE
+			name:     "transaction version before relative lock times",
+			version:  1,
+			pkScript: []byte{0x5a, 0xb2, 0x75, 0x51},
+			flags:    btcchain.ScriptVerifyCSV,
+			wantErr:  true,
+		},
+		{
+			// <11> OP_CHECKSEQUENCEVERIFY OP_DROP OP_TRUE
+			name:     "not enforced without the flag",
+			version:  2,
+			pkScript: []byte{0x5b, 0xb2, 0x75, 0x51},
+			flags:    0,
+			wantErr:  false,
+		},
+		{
+			// OP_FALSE OP_NOTIF OP_TRUE OP_ELSE <11>
+			// OP_CHECKSEQUENCEVERIFY OP_DROP OP_TRUE OP_ENDIF
+			name:    "branch which is not executed",
+			version: 2,
+			pkScript: []byte{0x00, 0x64, 0x51, 0x67, 0x5b, 0xb2, 0x75,
+				0x51, 0x68},
+			flags:   btcchain.ScriptVerifyCSV,
+			wantErr: false,
+		},
+		{
+			// <10> OP_1 OP_ADD OP_CHECKSEQUENCEVERIFY OP_DROP OP_TRUE
+			name:     "computed operand",
+			version:  2,
+			pkScript: []byte{0x5a, 0x51, 0x93, 0xb2, 0x75, 0x51},
+			flags:    btcchain.ScriptVerifyCSV,
+			wantErr:  true,
+		},
+	}
+
+	engine := btcchain.NewBtcscriptEngine()
+	for i, test := range tests {
+		tx := lockTimeTx(nil)
+		tx.Version = test.version
+		tx.TxIn[0].Sequence = 10
+		input := btcchain.ScriptInput{
+			Tx:              tx,
+			TxInIndex:       0,
+			PkScript:        test.pkScript,
+			ProtocolVersion: btcwire.ProtocolVersion,
+		}
+		err := engine.VerifyScript(&input, test.flags)
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("VerifyScript #%d (%s): unexpected error %v",
+					i, test.name, err)
+			}
+			continue
+		}
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != btcchain.ErrUnsatisfiedLockTime {
+			t.Errorf("VerifyScript #%d (%s): got %v, want %v", i,
+				test.name, err, btcchain.ErrUnsatisfiedLockTime)
+		}
+	}
+}
+
+// TestStrictDERSignatures ensures the strict DER encoding of signatures is
+// enforced by the btcscript engine on the signatures which are actually
+// verified by the signature checking opcodes.
+func TestStrictDERSignatures(t *testing.T) {
+	// push returns a script which pushes the passed data.
+	push := func(data []byte) []byte {
+		return append([]byte{byte(len(data))}, data...)
+	}
+	script := func(parts ...[]byte) []byte {
+		var s []byte
+		for _, part := range parts {
+			s = append(s, part...)
+		}
+		return s
+	}
+
+	// The signatures don't verify, so each script negates the result of
+	// the signature check to succeed when only the encoding matters.
+	derSig := []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01, 0x01}
+	nonDERSig := []byte{0x30, 0x07, 0x02, 0x02, 0x00, 0x01, 0x02, 0x01,
+		0x01, 0x01}
+	notSequenceSig := []byte{0x31, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01,
+		0x01, 0x01}
+	pubKey := push(append([]byte{0x02}, make([]byte, 32)...))
+	checkSigNot := []byte{0xac, 0x91}
+
+	tests := []struct {
+		name      string
+		sigScript []byte
+		pkScript  []byte
+		flags     btcchain.ScriptFlags
+		wantErr   bool
+	}{
+		{
+			name:     "strictly DER encoded signature",
+			pkScript: script(push(derSig), pubKey, checkSigNot),
+			flags:    btcchain.ScriptStrictDER,
+			wantErr:  false,
+		},
+		{
+			name:     "empty signature",
+			pkScript: script([]byte{0x00}, pubKey, checkSigNot),
+			flags:    btcchain.ScriptStrictDER,
+			wantErr:  false,
+		},
+		{
+			name:     "non-minimal R",
+			pkScript: script(push(nonDERSig), pubKey, checkSigNot),
+			flags:    btcchain.ScriptStrictDER,
+			wantErr:  true,
+		},
+		{
+			name:     "not enforced without the flag",
+			pkScript: script(push(nonDERSig), pubKey, checkSigNot),
+			flags:    0,
+			wantErr:  false,
+		},
+		{
+			name:      "signature which does not look like one",
+			sigScript: push(notSequenceSig),
+			pkScript:  script(pubKey, checkSigNot),
+			flags:     btcchain.ScriptStrictDER,
+			wantErr:   true,
+		},
+		{
+			name:      "data which looks like a signature",
+			sigScript: push(nonDERSig),
+			pkScript:  []byte{0x75, 0x51},
+			flags:     btcchain.ScriptStrictDER,
+			wantErr:   false,
+		},
+		{
+			// OP_FALSE OP_IF <sig> <pubkey> OP_CHECKSIG OP_DROP
+			// OP_ENDIF OP_TRUE
+			name: "branch which is not executed",
+			pkScript: script([]byte{0x00, 0x63}, push(nonDERSig),
+				pubKey, []byte{0xac, 0x75, 0x68, 0x51}),
+			flags:   btcchain.ScriptStrictDER,
+			wantErr: false,
+		},
+		{
+			// OP_0 <sig> OP_1 <pubkey> OP_1 OP_CHECKMULTISIG OP_NOT
+			name: "multisig with a strictly DER encoded signature",
+			pkScript: script([]byte{0x00}, push(derSig), []byte{0x51},
+				pubKey, []byte{0x51, 0xae, 0x91}),
+			flags:   btcchain.ScriptStrictDER,
+			wantErr: false,
+		},
+		{
+			// OP_0 <sig> OP_1 <pubkey> OP_1 OP_CHECKMULTISIG OP_NOT
+			name: "multisig with a non-minimal R",
+			pkScript: script([]byte{0x00}, push(nonDERSig),
+				[]byte{0x51}, pubKey, []byte{0x51, 0xae, 0x91}),
+			flags:   btcchain.ScriptStrictDER,
+			wantErr: true,
+		},
+		{
+			// OP_0 <sig> <sig> OP_2 <pubkey> <pubkey> OP_2
+			// OP_CHECKMULTISIG OP_NOT
+			name: "multisig with a non-minimal R on top",
+			pkScript: script([]byte{0x00}, push(derSig),
+				push(nonDERSig), []byte{0x52}, pubKey, pubKey,
+				[]byte{0x52, 0xae, 0x91}),
+			flags:   btcchain.ScriptStrictDER,
+			wantErr: true,
+		},
+		{
+			// The top signature fails to match the first public key,
+			// which leaves two signatures for one public key, so the
+			// signature below it is never reached.
+			// OP_0 <sig> <sig> OP_2 <pubkey> <pubkey> OP_2
+			// OP_CHECKMULTISIG OP_NOT
+			name: "multisig signature which is not reached",
+			pkScript: script([]byte{0x00}, push(nonDERSig),
+				push(derSig), []byte{0x52}, pubKey, pubKey,
+				[]byte{0x52, 0xae, 0x91}),
+			flags:   btcchain.ScriptStrictDER,
+			wantErr: false,
+		},
+		{
+			// The top signature fails to match the first two public
+			// keys, which leaves two signatures for one public key.
+			// OP_0 <sig> <sig> OP_2 <pubkey> <pubkey> <pubkey> OP_3
+			// OP_CHECKMULTISIG OP_NOT
+			name: "multisig signature which is not reached after " +
+				"several mismatches",
+			pkScript: script([]byte{0x00}, push(nonDERSig),
+				push(derSig), []byte{0x52}, pubKey, pubKey, pubKey,
+				[]byte{0x53, 0xae, 0x91}),
+			flags:   btcchain.ScriptStrictDER,
+			wantErr: false,
+		},
+	}
+
+	engine := btcchain.NewBtcscriptEngine()
+	for i, test := range tests {
+		input := btcchain.ScriptInput{
+			Tx:              lockTimeTx(test.sigScript),
+			TxInIndex:       0,
+			PkScript:        test.pkScript,
+			ProtocolVersion: btcwire.ProtocolVersion,
+		}
+		err := engine.VerifyScript(&input, test.flags)
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("VerifyScript #%d (%s): unexpected error %v",
+					i, test.name, err)
+			}
+			continue
+		}
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != btcchain.ErrNotStrictDER {
+			t.Errorf("VerifyScript #%d (%s): got %v, want %v", i,
+				test.name, err, btcchain.ErrNotStrictDER)
+		}
+	}
+}
+
+// TestStrictDERMultiSigBlock ensures that once strictly DER encoded signatures
+// are enforced, a block is accepted when an OP_CHECKMULTISIG it executes has a
+// signature which is not strictly DER encoded but is never reached, and is
+// rejected when that signature is reached.
+func TestStrictDERMultiSigBlock(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	chain, _, teardown := newTestChain(t, "strictdermultisigtest", &params,
+		nil)
+	defer teardown()
+
+	// The generated blocks are version 4, so strictly DER encoded
+	// signatures are enforced once enough of them are in the chain.
+	blocks := g.nextBlocks(g.genesis(), int(params.BlockEnforceNumRequired))
+	processBlocks(t, chain, blocks)
+
+	// multiSigScript returns the script
+	// OP_0 <sig> <sig> OP_2 <pubkey> <pubkey> OP_2 OP_CHECKMULTISIG OP_NOT
+	// where neither signature verifies, so the top signature fails to match
+	// the first public key and the one below it is never reached.
+	derSig := []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01, 0x01}
+	nonDERSig := []byte{0x30, 0x07, 0x02, 0x02, 0x00, 0x01, 0x02, 0x01,
+		0x01, 0x01}
+	pubKey := append([]byte{0x21, 0x02}, make([]byte, 32)...)
+	multiSigScript := func(bottomSig, topSig []byte) []byte {
+		script := []byte{0x00, byte(len(bottomSig))}
+		script = append(script, bottomSig...)
+		script = append(script, byte(len(topSig)))
+		script = append(script, topSig...)
+		script = append(script, 0x52)
+		script = append(script, pubKey...)
+		script = append(script, pubKey...)
+		return append(script, 0x52, 0xae, 0x91)
+	}
+
+	// spendBlock returns a block which pays the coinbase of the first block
+	// to the passed public key script and spends that output.
+	spendBlock := func(pkScript []byte) *btcutil.Block {
+		fundTx := spendTx(blocks[0], 1000)
+		fundTx.TxOut[0].PkScript = pkScript
+		fundHash, _ := fundTx.TxSha()
+		tx := btcwire.NewMsgTx()
+		tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&fundHash, 0),
+			nil))
+		tx.AddTxOut(btcwire.NewTxOut(fundTx.TxOut[0].Value-1000,
+			opTrueScript))
+		return g.nextBlock(blocks[len(blocks)-1],
+			func(msgBlock *btcwire.MsgBlock) {
+				msgBlock.AddTransaction(fundTx)
+				msgBlock.AddTransaction(tx)
+			})
+	}
+
+	reached := spendBlock(multiSigScript(derSig, nonDERSig))
+	_, _, err := chain.ProcessBlock(reached)
+	checkRuleError(t, "ProcessBlock (reached signature)", err,
+		btcchain.ErrNotStrictDER)
+
+	notReached := spendBlock(multiSigScript(nonDERSig, derSig))
+	processBlocks(t, chain, []*btcutil.Block{notReached})
+	checkBestBlock(t, "ProcessBlock (signature not reached)", chain,
+		notReached)
+}
+
+// testScriptEngine is a ScriptEngine which verifies scripts with btcscript
+// while counting the inputs it is called for.  Every input fails with err when
+// it is set.
+type testScriptEngine struct {
+	sync.Mutex
+	numInputs  int
+	numBatches int
+	err        error
+}
+
+// VerifyScript counts the passed input and verifies its scripts.  It is part
+// of the btcchain.ScriptEngine interface.
+func (e *testScriptEngine) VerifyScript(input *btcchain.ScriptInput, flags btcchain.ScriptFlags) error {
+	e.Lock()
+	e.numInputs++
+	e.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	return btcchain.NewBtcscriptEngine().VerifyScript(input, flags)
+}
+
+// testBatchScriptEngine is a testScriptEngine which also implements the
+// btcchain.BatchScriptEngine interface.
+type testBatchScriptEngine struct {
+	*testScriptEngine
+}
+
+// VerifyScripts counts the batch and verifies the scripts of the passed inputs
+// in order.  It is part of the btcchain.BatchScriptEngine interface.
+func (e testBatchScriptEngine) VerifyScripts(inputs []*btcchain.ScriptInput, flags btcchain.ScriptFlags) error {
+	e.Lock()
+	e.numBatches++
+	e.Unlock()
+	for _, input := range inputs {
+		if err := e.VerifyScript(input, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestNewWithScriptEngine ensures the scripts of the inputs of blocks are
+// verified with the script engine passed to NewWithScriptEngine, all at once
+// when it implements BatchScriptEngine, and that its failures reject blocks
+// with ErrScriptValidation.
+func TestNewWithScriptEngine(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 4)
+
+	tests := []struct {
+		name        string
+		batch       bool
+		err         error
+		wantBatches int
+	}{
+		{"per input", false, nil, 0},
+		{"per input failure", false, errors.New("rejected"), 0},
+		{"batch", true, nil, 1},
+		{"batch failure", true, errors.New("rejected"), 1},
+	}
+
+	for i, test := range tests {
+		engine := &testScriptEngine{err: test.err}
+		var scriptEngine btcchain.ScriptEngine = engine
+		if test.batch {
+			scriptEngine = testBatchScriptEngine{engine}
+		}
+		_, db, teardown := newTestChain(t, "scriptenginetest", &params,
+			nil)
+		chain, err := btcchain.NewWithScriptEngine(db, &params, nil,
+			scriptEngine)
+		if err != nil {
+			teardown()
+			t.Fatalf("NewWithScriptEngine #%d (%s): unexpected "+
+				"error %v", i, test.name, err)
+		}
+		processBlocks(t, chain, blocks)
+
+		// Only count the block which has inputs to verify.
+		engine.numBatches = 0
+		_, _, err = chain.ProcessBlock(spendAllBlock(g, blocks, -1))
+		teardown()
+		if engine.numBatches != test.wantBatches {
+			t.Errorf("NewWithScriptEngine #%d (%s): got %d batches, "+
+				"want %d", i, test.name, engine.numBatches,
+				test.wantBatches)
+		}
+		if test.err != nil {
+			rerr, ok := err.(btcchain.RuleError)
+			if !ok || rerr.ErrorCode != btcchain.ErrScriptValidation {
+				t.Errorf("ProcessBlock #%d (%s): got %v, want %v",
+					i, test.name, err,
+					btcchain.ErrScriptValidation)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ProcessBlock #%d (%s): unexpected error %v", i,
+				test.name, err)
+		}
+		if engine.numInputs != len(blocks) {
+			t.Errorf("NewWithScriptEngine #%d (%s): got %d inputs, "+
+				"want %d", i, test.name, engine.numInputs,
+				len(blocks))
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcscript"
+)
+
+// stepRuleFlags are the flags for the rules which btcscript does not support.
+// They are enforced by stepping through the scripts with btcscript and checking
+// the opcodes they apply to as they are executed.
+const stepRuleFlags = ScriptStrictDER | ScriptVerifyCLTV | ScriptVerifyCSV
+
+// These constants define the state of a conditional branch of a script.  A
+// branch which is nested inside a branch that is not executed is skipped
+// regardless of its condition.
+const (
+	condFalse = iota
+	condTrue
+	condSkip
+)
+
+// scriptStepper follows along with btcscript as it executes the scripts of an
+// input one opcode at a time so the rules btcscript does not support can be
+// enforced when, and only when, the opcodes they apply to are executed.  It
+// mirrors the order btcscript executes the scripts in, which is the signature
+// script, the public key script, and for pay-to-script-hash spends when
+// BIP0016 is enabled, the redeem script pushed last by the signature script.
+type scriptStepper struct {
+	engine     *btcscript.Script
+	input      *ScriptInput
+	flags      ScriptFlags
+	p2sh       bool
+	scripts    [][]parsedOpcode
+	scriptIdx  int
+	scriptOff  int
+	condStack  []int
+	savedStack [][]byte
+	numSteps   int
+}
+
+// executing returns whether or not the opcodes at the current position are
+// executed as opposed to being part of a branch which is not taken.
+func (s *scriptStepper) executing() bool {
+	return len(s.condStack) == 0 || s.condStack[len(s.condStack)-1] == condTrue
+}
+
+// current returns the opcode btcscript executes on the next step or nil when
+// the position is past the end of the scripts.
+func (s *scriptStepper) current() *parsedOpcode {
+	if s.scriptIdx >= len(s.scripts) ||
+		s.scriptOff >= len(s.scripts[s.scriptIdx]) {
+
+		return nil
+	}
+	return &s.scripts[s.scriptIdx][s.scriptOff]
+}
+
+// stackTop returns the item on the top of the data stack or nil when the stack
+// is empty.
+func (s *scriptStepper) stackTop() []byte {
+	stack := s.engine.GetStack()
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[len(stack)-1]
+}
+
+// checkOpcode enforces the rules defined by the flags which apply to the passed
+// opcode before btcscript executes it with the current data stack.
+func (s *scriptStepper) checkOpcode(pop *parsedOpcode) error {
+	tx := s.input.Tx
+	txInIdx := s.input.TxInIndex
+	switch {
+	case (pop.opcode == btcscript.OP_CHECKSIG ||
+		pop.opcode == btcscript.OP_CHECKSIGVERIFY) &&
+		s.flags&ScriptStrictDER == ScriptStrictDER:
+
+		// The signature is the item below the public key.
+		stack := s.engine.GetStack()
+		if len(stack) < 2 {
+			return nil
+		}
+		return verifySignatureEncoding(stack[len(stack)-2])
+
+	case pop.opcode == opCheckLockTimeVerify &&
+		s.flags&ScriptVerifyCLTV == ScriptVerifyCLTV:
+
+		return verifyLockTime(tx, txInIdx, s.engine.GetStack())
+
+	case pop.opcode == opCheckSequenceVerify &&
+		s.flags&ScriptVerifyCSV == ScriptVerifyCSV:
+
+		return verifySequence(tx, txInIdx, s.engine.GetStack())
+	}
+	return nil
+}
+
+// multiSigSucceeded returns whether or not all of the signatures matched a
+// public key when btcscript executed the passed OP_CHECKMULTISIG or
+// OP_CHECKMULTISIGVERIFY opcode at the current position without an error.
+func (s *scriptStepper) multiSigSucceeded(pop *parsedOpcode) bool {
+	if pop.opcode == btcscript.OP_CHECKMULTISIGVERIFY {
+		return true
+	}
+
+	// btcscript pops the result to check it is true when the opcode ends
+	// the public key script of a pay-to-script-hash spend and replaces the
+	// stack with the one the signature script left.
+	if s.p2sh && s.scriptIdx == 1 &&
+		s.scriptOff == len(s.scripts[s.scriptIdx])-1 {
+
+		return true
+	}
+	return asBool(s.stackTop())
+}
+
+// checkMultiSigEncodings ensures the signatures the passed OP_CHECKMULTISIG or
+// OP_CHECKMULTISIGVERIFY opcode verified when btcscript executed it with the
+// passed data stack are strictly DER encoded as required by BIP0066.  Like the
+// reference implementation, the signatures are matched against the public keys
+// from the top of the stack down and the encoding of each signature is checked
+// when it is reached.  Matching stops as soon as the remaining signatures
+// outnumber the remaining public keys, so the signatures which are not reached
+// by then may be encoded in any way.
+func (s *scriptStepper) checkMultiSigEncodings(pop *parsedOpcode, stack [][]byte) error {
+	pubKeys, sigs, base, ok := multiSigOperands(stack)
+	if !ok {
+		return nil
+	}
+
+	// Every signature was reached when they all matched a public key.
+	if s.multiSigSucceeded(pop) {
+		for _, sig := range sigs {
+			if err := verifySignatureEncoding(sig); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Otherwise, the matching is repeated one signature and public key at a
+	// time to find the signatures which were reached.
+	for isig, ikey := 0, 0; isig < len(sigs); ikey++ {
+		if len(sigs)-isig > len(pubKeys)-ikey {
+			break
+		}
+		if err := verifySignatureEncoding(sigs[isig]); err != nil {
+			return err
+		}
+		matched, err := s.probeSignature(base, sigs[isig], pubKeys[ikey])
+		if err != nil {
+			return err
+		}
+		if matched {
+			isig++
+		}
+	}
+	return nil
+}
+
+// probeSignature returns whether or not the passed signature is valid for the
+// passed public key according to the OP_CHECKMULTISIG opcode at the current
+// position.  btcscript only reports whether all of the signatures of the opcode
+// matched, so the scripts are replayed with a second engine up to the opcode,
+// which is then executed with only the passed signature and public key on top
+// of the passed base of the stack.  The signature hash is computed over the
+// same script as when the opcode was executed with all of its signatures,
+// except the other signatures are not removed from it, which only makes a
+// difference when the script pushes one of them itself.
+func (s *scriptStepper) probeSignature(base [][]byte, sig, pubKey []byte) (bool, error) {
+	// Empty signatures never verify.
+	if len(sig) == 0 {
+		return false, nil
+	}
+
+	engine, err := newScriptEngine(s.input, s.flags)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < s.numSteps; i++ {
+		if _, err := engine.Step(); err != nil {
+			return false, err
+		}
+	}
+
+	stack := make([][]byte, 0, len(base)+4)
+	stack = append(stack, base...)
+	stack = append(stack, sig, []byte{1}, pubKey, []byte{1})
+	engine.SetStack(stack)
+	if _, err := engine.Step(); err != nil {
+		return false, nil
+	}
+	stack = engine.GetStack()
+	return len(stack) > 0 && asBool(stack[len(stack)-1]), nil
+}
+
+// branchCondition returns the state of the branch the passed conditional opcode
+// starts when it is executed with the current data stack.
+func (s *scriptStepper) branchCondition(pop *parsedOpcode) int {
+	if !s.executing() {
+		return condSkip
+	}
+	cond := asBool(s.stackTop())
+	if pop.opcode == btcscript.OP_NOTIF {
+		cond = !cond
+	}
+	if cond {
+		return condTrue
+	}
+	return condFalse
+}
+
+// advance moves the position past the passed opcode once btcscript has
+// executed it.  The passed condition is the state of the branch it starts when
+// it is a conditional opcode.
+func (s *scriptStepper) advance(pop *parsedOpcode, cond int) {
+	switch pop.opcode {
+	case btcscript.OP_IF, btcscript.OP_NOTIF:
+		s.condStack = append(s.condStack, cond)
+
+	case btcscript.OP_ELSE:
+		if n := len(s.condStack); n > 0 {
+			switch s.condStack[n-1] {
+			case condTrue:
+				s.condStack[n-1] = condFalse
+			case condFalse:
+				s.condStack[n-1] = condTrue
+			}
+		}
+
+	case btcscript.OP_ENDIF:
+		if n := len(s.condStack); n > 0 {
+			s.condStack = s.condStack[:n-1]
+		}
+	}
+
+	s.scriptOff++
+	if s.scriptOff < len(s.scripts[s.scriptIdx]) {
+		return
+	}
+
+	// Move on to the next script the same way btcscript does.  The redeem
+	// script of a pay-to-script-hash spend is the last item the signature
+	// script left on the stack.
+	switch {
+	case s.scriptIdx == 0 && s.p2sh:
+		s.savedStack = s.engine.GetStack()
+
+	case s.scriptIdx == 1 && s.p2sh && len(s.savedStack) > 0:
+		redeemScript := s.savedStack[len(s.savedStack)-1]
+		s.scripts = append(s.scripts, parseScript(redeemScript))
+	}
+	s.condStack = s.condStack[:0]
+	s.scriptOff = 0
+	s.scriptIdx++
+	if s.scriptIdx < len(s.scripts) && len(s.scripts[s.scriptIdx]) == 0 {
+		s.scriptIdx++
+	}
+}
+
+// newScriptStepper returns a scriptStepper which follows along with the passed
+// btcscript engine, which must not have executed any opcodes yet, as it
+// executes the scripts of the passed input with the passed flags.
+func newScriptStepper(engine *btcscript.Script, input *ScriptInput, flags ScriptFlags) *scriptStepper {
+	sigScript := input.Tx.TxIn[input.TxInIndex].SignatureScript
+	s := &scriptStepper{
+		engine: engine,
+		input:  input,
+		flags:  flags,
+		p2sh: flags&ScriptBip16 == ScriptBip16 &&
+			btcscript.IsPayToScriptHash(input.PkScript),
+		scripts: [][]parsedOpcode{parseScript(sigScript),
+			parseScript(input.PkScript)},
+	}
+
+	// btcscript starts with the public key script when the signature
+	// script is empty.
+	if len(s.scripts[0]) == 0 {
+		s.scriptIdx++
+	}
+	return s
+}
+
+// executeScript executes the scripts of the passed input with the passed
+// btcscript engine one opcode at a time and enforces the rules defined by the
+// passed flags which btcscript does not support as the opcodes they apply to
+// are executed.  Opcodes in branches which are not taken are not checked and
+// the operands are the actual items on the stack, so the rules apply no matter
+// how the scripts are constructed.  The signatures of OP_CHECKMULTISIG are
+// checked once btcscript has executed it since which of them are reached
+// depends on which ones match.
+func executeScript(engine *btcscript.Script, input *ScriptInput, flags ScriptFlags) error {
+	s := newScriptStepper(engine, input, flags)
+	for {
+		pop := s.current()
+		cond := condSkip
+		var multiSigStack [][]byte
+		if pop != nil {
+			if s.executing() {
+				if err := s.checkOpcode(pop); err != nil {
+					return err
+				}
+				if (pop.opcode == btcscript.OP_CHECKMULTISIG ||
+					pop.opcode == btcscript.OP_CHECKMULTISIGVERIFY) &&
+					flags&ScriptStrictDER == ScriptStrictDER {
+
+					multiSigStack = engine.GetStack()
+				}
+			}
+			if pop.opcode == btcscript.OP_IF ||
+				pop.opcode == btcscript.OP_NOTIF {
+
+				cond = s.branchCondition(pop)
+			}
+		}
+
+		done, err := engine.Step()
+		if err != nil {
+			return err
+		}
+		if multiSigStack != nil {
+			err := s.checkMultiSigEncodings(pop, multiSigStack)
+			if err != nil {
+				return err
+			}
+		}
+		s.numSteps++
+		if done {
+			break
+		}
+		if pop != nil {
+			s.advance(pop, cond)
+		}
+	}
+
+	return engine.CheckErrorCondition()
+}
+
+// asBool returns the passed stack item interpreted as a boolean.  It is false
+// when all of the bytes are zero, including negative zero which has the sign
+// bit of the last byte set.
+func asBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return i != len(data)-1 || b != 0x80
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"code.google.com/p/go.crypto/ripemd160"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// opcodeByName maps the names of the opcodes used by the script test vectors,
+// without the OP_ prefix, to the opcodes.
+var opcodeByName = map[string]byte{
+	"PUSHDATA1":     btcscript.OP_PUSHDATA1,
+	"PUSHDATA2":     btcscript.OP_PUSHDATA2,
+	"PUSHDATA4":     btcscript.OP_PUSHDATA4,
+	"RESERVED":      btcscript.OP_RESERVED,
+	"NOP":           btcscript.OP_NOP,
+	"VER":           btcscript.OP_VER,
+	"IF":            btcscript.OP_IF,
+	"NOTIF":         btcscript.OP_NOTIF,
+	"VERIF":         btcscript.OP_VERIF,
+	"ELSE":          btcscript.OP_ELSE,
+	"ENDIF":         btcscript.OP_ENDIF,
+	"VERIFY":        btcscript.OP_VERIFY,
+	"RETURN":        btcscript.OP_RETURN,
+	"TOALTSTACK":    btcscript.OP_TOALTSTACK,
+	"FROMALTSTACK":  btcscript.OP_FROMALTSTACK,
+	"DEPTH":         btcscript.OP_DEPTH,
+	"DROP":          btcscript.OP_DROP,
+	"DUP":           btcscript.OP_DUP,
+	"CAT":           btcscript.OP_CAT,
+	"EQUAL":         btcscript.OP_EQUAL,
+	"NOT":           btcscript.OP_NOT,
+	"HASH160":       btcscript.OP_HASH160,
+	"CODESEPARATOR": btcscript.OP_CODESEPARATOR,
+	"NOP1":          btcscript.OP_NOP1,
+	"NOP10":         btcscript.OP_NOP10,
+}
+
+// scriptNumBytes returns the minimal encoding of the passed number as a script
+// number, which is little endian with the sign in the high bit of the last
+// byte.
+func scriptNumBytes(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	var data []byte
+	for ; n > 0; n >>= 8 {
+		data = append(data, byte(n))
+	}
+	switch {
+	case data[len(data)-1]&0x80 != 0 && negative:
+		data = append(data, 0x80)
+	case data[len(data)-1]&0x80 != 0:
+		data = append(data, 0x00)
+	case negative:
+		data[len(data)-1] |= 0x80
+	}
+	return data
+}
+
+// pushData returns a script which pushes the passed data with the smallest
+// opcode that can push it.
+func pushData(data []byte) []byte {
+	switch {
+	case len(data) < btcscript.OP_PUSHDATA1:
+		return append([]byte{byte(len(data))}, data...)
+	case len(data) <= 0xff:
+		return append([]byte{btcscript.OP_PUSHDATA1, byte(len(data))},
+			data...)
+	case len(data) <= 0xffff:
+		script := []byte{btcscript.OP_PUSHDATA2, 0, 0}
+		binary.LittleEndian.PutUint16(script[1:], uint16(len(data)))
+		return append(script, data...)
+	}
+	script := []byte{btcscript.OP_PUSHDATA4, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(script[1:], uint32(len(data)))
+	return append(script, data...)
+}
+
+// assembleScript returns the script described by the passed text, which is in
+// the notation of the reference implementation script test vectors.  Decimal
+// numbers are pushed as script numbers, hex prefixed by 0x is inserted into the
+// script as is, text in single quotes is pushed, and anything else is the name
+// of an opcode with or without the OP_ prefix.
+func assembleScript(t *testing.T, text string) []byte {
+	var script []byte
+	for _, token := range strings.Fields(text) {
+		if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+			switch {
+			case n == 0:
+				script = append(script, btcscript.OP_0)
+			case n == -1:
+				script = append(script, btcscript.OP_1NEGATE)
+			case n >= 1 && n <= 16:
+				script = append(script,
+					byte(btcscript.OP_1-1+n))
+			default:
+				script = append(script,
+					pushData(scriptNumBytes(n))...)
+			}
+			continue
+		}
+		if strings.HasPrefix(token, "0x") {
+			data, err := hex.DecodeString(token[2:])
+			if err != nil {
+				t.Fatalf("assembleScript (%s): bad hex %q",
+					text, token)
+			}
+			script = append(script, data...)
+			continue
+		}
+		if len(token) >= 2 && token[0] == '\'' &&
+			token[len(token)-1] == '\'' {
+
+			script = append(script,
+				pushData([]byte(token[1:len(token)-1]))...)
+			continue
+		}
+		opcode, ok := opcodeByName[strings.TrimPrefix(token, "OP_")]
+		if !ok {
+			t.Fatalf("assembleScript (%s): unknown opcode %q", text,
+				token)
+		}
+		script = append(script, opcode)
+	}
+	return script
+}
+
+// hash160 returns the RIPEMD160 hash of the SHA256 hash of the passed data.
+func hash160(data []byte) []byte {
+	sha := sha256.New()
+	sha.Write(data)
+	h := ripemd160.New()
+	h.Write(sha.Sum(nil))
+	return h.Sum(nil)
+}
+
+// TestScriptStepper ensures the stepper which enforces the rules btcscript does
+// not support follows the execution of btcscript exactly.  The vectors are in
+// the notation of the reference implementation script test vectors and focus on
+// what the stepper mirrors: conditional branches, including nested and skipped
+// ones, opcodes which fail even when they are skipped, the push encodings, the
+// order the scripts are executed in, and the redeem scripts of
+// pay-to-script-hash spends.  Each vector is traced opcode by opcode with and
+// without BIP0016 and the result of stepping through it must match the result
+// of executing it with btcscript directly.
+func TestScriptStepper(t *testing.T) {
+	tests := []struct {
+		sigScript string
+		pkScript  string
+		// p2sh makes the vector a pay-to-script-hash spend of the
+		// redeem script, which is pushed after the signature script.
+		p2sh         bool
+		redeemScript string
+	}{
+		{sigScript: "1", pkScript: ""},
+		{sigScript: "", pkScript: "1"},
+		{sigScript: "", pkScript: ""},
+		{sigScript: "1 IF 1 ENDIF", pkScript: ""},
+		{sigScript: "1", pkScript: "IF 1 ENDIF"},
+		{sigScript: "0", pkScript: "IF 0 ELSE 1 ENDIF"},
+		{sigScript: "1", pkScript: "NOTIF 0 ELSE 1 ENDIF"},
+		{sigScript: "0", pkScript: "NOTIF 1 ENDIF"},
+		{sigScript: "1 1", pkScript: "IF IF 1 ELSE 0 ENDIF ENDIF"},
+		{sigScript: "1 0", pkScript: "IF IF 1 ELSE 0 ENDIF ENDIF"},
+		{sigScript: "0 1", pkScript: "IF IF 1 ELSE 0 ENDIF ENDIF"},
+		{sigScript: "0", pkScript: "IF 0 IF 2 ELSE 3 ENDIF ELSE 1 " +
+			"ENDIF"},
+		{sigScript: "1", pkScript: "IF 1 ELSE 0 ELSE 1 ENDIF"},
+		{sigScript: "0", pkScript: "IF 1 ELSE 0 ELSE 1 ENDIF"},
+		{sigScript: "0", pkScript: "IF 1 ELSE 2 ENDIF 2 EQUAL"},
+		{sigScript: "0x02 0x0080", pkScript: "IF 0 ELSE 1 ENDIF"},
+		{sigScript: "0x01 0x80", pkScript: "NOTIF 1 ENDIF"},
+		{sigScript: "'a'", pkScript: "IF 'a' 'b' EQUAL NOT ENDIF"},
+		{sigScript: "", pkScript: "DEPTH NOTIF 1 ENDIF"},
+		{sigScript: "2 1", pkScript: "TOALTSTACK IF FROMALTSTACK " +
+			"ENDIF"},
+		{sigScript: "0", pkScript: "IF RETURN ENDIF 1"},
+		{sigScript: "1", pkScript: "IF RETURN ENDIF 1"},
+		{sigScript: "0", pkScript: "IF VER ENDIF 1"},
+		{sigScript: "0", pkScript: "IF VERIF ENDIF 1"},
+		{sigScript: "0", pkScript: "IF CAT ENDIF 1"},
+		{sigScript: "0", pkScript: "IF RESERVED ENDIF 1"},
+		{sigScript: "1", pkScript: "IF NOP1 NOP10 1 ENDIF"},
+		{sigScript: "NOP", pkScript: "1"},
+		{sigScript: "1", pkScript: "1 VERIFY IF 1 ENDIF"},
+		{sigScript: "0", pkScript: "VERIFY 1"},
+		{sigScript: "1", pkScript: "CODESEPARATOR IF CODESEPARATOR 1 " +
+			"ENDIF"},
+		{sigScript: "1", pkScript: "IF 0x4c 0x02 0x0102 DROP 1 ENDIF"},
+		{sigScript: "0", pkScript: "IF 0x4d 0x0200 0x0102 ENDIF 1"},
+		{sigScript: "0x4e 0x01000000 0x01", pkScript: "IF 1 ENDIF"},
+		{sigScript: "1", pkScript: "IF 0x4c 0x05 0x01"},
+		{sigScript: "1", pkScript: "IF"},
+		{sigScript: "", pkScript: "ENDIF 1"},
+		{sigScript: "", pkScript: "ELSE 1"},
+		{sigScript: "1 IF", pkScript: "1 ENDIF"},
+		{sigScript: "0 IF", pkScript: "ENDIF 1"},
+		{sigScript: "1000 -1 17", pkScript: "DROP DROP"},
+		{sigScript: "", p2sh: true, redeemScript: "1"},
+		{sigScript: "", p2sh: true, redeemScript: "0"},
+		{sigScript: "", p2sh: true, redeemScript: ""},
+		{sigScript: "1", p2sh: true, redeemScript: "IF 1 ENDIF"},
+		{sigScript: "0", p2sh: true, redeemScript: "IF 0 ELSE 1 ENDIF"},
+		{sigScript: "1 0", p2sh: true,
+			redeemScript: "IF 0 ELSE IF 1 ENDIF ENDIF"},
+		{sigScript: "0", p2sh: true,
+			redeemScript: "NOTIF 1 ENDIF CODESEPARATOR 1"},
+		{sigScript: "1", p2sh: true, redeemScript: "1 EQUAL"},
+		{sigScript: "", p2sh: true,
+			redeemScript: "0x4c 0x01 0x07 7 EQUAL"},
+		{sigScript: "", p2sh: true, redeemScript: "IF"},
+		{sigScript: "0", p2sh: true, redeemScript: "IF RETURN ENDIF 1"},
+	}
+
+	engine := btcchain.NewBtcscriptEngine()
+	for i, test := range tests {
+		sigScript := assembleScript(t, test.sigScript)
+		pkScript := assembleScript(t, test.pkScript)
+		if test.p2sh {
+			redeemScript := assembleScript(t, test.redeemScript)
+			sigScript = append(sigScript, pushData(redeemScript)...)
+			pkScript = append([]byte{btcscript.OP_HASH160},
+				pushData(hash160(redeemScript))...)
+			pkScript = append(pkScript, btcscript.OP_EQUAL)
+		}
+		input := btcchain.ScriptInput{
+			Tx:              lockTimeTx(sigScript),
+			TxInIndex:       0,
+			PkScript:        pkScript,
+			ProtocolVersion: btcwire.ProtocolVersion,
+		}
+
+		for _, flags := range []btcchain.ScriptFlags{0,
+			btcchain.ScriptBip16} {
+
+			err := btcchain.TstTraceScript(&input, flags)
+			if err != nil {
+				t.Errorf("TstTraceScript #%d (flags %d): %v", i,
+					flags, err)
+			}
+
+			// None of the vectors are affected by the rule, so
+			// stepping through them must give the same result as
+			// executing them directly.
+			want := engine.VerifyScript(&input, flags)
+			got := engine.VerifyScript(&input,
+				flags|btcchain.ScriptStrictDER)
+			if (got == nil) != (want == nil) {
+				t.Errorf("VerifyScript #%d (flags %d): got %v "+
+					"when stepping, want %v", i, flags, got,
+					want)
+			}
+		}
+	}
+}
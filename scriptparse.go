@@ -0,0 +1,116 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"encoding/binary"
+)
+
+// These constants are the opcodes which push data onto the stack using an
+// explicit length prefix.  Opcodes below opPushData1 push the number of bytes
+// they are equal to.
+const (
+	opPushData1 = 0x4c
+	opPushData2 = 0x4d
+	opPushData4 = 0x4e
+)
+
+// parsedOpcode is an opcode from a script along with the data it pushes, if
+// any.
+type parsedOpcode struct {
+	opcode byte
+	data   []byte
+}
+
+// isPush returns whether or not the opcode pushes data onto the stack using
+// explicit data.  Note that this excludes the small integer opcodes.
+func (pop *parsedOpcode) isPush() bool {
+	return pop.opcode > 0 && pop.opcode <= opPushData4
+}
+
+// parseScript returns the opcodes in the passed script.  Parsing stops at the
+// first push which extends beyond the end of the script, so only the opcodes
+// before it are returned.
+func parseScript(script []byte) []parsedOpcode {
+	var pops []parsedOpcode
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		var dataLen int
+		switch {
+		case opcode > 0 && opcode < opPushData1:
+			dataLen = int(opcode)
+
+		case opcode == opPushData1:
+			if i+1 > len(script) {
+				return pops
+			}
+			dataLen = int(script[i])
+			i++
+
+		case opcode == opPushData2:
+			if i+2 > len(script) {
+				return pops
+			}
+			dataLen = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+
+		case opcode == opPushData4:
+			if i+4 > len(script) {
+				return pops
+			}
+			dataLen = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+
+		default:
+			pops = append(pops, parsedOpcode{opcode: opcode})
+			continue
+		}
+
+		if dataLen < 0 || i+dataLen > len(script) {
+			return pops
+		}
+		pops = append(pops, parsedOpcode{
+			opcode: opcode,
+			data:   script[i : i+dataLen],
+		})
+		i += dataLen
+	}
+	return pops
+}
+
+// parseScriptPushes returns the data for all of the data pushes in the passed
+// script.  Opcodes which do not push data are skipped.  Parsing stops at the
+// first push which extends beyond the end of the script, so only the pushes
+// before it are returned.
+func parseScriptPushes(script []byte) [][]byte {
+	var pushes [][]byte
+	for _, pop := range parseScript(script) {
+		if pop.isPush() {
+			pushes = append(pushes, pop.data)
+		}
+	}
+	return pushes
+}
+
+// scriptNum decodes the passed data as a script number.  Script numbers are
+// little endian with the most significant bit of the last byte used as the
+// sign bit.  The data must not be longer than 8 bytes.
+func scriptNum(data []byte) int64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var num int64
+	for i, b := range data {
+		num |= int64(b) << uint(8*i)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		num &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		num = -num
+	}
+	return num
+}
@@ -10,127 +10,347 @@ import (
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
 	"math"
-	"time"
+	"runtime"
 )
 
-// txValidate is used to track results of validating scripts for each
-// transaction input index.
-type txValidate struct {
-	txIndex int
-	err     error
-}
+// ScriptFlags is a bitmask defining additional rules which are enforced while
+// validating scripts.  The rules which apply to a block depend on its position
+// within the block chain.  See ScriptFlagsForNextBlock.
+//
+// The rules btcscript does not support are enforced by the script engine
+// returned by NewBtcscriptEngine as the scripts are executed.
+type ScriptFlags uint32
+
+const (
+	// ScriptBip16 enables the BIP0016 pay-to-script-hash rules.
+	ScriptBip16 ScriptFlags = 1 << iota
+
+	// ScriptStrictDER requires signatures to be strictly DER encoded as
+	// defined by BIP0066.
+	ScriptStrictDER
+
+	// ScriptVerifyCLTV enables the OP_CHECKLOCKTIMEVERIFY opcode defined
+	// by BIP0065.
+	ScriptVerifyCLTV
+
+	// ScriptVerifyCSV enables the OP_CHECKSEQUENCEVERIFY opcode defined by
+	// BIP0112.
+	ScriptVerifyCSV
 
-// txProcessList
-type txProcessList struct {
-	txsha btcwire.ShaHash
-	tx    *btcwire.MsgTx
+	// StandardScriptFlags is the set of all of the flags known to this
+	// package.  It is a superset of the flags enforced by consensus for
+	// any block, so it is suitable for policy such as a memory pool.
+	StandardScriptFlags = ScriptBip16 | ScriptStrictDER |
+		ScriptVerifyCLTV | ScriptVerifyCSV
+)
+
+// txValidateItem houses a transaction input whose script is to be validated
+// along with the transaction it is part of.
+type txValidateItem struct {
+	txInIndex int
+	txIn      *btcwire.TxIn
+	tx        *btcwire.MsgTx
+	txHash    *btcwire.ShaHash
 }
 
-// validateTxIn validates a the script pair for the passed spending transaction
-// (along with the specific input index) and origin transaction (with the
-// specific output index).
-func validateTxIn(txInIdx int, txin *btcwire.TxIn, txSha *btcwire.ShaHash, tx *btcwire.MsgTx, pver uint32, timestamp time.Time, originTx *btcwire.MsgTx) error {
-	// If the input transaction has no previous input, there is nothing
-	// to check.
-	originTxIdx := txin.PreviousOutpoint.Index
-	if originTxIdx == math.MaxUint32 {
-		return nil
+// resolveScriptInput returns the script input for the passed item using the
+// passed transaction store to find the public key script of the output it
+// spends.
+func resolveScriptInput(item *txValidateItem, txStore TxStore, pver uint32) (*ScriptInput, error) {
+	originTxSha := &item.txIn.PreviousOutpoint.Hash
+	originTxIdx := item.txIn.PreviousOutpoint.Index
+	txD, ok := txStore[*originTxSha]
+	if !ok || txD.Tx == nil {
+		str := fmt.Sprintf("unable to find input transaction %v "+
+			"referenced from transaction %v", originTxSha,
+			item.txHash)
+		return nil, ruleError(ErrMissingTx, str)
 	}
-
+	originTx := txD.Tx
 	if originTxIdx >= uint32(len(originTx.TxOut)) {
-		originTxSha := &txin.PreviousOutpoint.Hash
-		log.Warnf("unable to locate source tx %v spending tx %v", originTxSha, &txSha)
-		return fmt.Errorf("invalid index %x", originTxIdx)
+		log.Warnf("unable to locate source tx %v spending tx %v",
+			originTxSha, item.txHash)
+		str := fmt.Sprintf("invalid index %x", originTxIdx)
+		return nil, ruleError(ErrBadTxInput, str)
 	}
 
-	sigScript := txin.SignatureScript
-	pkScript := originTx.TxOut[originTxIdx].PkScript
-	engine, err := btcscript.NewScript(sigScript, pkScript, txInIdx, tx,
-		pver, timestamp.After(btcscript.Bip16Activation))
-	if err != nil {
-		return err
+	input := ScriptInput{
+		Tx:              item.tx,
+		TxInIndex:       item.txInIndex,
+		PkScript:        originTx.TxOut[originTxIdx].PkScript,
+		ProtocolVersion: pver,
 	}
+	return &input, nil
+}
 
-	err = engine.Execute()
-	if err != nil {
-		log.Warnf("validate of input %v failed: %v", txInIdx, err)
+// scriptValidationError converts the passed error returned by a script engine
+// into a RuleError so that script failures are distinguishable from other
+// failures in the same way as all other rule violations.  Errors which are
+// already a RuleError are returned as is.
+func scriptValidationError(err error) error {
+	if _, ok := err.(RuleError); ok {
 		return err
 	}
+	return ruleError(ErrScriptValidation, err.Error())
+}
 
-	return nil
+// scriptWorker validates the scripts of the items received on the passed item
+// channel with the passed engine and sends the results on the passed result
+// channel until the quit channel is closed.
+func scriptWorker(items <-chan *txValidateItem, results chan<- error, quit <-chan struct{}, txStore TxStore, pver uint32, flags ScriptFlags, engine ScriptEngine) {
+	for {
+		select {
+		case item := <-items:
+			input, err := resolveScriptInput(item, txStore, pver)
+			if err == nil {
+				err = engine.VerifyScript(input, flags)
+				if err != nil {
+					log.Warnf("validate of input %v failed: %v",
+						item.txInIndex, err)
+					err = scriptValidationError(err)
+				}
+			}
+			if err != nil {
+				err = contextError(err, txInContext(item.txHash,
+					item.txInIndex))
+			}
+
+			select {
+			case results <- err:
+			case <-quit:
+				return
+			}
+
+		case <-quit:
+			return
+		}
+	}
 }
 
-// validateAllTxIn validates the scripts for all of the passed transaction
-// inputs using multiple goroutines.
-func validateAllTxIn(txsha *btcwire.ShaHash, txValidator *btcwire.MsgTx, pver uint32, timestamp time.Time, job []*btcwire.TxIn, txStore map[btcwire.ShaHash]*txData) (err error) {
-	c := make(chan txValidate)
-	resultErrors := make([]error, len(job))
-
-	var currentItem int
-	var completedItems int
-
-	processFunc := func(txInIdx int) {
-		log.Tracef("validating tx %v input %v len %v",
-			&txsha, currentItem, len(job))
-		txin := job[txInIdx]
-		originTxSha := &txin.PreviousOutpoint.Hash
-		origintxidx := txin.PreviousOutpoint.Index
-
-		var originTx *btcwire.MsgTx
-		if origintxidx != math.MaxUint32 {
-			txInfo, ok := txStore[*originTxSha]
-			if !ok {
-				//wtf?
-				fmt.Printf("obj not found in txStore %v",
-					originTxSha)
+// validateScripts validates the scripts of all of the passed items with the
+// passed engine.  Engines which implement the BatchScriptEngine interface are
+// handed all of the inputs at once.  Otherwise, the inputs are validated using
+// a pool of the passed number of goroutines.  It returns the first error
+// encountered without waiting for the remaining items to be validated.
+func validateScripts(items []*txValidateItem, txStore TxStore, pver uint32, flags ScriptFlags, numWorkers int, engine ScriptEngine) error {
+	if batchEngine, ok := engine.(BatchScriptEngine); ok {
+		inputs := make([]*ScriptInput, 0, len(items))
+		for _, item := range items {
+			input, err := resolveScriptInput(item, txStore, pver)
+			if err != nil {
+				return contextError(err, txInContext(item.txHash,
+					item.txInIndex))
 			}
-			originTx = txInfo.tx
+			inputs = append(inputs, input)
+		}
+		err := batchEngine.VerifyScripts(inputs, flags)
+		if err != nil {
+			return scriptValidationError(err)
 		}
-		err := validateTxIn(txInIdx, job[txInIdx], txsha, txValidator,
-			pver, timestamp, originTx)
-		r := txValidate{txInIdx, err}
-		c <- r
+		return nil
+	}
+
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	if numWorkers > len(items) {
+		numWorkers = len(items)
 	}
-	for currentItem = 0; currentItem < len(job) && currentItem < 16; currentItem++ {
-		go processFunc(currentItem)
+
+	itemChan := make(chan *txValidateItem)
+	resultChan := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	for i := 0; i < numWorkers; i++ {
+		go scriptWorker(itemChan, resultChan, quit, txStore, pver, flags,
+			engine)
 	}
-	for completedItems < len(job) {
+
+	// Hand out the items while collecting the results.  Sending is only
+	// enabled while there are items left.
+	var numSent, numDone int
+	for numDone < len(items) {
+		var sendChan chan *txValidateItem
+		var item *txValidateItem
+		if numSent < len(items) {
+			sendChan = itemChan
+			item = items[numSent]
+		}
+
 		select {
-		case result := <-c:
-			completedItems++
-			resultErrors[result.txIndex] = result.err
-			// would be nice to determine if we could stop
-			// on early errors here instead of running more.
-			if err == nil {
-				err = result.err
-			}
+		case sendChan <- item:
+			numSent++
 
-			if currentItem < len(job) {
-				go processFunc(currentItem)
-				currentItem++
+		case err := <-resultChan:
+			numDone++
+			if err != nil {
+				return err
 			}
 		}
 	}
-	for i := 0; i < len(job); i++ {
-		if resultErrors[i] != nil {
-			log.Warnf("tx %v failed input %v, err %v", &txsha, i, resultErrors[i])
-		}
-	}
-	return
+
+	return nil
 }
 
 // checkBlockScripts executes and validates the scripts for all transactions in
-// the passed block.
-func checkBlockScripts(block *btcutil.Block, txStore map[btcwire.ShaHash]*txData) error {
-	pver := block.ProtocolVersion()
-	timestamp := block.MsgBlock().Header.Timestamp
+// the passed block using the additional rules defined by the passed flags.  The
+// inputs of all of the transactions are validated with the passed engine in
+// parallel by a pool of the passed number of goroutines, or one per CPU when it
+// is zero.
+func checkBlockScripts(block *btcutil.Block, txStore TxStore, flags ScriptFlags, numWorkers int, engine ScriptEngine) error {
+	var items []*txValidateItem
 	for i, tx := range block.MsgBlock().Transactions {
 		txHash, _ := block.TxSha(i)
-		err := validateAllTxIn(txHash, tx, pver, timestamp, tx.TxIn, txStore)
-		if err != nil {
-			return err
+		for txInIdx, txIn := range tx.TxIn {
+			// Skip coinbases.
+			if txIn.PreviousOutpoint.Index == math.MaxUint32 {
+				continue
+			}
+			items = append(items, &txValidateItem{
+				txInIndex: txInIdx,
+				txIn:      txIn,
+				tx:        tx,
+				txHash:    txHash,
+			})
 		}
 	}
 
-	return nil
+	return validateScripts(items, txStore, block.ProtocolVersion(), flags,
+		numWorkers, engine)
+}
+
+// ValidateTransactionScripts validates the scripts for all of the inputs of the
+// passed transaction using the additional rules defined by the passed flags and
+// the script engine the chain was created with.  The passed transaction store
+// must contain the input transactions.  Callers such as memory pools should use
+// flags which are a superset of the ones returned by ScriptFlagsForNextBlock,
+// such as StandardScriptFlags, so they never accept transactions which blocks
+// may not contain.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ValidateTransactionScripts(tx *btcwire.MsgTx, txStore TxStore, flags ScriptFlags) error {
+	txHash, err := tx.TxSha(btcwire.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+
+	var items []*txValidateItem
+	for txInIdx, txIn := range tx.TxIn {
+		if txIn.PreviousOutpoint.Index == math.MaxUint32 {
+			continue
+		}
+		items = append(items, &txValidateItem{
+			txInIndex: txInIdx,
+			txIn:      txIn,
+			tx:        tx,
+			txHash:    &txHash,
+		})
+	}
+	return validateScripts(items, txStore, btcwire.ProtocolVersion, flags, 0,
+		b.scriptEngine)
+}
+
+// SetScriptValidationWorkers sets the number of goroutines used to validate the
+// scripts of the inputs of a block in parallel.  The default of zero uses one
+// per CPU.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetScriptValidationWorkers(numWorkers int) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.scriptWorkers = numWorkers
+}
+
+// scriptFlagsForNode returns the additional script rules which apply to the
+// block for the passed node.  This is the single place the position based
+// activation of each of the rules is decided.  BIP0016 is based on the block
+// timestamp, BIP0066 and BIP0065 on the versions of the blocks before it, and
+// BIP0112 on the height at which relative lock times activated.
+func (b *BlockChain) scriptFlagsForNode(node *blockNode) (ScriptFlags, error) {
+	var flags ScriptFlags
+
+	// Enforce the pay-to-script-hash rules for blocks after the activation
+	// time.  This is part of BIP_0016.
+	if node.timestamp.After(btcscript.Bip16Activation) {
+		flags |= ScriptBip16
+	}
+
+	prevNode, err := b.getPrevNodeFromNode(node)
+	if err != nil {
+		return 0, err
+	}
+
+	// Enforce strictly DER encoded signatures for blocks whose version is
+	// the strictDERVersion or newer once a majority of the network has
+	// upgraded.
+	// Rules:
+	//  75% (750 / 1000) for main network
+	//  51% (51 / 100) for the test network
+	// This is part of BIP_0066.
+	if node.version >= strictDERVersion {
+		minRequired := b.chainParams.BlockEnforceNumRequired
+		numToCheck := b.chainParams.BlockUpgradeNumToCheck
+		if b.isMajorityVersion(strictDERVersion, prevNode, minRequired,
+			numToCheck) {
+
+			flags |= ScriptStrictDER
+		}
+	}
+
+	// Enforce OP_CHECKLOCKTIMEVERIFY for blocks whose version is the
+	// checkLockTimeVerifyVersion or newer once a majority of the network
+	// has upgraded.
+	// Rules:
+	//  75% (750 / 1000) for main network
+	//  51% (51 / 100) for the test network
+	// This is part of BIP_0065.
+	if node.version >= checkLockTimeVerifyVersion {
+		minRequired := b.chainParams.BlockEnforceNumRequired
+		numToCheck := b.chainParams.BlockUpgradeNumToCheck
+		if b.isMajorityVersion(checkLockTimeVerifyVersion, prevNode,
+			minRequired, numToCheck) {
+
+			flags |= ScriptVerifyCLTV
+		}
+	}
+
+	// Enforce OP_CHECKSEQUENCEVERIFY once relative lock times are active.
+	// This is part of BIP_0112.
+	csvActive, err := b.isCSVActive(prevNode)
+	if err != nil {
+		return 0, err
+	}
+	if csvActive {
+		flags |= ScriptVerifyCSV
+	}
+
+	return flags, nil
+}
+
+// ScriptFlagsForNextBlock returns the additional script rules enforced by
+// consensus for a block which extends the end of the main chain.  The block is
+// assumed to have the latest version known to this package and the current
+// network-adjusted time as its timestamp.  Callers such as memory pools should
+// validate transactions with a superset of these flags.  See
+// ValidateTransactionScripts.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) ScriptFlagsForNextBlock() (ScriptFlags, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return 0, fmt.Errorf("no main chain blocks are available")
+	}
+	node := &blockNode{
+		parent:    b.bestChain,
+		height:    b.bestChain.height + 1,
+		hash:      zeroHash,
+		version:   maxKnownBlockVersion,
+		timestamp: b.timeSource.AdjustedTime(),
+	}
+	return b.scriptFlagsForNode(node)
 }
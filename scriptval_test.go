@@ -0,0 +1,70 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// spendAllBlock returns a block which builds on the last of the passed blocks
+// and spends the coinbases of all of them.  The signature script of the spend
+// at the passed index is made to fail, unless it is negative.
+func spendAllBlock(g *blockGenerator, blocks []*btcutil.Block, badIndex int) *btcutil.Block {
+	return g.nextBlock(blocks[len(blocks)-1], func(msgBlock *btcwire.MsgBlock) {
+		for i, block := range blocks {
+			tx := spendTx(block, 1000)
+			if i == badIndex {
+				// OP_RETURN
+				tx.TxIn[0].SignatureScript = []byte{0x6a}
+			}
+			msgBlock.AddTransaction(tx)
+		}
+	})
+}
+
+// TestScriptValidationWorkers ensures the scripts of all of the inputs of a
+// block are validated regardless of the number of script validation workers
+// and that a failing script anywhere in the block rejects it.
+func TestScriptValidationWorkers(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 4)
+	goodBlock := spendAllBlock(g, blocks, -1)
+
+	tests := []struct {
+		name       string
+		numWorkers int
+		badIndex   int
+	}{
+		{"one per CPU", 0, 2},
+		{"single worker", 1, 3},
+		{"fewer workers than inputs", 2, 0},
+		{"more workers than inputs", 8, 3},
+	}
+
+	for i, test := range tests {
+		chain, _, teardown := newTestChain(t, "scriptvaltest", &params,
+			nil)
+		chain.SetScriptValidationWorkers(test.numWorkers)
+		processBlocks(t, chain, blocks)
+
+		_, _, err := chain.ProcessBlock(spendAllBlock(g, blocks,
+			test.badIndex))
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != btcchain.ErrScriptValidation {
+			t.Errorf("ProcessBlock #%d (%s): got %v, want %v", i,
+				test.name, err, btcchain.ErrScriptValidation)
+		}
+		_, _, err = chain.ProcessBlock(goodBlock)
+		if err != nil {
+			t.Errorf("ProcessBlock #%d (%s): unexpected error %v", i,
+				test.name, err)
+		}
+		teardown()
+	}
+}
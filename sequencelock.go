@@ -0,0 +1,176 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"time"
+)
+
+// These constants define how the sequence numbers of transaction inputs are
+// interpreted as relative lock times by BIP0068.
+const (
+	// sequenceLockTimeDisabled is the flag which disables the relative
+	// lock time of an input when it is set.
+	sequenceLockTimeDisabled = 1 << 31
+
+	// sequenceLockTimeIsSeconds is the flag which indicates the relative
+	// lock time is in units of seconds as opposed to blocks.
+	sequenceLockTimeIsSeconds = 1 << 22
+
+	// sequenceLockTimeMask is the mask which extracts the relative lock
+	// time from the sequence number.
+	sequenceLockTimeMask = 0x0000ffff
+
+	// sequenceLockTimeGranularity is the number of bits relative lock
+	// times in seconds are shifted by, so they are in units of 512
+	// seconds.
+	sequenceLockTimeGranularity = 9
+)
+
+// isCSVActive returns whether or not the relative lock time rules apply to the
+// block after the passed node.  They apply from the CSVHeight of the network
+// when it has one and once the CSV deployment is active via version bits
+// otherwise.
+func (b *BlockChain) isCSVActive(prevNode *blockNode) (bool, error) {
+	if prevNode == nil {
+		return false, nil
+	}
+	if activationHeight := b.chainParams.CSVHeight; activationHeight != 0 {
+		return prevNode.height+1 >= activationHeight, nil
+	}
+
+	state, err := b.thresholdState(prevNode, DeploymentCSV)
+	if err != nil {
+		return false, err
+	}
+	return state == ThresholdActive, nil
+}
+
+// SequenceLock houses the relative lock times of a transaction as the most
+// recent height and time which must have already passed for it to be included
+// in a block.  A value of -1 means there is no lock of that type.
+type SequenceLock struct {
+	Seconds     int64
+	BlockHeight int64
+}
+
+// IsActive returns whether or not the sequence lock allows the transaction to
+// be included in a block at the passed height whose previous block has the
+// passed median time past.
+func (l *SequenceLock) IsActive(blockHeight int64, medianTime time.Time) bool {
+	return l.Seconds < medianTime.Unix() && l.BlockHeight < blockHeight
+}
+
+// ancestorNode returns the ancestor of the passed node at the passed height,
+// loading nodes from the database as needed.
+func (b *BlockChain) ancestorNode(node *blockNode, height int64) (*blockNode, error) {
+	for node != nil && node.height > height {
+		var err error
+		node, err = b.getPrevNodeFromNode(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if node == nil {
+		return nil, fmt.Errorf("no ancestor at height %d", height)
+	}
+	return node, nil
+}
+
+// calcSequenceLock returns the sequence lock of the passed transaction as
+// defined by BIP0068 when it is included in the block for the passed node.  The
+// passed transaction store must contain the input transactions.  Inputs which
+// are not yet in a block as of the node, such as those from a memory pool, are
+// treated as though they are in the block for the node.
+func (b *BlockChain) calcSequenceLock(node *blockNode, tx *btcwire.MsgTx, txStore TxStore) (*SequenceLock, error) {
+	lock := SequenceLock{Seconds: -1, BlockHeight: -1}
+
+	// Relative lock times only apply to transactions with a version of at
+	// least 2.  The coinbase has no inputs to be relative to.
+	if IsCoinBase(tx) || tx.Version < 2 {
+		return &lock, nil
+	}
+
+	for _, txIn := range tx.TxIn {
+		sequence := txIn.Sequence
+		if sequence&sequenceLockTimeDisabled != 0 {
+			continue
+		}
+
+		originHash := &txIn.PreviousOutpoint.Hash
+		originTx, ok := txStore[*originHash]
+		if !ok || originTx.Err != nil || originTx.Tx == nil {
+			str := fmt.Sprintf("unable to find input transaction "+
+				"%v", originHash)
+			return nil, ruleError(ErrMissingTx, str)
+		}
+		inputHeight := originTx.BlockHeight
+		if inputHeight > node.height {
+			inputHeight = node.height
+		}
+
+		// Relative lock times in seconds are relative to the median time
+		// past of the block before the one containing the input, while
+		// those in blocks are relative to the block containing it.
+		relativeLock := int64(sequence & sequenceLockTimeMask)
+		if sequence&sequenceLockTimeIsSeconds != 0 {
+			prevHeight := inputHeight - 1
+			if prevHeight < 0 {
+				prevHeight = 0
+			}
+			ancestor, err := b.ancestorNode(node, prevHeight)
+			if err != nil {
+				return nil, err
+			}
+			medianTime, err := b.calcPastMedianTime(ancestor)
+			if err != nil {
+				return nil, err
+			}
+
+			seconds := medianTime.Unix() +
+				relativeLock<<sequenceLockTimeGranularity - 1
+			if seconds > lock.Seconds {
+				lock.Seconds = seconds
+			}
+		} else {
+			height := inputHeight + relativeLock - 1
+			if height > lock.BlockHeight {
+				lock.BlockHeight = height
+			}
+		}
+	}
+
+	return &lock, nil
+}
+
+// CalcSequenceLock returns the sequence lock of the passed transaction as
+// defined by BIP0068 if it were to be included in the next block after the end
+// of the main chain.  The passed transaction store must contain the input
+// transactions, such as one returned by FetchTransactionStore.  Inputs which
+// are not in the main chain, such as those from a memory pool, must have their
+// BlockHeight set to a height after the end of the main chain.  This allows
+// callers such as a memory pool to enforce the same relative lock time rules as
+// the block chain via SequenceLock.IsActive.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) CalcSequenceLock(tx *btcwire.MsgTx, txStore TxStore) (*SequenceLock, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	// The lock is calculated from the point of view of a new block that
+	// extends the end of the main chain.  See FetchTransactionStore.
+	node := &blockNode{hash: b.chainParams.GenesisHash}
+	if b.bestChain != nil {
+		node = &blockNode{
+			parent: b.bestChain,
+			height: b.bestChain.height + 1,
+			hash:   zeroHash,
+		}
+	}
+	return b.calcSequenceLock(node, tx, txStore)
+}
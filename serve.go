@@ -0,0 +1,70 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// CanServeBlock returns whether or not the main chain block at the provided
+// height is available to be served to peers.  This allows higher layers to
+// accurately answer requests up front rather than discovering the block is
+// missing via an error part way through a response, such as when the chain is
+// still syncing.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) CanServeBlock(height int64) bool {
+	if height < 0 {
+		return false
+	}
+
+	// Blocks beyond the end of the main chain are not available yet.
+	b.chainLock.RLock()
+	bestChain := b.bestChain
+	b.chainLock.RUnlock()
+	if bestChain != nil && height > bestChain.height {
+		return false
+	}
+
+	hash, err := b.db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return false
+	}
+	return b.db.ExistsSha(hash)
+}
+
+// FilterIndexer is the interface filter indexes, such as those which build the
+// compact block filters defined by BIP0158, implement in addition to Indexer so
+// CanServeFilter can determine whether the filter for a block is available.
+type FilterIndexer interface {
+	Indexer
+
+	// HasFilter returns whether or not the index holds the filter for the
+	// block with the passed hash.
+	HasFilter(hash *btcwire.ShaHash) bool
+}
+
+// CanServeFilter returns whether or not a filter for the block with the passed
+// hash is available to be served to peers.  That is the case when one of the
+// indexes added via AddIndexer is a FilterIndexer which is in sync with the
+// main chain and holds the filter for the block.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) CanServeFilter(hash *btcwire.ShaHash) bool {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	for _, state := range b.indexers {
+		if !state.inSync {
+			continue
+		}
+		filterIndexer, ok := state.indexer.(FilterIndexer)
+		if ok && filterIndexer.HasFilter(hash) {
+			return true
+		}
+	}
+	return false
+}
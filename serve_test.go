@@ -0,0 +1,88 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// testFilterIndexer is a FilterIndexer which keeps track of the blocks it holds
+// a filter for.
+type testFilterIndexer struct {
+	testIndexer
+	filters map[btcwire.ShaHash]struct{}
+}
+
+// ConnectBlock adds the filter for the passed block.  It is part of the
+// btcchain.Indexer interface.
+func (idx *testFilterIndexer) ConnectBlock(block *btcutil.Block) error {
+	idx.filters[*blockHash(block)] = struct{}{}
+	return idx.testIndexer.ConnectBlock(block)
+}
+
+// DisconnectBlock removes the filter for the passed block.  It is part of the
+// btcchain.Indexer interface.
+func (idx *testFilterIndexer) DisconnectBlock(block *btcutil.Block) error {
+	delete(idx.filters, *blockHash(block))
+	return idx.testIndexer.DisconnectBlock(block)
+}
+
+// HasFilter returns whether or not the index holds the filter for the block
+// with the passed hash.  It is part of the btcchain.FilterIndexer interface.
+func (idx *testFilterIndexer) HasFilter(hash *btcwire.ShaHash) bool {
+	_, ok := idx.filters[*hash]
+	return ok
+}
+
+// TestCanServeFilter ensures filters are only reported as available for the
+// blocks a filter index which is in sync with the main chain holds them for.
+func TestCanServeFilter(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "servefiltertest", &params, nil)
+	defer teardown()
+
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 2)
+	processBlocks(t, chain, blocks)
+
+	// Indexes which don't build filters don't make them available.
+	err := chain.AddIndexer(&testIndexer{tipHash: params.GenesisHash})
+	if err != nil {
+		t.Fatalf("AddIndexer: unexpected error %v", err)
+	}
+	if chain.CanServeFilter(blockHash(blocks[0])) {
+		t.Fatalf("CanServeFilter: filter available without a filter " +
+			"index")
+	}
+
+	// The filter index is caught up with the main chain when it is added.
+	indexer := &testFilterIndexer{
+		testIndexer: testIndexer{tipHash: params.GenesisHash},
+		filters:     make(map[btcwire.ShaHash]struct{}),
+	}
+	if err := chain.AddIndexer(indexer); err != nil {
+		t.Fatalf("AddIndexer: unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hash *btcwire.ShaHash
+		want bool
+	}{
+		{"first block", blockHash(blocks[0]), true},
+		{"end of the main chain", blockHash(blocks[1]), true},
+		{"unknown block", blockHash(g.nextBlock(blocks[1])), false},
+	}
+	for i, test := range tests {
+		got := chain.CanServeFilter(test.hash)
+		if got != test.want {
+			t.Errorf("CanServeFilter #%d (%s): got %v, want %v", i,
+				test.name, got, test.want)
+		}
+	}
+}
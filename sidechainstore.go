@@ -0,0 +1,241 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sideChainBlockExt is the file name extension of the blocks written to the
+// side chain block directory.
+const sideChainBlockExt = ".blk"
+
+// SetSideChainBlockDir sets the directory side chain blocks are persisted to.
+// Side chain blocks are otherwise only held in memory, which means the memory
+// ceiling set via SetResourceLimits rejects side chain blocks once it is
+// reached.  With a directory set, the lowest side chain blocks are evicted
+// from memory instead and are loaded from the directory again when they are
+// needed, such as when the chain is reorganized onto their side chain.  Passing
+// an empty path stops persisting side chain blocks.
+//
+// Side chains are not restored after a restart, so any blocks left in the
+// directory by a previous instance are removed.  For this reason, it must be
+// called before any blocks are processed.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SetSideChainBlockDir(dir string) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.root != nil {
+		return fmt.Errorf("the side chain block directory can only be " +
+			"set before any blocks are processed")
+	}
+
+	b.sideChainDir = dir
+	if dir == "" {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), sideChainBlockExt) {
+			err := os.Remove(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sideChainBlockPath returns the path of the file the block with the passed
+// hash is persisted to in the side chain block directory.
+func (b *BlockChain) sideChainBlockPath(hash *btcwire.ShaHash) string {
+	return filepath.Join(b.sideChainDir, hash.String()+sideChainBlockExt)
+}
+
+// blockSize returns the serialized size of the passed block.  The blocks held
+// in memory were all either deserialized or have been serialized before, so
+// the size is available without serializing them again.
+func blockSize(block *btcutil.Block) int64 {
+	serializedBlock, err := block.Bytes()
+	if err != nil {
+		return 0
+	}
+	return int64(len(serializedBlock))
+}
+
+// setCachedBlock adds the passed block to the side chain block cache while
+// keeping track of the total size of the cached blocks.  It must be called with
+// the chain lock held for writes.
+func (b *BlockChain) setCachedBlock(hash *btcwire.ShaHash, block *btcutil.Block) {
+	if cached, ok := b.blockCache[*hash]; ok {
+		b.blockCacheBytes -= blockSize(cached)
+	}
+	b.blockCache[*hash] = block
+	b.blockCacheBytes += blockSize(block)
+}
+
+// deleteCachedBlock removes the block with the passed hash from the side chain
+// block cache while keeping track of the total size of the cached blocks.  It
+// returns the size of the removed block.  It must be called with the chain lock
+// held for writes.
+func (b *BlockChain) deleteCachedBlock(hash *btcwire.ShaHash) int64 {
+	cached, ok := b.blockCache[*hash]
+	if !ok {
+		return 0
+	}
+	delete(b.blockCache, *hash)
+	size := blockSize(cached)
+	b.blockCacheBytes -= size
+	return size
+}
+
+// cacheSideChainBlock adds the passed block to the side chain block cache and
+// persists it to the side chain block directory when one is set so it can be
+// evicted from memory later.  It must be called with the chain lock held for
+// writes.
+func (b *BlockChain) cacheSideChainBlock(hash *btcwire.ShaHash, block *btcutil.Block) {
+	b.setCachedBlock(hash, block)
+	if b.sideChainDir == "" {
+		return
+	}
+	if _, ok := b.storedBlocks[*hash]; ok {
+		return
+	}
+
+	// The block is simply kept in memory when it can't be persisted.  The
+	// file is written to a temporary path which is then renamed, so it is
+	// either complete or does not exist.
+	serializedBlock, err := block.Bytes()
+	if err == nil {
+		path := b.sideChainBlockPath(hash)
+		err = ioutil.WriteFile(path+".tmp", serializedBlock, 0600)
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Warnf("Unable to persist side chain block %v: %v", hash,
+			err)
+		return
+	}
+	b.storedBlocks[*hash] = struct{}{}
+}
+
+// uncacheSideChainBlock removes the block with the passed hash from the side
+// chain block cache and the side chain block directory, such as when it is
+// connected to the main chain or discarded.  It must be called with the chain
+// lock held for writes.
+func (b *BlockChain) uncacheSideChainBlock(hash *btcwire.ShaHash) {
+	b.deleteCachedBlock(hash)
+	if _, ok := b.storedBlocks[*hash]; !ok {
+		return
+	}
+	delete(b.storedBlocks, *hash)
+	err := os.Remove(b.sideChainBlockPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Unable to remove side chain block %v: %v", hash, err)
+	}
+}
+
+// loadStoredBlock loads the block with the passed hash from the side chain
+// block directory.  It returns nil when the block was not persisted there.
+func (b *BlockChain) loadStoredBlock(hash *btcwire.ShaHash) (*btcutil.Block, error) {
+	if _, ok := b.storedBlocks[*hash]; !ok {
+		return nil, nil
+	}
+	serializedBlock, err := ioutil.ReadFile(b.sideChainBlockPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	block, err := btcutil.NewBlockFromBytes(serializedBlock,
+		btcwire.ProtocolVersion)
+	if err != nil {
+		return nil, deserializationError(err)
+	}
+	return block, nil
+}
+
+// haveSideChainBlock returns whether or not the block with the passed hash is
+// available as a side chain block, either in memory or in the side chain block
+// directory.
+func (b *BlockChain) haveSideChainBlock(hash *btcwire.ShaHash) bool {
+	if _, ok := b.blockCache[*hash]; ok {
+		return true
+	}
+	_, ok := b.storedBlocks[*hash]
+	return ok
+}
+
+// sideChainNodes returns the nodes for all of the side chain blocks, both those
+// which are held in memory and those which were evicted to the side chain
+// block directory.
+func (b *BlockChain) sideChainNodes() []*blockNode {
+	nodes := make([]*blockNode, 0, len(b.blockCache))
+	for hash := range b.blockCache {
+		if node, ok := b.index[hash]; ok && !node.inMainChain {
+			nodes = append(nodes, node)
+		}
+	}
+	for hash := range b.storedBlocks {
+		if _, ok := b.blockCache[hash]; ok {
+			continue
+		}
+		if node, ok := b.index[hash]; ok && !node.inMainChain {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// evictSideChainBlocks removes side chain blocks which are persisted to the
+// side chain block directory from memory, starting with the lowest ones, until
+// at least the passed number of bytes have been freed.  It returns the number
+// of bytes freed, which is less when there are not enough such blocks.
+func (b *BlockChain) evictSideChainBlocks(numBytes int64) int64 {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	var freed int64
+	for freed < numBytes {
+		var lowest *blockNode
+		for hash := range b.storedBlocks {
+			if _, ok := b.blockCache[hash]; !ok {
+				continue
+			}
+			node, ok := b.index[hash]
+			if !ok || node.inMainChain {
+				continue
+			}
+			if lowest == nil || node.height < lowest.height {
+				lowest = node
+			}
+		}
+		if lowest == nil {
+			break
+		}
+
+		log.Debugf("Evicting side chain block %v (height %d) from "+
+			"memory", lowest.hash, lowest.height)
+		freed += b.deleteCachedBlock(lowest.hash)
+	}
+	return freed
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// checkBlockCacheBytes fails the test when the running total of the size of
+// the side chain blocks held in memory does not match the blocks.
+func checkBlockCacheBytes(t *testing.T, context string, chain *btcchain.BlockChain) {
+	got, want := chain.TstBlockCacheBytes()
+	if got != want {
+		t.Errorf("%s: block cache size is %d, want %d", context, got,
+			want)
+	}
+}
+
+// TestSideChainBlockEviction ensures side chain blocks which are persisted to
+// the side chain block directory are evicted from memory to stay under the
+// memory ceiling and are loaded again when the chain is reorganized onto their
+// side chain, while side chain blocks are rejected once the ceiling is reached
+// without a directory.
+func TestSideChainBlockEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbName  string
+		withDir bool
+	}{
+		{"with side chain block directory", "sidechainstoretest1", true},
+		{"without side chain block directory", "sidechainstoretest2",
+			false},
+	}
+
+	for i, test := range tests {
+		params := btcchain.RegressionNetParams
+		chain, _, teardown := newTestChain(t, test.dbName, &params,
+			nil)
+		defer teardown()
+
+		if test.withDir {
+			dir, err := ioutil.TempDir("", "sidechainstoretest")
+			if err != nil {
+				t.Fatalf("TempDir: unexpected error %v", err)
+			}
+			defer os.RemoveAll(dir)
+			err = chain.SetSideChainBlockDir(dir)
+			if err != nil {
+				t.Fatalf("SetSideChainBlockDir #%d (%s): unexpected "+
+					"error %v", i, test.name, err)
+			}
+		}
+
+		// Only allow a single coinbase only block to be held in memory.
+		chain.SetResourceLimits(btcchain.ResourceLimits{MaxMemory: 200})
+
+		// Build a main chain a1 <- a2 <- a3 and a longer side chain
+		// b2 <- b3 <- b4 which forks from a1.
+		g := newBlockGenerator(&params)
+		mainBlocks := g.nextBlocks(g.genesis(), 3)
+		sideBlocks := g.nextBlocks(mainBlocks[0], 3)
+		processBlocks(t, chain, mainBlocks)
+		processBlocks(t, chain, sideBlocks[:1])
+		checkBlockCacheBytes(t, test.name, chain)
+
+		// The second side chain block exceeds the memory ceiling, so it
+		// is only accepted when the first can be evicted.
+		_, _, err := chain.ProcessBlock(sideBlocks[1])
+		if !test.withDir {
+			if _, ok := err.(btcchain.ResourceError); !ok {
+				t.Errorf("ProcessBlock #%d (%s): got %v, want a "+
+					"ResourceError", i, test.name, err)
+			}
+			checkBestBlock(t, test.name, chain, mainBlocks[2])
+			checkBlockCacheBytes(t, test.name, chain)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ProcessBlock #%d (%s): unexpected error %v", i,
+				test.name, err)
+		}
+		checkBlockCacheBytes(t, test.name, chain)
+
+		// The block which makes the side chain the best chain causes a
+		// reorganization which needs the evicted blocks.
+		processBlocks(t, chain, sideBlocks[2:])
+		checkBestBlock(t, test.name, chain, sideBlocks[2])
+		checkBlockCacheBytes(t, test.name, chain)
+		for _, block := range sideBlocks {
+			if !chain.HaveBlock(blockHash(block)) {
+				t.Errorf("HaveBlock #%d (%s): block %v is not "+
+					"known", i, test.name, blockHash(block))
+			}
+		}
+	}
+}
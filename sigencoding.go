@@ -0,0 +1,211 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// halfOrder is half of the order of the secp256k1 curve.  Signatures with an S
+// value above it are considered high-S since an equivalent low-S signature can
+// be created by anyone by negating S.
+var halfOrder = func() *big.Int {
+	n, _ := new(big.Int).SetString("fffffffffffffffffffffffffffffffe"+
+		"baaedce6af48a03bbfd25e8cd0364141", 16)
+	return n.Rsh(n, 1)
+}()
+
+// isSignaturePush returns whether or not the passed data pushed by a signature
+// script appears to be a signature for the purposes of scanning signature
+// encodings.  Signatures are DER encoded sequences,
+// which start with 0x30, followed by a hash type byte.  Public keys and
+// serialized scripts essentially never start with 0x30 and are that short.
+func isSignaturePush(data []byte) bool {
+	return len(data) >= 9 && len(data) <= 73 && data[0] == 0x30
+}
+
+// isStrictDERSignature returns whether or not the passed signature, including
+// the trailing hash type byte, is strictly DER encoded.  This means it is a
+// sequence with the correct overall length containing exactly two integers, R
+// and S, which are positive and minimally encoded.
+func isStrictDERSignature(sig []byte) bool {
+	// Format: 0x30 <total len> 0x02 <R len> <R> 0x02 <S len> <S> <hashtype>
+	if len(sig) < 9 || len(sig) > 73 {
+		return false
+	}
+	if sig[0] != 0x30 || int(sig[1]) != len(sig)-3 {
+		return false
+	}
+
+	// The lengths of R and S must account for the entire signature.
+	rLen := int(sig[3])
+	if 5+rLen >= len(sig) {
+		return false
+	}
+	sLen := int(sig[5+rLen])
+	if rLen+sLen+7 != len(sig) {
+		return false
+	}
+
+	// R must be a positive, minimally encoded integer.
+	if sig[2] != 0x02 || rLen == 0 || sig[4]&0x80 != 0 {
+		return false
+	}
+	if rLen > 1 && sig[4] == 0x00 && sig[5]&0x80 == 0 {
+		return false
+	}
+
+	// S must be a positive, minimally encoded integer.
+	sStart := rLen + 6
+	if sig[sStart-2] != 0x02 || sLen == 0 || sig[sStart]&0x80 != 0 {
+		return false
+	}
+	if sLen > 1 && sig[sStart] == 0x00 && sig[sStart+1]&0x80 == 0 {
+		return false
+	}
+
+	return true
+}
+
+// isLowSSignature returns whether or not the S value of the passed strictly DER
+// encoded signature is at most half the order of the curve.
+func isLowSSignature(sig []byte) bool {
+	rLen := int(sig[3])
+	sLen := int(sig[5+rLen])
+	sStart := rLen + 6
+	s := new(big.Int).SetBytes(sig[sStart : sStart+sLen])
+	return s.Cmp(halfOrder) <= 0
+}
+
+// verifySignatureEncoding ensures the passed signature, which is about to be
+// verified by a signature checking opcode, is strictly DER encoded as required
+// by BIP0066.  Empty signatures are allowed since they are a compact way to
+// provide a signature which fails verification.
+func verifySignatureEncoding(sig []byte) error {
+	if len(sig) != 0 && !isStrictDERSignature(sig) {
+		str := fmt.Sprintf("signature %x is not strictly DER encoded",
+			sig)
+		return ruleError(ErrNotStrictDER, str)
+	}
+	return nil
+}
+
+// multiSigOperands splits the passed data stack, whose last item is the top,
+// into the operands of an OP_CHECKMULTISIG opcode executed with it.  The public
+// keys and signatures are returned in the order they are matched against each
+// other, which is from the top of the stack down, along with the items below
+// the signatures, the last of which is the extra item the opcode consumes.  The
+// ok result is false when the stack is malformed, which btcscript rejects.
+func multiSigOperands(stack [][]byte) (pubKeys, sigs, base [][]byte, ok bool) {
+	idx := len(stack) - 1
+	if idx < 0 {
+		return nil, nil, nil, false
+	}
+	numPubKeys := scriptNum(stack[idx])
+	if numPubKeys < 0 || numPubKeys > int64(idx) {
+		return nil, nil, nil, false
+	}
+	for i := idx - 1; i >= idx-int(numPubKeys); i-- {
+		pubKeys = append(pubKeys, stack[i])
+	}
+	idx -= int(numPubKeys) + 1
+	if idx < 0 {
+		return nil, nil, nil, false
+	}
+	numSigs := scriptNum(stack[idx])
+	if numSigs < 0 || numSigs >= int64(idx) {
+		return nil, nil, nil, false
+	}
+	for i := idx - 1; i >= idx-int(numSigs); i-- {
+		sigs = append(sigs, stack[i])
+	}
+	return pubKeys, sigs, stack[:idx-int(numSigs)], true
+}
+
+// SignatureEncodingReport is the data sent with an NTSignatureEncoding
+// notification.  It describes how many of the signatures in a block which was
+// connected to the main chain are encoded in ways that would be rejected by
+// stricter signature rules.  See EnableSignatureEncodingScan.
+type SignatureEncodingReport struct {
+	// Hash and Height identify the block the report is for.
+	Hash   *btcwire.ShaHash
+	Height int64
+
+	// NumSignatures is the number of signatures found in the signature
+	// scripts of the block.
+	NumSignatures uint64
+
+	// NumNotStrictDER is the number of those signatures which are not
+	// strictly DER encoded.
+	NumNotStrictDER uint64
+
+	// NumHighS is the number of strictly DER encoded signatures which have
+	// an S value greater than half the order of the curve.
+	NumHighS uint64
+}
+
+// EnableSignatureEncodingScan provides a mechanism to scan the signatures in
+// each block connected to the main chain for encodings that are not canonical
+// and report the results via NTSignatureEncoding notifications.  This has no
+// effect on which blocks are considered valid.  It is intended to help gauge
+// how ready the ecosystem is for enforcing stricter signature rules such as
+// strict DER encoding and low S values.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) EnableSignatureEncodingScan(enable bool) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	b.scanSigEncodings = enable
+}
+
+// calcSignatureEncodingReport scans the signature scripts of all transactions
+// in the passed block and returns a report of the signature encodings found.
+func calcSignatureEncodingReport(block *btcutil.Block) *SignatureEncodingReport {
+	var report SignatureEncodingReport
+	for _, tx := range block.MsgBlock().Transactions[1:] {
+		for _, txIn := range tx.TxIn {
+			for _, data := range parseScriptPushes(txIn.SignatureScript) {
+				if !isSignaturePush(data) {
+					continue
+				}
+
+				report.NumSignatures++
+				if !isStrictDERSignature(data) {
+					report.NumNotStrictDER++
+					continue
+				}
+				if !isLowSSignature(data) {
+					report.NumHighS++
+				}
+			}
+		}
+	}
+	return &report
+}
+
+// reportSignatureEncodings sends an NTSignatureEncoding notification for the
+// passed block which was just connected to the main chain when scanning
+// signature encodings is enabled.
+func (b *BlockChain) reportSignatureEncodings(node *blockNode, block *btcutil.Block) {
+	if !b.scanSigEncodings || len(block.MsgBlock().Transactions) == 0 {
+		return
+	}
+
+	report := calcSignatureEncodingReport(block)
+	report.Hash = node.hash
+	report.Height = node.height
+	if report.NumNotStrictDER > 0 || report.NumHighS > 0 {
+		log.Debugf("Block %v (height %d) contains %d of %d signatures "+
+			"which are not strictly DER encoded and %d with high S "+
+			"values", node.hash, node.height, report.NumNotStrictDER,
+			report.NumSignatures, report.NumHighS)
+	}
+	b.sendNotification(NTSignatureEncoding, report)
+}
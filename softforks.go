@@ -0,0 +1,208 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+// supermajorityFork describes a soft fork which is deployed by requiring a
+// supermajority of recent blocks to have at least a given version.
+type supermajorityFork struct {
+	id      string
+	version uint32
+}
+
+// supermajorityForks houses the soft forks deployed via supermajority in the
+// order they were deployed.
+var supermajorityForks = []supermajorityFork{
+	{"bip34", serializedHeightVersion},
+	{"bip66", strictDERVersion},
+	{"bip65", checkLockTimeVerifyVersion},
+}
+
+// deploymentIDs houses the identifiers of the version bits deployments indexed
+// by the deployment constants.
+var deploymentIDs = [numDeployments]string{
+	DeploymentCSV: "csv",
+}
+
+// SupermajorityForkStatus describes the status of a soft fork which is deployed
+// by requiring a supermajority of recent blocks to have at least a given
+// version, such as BIP0034, BIP0066, and BIP0065.  The status applies to the
+// block after the end of the main chain.
+type SupermajorityForkStatus struct {
+	// ID identifies the soft fork, such as "bip34".
+	ID string
+
+	// Version is the block version which signals for the soft fork.
+	Version uint32
+
+	// NumFound is the number of blocks out of the NumChecked most recent
+	// main chain blocks which have at least the version.  At most Window
+	// blocks are checked.
+	NumFound   uint64
+	NumChecked uint64
+	Window     uint64
+
+	// EnforceRequired and RejectRequired are the number of blocks in the
+	// window which must have at least the version for the new rules to be
+	// enforced for blocks with the version and for blocks with an older
+	// version to be rejected respectively.
+	EnforceRequired uint64
+	RejectRequired  uint64
+
+	// Enforced and Rejecting indicate whether new rules are enforced and
+	// whether blocks with an older version are rejected.
+	Enforced  bool
+	Rejecting bool
+}
+
+// VersionBitsForkStatus describes the status of a soft fork which is deployed
+// via version bits as defined by BIP0009.  The status applies to the block
+// after the end of the main chain.
+type VersionBitsForkStatus struct {
+	// ID identifies the deployment, such as "csv".
+	ID string
+
+	// Bit is the version bit which signals for the deployment.
+	Bit uint8
+
+	// StartTime and ExpireTime are the median times past, in seconds since
+	// the unix epoch, the deployment may be signaled for between.
+	StartTime  int64
+	ExpireTime int64
+
+	// State is the threshold state of the deployment.
+	State ThresholdState
+
+	// Period is the number of blocks in each signaling window and
+	// Threshold is the number of those which must signal for the
+	// deployment to lock in.
+	Period    int64
+	Threshold int64
+
+	// Elapsed is the number of blocks in the current window so far and
+	// Count is the number of those which signal for the deployment.  The
+	// statistics are only meaningful in the started state.
+	Elapsed int64
+	Count   int64
+
+	// Possible indicates whether enough blocks may still signal in the
+	// current window for the deployment to lock in.
+	Possible bool
+}
+
+// SoftForkStatuses houses the status of all of the soft forks known to this
+// package.  See SoftForkStatus.
+type SoftForkStatuses struct {
+	Supermajority []SupermajorityForkStatus
+	VersionBits   []VersionBitsForkStatus
+}
+
+// countVersions returns the number of blocks out of the previous numToCheck
+// blocks in the chain starting with startNode which have at least the passed
+// version along with the number of blocks that were actually checked.
+func (b *BlockChain) countVersions(minVer uint32, startNode *blockNode, numToCheck uint64) (uint64, uint64, error) {
+	var numFound, numChecked uint64
+	iterNode := startNode
+	for numChecked < numToCheck && iterNode != nil {
+		if iterNode.version >= minVer {
+			numFound++
+		}
+		numChecked++
+
+		var err error
+		iterNode, err = b.getPrevNodeFromNode(iterNode)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return numFound, numChecked, nil
+}
+
+// SoftForkStatus returns the status of all of the soft forks known to this
+// package for the block after the end of the main chain.  This includes the
+// soft forks deployed via supermajority as well as those deployed via version
+// bits along with signaling statistics over the current window.  It is
+// primarily intended for reporting, such as by a getblockchaininfo RPC.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SoftForkStatus() (*SoftForkStatuses, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	window := b.chainParams.BlockUpgradeNumToCheck
+	enforceRequired := b.chainParams.BlockEnforceNumRequired
+	rejectRequired := b.chainParams.BlockRejectNumRequired
+
+	var statuses SoftForkStatuses
+	bestChain := b.bestChain
+	for _, fork := range supermajorityForks {
+		numFound, numChecked, err := b.countVersions(fork.version,
+			bestChain, window)
+		if err != nil {
+			return nil, err
+		}
+		status := SupermajorityForkStatus{
+			ID:              fork.id,
+			Version:         fork.version,
+			NumFound:        numFound,
+			NumChecked:      numChecked,
+			Window:          window,
+			EnforceRequired: enforceRequired,
+			RejectRequired:  rejectRequired,
+			Enforced:        numFound >= enforceRequired,
+			Rejecting:       numFound >= rejectRequired,
+		}
+
+		// BIP0034 is always enforced after its known activation block.
+		if fork.version == serializedHeightVersion && bestChain != nil {
+			bip0034Height := b.chainParams.BIP0034Height
+			if bip0034Height != 0 && bestChain.height+1 >= bip0034Height {
+				status.Enforced = true
+			}
+		}
+		statuses.Supermajority = append(statuses.Supermajority, status)
+	}
+
+	blocksPerRetarget := b.chainParams.blocksPerRetarget()
+	deployments := b.networkDeployments()
+	for id := range deployments {
+		deployment := &deployments[id]
+		state, err := b.thresholdState(bestChain, id)
+		if err != nil {
+			return nil, err
+		}
+		status := VersionBitsForkStatus{
+			ID:         deploymentIDs[id],
+			Bit:        deployment.BitNumber,
+			StartTime:  deployment.StartTime,
+			ExpireTime: deployment.ExpireTime,
+			State:      state,
+			Period:     blocksPerRetarget,
+			Threshold:  b.ruleChangeThreshold(),
+		}
+
+		// Count the signaling blocks in the current window.
+		if bestChain != nil {
+			status.Elapsed = (bestChain.height + 1) % blocksPerRetarget
+		}
+		iterNode := bestChain
+		for i := int64(0); i < status.Elapsed && iterNode != nil; i++ {
+			if isSignaling(iterNode.version, deployment) {
+				status.Count++
+			}
+			iterNode, err = b.getPrevNodeFromNode(iterNode)
+			if err != nil {
+				return nil, err
+			}
+		}
+		remaining := status.Period - status.Elapsed
+		status.Possible = state == ThresholdStarted &&
+			status.Count+remaining >= status.Threshold
+
+		statuses.VersionBits = append(statuses.VersionBits, status)
+	}
+
+	return &statuses, nil
+}
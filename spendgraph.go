@@ -0,0 +1,150 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// BlockSpend describes a main chain transaction which spends outputs created by
+// an earlier block.  See FetchBlockSpends.
+type BlockSpend struct {
+	// TxHash identifies the spending transaction.
+	TxHash *btcwire.ShaHash
+
+	// BlockHash and Height identify the block the spending transaction is
+	// in.
+	BlockHash *btcwire.ShaHash
+	Height    int64
+
+	// OutPoints are the outputs created by the earlier block which the
+	// transaction spends.
+	OutPoints []btcwire.OutPoint
+}
+
+// blockSpendCollector collects the spends of the outputs created by a block in
+// the order they are added.
+type blockSpendCollector struct {
+	txHashes map[btcwire.ShaHash]struct{}
+	spends   []*BlockSpend
+	bySpend  map[btcwire.ShaHash]*BlockSpend
+}
+
+// add records that the passed transaction in the block with the passed hash and
+// height spends the passed output when it was created by the block.
+func (c *blockSpendCollector) add(txHash, blockHash *btcwire.ShaHash, height int64, outPoint *btcwire.OutPoint) {
+	if _, ok := c.txHashes[outPoint.Hash]; !ok {
+		return
+	}
+
+	spend, ok := c.bySpend[*txHash]
+	if !ok {
+		spend = &BlockSpend{
+			TxHash:    txHash,
+			BlockHash: blockHash,
+			Height:    height,
+		}
+		c.bySpend[*txHash] = spend
+		c.spends = append(c.spends, spend)
+	}
+	spend.OutPoints = append(spend.OutPoints, *outPoint)
+}
+
+// addBlock records the spends by all transactions in the passed block at the
+// passed height.
+func (c *blockSpendCollector) addBlock(block *btcutil.Block, height int64) error {
+	blockHash, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	for i, tx := range block.MsgBlock().Transactions {
+		if i == 0 {
+			continue
+		}
+
+		// It's safe to ignore the error on TxSha since the only way it
+		// can fail is if the index is out of range which is impossible
+		// here.
+		txHash, _ := block.TxSha(i)
+		for _, txIn := range tx.TxIn {
+			c.add(txHash, blockHash, height, &txIn.PreviousOutpoint)
+		}
+	}
+	return nil
+}
+
+// FetchBlockSpends returns the main chain transactions in the maxDepth blocks
+// after the main chain block identified by the passed hash which spend outputs
+// created by it, ordered by the position of the transactions in the chain.  The
+// spend journal is used to find the spends in the most recent blocks it covers,
+// while the spends in older blocks are found by loading the blocks from the
+// database.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) FetchBlockSpends(hash *btcwire.ShaHash, maxDepth int64) ([]*BlockSpend, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	// Only main chain blocks are stored in the database.
+	block, err := b.db.FetchBlockBySha(hash)
+	if err != nil {
+		return nil, err
+	}
+	txHashes, err := block.TxShas()
+	if err != nil {
+		return nil, err
+	}
+	collector := blockSpendCollector{
+		txHashes: make(map[btcwire.ShaHash]struct{}, len(txHashes)),
+		bySpend:  make(map[btcwire.ShaHash]*BlockSpend),
+	}
+	for _, txHash := range txHashes {
+		collector.txHashes[*txHash] = struct{}{}
+	}
+
+	startHeight := block.Height() + 1
+	endHeight := block.Height() + maxDepth
+	if b.bestChain != nil && endHeight > b.bestChain.height {
+		endHeight = b.bestChain.height
+	}
+
+	// Load the blocks which are before the start of the spend journal from
+	// the database.
+	b.chainLock.RLock()
+	journalStart := b.spendJournalStart()
+	b.chainLock.RUnlock()
+	height := startHeight
+	for ; height <= endHeight && height < journalStart; height++ {
+		if b.interruptRequested() {
+			return nil, ErrInterrupted
+		}
+
+		block, err := b.fetchMainChainBlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		err = collector.addBlock(block, height)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use the spend journal for the rest.
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+	for _, entry := range b.spendJournal {
+		if entry.height < height || entry.height > endHeight {
+			continue
+		}
+		for _, spent := range entry.spent {
+			collector.add(spent.spenderHash, entry.hash, entry.height,
+				&spent.outPoint)
+		}
+	}
+
+	return collector.spends, nil
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// maxSpendJournalBlocks is the default maximum number of the most recent main
+// chain blocks the spend journal keeps records for.  See
+// ResourceLimits.MaxSpendJournalBlocks.
+const maxSpendJournalBlocks = 2016
+
+// spentTxOut describes a transaction output which was spent by a transaction
+// in a main chain block.
+type spentTxOut struct {
+	outPoint    btcwire.OutPoint
+	spenderHash *btcwire.ShaHash
+	height      int64
+}
+
+// spendJournalEntry houses the outputs which were spent by the transactions in
+// a main chain block.
+type spendJournalEntry struct {
+	hash   *btcwire.ShaHash
+	height int64
+	spent  []*spentTxOut
+}
+
+// newSpendJournalEntry returns a spend journal entry for the outputs spent by
+// the passed block which is at the height of the passed node.
+func newSpendJournalEntry(node *blockNode, block *btcutil.Block) *spendJournalEntry {
+	entry := spendJournalEntry{hash: node.hash, height: node.height}
+	transactions := block.MsgBlock().Transactions
+	for i, tx := range transactions {
+		if i == 0 {
+			continue
+		}
+
+		// It's safe to ignore the error on TxSha since the only way it
+		// can fail is if the index is out of range which is impossible
+		// here.
+		txHash, _ := block.TxSha(i)
+		for _, txIn := range tx.TxIn {
+			entry.spent = append(entry.spent, &spentTxOut{
+				outPoint:    txIn.PreviousOutpoint,
+				spenderHash: txHash,
+				height:      node.height,
+			})
+		}
+	}
+	return &entry
+}
+
+// addSpendJournalEntry adds the passed entry, which must be for the block that
+// was just connected to the end of the main chain, to the spend journal.  Only
+// the entries for the most recent spendJournalLimit blocks are kept.  It
+// must be called with the chain lock held for writes.
+func (b *BlockChain) addSpendJournalEntry(entry *spendJournalEntry) {
+	b.spendJournal = append(b.spendJournal, entry)
+	for _, spent := range entry.spent {
+		b.spentOutputs[spent.outPoint] = spent
+	}
+
+	for len(b.spendJournal) > b.spendJournalLimit() {
+		oldest := b.spendJournal[0]
+		b.spendJournal = b.spendJournal[1:]
+		for _, spent := range oldest.spent {
+			if b.spentOutputs[spent.outPoint] == spent {
+				delete(b.spentOutputs, spent.outPoint)
+			}
+		}
+	}
+}
+
+// removeSpendJournalEntry removes the spend journal entry for the block with
+// the passed hash, which must be the block that was just disconnected from the
+// end of the main chain.  It returns the removed entry or nil when there was no
+// entry for it.  It must be called with the chain lock held for writes.
+func (b *BlockChain) removeSpendJournalEntry(hash *btcwire.ShaHash) *spendJournalEntry {
+	numEntries := len(b.spendJournal)
+	if numEntries == 0 || !b.spendJournal[numEntries-1].hash.IsEqual(hash) {
+		return nil
+	}
+
+	entry := b.spendJournal[numEntries-1]
+	b.spendJournal = b.spendJournal[:numEntries-1]
+	for _, spent := range entry.spent {
+		if b.spentOutputs[spent.outPoint] == spent {
+			delete(b.spentOutputs, spent.outPoint)
+		}
+	}
+	return entry
+}
+
+// spendJournalEntryFor returns the spend journal entry for the main chain block
+// associated with the passed node or nil when the journal does not cover it.
+// It must be called with either the process lock or the chain lock held.
+func (b *BlockChain) spendJournalEntryFor(node *blockNode) *spendJournalEntry {
+	if len(b.spendJournal) == 0 {
+		return nil
+	}
+	index := node.height - b.spendJournal[0].height
+	if index < 0 || index >= int64(len(b.spendJournal)) {
+		return nil
+	}
+	entry := b.spendJournal[index]
+	if !entry.hash.IsEqual(node.hash) {
+		return nil
+	}
+	return entry
+}
+
+// undoSpendJournalEntry updates the passed transaction store by undoing the
+// transactions of the block the passed spend journal entry is for the same way
+// disconnectTransactions does.  The outputs the block spent are restored from
+// the entry and the transactions it created are identified by their height, so
+// the block itself is not needed.
+func undoSpendJournalEntry(txStore TxStore, entry *spendJournalEntry) {
+	// Remove the transactions created by the block from the transaction
+	// store.
+	for hash, txD := range txStore {
+		if txD.Err == nil && txD.BlockHeight == entry.height {
+			delete(txStore, hash)
+		}
+	}
+
+	// Unspend the outputs the block spent.
+	for _, spent := range entry.spent {
+		originTx, exists := txStore[spent.outPoint.Hash]
+		if !exists || originTx.Err != nil {
+			continue
+		}
+		if spent.outPoint.Index < uint32(len(originTx.Spent)) {
+			originTx.Spent[spent.outPoint.Index] = false
+		}
+	}
+}
+
+// spendJournalStart returns the height of the oldest block in the spend
+// journal.  Every output spent by a main chain block at or after that height is
+// in the journal.  It must be called with the chain lock held for reads.
+func (b *BlockChain) spendJournalStart() int64 {
+	if len(b.spendJournal) == 0 {
+		if b.bestChain == nil {
+			return 0
+		}
+		return b.bestChain.height + 1
+	}
+	return b.spendJournal[0].height
+}
+
+// FetchUtxoAtHeight returns whether or not the passed output existed and was
+// unspent as of the main chain block at the passed height.  That is, the
+// output was created by a block at or before the height and was not spent by
+// any block at or before it.  Outputs spent by blocks after the start of the
+// spend journal, which covers up to the most recent 2016 main chain blocks
+// connected since the BlockChain instance was created or loaded along with the
+// block index, can be queried at any height.  An error is returned when whether
+// an output was spent as of the height can't be determined since the spend is
+// older than the journal.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) FetchUtxoAtHeight(outPoint *btcwire.OutPoint, height int64) (bool, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil || height < 0 || height > b.bestChain.height {
+		return false, fmt.Errorf("height %d is not in the main chain",
+			height)
+	}
+
+	// Find the transaction which created the output as of the height.
+	// There can be several transactions with the same hash in the main
+	// chain (see BIP0030), so choose the most recent one at or before the
+	// height.
+	txReplies, err := b.db.FetchTxBySha(&outPoint.Hash)
+	if err != nil || len(txReplies) == 0 {
+		return false, nil
+	}
+	var txReply *btcdb.TxListReply
+	for _, reply := range txReplies {
+		if reply.Err != nil || reply.Height > height {
+			continue
+		}
+		if txReply == nil || reply.Height > txReply.Height {
+			txReply = reply
+		}
+	}
+	if txReply == nil {
+		return false, nil
+	}
+	if outPoint.Index >= uint32(len(txReply.TxSpent)) {
+		return false, fmt.Errorf("transaction %v does not have an "+
+			"output at index %d", outPoint.Hash, outPoint.Index)
+	}
+
+	// Outputs which are unspent as of the end of the main chain were
+	// unspent as of every height since they were created.
+	if !txReply.TxSpent[outPoint.Index] {
+		return true, nil
+	}
+
+	// The output is spent as of the end of the main chain, so consult the
+	// spend journal to find out when.
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+	if spent, ok := b.spentOutputs[*outPoint]; ok {
+		return spent.height > height, nil
+	}
+
+	// The output was spent by a block before the start of the journal.
+	// That is only enough to determine it was spent as of heights at or
+	// after the start of the journal.
+	journalStart := b.spendJournalStart()
+	if height >= journalStart-1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to determine whether output %v:%d was "+
+		"spent as of height %d since the spend journal only covers "+
+		"heights %d and later", outPoint.Hash, outPoint.Index, height,
+		journalStart)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// txStoreAfter returns a transaction store with the transactions of the passed
+// blocks as of after all of them have been connected.  The transactions created
+// by the last block are left out when omitLast is set.
+func txStoreAfter(blocks []*btcutil.Block, omitLast bool) btcchain.TxStore {
+	txStore := make(btcchain.TxStore)
+	for i, block := range blocks {
+		if omitLast && i == len(blocks)-1 {
+			break
+		}
+		for j, tx := range block.MsgBlock().Transactions {
+			hash, _ := block.TxSha(j)
+			txStore[*hash] = &btcchain.TxData{
+				Tx:          tx,
+				Hash:        hash,
+				BlockHeight: block.Height(),
+				Spent:       make([]bool, len(tx.TxOut)),
+			}
+		}
+	}
+	for _, block := range blocks {
+		for _, tx := range block.MsgBlock().Transactions {
+			for _, txIn := range tx.TxIn {
+				prevOut := &txIn.PreviousOutpoint
+				if txD, ok := txStore[prevOut.Hash]; ok {
+					txD.Spent[prevOut.Index] = true
+				}
+			}
+		}
+	}
+	return txStore
+}
+
+// TestUndoSpendJournalEntry ensures undoing a block from its spend journal
+// entry results in the same transaction store as undoing it by disconnecting
+// its transactions.
+func TestUndoSpendJournalEntry(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 2)
+
+	// The third block spends the coinbase of the first one along with an
+	// output created in the same block and the fourth block spends the
+	// coinbase of the second one.
+	blocks = append(blocks, g.nextBlock(blocks[1],
+		func(msgBlock *btcwire.MsgBlock) {
+			tx := spendTx(blocks[0], 1000)
+			txHash, _ := tx.TxSha()
+			chained := btcwire.NewMsgTx()
+			chained.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&txHash,
+				0), nil))
+			chained.AddTxOut(btcwire.NewTxOut(tx.TxOut[0].Value-1000,
+				opTrueScript))
+			msgBlock.AddTransaction(tx)
+			msgBlock.AddTransaction(chained)
+		}))
+	blocks = append(blocks, g.nextBlock(blocks[2],
+		func(msgBlock *btcwire.MsgBlock) {
+			msgBlock.AddTransaction(spendTx(blocks[1], 1000))
+		}))
+
+	tests := []struct {
+		name      string
+		numBlocks int
+		omitLast  bool
+	}{
+		{"coinbase only", 2, false},
+		{"spends in the same block", 3, false},
+		{"spends an earlier coinbase", 4, false},
+		{"without the created transactions", 3, true},
+	}
+
+	for i, test := range tests {
+		undoBlock := blocks[test.numBlocks-1]
+		want := txStoreAfter(blocks[:test.numBlocks], test.omitLast)
+		err := btcchain.TstDisconnectTransactions(want, undoBlock)
+		if err != nil {
+			t.Errorf("disconnectTransactions #%d (%s): unexpected "+
+				"error %v", i, test.name, err)
+			continue
+		}
+
+		got := txStoreAfter(blocks[:test.numBlocks], test.omitLast)
+		err = btcchain.TstUndoSpendJournalEntry(got, undoBlock)
+		if err != nil {
+			t.Errorf("undoSpendJournalEntry #%d (%s): unexpected "+
+				"error %v", i, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("undoSpendJournalEntry #%d (%s): transaction "+
+				"store does not match the one from "+
+				"disconnectTransactions", i, test.name)
+		}
+	}
+}
+
+// TestFetchUtxoAtHeight ensures FetchUtxoAtHeight reports whether outputs were
+// unspent as of a given main chain height and returns an error when that can't
+// be determined from the spend journal.
+func TestFetchUtxoAtHeight(t *testing.T) {
+	// The main chain is a1 <- a2 <- a3 <- a4 where a3 spends the coinbase
+	// of a1.
+	params := btcchain.RegressionNetParams
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 2)
+	spend := spendTx(blocks[0], 1000)
+	blocks = append(blocks, g.nextBlock(blocks[1],
+		func(msgBlock *btcwire.MsgBlock) {
+			msgBlock.AddTransaction(spend)
+		}))
+	blocks = append(blocks, g.nextBlock(blocks[2]))
+	spentOut := spend.TxIn[0].PreviousOutpoint
+	spendHash, _ := spend.TxSha()
+	unspentCoinbase, _ := blocks[1].TxSha(0)
+
+	tests := []struct {
+		name          string
+		journalBlocks int
+		outPoint      btcwire.OutPoint
+		height        int64
+		want          bool
+		wantErr       bool
+	}{
+		{"before created", 0, spentOut, 0, false, false},
+		{"when created", 0, spentOut, 1, true, false},
+		{"before spent", 0, spentOut, 2, true, false},
+		{"when spent", 0, spentOut, 3, false, false},
+		{"after spent", 0, spentOut, 4, false, false},
+		{"created by a spend", 0, *btcwire.NewOutPoint(&spendHash, 0),
+			3, true, false},
+		{"never spent", 0, *btcwire.NewOutPoint(unspentCoinbase, 0), 4,
+			true, false},
+		{"unknown transaction", 0, btcwire.OutPoint{}, 4, false, false},
+		{"no such output", 0, *btcwire.NewOutPoint(unspentCoinbase, 1),
+			4, false, true},
+		{"negative height", 0, spentOut, -1, false, true},
+		{"after end of main chain", 0, spentOut, 5, false, true},
+		{"spent before journal", 1, spentOut, 3, false, false},
+		{"spend older than journal", 1, spentOut, 2, false, true},
+	}
+
+	for i, test := range tests {
+		chain, _, teardown := newTestChain(t, "spendjournaltest",
+			&params, nil)
+		chain.SetResourceLimits(btcchain.ResourceLimits{
+			MaxSpendJournalBlocks: test.journalBlocks,
+		})
+		processBlocks(t, chain, blocks)
+
+		unspent, err := chain.FetchUtxoAtHeight(&test.outPoint,
+			test.height)
+		teardown()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("FetchUtxoAtHeight #%d (%s): expected "+
+					"error", i, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FetchUtxoAtHeight #%d (%s): unexpected error "+
+				"%v", i, test.name, err)
+			continue
+		}
+		if unspent != test.want {
+			t.Errorf("FetchUtxoAtHeight #%d (%s): got unspent %v, "+
+				"want %v", i, test.name, unspent, test.want)
+		}
+	}
+}
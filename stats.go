@@ -0,0 +1,340 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sort"
+	"time"
+)
+
+const (
+	// maxBlockStatsHistory is the maximum number of the most recently
+	// connected main chain blocks statistics are kept for.
+	maxBlockStatsHistory = 2016
+
+	// relayFeeFloorBlocks is the number of the most recently connected main
+	// chain blocks which are considered when calculating the relay fee
+	// floor.
+	relayFeeFloorBlocks = 144
+)
+
+// blockStats houses statistics about a block which are gathered while it is
+// being validated for connection to the main chain.
+type blockStats struct {
+	hash   *btcwire.ShaHash
+	height int64
+
+	// minFeeRate is the lowest fee rate, in satoshi per 1000 bytes, paid by
+	// any of the non-coinbase transactions in the block.  It is -1 when the
+	// block does not contain any transactions other than the coinbase.
+	minFeeRate int64
+
+	// coinDaysDestroyed is the total number of coin days destroyed by the
+	// transactions in the block.  See calcCoinDaysDestroyed for details.
+	coinDaysDestroyed float64
+
+	// scriptTypes houses the number of outputs of each script type created
+	// by the transactions in the block.
+	scriptTypes ScriptTypeCounts
+}
+
+// newBlockStats returns a new blockStats instance for the passed node with
+// all of the statistics set to the values for a block that only contains a
+// coinbase.
+func newBlockStats(node *blockNode) *blockStats {
+	return &blockStats{
+		hash:       node.hash,
+		height:     node.height,
+		minFeeRate: -1,
+	}
+}
+
+// addBlockStats adds the passed statistics for a block that was just connected
+// to the end of the main chain to the history of recent block statistics.
+func (b *BlockChain) addBlockStats(stats *blockStats) {
+	if stats == nil {
+		return
+	}
+
+	b.scriptTypeTotals.add(&stats.scriptTypes)
+
+	if len(b.recentStats) >= maxBlockStatsHistory {
+		copy(b.recentStats, b.recentStats[1:])
+		b.recentStats[len(b.recentStats)-1] = nil
+		b.recentStats = b.recentStats[:len(b.recentStats)-1]
+	}
+	b.recentStats = append(b.recentStats, stats)
+}
+
+// removeBlockStats removes the statistics for the passed node, which was just
+// disconnected from the end of the main chain, from the history of recent
+// block statistics and returns them.  It is a no-op that returns nil when there
+// are no statistics for the node such as when it was connected before this
+// instance was created.
+func (b *BlockChain) removeBlockStats(node *blockNode) *blockStats {
+	numStats := len(b.recentStats)
+	if numStats == 0 || !b.recentStats[numStats-1].hash.IsEqual(node.hash) {
+		return nil
+	}
+
+	stats := b.recentStats[numStats-1]
+	b.recentStats[numStats-1] = nil
+	b.recentStats = b.recentStats[:numStats-1]
+	return stats
+}
+
+// RelayFeeFloor returns a fee rate, in satoshi per 1000 bytes, below which
+// transactions are currently unlikely to be mined.  It is intended to be used
+// as a signal for relay and memory pool policy.
+//
+// It is calculated as the median of the lowest fee rates paid by any of the
+// transactions in each of the most recent 144 main chain blocks which contain
+// transactions other than the coinbase.  Zero is returned when the statistics
+// for no such blocks are available.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) RelayFeeFloor() int64 {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	startIdx := len(b.recentStats) - relayFeeFloorBlocks
+	if startIdx < 0 {
+		startIdx = 0
+	}
+
+	feeRates := make([]int64, 0, len(b.recentStats)-startIdx)
+	for _, stats := range b.recentStats[startIdx:] {
+		if stats.minFeeRate >= 0 {
+			feeRates = append(feeRates, stats.minFeeRate)
+		}
+	}
+	if len(feeRates) == 0 {
+		return 0
+	}
+
+	sort.Sort(int64Sorter(feeRates))
+	return feeRates[len(feeRates)/2]
+}
+
+// CoinDaysDestroyed describes the number of coin days destroyed by a main
+// chain block.  The age of the coins is measured in blocks and converted to
+// days at the target time per block of the network, so the coin days are
+// block-days rather than calendar days.
+type CoinDaysDestroyed struct {
+	Hash     *btcwire.ShaHash
+	Height   int64
+	CoinDays float64
+}
+
+// CoinDaysDestroyedSeries returns the number of coin days destroyed by each of
+// the most recently connected main chain blocks (up to the last 2016) ordered
+// from oldest to newest.  Blocks which were connected before this instance was
+// created are not included.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) CoinDaysDestroyedSeries() []CoinDaysDestroyed {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	series := make([]CoinDaysDestroyed, 0, len(b.recentStats))
+	for _, stats := range b.recentStats {
+		series = append(series, CoinDaysDestroyed{
+			Hash:     stats.hash,
+			Height:   stats.height,
+			CoinDays: stats.coinDaysDestroyed,
+		})
+	}
+	return series
+}
+
+// calcCoinDaysDestroyed returns the number of coin days destroyed by the passed
+// transaction when it is included in a block at the provided height.  Each
+// input contributes the value of the output it spends, in bitcoins, multiplied
+// by the age of that output in days.
+//
+// Since the input transaction store only houses the height of the block each
+// input transaction is in, the age is the difference in height converted to
+// days at the passed target time between blocks rather than the time between
+// the block timestamps.  The result is therefore in block-days, which only
+// match calendar days while blocks are found at the target rate, but it can be
+// calculated without any additional database access.  Nothing is destroyed
+// when the target time between blocks is not positive.
+//
+// The transaction inputs must have already been validated by
+// checkTransactionInputs.
+func calcCoinDaysDestroyed(tx *btcwire.MsgTx, height int64, txStore TxStore, targetTimePerBlock time.Duration) float64 {
+	if targetTimePerBlock <= 0 {
+		return 0
+	}
+	blocksPerDay := float64(time.Hour*24) / float64(targetTimePerBlock)
+
+	var coinDays float64
+	for _, txIn := range tx.TxIn {
+		originTx, exists := txStore[txIn.PreviousOutpoint.Hash]
+		if !exists || originTx.Tx == nil {
+			continue
+		}
+		originTxIndex := txIn.PreviousOutpoint.Index
+		if originTxIndex >= uint32(len(originTx.Tx.TxOut)) {
+			continue
+		}
+
+		value := originTx.Tx.TxOut[originTxIndex].Value
+		ageDays := float64(height-originTx.BlockHeight) / blocksPerDay
+		coinDays += float64(value) / float64(satoshiPerBitcoin) * ageDays
+	}
+	return coinDays
+}
+
+// ScriptTypeCounts houses the number of transaction outputs of each script
+// type.
+type ScriptTypeCounts struct {
+	PubKey      uint64
+	PubKeyHash  uint64
+	ScriptHash  uint64
+	MultiSig    uint64
+	NullData    uint64
+	NonStandard uint64
+}
+
+// add adds the passed counts to the counts.
+func (c *ScriptTypeCounts) add(other *ScriptTypeCounts) {
+	c.PubKey += other.PubKey
+	c.PubKeyHash += other.PubKeyHash
+	c.ScriptHash += other.ScriptHash
+	c.MultiSig += other.MultiSig
+	c.NullData += other.NullData
+	c.NonStandard += other.NonStandard
+}
+
+// subtract subtracts the passed counts, which must have previously been added,
+// from the counts.
+func (c *ScriptTypeCounts) subtract(other *ScriptTypeCounts) {
+	c.PubKey -= other.PubKey
+	c.PubKeyHash -= other.PubKeyHash
+	c.ScriptHash -= other.ScriptHash
+	c.MultiSig -= other.MultiSig
+	c.NullData -= other.NullData
+	c.NonStandard -= other.NonStandard
+}
+
+// calcScriptTypeCounts returns the number of outputs of each script type
+// created by the transactions in the passed block.  Outputs with provably
+// unspendable scripts are counted as null data regardless of what follows the
+// OP_RETURN.
+func calcScriptTypeCounts(block *btcutil.Block) ScriptTypeCounts {
+	var counts ScriptTypeCounts
+	for _, tx := range block.MsgBlock().Transactions {
+		for _, txOut := range tx.TxOut {
+			if isProvablyUnspendable(txOut.PkScript) {
+				counts.NullData++
+				continue
+			}
+
+			switch btcscript.GetScriptClass(txOut.PkScript) {
+			case btcscript.PubKeyTy:
+				counts.PubKey++
+			case btcscript.PubKeyHashTy:
+				counts.PubKeyHash++
+			case btcscript.ScriptHashTy:
+				counts.ScriptHash++
+			case btcscript.MultiSigTy:
+				counts.MultiSig++
+			default:
+				counts.NonStandard++
+			}
+		}
+	}
+	return counts
+}
+
+// BlockScriptTypes describes the number of outputs of each script type created
+// by a main chain block.
+type BlockScriptTypes struct {
+	Hash   *btcwire.ShaHash
+	Height int64
+	Counts ScriptTypeCounts
+}
+
+// ScriptTypeSeries returns the number of outputs of each script type created by
+// each of the most recently connected main chain blocks (up to the last 2016)
+// ordered from oldest to newest.  Blocks which were connected before this
+// instance was created are not included.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ScriptTypeSeries() []BlockScriptTypes {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	series := make([]BlockScriptTypes, 0, len(b.recentStats))
+	for _, stats := range b.recentStats {
+		series = append(series, BlockScriptTypes{
+			Hash:   stats.hash,
+			Height: stats.height,
+			Counts: stats.scriptTypes,
+		})
+	}
+	return series
+}
+
+// ScriptTypeTotals returns the total number of outputs of each script type
+// created by all of the blocks connected to the main chain by this instance
+// which are still in the main chain.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ScriptTypeTotals() ScriptTypeCounts {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	return b.scriptTypeTotals
+}
+
+// int64Sorter implements sort.Interface to allow a slice of 64-bit integers to
+// be sorted.
+type int64Sorter []int64
+
+// Len returns the number of integers in the slice.  It is part of the
+// sort.Interface implementation.
+func (s int64Sorter) Len() int {
+	return len(s)
+}
+
+// Swap swaps the integers at the passed indices.  It is part of the
+// sort.Interface implementation.
+func (s int64Sorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Less returns whether the integer with index i should sort before the integer
+// with index j.  It is part of the sort.Interface implementation.
+func (s int64Sorter) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+// byteCounter is an io.Writer which simply counts the number of bytes written
+// to it.  It is used to determine the serialized size of data without
+// actually allocating a buffer to hold it.
+type byteCounter int
+
+// Write increments the byte count by the length of the passed data.  It is
+// part of the io.Writer interface implementation and never returns an error.
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// txSerializeSize returns the number of bytes it would take to serialize the
+// passed transaction.
+func txSerializeSize(tx *btcwire.MsgTx, pver uint32) (int, error) {
+	var size byteCounter
+	err := tx.BtcEncode(&size, pver)
+	if err != nil {
+		return 0, err
+	}
+	return int(size), nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcwire"
+	"testing"
+	"time"
+)
+
+// TestCoinDaysDestroyed ensures the coin days destroyed by a block are the
+// value of the spent outputs multiplied by their age in blocks converted to
+// days at the target time per block, including when that is longer than a day.
+func TestCoinDaysDestroyed(t *testing.T) {
+	tests := []struct {
+		name               string
+		targetTimePerBlock time.Duration
+		want               float64
+	}{
+		// 50 bitcoins which are two blocks old.
+		{"ten minute blocks", time.Minute * 10, 50 * 2.0 / 144},
+		{"two day blocks", time.Hour * 48, 50 * 4},
+	}
+
+	for i, test := range tests {
+		params := btcchain.RegressionNetParams
+		params.TargetTimePerBlock = test.targetTimePerBlock
+		g := newBlockGenerator(&params)
+		chain, _, teardown := newTestChain(t, "coindaystest", &params,
+			nil)
+
+		blocks := g.nextBlocks(g.genesis(), 2)
+		blocks = append(blocks, g.nextBlock(blocks[1],
+			func(msgBlock *btcwire.MsgBlock) {
+				msgBlock.AddTransaction(spendTx(blocks[0], 1000))
+			}))
+		processBlocks(t, chain, blocks)
+		series := chain.CoinDaysDestroyedSeries()
+		teardown()
+
+		if len(series) != len(blocks) {
+			t.Errorf("CoinDaysDestroyedSeries #%d (%s): got %d "+
+				"blocks, want %d", i, test.name, len(series),
+				len(blocks))
+			continue
+		}
+		got := series[len(series)-1].CoinDays
+		if got < test.want-1e-9 || got > test.want+1e-9 {
+			t.Errorf("CoinDaysDestroyedSeries #%d (%s): got %v coin "+
+				"days, want %v", i, test.name, got, test.want)
+		}
+	}
+}
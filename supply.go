@@ -0,0 +1,156 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcutil"
+)
+
+// isProvablyUnspendable returns whether or not the passed public key script
+// can provably never be satisfied.  Currently this is only the case for scripts
+// that start with OP_RETURN, since executing it immediately fails the script.
+func isProvablyUnspendable(pkScript []byte) bool {
+	return len(pkScript) > 0 && pkScript[0] == btcscript.OP_RETURN
+}
+
+// calcBurnedAmount returns the total amount of satoshi that the passed main
+// chain block at the given height provably removes from the supply.  This
+// includes all outputs with provably unspendable public key scripts as well as
+// the outputs of the genesis block coinbase since it can never be spent.
+func calcBurnedAmount(block *btcutil.Block, height int64) int64 {
+	var burned int64
+	for i, tx := range block.MsgBlock().Transactions {
+		unspendableTx := height == 0 && i == 0
+		for _, txOut := range tx.TxOut {
+			if unspendableTx || isProvablyUnspendable(txOut.PkScript) {
+				burned += txOut.Value
+			}
+		}
+	}
+	return burned
+}
+
+// calcTotalSubsidy returns the sum of the subsidies of all blocks from the
+// genesis block up to and including the block at the provided height.  The
+// halving schedule is summed up one interval at a time, while a custom subsidy
+// function of the network parameters has to be called for every block.
+func calcTotalSubsidy(height int64, params *Params) int64 {
+	numBlocks := height + 1
+	if params.SubsidyFunc != nil {
+		var total int64
+		for h := int64(0); h < numBlocks; h++ {
+			total += params.SubsidyFunc(h)
+		}
+		return total
+	}
+	if params.SubsidyHalvingInterval <= 0 {
+		return numBlocks * params.BaseSubsidy
+	}
+
+	subsidyHalvingInterval := params.SubsidyHalvingInterval
+	var total int64
+	for halvings := uint(0); numBlocks > 0 && halvings < 64; halvings++ {
+		eraBlocks := numBlocks
+		if eraBlocks > subsidyHalvingInterval {
+			eraBlocks = subsidyHalvingInterval
+		}
+		total += eraBlocks * (params.BaseSubsidy >> halvings)
+		numBlocks -= eraBlocks
+	}
+	return total
+}
+
+// trackBurnedAmount updates the running totals of burned coins with the passed
+// block which was just connected to the end of the main chain.  The totals are
+// only extended when they are contiguous with the block, otherwise they are
+// lazily filled in by SupplyAtHeight.
+func (b *BlockChain) trackBurnedAmount(node *blockNode, block *btcutil.Block) {
+	if node.height != int64(len(b.burnedTotals)) {
+		return
+	}
+
+	var prevTotal int64
+	if node.height > 0 {
+		prevTotal = b.burnedTotals[node.height-1]
+	}
+	burned := calcBurnedAmount(block, node.height)
+	b.burnedTotals = append(b.burnedTotals, prevTotal+burned)
+}
+
+// untrackBurnedAmount removes the passed node, which was just disconnected
+// from the end of the main chain, from the running totals of burned coins.
+func (b *BlockChain) untrackBurnedAmount(node *blockNode) {
+	if node.height < int64(len(b.burnedTotals)) {
+		b.burnedTotals = b.burnedTotals[:node.height]
+	}
+}
+
+// SupplyAtHeight returns the total amount of satoshi in existence as of the
+// main chain block at the provided height.  This is the sum of the subsidies
+// of all blocks up to and including the block at the height less any coins
+// which have provably been burned by then, such as outputs with public key
+// scripts that start with OP_RETURN and the unspendable genesis block coinbase.
+//
+// The result is an upper bound rather than the exact supply.  Coins which were
+// never created because a coinbase claimed less than the subsidy and fees it
+// was entitled to are not accounted for, since that would require the value of
+// every input to be known.  Neither are the coinbases which were overwritten
+// by the duplicate coinbases of the two blocks which violate BIP0030.
+//
+// The amount of burned coins is tracked as blocks are connected to the main
+// chain.  However, the first call for a height before the blocks connected by
+// this instance requires all of the main chain blocks which have not been
+// accounted for yet to be loaded from the database, so it can take a while.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) SupplyAtHeight(height int64) (int64, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return 0, fmt.Errorf("no main chain blocks are available")
+	}
+	if height < 0 || height > b.bestChain.height {
+		return 0, fmt.Errorf("height %d is outside of the main chain "+
+			"range 0-%d", height, b.bestChain.height)
+	}
+
+	// Load any main chain blocks up to the requested height which have not
+	// been accounted for yet from the database.  In the case the totals
+	// are not contiguous, continue on to the best height so later
+	// connected blocks extend them.
+	fillHeight := int64(len(b.burnedTotals))
+	if fillHeight <= height {
+		fillTotals := make([]int64, 0, b.bestChain.height-fillHeight+1)
+		var prevTotal int64
+		if fillHeight > 0 {
+			prevTotal = b.burnedTotals[fillHeight-1]
+		}
+		for h := fillHeight; h <= b.bestChain.height; h++ {
+			block, err := b.fetchMainChainBlockByHeight(h)
+			if err != nil {
+				return 0, err
+			}
+			prevTotal += calcBurnedAmount(block, h)
+			fillTotals = append(fillTotals, prevTotal)
+		}
+		b.burnedTotals = append(b.burnedTotals, fillTotals...)
+	}
+
+	return calcTotalSubsidy(height, b.chainParams) - b.burnedTotals[height], nil
+}
+
+// fetchMainChainBlockByHeight returns the main chain block at the provided
+// height from the database.
+func (b *BlockChain) fetchMainChainBlockByHeight(height int64) (*btcutil.Block, error) {
+	hash, err := b.db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return b.db.FetchBlockBySha(hash)
+}
@@ -11,20 +11,26 @@ import (
 	"github.com/conformal/btcwire"
 )
 
-// txData contains contextual information about transactions such as which block
+// TxData contains contextual information about transactions such as which block
 // they were found in and whether or not the outputs are spent.
-type txData struct {
-	tx          *btcwire.MsgTx
-	hash        *btcwire.ShaHash
-	blockHeight int64
-	spent       []bool
-	err         error
+type TxData struct {
+	Tx          *btcwire.MsgTx
+	Hash        *btcwire.ShaHash
+	BlockHeight int64
+	Spent       []bool
+	Err         error
 }
 
+// TxStore is used to store transactions needed by other transactions for things
+// such as script validation and double spend prevention.  This also allows the
+// transaction data to be treated as a view since it can contain the
+// information from the point of view of different points in the chain.
+type TxStore map[btcwire.ShaHash]*TxData
+
 // connectTransactions updates the passed map by applying transaction and
 // spend information for all the transactions in the passed block. Only
 // transactions in the passed map are updated.
-func connectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.Block) error {
+func connectTransactions(txStore TxStore, block *btcutil.Block) error {
 	// Loop through all of the transactions in the block to see if any of
 	// them are ones we need to update and spend based on the results map.
 	for i, tx := range block.MsgBlock().Transactions {
@@ -36,10 +42,10 @@ func connectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.Blo
 		// Update the transaction store with the transaction information
 		// if it's one of the requested transactions.
 		if txD, exists := txStore[*txHash]; exists {
-			txD.tx = tx
-			txD.blockHeight = block.Height()
-			txD.spent = make([]bool, len(tx.TxOut))
-			txD.err = nil
+			txD.Tx = tx
+			txD.BlockHeight = block.Height()
+			txD.Spent = make([]bool, len(tx.TxOut))
+			txD.Err = nil
 		}
 
 		// Spend the origin transaction output.
@@ -47,7 +53,7 @@ func connectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.Blo
 			originHash := &txIn.PreviousOutpoint.Hash
 			originIndex := txIn.PreviousOutpoint.Index
 			if originTx, exists := txStore[*originHash]; exists {
-				originTx.spent[originIndex] = true
+				originTx.Spent[originIndex] = true
 			}
 		}
 	}
@@ -58,7 +64,7 @@ func connectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.Blo
 // disconnectTransactions updates the passed map by undoing transaction and
 // spend information for all transactions in the passed block.  Only
 // transactions in the passed map are updated.
-func disconnectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.Block) error {
+func disconnectTransactions(txStore TxStore, block *btcutil.Block) error {
 	// Loop through all of the transactions in the block to see if any of
 	// them are ones were need to undo based on the results map.
 	for i, tx := range block.MsgBlock().Transactions {
@@ -76,7 +82,7 @@ func disconnectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.
 			originHash := &txIn.PreviousOutpoint.Hash
 			originIndex := txIn.PreviousOutpoint.Index
 			if originTx, exists := txStore[*originHash]; exists {
-				originTx.spent[originIndex] = false
+				originTx.Spent[originIndex] = false
 			}
 		}
 	}
@@ -91,7 +97,7 @@ func disconnectTransactions(txStore map[btcwire.ShaHash]*txData, block *btcutil.
 // chain).  Another scenario is where a transaction exists from the point of
 // view of the main chain, but doesn't exist in a side chain that branches
 // before the block that contains the transaction on the main chain.
-func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (map[btcwire.ShaHash]*txData, error) {
+func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (TxStore, error) {
 	// Get the previous block node.  This function is used over simply
 	// accessing node.parent directly as it will dynamically create previous
 	// block nodes as needed.  This helps allow only the pieces of the chain
@@ -104,9 +110,9 @@ func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (ma
 	// The transaction store map needs to have an entry for every requested
 	// transaction.  By default, all the transactions are marked as missing.
 	// Each entry will be filled in with the appropriate data below.
-	txStore := make(map[btcwire.ShaHash]*txData)
+	txStore := make(TxStore)
 	for _, hash := range txList {
-		txStore[*hash] = &txData{hash: hash, err: btcdb.TxShaMissing}
+		txStore[*hash] = &TxData{Hash: hash, Err: btcdb.TxShaMissing}
 	}
 
 	// Ask the database (main chain) for the list of transactions.  This
@@ -128,12 +134,12 @@ func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (ma
 		// this code modifies the data.  A bug caused by modifying the
 		// cached data would likely be difficult to track down and could
 		// cause subtle errors, so avoid the potential altogether.
-		txD.err = txReply.Err
+		txD.Err = txReply.Err
 		if txReply.Err == nil {
-			txD.tx = txReply.Tx
-			txD.blockHeight = txReply.Height
-			txD.spent = make([]bool, len(txReply.TxSpent))
-			copy(txD.spent, txReply.TxSpent)
+			txD.Tx = txReply.Tx
+			txD.BlockHeight = txReply.Height
+			txD.Spent = make([]bool, len(txReply.TxSpent))
+			copy(txD.Spent, txReply.TxSpent)
 		}
 	}
 
@@ -149,13 +155,21 @@ func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (ma
 	// chain before the end of it.  In either case, we need to undo the
 	// transactions and spend information for the blocks which would be
 	// disconnected during a reorganize to the point of view of the
-	// node just before the requested node.
+	// node just before the requested node.  The outputs spent by the blocks
+	// are restored from the spend journal when it covers them, which avoids
+	// loading each block from the database and makes deep reorganizations
+	// considerably faster.  Older blocks are loaded from the database.
 	detachNodes, attachNodes := b.getReorganizeNodes(prevNode)
 	for e := detachNodes.Front(); e != nil; e = e.Next() {
 		n := e.Value.(*blockNode)
+		if entry := b.spendJournalEntryFor(n); entry != nil {
+			undoSpendJournalEntry(txStore, entry)
+			continue
+		}
+
 		block, err := b.db.FetchBlockBySha(n.hash)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 
 		disconnectTransactions(txStore, block)
@@ -175,11 +189,9 @@ func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (ma
 	// transactions and spend information from each of the nodes to attach.
 	for e := attachNodes.Front(); e != nil; e = e.Next() {
 		n := e.Value.(*blockNode)
-		block, exists := b.blockCache[*n.hash]
-		if !exists {
-			return nil, fmt.Errorf("unable to find block %v in "+
-				"side chain cache for transaction search",
-				n.hash)
+		block, err := b.fetchSideChainBlock(n)
+		if err != nil {
+			return nil, err
 		}
 
 		connectTransactions(txStore, block)
@@ -191,7 +203,7 @@ func (b *BlockChain) fetchTxList(node *blockNode, txList []*btcwire.ShaHash) (ma
 // fetchInputTransactions fetches the input transactions referenced by the
 // transactions in the given block from its point of view.  See fetchTxList
 // for more details on what the point of view entails.
-func (b *BlockChain) fetchInputTransactions(node *blockNode, block *btcutil.Block) (map[btcwire.ShaHash]*txData, error) {
+func (b *BlockChain) fetchInputTransactions(node *blockNode, block *btcutil.Block) (TxStore, error) {
 	// Build a map of in-flight transactions because some of the inputs in
 	// this block could be referencing other transactions in this block
 	// which are not yet in the chain.
@@ -209,23 +221,23 @@ func (b *BlockChain) fetchInputTransactions(node *blockNode, block *btcutil.Bloc
 	// which has no inputs) collecting them into lists of what is needed and
 	// what is already known (in-flight).
 	var txNeededList []*btcwire.ShaHash
-	txStore := make(map[btcwire.ShaHash]*txData)
+	txStore := make(TxStore)
 	for _, tx := range block.MsgBlock().Transactions[1:] {
 		for _, txIn := range tx.TxIn {
 			// Add an entry to the transaction store for the needed
 			// transaction with it set to missing by default.
 			originHash := &txIn.PreviousOutpoint.Hash
-			txD := &txData{hash: originHash, err: btcdb.TxShaMissing}
+			txD := &TxData{Hash: originHash, Err: btcdb.TxShaMissing}
 			txStore[*originHash] = txD
 
 			// The transaction is already in-flight, so update the
 			// transaction store acccordingly.  Otherwise, we need
 			// it.
 			if tx, ok := txInFlight[*originHash]; ok {
-				txD.tx = tx
-				txD.blockHeight = node.height
-				txD.spent = make([]bool, len(tx.TxOut))
-				txD.err = nil
+				txD.Tx = tx
+				txD.BlockHeight = node.height
+				txD.Spent = make([]bool, len(tx.TxOut))
+				txD.Err = nil
 			} else {
 				txNeededList = append(txNeededList, originHash)
 			}
@@ -241,8 +253,128 @@ func (b *BlockChain) fetchInputTransactions(node *blockNode, block *btcutil.Bloc
 	// Merge the results of the requested transactions and the in-flight
 	// transactions.
 	for _, txD := range txNeededStore {
-		txStore[*txD.hash] = txD
+		txStore[*txD.Hash] = txD
 	}
 
 	return txStore, nil
 }
+
+// fetchBlock returns the block identified by the passed hash from either the
+// side chain block cache, the side chain block directory, or the block
+// database (main chain).
+func (b *BlockChain) fetchBlock(hash *btcwire.ShaHash) (*btcutil.Block, error) {
+	// Side chain blocks are not in the database, so check for them first.
+	if block, exists := b.blockCache[*hash]; exists {
+		return block, nil
+	}
+	block, err := b.loadStoredBlock(hash)
+	if err != nil || block != nil {
+		return block, err
+	}
+
+	return b.db.FetchBlockBySha(hash)
+}
+
+// fetchSideChainBlock returns the block associated with the passed side chain
+// node from the side chain block cache.  When it was evicted from the cache, it
+// is loaded from the side chain block directory instead and added back to the
+// cache so the point of view of the side chain can still be determined.  Side
+// chain blocks are never in the database, so there is nowhere else to look.
+func (b *BlockChain) fetchSideChainBlock(node *blockNode) (*btcutil.Block, error) {
+	if block, exists := b.blockCache[*node.hash]; exists {
+		return block, nil
+	}
+
+	block, err := b.loadStoredBlock(node.hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load side chain block %v: %v",
+			node.hash, err)
+	}
+	if block == nil {
+		return nil, fmt.Errorf("unable to find block %v in side "+
+			"chain cache", node.hash)
+	}
+	log.Debugf("Loaded side chain block %v evicted from the side chain "+
+		"cache", node.hash)
+
+	b.chainLock.Lock()
+	b.setCachedBlock(node.hash, block)
+	b.chainLock.Unlock()
+	return block, nil
+}
+
+// FetchBlockTransactions returns the transactions located at the passed
+// indices of the block identified by the provided hash.  The transactions are
+// returned in the same order as the requested indices.  The block may be part
+// of the main chain or any of the known side chains.
+//
+// This is primarily intended to serve requests for a subset of the
+// transactions of a block, such as the follow-up requests for transactions a
+// peer was unable to reconstruct from a compact block, without requiring the
+// caller to load and walk the entire block itself.
+//
+// The returned transactions are shared with the block and therefore must not
+// be modified by the caller.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) FetchBlockTransactions(hash *btcwire.ShaHash, txIndices []int) ([]*btcwire.MsgTx, error) {
+	b.chainLock.RLock()
+	block, err := b.fetchBlock(hash)
+	b.chainLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := block.MsgBlock().Transactions
+	txns := make([]*btcwire.MsgTx, 0, len(txIndices))
+	for _, txIndex := range txIndices {
+		if txIndex < 0 || txIndex >= len(transactions) {
+			return nil, fmt.Errorf("transaction index %d is out of "+
+				"range for block %v which only has %d "+
+				"transactions", txIndex, hash, len(transactions))
+		}
+		txns = append(txns, transactions[txIndex])
+	}
+
+	return txns, nil
+}
+
+// FetchTransactionStore fetches the input transactions referenced by the passed
+// transaction from the point of view of the end of the main chain.  The
+// returned store is suitable for use with CheckTransactionInputs, such as when
+// deciding whether to accept the transaction into a memory pool.  Entries for
+// input transactions which could not be found have their Err field set to
+// btcdb.TxShaMissing.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) FetchTransactionStore(tx *btcwire.MsgTx) (TxStore, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	txNeededSet := make(map[btcwire.ShaHash]struct{})
+	var txNeededList []*btcwire.ShaHash
+	for _, txIn := range tx.TxIn {
+		originHash := &txIn.PreviousOutpoint.Hash
+		if _, ok := txNeededSet[*originHash]; ok {
+			continue
+		}
+		txNeededSet[*originHash] = struct{}{}
+		txNeededList = append(txNeededList, originHash)
+	}
+
+	// The transactions are requested from the point of view of a new block
+	// that extends the end of the main chain.  The node is only used to
+	// determine that point of view, so it doesn't need a real hash.  When
+	// there is no main chain yet, the genesis hash is used since it has no
+	// previous node.
+	node := &blockNode{hash: b.chainParams.GenesisHash}
+	if b.bestChain != nil {
+		node = &blockNode{
+			parent: b.bestChain,
+			height: b.bestChain.height + 1,
+			hash:   zeroHash,
+		}
+	}
+	return b.fetchTxList(node, txNeededList)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcwire"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestFetchBlockTransactions ensures the transactions at the requested indices
+// are returned in the requested order for main chain blocks and for side chain
+// blocks which were evicted to the side chain block directory, while unknown
+// blocks and out of range indices are rejected.
+func TestFetchBlockTransactions(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "txlookuptest", &params, nil)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "txlookuptest")
+	if err != nil {
+		t.Fatalf("TempDir: unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := chain.SetSideChainBlockDir(dir); err != nil {
+		t.Fatalf("SetSideChainBlockDir: unexpected error %v", err)
+	}
+
+	// Only allow a single coinbase only block to be held in memory.
+	chain.SetResourceLimits(btcchain.ResourceLimits{MaxMemory: 200})
+
+	// Build a main chain a1 <- a2 <- a3 where a3 spends the coinbase of a1
+	// and a side chain b2 <- b3 which forks from a1.  The side chain is not
+	// longer than the main chain, so b2 is evicted from memory when b3 is
+	// added.
+	g := newBlockGenerator(&params)
+	mainBlocks := g.nextBlocks(g.genesis(), 2)
+	mainBlocks = append(mainBlocks, g.nextBlock(mainBlocks[1],
+		func(msgBlock *btcwire.MsgBlock) {
+			msgBlock.AddTransaction(spendTx(mainBlocks[0], 1000))
+		}))
+	sideBlocks := g.nextBlocks(mainBlocks[0], 2)
+	processBlocks(t, chain, mainBlocks)
+	processBlocks(t, chain, sideBlocks)
+	checkBestBlock(t, "TestFetchBlockTransactions", chain, mainBlocks[2])
+	if chain.TstIsBlockCached(blockHash(sideBlocks[0])) {
+		t.Fatalf("TestFetchBlockTransactions: side chain block %v was "+
+			"not evicted", blockHash(sideBlocks[0]))
+	}
+
+	mainTxns := mainBlocks[2].MsgBlock().Transactions
+	sideTxns := sideBlocks[0].MsgBlock().Transactions
+	unknownHash := btcwire.ShaHash{0x01}
+	tests := []struct {
+		name      string
+		hash      *btcwire.ShaHash
+		txIndices []int
+		want      []*btcwire.MsgTx
+		wantErr   bool
+	}{
+		{
+			name:      "main chain block",
+			hash:      blockHash(mainBlocks[2]),
+			txIndices: []int{1, 0},
+			want:      []*btcwire.MsgTx{mainTxns[1], mainTxns[0]},
+		},
+		{
+			name:      "main chain block with no indices",
+			hash:      blockHash(mainBlocks[2]),
+			txIndices: nil,
+			want:      []*btcwire.MsgTx{},
+		},
+		{
+			name:      "evicted side chain block",
+			hash:      blockHash(sideBlocks[0]),
+			txIndices: []int{0},
+			want:      []*btcwire.MsgTx{sideTxns[0]},
+		},
+		{
+			name:      "second side chain block",
+			hash:      blockHash(sideBlocks[1]),
+			txIndices: []int{0},
+			want: []*btcwire.MsgTx{
+				sideBlocks[1].MsgBlock().Transactions[0],
+			},
+		},
+		{
+			name:      "index out of range",
+			hash:      blockHash(mainBlocks[2]),
+			txIndices: []int{0, 2},
+			wantErr:   true,
+		},
+		{
+			name:      "negative index",
+			hash:      blockHash(sideBlocks[0]),
+			txIndices: []int{-1},
+			wantErr:   true,
+		},
+		{
+			name:      "unknown block",
+			hash:      &unknownHash,
+			txIndices: []int{0},
+			wantErr:   true,
+		},
+	}
+
+	for i, test := range tests {
+		got, err := chain.FetchBlockTransactions(test.hash,
+			test.txIndices)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("FetchBlockTransactions #%d (%s): "+
+					"unexpected success", i, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FetchBlockTransactions #%d (%s): unexpected "+
+				"error %v", i, test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FetchBlockTransactions #%d (%s): got %v, "+
+				"want %v", i, test.name, got, test.want)
+		}
+	}
+}
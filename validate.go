@@ -5,13 +5,14 @@
 package btcchain
 
 import (
-	"encoding/binary"
+	"bytes"
 	"fmt"
 	"github.com/conformal/btcdb"
 	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
 	"math"
+	"math/big"
 	"time"
 )
 
@@ -23,7 +24,8 @@ const (
 	maxSatoshi int64 = 21e6 * satoshiPerBitcoin
 
 	// maxSigOpsPerBlock is the maximum number of signature operations
-	// allowed for a block.  It is a fraction of the max block payload size.
+	// allowed for a block on the bitcoin networks.  It is a fraction of the
+	// max block payload size.
 	maxSigOpsPerBlock = btcwire.MaxBlockPayload / 50
 
 	// lockTimeThreshold is the number below which a lock time is
@@ -47,23 +49,24 @@ const (
 	// coinbases to start with the serialized block height.
 	serializedHeightVersion = 2
 
-	// baseSubsidy is the starting subsidy amount for mined blocks.  This
-	// value is halved every subsidyHalvingInterval blocks.
-	baseSubsidy = 50 * satoshiPerBitcoin
-
-	// subsidyHalvingInterval is the interval of blocks at which the
-	// baseSubsidy is continually halved.  See calcBlockSubsidy for more
-	// details.
-	subsidyHalvingInterval = 210000
+	// strictDERVersion is the block version which changed signatures to be
+	// required to be strictly DER encoded.  This is part of BIP0066.
+	strictDERVersion = 3
+
+	// checkLockTimeVerifyVersion is the block version which enabled the
+	// OP_CHECKLOCKTIMEVERIFY opcode.  This is part of BIP0065.
+	checkLockTimeVerifyVersion = 4
+
+	// bip0034ImpliesBIP0030Limit is the height at which BIP0034 no longer
+	// implies BIP0030.  Some coinbases of blocks from before BIP0034
+	// activated happen to start with data which serializes a height that
+	// is still in the future, the lowest of which is 1,983,702.  A block at
+	// that height could therefore duplicate such a coinbase, so the BIP0030
+	// check resumes there.
+	bip0034ImpliesBIP0030Limit = 1983702
 )
 
 var (
-	// coinbaseMaturity is the number of blocks required before newly
-	// mined bitcoins (coinbase transactions) can be spent.  This is a
-	// variable as opposed to a constant because the tests need the ability
-	// to modify it.
-	coinbaseMaturity int64 = 100
-
 	// zeroHash is the zero value for a btcwire.ShaHash and is defined as
 	// a package level variable to avoid the need to create a new instance
 	// every time a check is needed.
@@ -89,12 +92,16 @@ func isNullOutpoint(outpoint *btcwire.OutPoint) bool {
 	return false
 }
 
-// isCoinBase determines whether or not a transaction is a coinbase.  A coinbase
+// IsCoinBase determines whether or not a transaction is a coinbase.  A coinbase
 // is a special transaction created by miners that has no inputs.  This is
 // represented in the block chain by a transaction with a single input that has
 // a previous output transaction index set to the maximum value along with a
 // zero hash.
-func isCoinBase(msgTx *btcwire.MsgTx) bool {
+//
+// This function only differentiates between coinbase and non-coinbase
+// transactions by examining the single input.  It does not otherwise check that
+// the transaction is valid.
+func IsCoinBase(msgTx *btcwire.MsgTx) bool {
 	// A coin base must only have one transaction input.
 	if len(msgTx.TxIn) != 1 {
 		return false
@@ -110,8 +117,12 @@ func isCoinBase(msgTx *btcwire.MsgTx) bool {
 	return true
 }
 
-// isFinalized determines whether or not a transaction is finalized.
-func isFinalizedTransaction(msgTx *btcwire.MsgTx, blockHeight int64, blockTime time.Time) bool {
+// IsFinalizedTransaction determines whether or not a transaction is finalized
+// when included in a block at the passed height and time.  A transaction is
+// finalized when its lock time is zero, its lock time is before the passed
+// height or time depending on whether it is interpreted as a block height or a
+// timestamp, or all of its inputs have a final sequence number.
+func IsFinalizedTransaction(msgTx *btcwire.MsgTx, blockHeight int64, blockTime time.Time) bool {
 	// Lock time of zero means the transaction is finalized.
 	lockTime := msgTx.LockTime
 	if lockTime == 0 {
@@ -158,32 +169,46 @@ func isBIP0030Node(node *blockNode) bool {
 	return false
 }
 
-// calcBlockSubsidy returns the subsidy amount a block at the provided height
-// should have. This is mainly used for determining how much the coinbase for
-// newly generated blocks awards as well as validating the coinbase for blocks
-// has the expected value.
+// CalcBlockSubsidy returns the subsidy amount a block at the provided height
+// should have on the network defined by the passed parameters.  This is mainly
+// used for determining how much the coinbase for newly generated blocks awards
+// as well as validating the coinbase for blocks has the expected value.
 //
-// The subsidy is halved every subsidyHalvingInterval blocks.  Mathematically
-// this is: baseSubsidy / 2^(height/subsidyHalvingInterval)
+// The subsidy is returned by the SubsidyFunc of the parameters when it is set.
+// Otherwise, the BaseSubsidy is halved every SubsidyHalvingInterval blocks.
+// Mathematically this is: BaseSubsidy / 2^(height/SubsidyHalvingInterval)
 //
-// At the target block generation rate this is approximately every 4
-// years.
-func calcBlockSubsidy(height int64) int64 {
-	// Equivalent to: baseSubsidy / 2^(height/subsidyHalvingInterval)
-	return baseSubsidy >> uint(height/subsidyHalvingInterval)
+// At the target block generation rate for the main network this is
+// approximately every 4 years.
+func CalcBlockSubsidy(height int64, params *Params) int64 {
+	if params.SubsidyFunc != nil {
+		return params.SubsidyFunc(height)
+	}
+	if params.SubsidyHalvingInterval <= 0 {
+		return params.BaseSubsidy
+	}
+
+	// Equivalent to: BaseSubsidy / 2^(height/SubsidyHalvingInterval)
+	return params.BaseSubsidy >> uint(height/params.SubsidyHalvingInterval)
 }
 
-// checkTransactionSanity performs some preliminary checks on a transaction to
-// ensure it is sane.  These checks are context free.
-func checkTransactionSanity(tx *btcwire.MsgTx) error {
+// CheckTransactionSanity performs some preliminary checks on a transaction to
+// ensure it is sane.  These checks are context free which makes them suitable
+// for use by callers such as memory pools and RPC servers which need to reject
+// malformed transactions using the same rules the block chain enforces.  They
+// include ensuring the transaction has inputs and outputs, the output values
+// are in range, there are no duplicate inputs, the coinbase script length is
+// in range for coinbase transactions, and no other transaction inputs refer to
+// a null previous output.
+func CheckTransactionSanity(tx *btcwire.MsgTx) error {
 	// A transaction must have at least one input.
 	if len(tx.TxIn) == 0 {
-		return RuleError("transaction has no inputs")
+		return ruleError(ErrNoTxInputs, "transaction has no inputs")
 	}
 
 	// A transaction must have at least one output.
 	if len(tx.TxOut) == 0 {
-		return RuleError("transaction has no outputs")
+		return ruleError(ErrNoTxOutputs, "transaction has no outputs")
 	}
 
 	// NOTE: bitcoind does size limits checking here, but the size limits
@@ -203,13 +228,13 @@ func checkTransactionSanity(tx *btcwire.MsgTx) error {
 		if satoshi < 0 {
 			str := fmt.Sprintf("transaction output has negative "+
 				"value of %v", satoshi)
-			return RuleError(str)
+			return ruleError(ErrBadTxOutValue, str)
 		}
 		if satoshi > maxSatoshi {
 			str := fmt.Sprintf("transaction output value of %v is "+
 				"higher than max allowed value of %v", satoshi,
 				maxSatoshi)
-			return RuleError(str)
+			return ruleError(ErrBadTxOutValue, str)
 		}
 
 		// TODO(davec): No need to check < 0 here as satoshi is
@@ -219,13 +244,13 @@ func checkTransactionSanity(tx *btcwire.MsgTx) error {
 		if totalSatoshi < 0 {
 			str := fmt.Sprintf("total value of all transaction "+
 				"outputs has negative value of %v", totalSatoshi)
-			return RuleError(str)
+			return ruleError(ErrBadTxOutValue, str)
 		}
 		if totalSatoshi > maxSatoshi {
 			str := fmt.Sprintf("total value of all transaction "+
 				"outputs is %v which is higher than max "+
 				"allowed value of %v", totalSatoshi, maxSatoshi)
-			return RuleError(str)
+			return ruleError(ErrBadTxOutValue, str)
 		}
 	}
 
@@ -235,19 +260,20 @@ func checkTransactionSanity(tx *btcwire.MsgTx) error {
 		prevOut := &txIn.PreviousOutpoint
 		key := fmt.Sprintf("%v%v", prevOut.Hash, prevOut.Index)
 		if _, exists := existingTxOut[key]; exists {
-			return RuleError("transaction contains duplicate outpoint")
+			return ruleError(ErrDuplicateTxInputs, "transaction "+
+				"contains duplicate outpoint")
 		}
 		existingTxOut[key] = true
 	}
 
 	// Coinbase script length must be between min and max length.
-	if isCoinBase(tx) {
+	if IsCoinBase(tx) {
 		slen := len(tx.TxIn[0].SignatureScript)
 		if slen < minCoinbaseScriptLen || slen > maxCoinbaseScriptLen {
 			str := fmt.Sprintf("coinbase transaction script length "+
 				"of %d is out of range (min: %d, max: %d)",
 				slen, minCoinbaseScriptLen, maxCoinbaseScriptLen)
-			return RuleError(str)
+			return ruleError(ErrBadCoinbaseScriptLen, str)
 		}
 	} else {
 		// Previous transaction outputs referenced by the inputs to this
@@ -255,8 +281,8 @@ func checkTransactionSanity(tx *btcwire.MsgTx) error {
 		for _, txIn := range tx.TxIn {
 			prevOut := &txIn.PreviousOutpoint
 			if isNullOutpoint(prevOut) {
-				return RuleError("transaction input refers to " +
-					"previous output that is null")
+				return ruleError(ErrBadTxInput, "transaction input "+
+					"refers to previous output that is null")
 			}
 		}
 	}
@@ -264,46 +290,80 @@ func checkTransactionSanity(tx *btcwire.MsgTx) error {
 	return nil
 }
 
-// checkProofOfWork ensures the block header bits which indicate the target
-// difficulty is in min/max range and that the block hash is less than the
-// target difficulty as claimed.
-func checkProofOfWork(block *btcutil.Block) error {
+// checkTargetRange ensures the passed bits which indicate a target difficulty
+// describe a target which is larger than zero, which rules out negative
+// targets, and not larger than the passed proof of work limit, which rules out
+// targets which overflow.  It returns the target when it is in range.
+func checkTargetRange(bits uint32, powLimit *big.Int) (*big.Int, error) {
 	// The target difficulty must be larger than zero.
-	header := block.MsgBlock().Header
-	target := CompactToBig(header.Bits)
+	target := CompactToBig(bits)
 	if target.Sign() <= 0 {
 		str := fmt.Sprintf("block target difficulty of %064x is too low",
 			target)
-		return RuleError(str)
+		return nil, ruleError(ErrUnexpectedDifficulty, str)
 	}
 
 	// The target difficulty must be less than the maximum allowed.
 	if target.Cmp(powLimit) > 0 {
 		str := fmt.Sprintf("block target difficulty of %064x is "+
 			"higher than max of %064x", target, powLimit)
-		return RuleError(str)
+		return nil, ruleError(ErrUnexpectedDifficulty, str)
 	}
 
-	// The block hash must be less than the claimed target.
-	blockHash, err := block.Sha()
+	return target, nil
+}
+
+// CheckProofOfWork ensures the passed bits which indicate the target difficulty
+// claimed by a block are in min/max range, with the passed proof of work limit
+// being the max, and that the passed block hash is less than the target
+// difficulty as claimed.  Targets which are negative or overflow the proof of
+// work limit when the compact bits are expanded are rejected.
+//
+// This does not require a BlockChain instance, so it is suitable for use by
+// callers such as header relay code and testing tools.
+func CheckProofOfWork(blockHash *btcwire.ShaHash, bits uint32, powLimit *big.Int) error {
+	target, err := checkTargetRange(bits, powLimit)
 	if err != nil {
 		return err
 	}
+
+	// The block hash must be less than the claimed target.
 	hashNum := ShaHashToBig(blockHash)
 	if hashNum.Cmp(target) > 0 {
 		str := fmt.Sprintf("block hash of %064x is higher than "+
 			"expected max of %064x", hashNum, target)
-		return RuleError(str)
+		return ruleError(ErrHighHash, str)
 	}
 
 	return nil
 }
 
-// countSigOps returns the number of signature operations for all transaction
+// checkProofOfWork ensures the block header bits which indicate the target
+// difficulty is in min/max range, with the passed proof of work limit being the
+// max, and that the block hash is less than the target difficulty as claimed.
+// See CheckProofOfWork for details.
+//
+// The flags modify the behavior of this function as follows:
+//  - BFNoPoWCheck: The check to ensure the block hash is less than the target
+//    difficulty is not performed.
+func checkProofOfWork(header *btcwire.BlockHeader, blockHash *btcwire.ShaHash, powLimit *big.Int, flags BehaviorFlags) error {
+	if flags&BFNoPoWCheck == BFNoPoWCheck {
+		_, err := checkTargetRange(header.Bits, powLimit)
+		return err
+	}
+
+	return CheckProofOfWork(blockHash, header.Bits, powLimit)
+}
+
+// CountSigOps returns the number of signature operations for all transaction
 // input and output scripts in the provided transaction.  This uses the
 // quicker, but imprecise, signature operation counting mechanism from
 // btcscript.
-func countSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool) (int, error) {
+//
+// This is the same counting the chain uses to enforce the maximum number of
+// signature operations per block, so it is suitable for use by callers such as
+// mining code and memory pool policy which need to apply the same limits.
+func CountSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool) (int, error) {
 	// Choose the starting transaction input based on whether this is a
 	// coinbase transaction since the coinbase input script should not be
 	// executed.
@@ -336,11 +396,12 @@ func countSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool) (int, error) {
 	return totalSigOps, nil
 }
 
-// countP2SHSigOps returns the number of signature operations for all input
+// CountP2SHSigOps returns the number of signature operations for all input
 // transactions which are of the pay-to-script-hash type.  This uses the
 // precise, signature operation counting mechanism from btcscript which requires
-// access to the input transaction scripts.
-func countP2SHSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool, txStore map[btcwire.ShaHash]*txData) (int, error) {
+// access to the input transaction scripts.  A transaction store with the input
+// transactions can be obtained via FetchTransactionStore.
+func CountP2SHSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool, txStore TxStore) (int, error) {
 	// Coinbase transactions have no interesting inputs.
 	if isCoinBaseTx {
 		return 0, nil
@@ -360,23 +421,25 @@ func countP2SHSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool, txStore map[btcwir
 		txInHash := &txIn.PreviousOutpoint.Hash
 		originTx, exists := txStore[*txInHash]
 		if !exists {
-			return 0, fmt.Errorf("unable to find input transaction "+
+			str := fmt.Sprintf("unable to find input transaction "+
 				"%v referenced from transaction %v", txHash,
 				txInHash)
+			return 0, ruleError(ErrMissingTx, str)
 		}
 
 		// Ensure the output index in the referenced transaction is
 		// available.
 		originTxIndex := txIn.PreviousOutpoint.Index
-		if originTxIndex >= uint32(len(originTx.tx.TxOut)) {
-			return 0, fmt.Errorf("out of bounds input index %d in "+
+		if originTxIndex >= uint32(len(originTx.Tx.TxOut)) {
+			str := fmt.Sprintf("out of bounds input index %d in "+
 				"transaction %v referenced from transaction %v",
 				originTxIndex, txInHash, txHash)
+			return 0, ruleError(ErrBadTxInput, str)
 		}
 
 		// We're only interested in pay-to-script-hash types, so skip
 		// this input if it's not one.
-		pkScript := originTx.tx.TxOut[originTxIndex].PkScript
+		pkScript := originTx.Tx.TxOut[originTxIndex].PkScript
 		if !btcscript.IsPayToScriptHash(pkScript) {
 			continue
 		}
@@ -395,65 +458,136 @@ func countP2SHSigOps(msgTx *btcwire.MsgTx, isCoinBaseTx bool, txStore map[btcwir
 		lastSigOps := totalSigOps
 		totalSigOps += numSigOps
 		if totalSigOps < lastSigOps {
-			return 0, fmt.Errorf("the public key script from "+
-				"output index %d in transaction %v contains "+
-				"too many signature operations - overflow",
+			str := fmt.Sprintf("the public key script from output "+
+				"index %d in transaction %v contains too many "+
+				"signature operations - overflow",
 				originTxIndex, txInHash)
+			return 0, ruleError(ErrTooManySigOps, str)
 		}
 	}
 
 	return totalSigOps, nil
 }
 
-// checkBlockSanity performs some preliminary checks on a block to ensure it is
-// sane before continuing with block processing.  These checks are context free.
-func checkBlockSanity(block *btcutil.Block) error {
-	// NOTE: bitcoind does size limits checking here, but the size limits
-	// have already been checked by btcwire for incoming blocks.  Also,
-	// btcwire checks the size limits on send too, so there is no need
-	// to double check it here.
-
+// checkBlockHeaderSanity performs some preliminary checks on a block header to
+// ensure it is sane before continuing with processing.  These checks are
+// context free.
+//
+// The proof of work limit and flags are passed to checkProofOfWork.  See its
+// documentation for how they modify its behavior.  The passed time source
+// provides the network-adjusted time the block timestamp is checked against.
+func checkBlockHeaderSanity(header *btcwire.BlockHeader, blockHash *btcwire.ShaHash, powLimit *big.Int, timeSource MedianTimeSource, flags BehaviorFlags) error {
 	// Ensure the proof of work bits in the block header is in min/max range
 	// and the block hash is less than the target value described by the
 	// bits.
-	err := checkProofOfWork(block)
+	err := checkProofOfWork(header, blockHash, powLimit, flags)
 	if err != nil {
 		return err
 	}
 
-	// Ensure the block time is not more than 2 hours in the future.
-	msgBlock := block.MsgBlock()
-	header := &msgBlock.Header
-	if header.Timestamp.After(time.Now().Add(time.Hour * 2)) {
+	// Ensure the block time is not more than 2 hours in the future
+	// according to the network-adjusted time.
+	maxTimestamp := timeSource.AdjustedTime().Add(time.Hour * 2)
+	if header.Timestamp.After(maxTimestamp) {
 		str := fmt.Sprintf("block timestamp of %v is too far in the "+
 			"future", header.Timestamp)
-		return RuleError(str)
+		return ruleError(ErrTimeTooNew, str)
+	}
+
+	return nil
+}
+
+// CheckBlockSanity performs some preliminary checks on a block to ensure it is
+// sane before continuing with block processing.  These checks are context free
+// which makes them suitable for use by callers such as memory pools, relay
+// code, and testing tools which do not have access to the block's position
+// within the block chain.
+//
+// The proof of work, block weight, and signature operation limits are those of
+// the passed network parameters, which must be for the chain the block is
+// intended for, and the passed limits on the size and number of transactions
+// are normally DefaultSanityLimits.  The passed time source provides the
+// network-adjusted time used to ensure the block timestamp is not too far in
+// the future.
+func CheckBlockSanity(block *btcutil.Block, params *Params, timeSource MedianTimeSource, limits *SanityLimits) error {
+	// NOTE: bitcoind does size limits checking here, but the size limits
+	// have already been checked by btcwire for incoming blocks.  Also,
+	// btcwire checks the size limits on send too, so there is no need
+	// to double check it here.
+
+	// Perform the context free checks on the block header.
+	blockHash, err := block.Sha()
+	if err != nil {
+		return deserializationError(err)
+	}
+	msgBlock := block.MsgBlock()
+	header := &msgBlock.Header
+	err = checkBlockHeaderSanity(header, blockHash, params.PowLimit,
+		timeSource, BFNone)
+	if err != nil {
+		return err
 	}
 
 	// A block must have at least one transaction.
 	transactions := msgBlock.Transactions
 	if len(transactions) == 0 {
-		return RuleError("block does not contain any transactions")
+		return ruleError(ErrNoTransactions, "block does not contain "+
+			"any transactions")
+	}
+
+	// A block must not have more transactions than the max allowed.
+	if len(transactions) > limits.MaxTxPerBlock {
+		str := fmt.Sprintf("block contains %d transactions which is "+
+			"more than the max allowed of %d", len(transactions),
+			limits.MaxTxPerBlock)
+		return ruleError(ErrTooManyTransactions, str)
+	}
+
+	// A block must not exceed the maximum allowed block weight.
+	blockWeight, err := BlockWeight(block)
+	if err != nil {
+		return deserializationError(err)
+	}
+	if blockWeight > params.MaxBlockWeight {
+		str := fmt.Sprintf("serialized block weight of %d exceeds max "+
+			"allowed weight of %d", blockWeight, params.MaxBlockWeight)
+		return ruleError(ErrBlockTooBig, str)
 	}
 
 	// The first transaction in a block must be a coinbase.
-	if !isCoinBase(transactions[0]) {
-		return RuleError("first transaction in block is not a coinbase")
+	if !IsCoinBase(transactions[0]) {
+		return ruleError(ErrFirstTxNotCoinbase, "first transaction in "+
+			"block is not a coinbase")
 	}
 
 	// A block must not have more than one coinbase.
 	for _, tx := range transactions[1:] {
-		if isCoinBase(tx) {
-			return RuleError("block contains more than one coinbase")
+		if IsCoinBase(tx) {
+			return ruleError(ErrMultipleCoinbases, "block contains "+
+				"more than one coinbase")
 		}
 	}
 
 	// Do some preliminary checks on each transaction to ensure they are
-	// sane before continuing.
-	for _, tx := range transactions {
-		err := checkTransactionSanity(tx)
+	// sane before continuing.  This includes ensuring they do not exceed
+	// the max allowed size.
+	pver := block.ProtocolVersion()
+	for i, tx := range transactions {
+		err := CheckTransactionSanity(tx)
 		if err != nil {
-			return err
+			txHash, _ := block.TxSha(i)
+			return contextError(err, txContext(txHash))
+		}
+
+		txSize, err := txSerializeSize(tx, pver)
+		if err != nil {
+			return deserializationError(err)
+		}
+		if txSize > limits.MaxTxSize {
+			str := fmt.Sprintf("serialized transaction size of %d "+
+				"exceeds max allowed size of %d", txSize,
+				limits.MaxTxSize)
+			return ruleError(ErrTxTooBig, str)
 		}
 	}
 
@@ -468,7 +602,7 @@ func checkBlockSanity(block *btcutil.Block) error {
 	if !header.MerkleRoot.IsEqual(calculatedMerkleRoot) {
 		str := fmt.Sprintf("block merkle root is invalid - got %v, "+
 			"want %v", calculatedMerkleRoot, header.MerkleRoot)
-		return RuleError(str)
+		return ruleError(ErrBadMerkleRoot, str)
 	}
 
 	// Check for duplicate transactions.  This check will be fairly quick
@@ -477,13 +611,13 @@ func checkBlockSanity(block *btcutil.Block) error {
 	existingTxHashes := make(map[btcwire.ShaHash]bool)
 	txShas, err := block.TxShas()
 	if err != nil {
-		return err
+		return deserializationError(err)
 	}
 	for _, hash := range txShas {
 		if _, exists := existingTxHashes[*hash]; exists {
 			str := fmt.Sprintf("block contains duplicate "+
 				"transaction %v", hash)
-			return RuleError(str)
+			return ruleError(ErrDuplicateTx, str)
 		}
 		existingTxHashes[*hash] = true
 	}
@@ -494,10 +628,10 @@ func checkBlockSanity(block *btcutil.Block) error {
 	for i, tx := range transactions {
 		// Since the first (and only the first) transaction has already
 		// been verified above to be a coinbase transaction, use i == 0
-		// as an optimization for the flag to countSigOps for whether
+		// as an optimization for the flag to CountSigOps for whether
 		// or not the transaction is a coinbase transaction rather than
 		// having to do a full coinbase check again.
-		numSigOps, err := countSigOps(tx, i == 0)
+		numSigOps, err := CountSigOps(tx, i == 0)
 		if err != nil {
 			return err
 		}
@@ -506,37 +640,122 @@ func checkBlockSanity(block *btcutil.Block) error {
 		// overflow.
 		lastSigOps := totalSigOps
 		totalSigOps += numSigOps
-		if totalSigOps < lastSigOps || totalSigOps > maxSigOpsPerBlock {
+		if totalSigOps < lastSigOps || totalSigOps > params.MaxBlockSigOps {
 			str := fmt.Sprintf("block contains too many signature "+
 				"operations - got %v, max %v", totalSigOps,
-				maxSigOpsPerBlock)
-			return RuleError(str)
+				params.MaxBlockSigOps)
+			return ruleError(ErrTooManySigOps, str)
 		}
 	}
 
 	return nil
 }
 
-// checkSerializedHeight checks if the signature script in the passed
-// transaction starts with the serialized block height of wantHeight.
-func checkSerializedHeight(coinbaseTx *btcwire.MsgTx, wantHeight int64) error {
+// ExtractCoinbaseHeight returns the block height serialized at the start of the
+// signature script of the passed coinbase transaction as required by BIP0034
+// for blocks of version 2 or greater.  The height is encoded as a script
+// number: heights 0 through 16 use the small integer opcodes and all others are
+// a minimal little endian data push of up to 8 bytes.  Heights which are not
+// encoded that way are rejected with ErrBadCoinbaseHeight.
+func ExtractCoinbaseHeight(coinbaseTx *btcwire.MsgTx) (int64, error) {
+	if len(coinbaseTx.TxIn) == 0 {
+		return 0, ruleError(ErrMissingCoinbaseHeight, "the coinbase has no inputs")
+	}
 	sigScript := coinbaseTx.TxIn[0].SignatureScript
-	if len(sigScript) < 4 {
+	if len(sigScript) < 1 {
 		str := "the coinbase signature script for blocks of " +
 			"version %d or greater must start with the " +
 			"serialized block height"
 		str = fmt.Sprintf(str, serializedHeightVersion)
-		return RuleError(str)
+		return 0, ruleError(ErrMissingCoinbaseHeight, str)
+	}
+
+	// Heights 0 through 16 are encoded with the small integer opcodes.
+	opcode := sigScript[0]
+	if opcode == btcscript.OP_0 {
+		return 0, nil
+	}
+	if opcode >= btcscript.OP_1 && opcode <= btcscript.OP_16 {
+		return int64(opcode - (btcscript.OP_1 - 1)), nil
+	}
+
+	// Otherwise, the opcode is the number of bytes in the serialized
+	// height.
+	serializedLen := int(opcode)
+	if serializedLen > 8 || len(sigScript[1:]) < serializedLen {
+		str := "the coinbase signature script for blocks of " +
+			"version %d or greater must start with the " +
+			"serialized block height"
+		str = fmt.Sprintf(str, serializedHeightVersion)
+		return 0, ruleError(ErrMissingCoinbaseHeight, str)
+	}
+
+	// The height must be encoded exactly the way SerializeCoinbaseHeight
+	// encodes it.
+	height := scriptNum(sigScript[1 : serializedLen+1])
+	if !bytes.HasPrefix(sigScript, SerializeCoinbaseHeight(height)) {
+		str := fmt.Sprintf("the coinbase signature script serialized "+
+			"block height %x is not minimally encoded",
+			sigScript[:serializedLen+1])
+		return 0, ruleError(ErrBadCoinbaseHeight, str)
+	}
+	return height, nil
+}
+
+// SerializeCoinbaseHeight returns the start of a coinbase signature script
+// which encodes the passed block height the way ExtractCoinbaseHeight expects
+// for BIP0034.  It is intended to be used by mining code to create compliant
+// coinbase transactions.
+func SerializeCoinbaseHeight(height int64) []byte {
+	if height == 0 {
+		return []byte{btcscript.OP_0}
+	}
+	if height >= 1 && height <= 16 {
+		return []byte{byte(btcscript.OP_1 - 1 + height)}
+	}
+
+	// Encode the height as a minimal little endian script number.  An
+	// extra byte is needed when the most significant bit is set since it
+	// would otherwise be interpreted as the sign bit.
+	isNegative := height < 0
+	if isNegative {
+		height = -height
+	}
+	var serialized []byte
+	for height > 0 {
+		serialized = append(serialized, byte(height&0xff))
+		height >>= 8
+	}
+	if serialized[len(serialized)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if isNegative {
+			extra = 0x80
+		}
+		serialized = append(serialized, extra)
+	} else if isNegative {
+		serialized[len(serialized)-1] |= 0x80
+	}
+
+	return append([]byte{byte(len(serialized))}, serialized...)
+}
+
+// checkSerializedHeight checks if the signature script in the passed
+// transaction starts with exactly the bytes SerializeCoinbaseHeight produces
+// for wantHeight.
+func checkSerializedHeight(coinbaseTx *btcwire.MsgTx, wantHeight int64) error {
+	serializedHeight, err := ExtractCoinbaseHeight(coinbaseTx)
+	if err != nil {
+		return err
 	}
 
-	serializedHeightBytes := make([]byte, 4, 4)
-	copy(serializedHeightBytes, sigScript[1:4])
-	serializedHeight := binary.LittleEndian.Uint32(serializedHeightBytes)
-	if int64(serializedHeight) != wantHeight {
+	sigScript := coinbaseTx.TxIn[0].SignatureScript
+	if serializedHeight != wantHeight ||
+		!bytes.HasPrefix(sigScript, SerializeCoinbaseHeight(wantHeight)) {
+
 		str := fmt.Sprintf("the coinbase signature script serialized "+
 			"block height is %d when %d was expected",
 			serializedHeight, wantHeight)
-		return RuleError(str)
+		return ruleError(ErrBadCoinbaseHeight, str)
 	}
 
 	return nil
@@ -544,8 +763,8 @@ func checkSerializedHeight(coinbaseTx *btcwire.MsgTx, wantHeight int64) error {
 
 // isTransactionSpent returns whether or not the provided transaction is fully
 // spent.  A fully spent transaction is one where all outputs have been spent.
-func isTransactionSpent(tx *txData) bool {
-	for _, isOutputSpent := range tx.spent {
+func isTransactionSpent(tx *TxData) bool {
+	for _, isOutputSpent := range tx.Spent {
 		if !isOutputSpent {
 			return false
 		}
@@ -553,6 +772,51 @@ func isTransactionSpent(tx *txData) bool {
 	return true
 }
 
+// isBIP0030Redundant returns whether or not the BIP0030 check is unnecessary
+// for the passed node because the chain it is part of has BIP0034 active.
+// BIP0034 requires coinbases to include the block height, which makes it
+// impossible to create a transaction with the same hash as an existing one
+// without first creating a duplicate coinbase, so there is nothing left for
+// BIP0030 to prevent.  This only applies when the chain contains the known
+// BIP0034 activation block for the network since the heights are otherwise not
+// guaranteed to be in the coinbases of earlier blocks.
+//
+// It also only applies below bip0034ImpliesBIP0030Limit, since some coinbases
+// from before BIP0034 activated already contain the height of a block at that
+// height, so the BIP0030 check resumes from there on.
+func (b *BlockChain) isBIP0030Redundant(node *blockNode) bool {
+	bip0034Block := Checkpoint{
+		Height: b.chainParams.BIP0034Height,
+		Hash:   b.chainParams.BIP0034Hash,
+	}
+	if bip0034Block.Height == 0 || node.height < bip0034Block.Height ||
+		node.height >= bip0034ImpliesBIP0030Limit {
+
+		return false
+	}
+
+	// Find the ancestor of the node at the activation height.  Once an
+	// ancestor is in the main chain, the main chain block at that height
+	// is the ancestor, so there is no need to walk all the way back.
+	ancestor := node
+	for ancestor != nil && ancestor.height > bip0034Block.Height &&
+		!ancestor.inMainChain {
+
+		ancestor = ancestor.parent
+	}
+	if ancestor == nil {
+		return false
+	}
+	if ancestor.height == bip0034Block.Height {
+		return ancestor.hash.IsEqual(bip0034Block.Hash)
+	}
+	mainHash, err := b.db.FetchBlockShaByHeight(bip0034Block.Height)
+	if err != nil {
+		return false
+	}
+	return mainHash.IsEqual(bip0034Block.Hash)
+}
+
 // checkBIP0030 ensures blocks do not contain duplicate transactions which
 // 'overwrite' older transactions that are not fully spent.  This prevents an
 // attack where a coinbase and all of its dependent transactions could be
@@ -575,7 +839,7 @@ func (b *BlockChain) checkBIP0030(node *blockNode, block *btcutil.Block) error {
 
 	// Examine the resulting data about the requested transactions.
 	for _, txD := range txResults {
-		switch txD.err {
+		switch txD.Err {
 		// A duplicate transaction was not found.  This is the most
 		// common case.
 		case btcdb.TxShaMissing:
@@ -587,21 +851,21 @@ func (b *BlockChain) checkBIP0030(node *blockNode, block *btcutil.Block) error {
 			if !isTransactionSpent(txD) {
 				str := fmt.Sprintf("tried to overwrite "+
 					"transaction %v at block height %d "+
-					"that is not fully spent", txD.hash,
-					txD.blockHeight)
-				return RuleError(str)
+					"that is not fully spent", txD.Hash,
+					txD.BlockHeight)
+				return ruleError(ErrOverwriteTx, str)
 			}
 
 		// Some other unexpected error occurred.  Return it now.
 		default:
-			return txD.err
+			return dbError(txD.Err)
 		}
 	}
 
 	return nil
 }
 
-// checkTransactionInputs performs a series of checks on the inputs to a
+// CheckTransactionInputs performs a series of checks on the inputs to a
 // transaction to ensure they are valid.  An example of some of the checks
 // include verifying all inputs exist, ensuring the coinbase seasoning
 // requirements are met, validating all values and fees are in the legal range
@@ -609,9 +873,15 @@ func (b *BlockChain) checkBIP0030(node *blockNode, block *btcutil.Block) error {
 // the signatures to prove the spender was the owner of the bitcoins and
 // therefore allowed to spend them.  As it checks the inputs, it also calculates
 // the total fees for the transaction and returns that value.
-func checkTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore map[btcwire.ShaHash]*txData) (int64, error) {
+//
+// The passed height is the height of the block the transaction is, or would
+// be, included in and the transaction store must contain the input
+// transactions from the point of view of that block, such as those returned by
+// FetchTransactionStore for a transaction which is not in a block yet.  The
+// coinbase maturity is that of the passed network parameters.
+func CheckTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore TxStore, params *Params) (int64, error) {
 	// Coinbase transactions have no inputs.
-	if isCoinBase(tx) {
+	if IsCoinBase(tx) {
 		return 0, nil
 	}
 
@@ -626,39 +896,46 @@ func checkTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore map[btcwi
 		// Ensure the input is available.
 		txInHash := &txIn.PreviousOutpoint.Hash
 		originTx, exists := txStore[*txInHash]
-		if !exists {
+		if exists && originTx.Err != nil &&
+			originTx.Err != btcdb.TxShaMissing {
+
+			return 0, dbError(originTx.Err)
+		}
+		if !exists || originTx.Tx == nil {
 			str := fmt.Sprintf("unable to find input transaction "+
 				"%v for transaction %v", txHash, txInHash)
-			return 0, RuleError(str)
+			return 0, ruleError(ErrMissingTx, str)
 		}
 
 		// Ensure the transaction is not spending coins which have not
 		// yet reached the required coinbase maturity.
-		if isCoinBase(originTx.tx) {
-			originHeight := originTx.blockHeight
+		if IsCoinBase(originTx.Tx) {
+			originHeight := originTx.BlockHeight
 			blocksSincePrev := txHeight - originHeight
+			coinbaseMaturity := params.CoinbaseMaturity
 			if blocksSincePrev < coinbaseMaturity {
 				str := fmt.Sprintf("tried to spend coinbase "+
 					"transaction %v from height %v at "+
 					"height %v before required maturity "+
 					"of %v blocks", txHash, originHeight,
 					txHeight, coinbaseMaturity)
-				return 0, RuleError(str)
+				return 0, ruleError(ErrImmatureSpend, str)
 			}
 		}
 
 		// Ensure the transaction is not double spending coins.
 		originTxIndex := txIn.PreviousOutpoint.Index
-		if originTxIndex >= uint32(len(originTx.spent)) {
-			return 0, fmt.Errorf("out of bounds input index %d in "+
+		if originTxIndex >= uint32(len(originTx.Spent)) {
+			str := fmt.Sprintf("out of bounds input index %d in "+
 				"transaction %v referenced from transaction %v",
 				originTxIndex, txInHash, txHash)
+			return 0, ruleError(ErrBadTxInput, str)
 		}
-		if originTx.spent[originTxIndex] {
+		if originTx.Spent[originTxIndex] {
 			str := fmt.Sprintf("transaction %v tried to double "+
 				"spend coins from transaction %v", txHash,
 				txInHash)
-			return 0, RuleError(str)
+			return 0, ruleError(ErrDoubleSpend, str)
 		}
 
 		// Ensure the transaction amounts are in range.  Each of the
@@ -667,17 +944,17 @@ func checkTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore map[btcwi
 		// a transaction are in a unit value known as a satoshi.  One
 		// bitcoin is a quantity of satoshi as defined by the
 		// satoshiPerBitcoin constant.
-		originTxSatoshi := originTx.tx.TxOut[originTxIndex].Value
+		originTxSatoshi := originTx.Tx.TxOut[originTxIndex].Value
 		if originTxSatoshi < 0 {
 			str := fmt.Sprintf("transaction output has negative "+
 				"value of %v", originTxSatoshi)
-			return 0, RuleError(str)
+			return 0, ruleError(ErrBadTxOutValue, str)
 		}
 		if originTxSatoshi > maxSatoshi {
 			str := fmt.Sprintf("transaction output value of %v is "+
 				"higher than max allowed value of %v",
 				originTxSatoshi, maxSatoshi)
-			return 0, RuleError(str)
+			return 0, ruleError(ErrBadTxOutValue, str)
 		}
 
 		// The total of all outputs must not be more than the max
@@ -690,13 +967,13 @@ func checkTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore map[btcwi
 				"inputs is %v which is higher than max "+
 				"allowed value of %v", totalSatoshiIn,
 				maxSatoshi)
-			return 0, RuleError(str)
+			return 0, ruleError(ErrBadTxOutValue, str)
 		}
 	}
 
 	// Calculate the total output amount for this transaction.  It is safe
 	// to ignore overflow and out of range errors here because those error
-	// conditions would have already been caught by checkTransactionSanity.
+	// conditions would have already been caught by CheckTransactionSanity.
 	var totalSatoshiOut int64
 	for _, txOut := range tx.TxOut {
 		totalSatoshiOut += txOut.Value
@@ -707,7 +984,7 @@ func checkTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore map[btcwi
 		str := fmt.Sprintf("total value of all transaction inputs for "+
 			"transaction %v is %v which is less than the amount "+
 			"spent of %v", txHash, totalSatoshiIn, totalSatoshiOut)
-		return 0, RuleError(str)
+		return 0, ruleError(ErrSpendTooHigh, str)
 	}
 
 	// NOTE: bitcoind checks if the transaction fees are < 0 here, but that
@@ -719,10 +996,14 @@ func checkTransactionInputs(tx *btcwire.MsgTx, txHeight int64, txStore map[btcwi
 
 // checkConnectBlock performs several checks to confirm connecting the passed
 // block to the main chain (including whatever reorganization might be necessary
-// to get this node to the main chain) does not violate any rules.
-func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) error {
+// to get this node to the main chain) does not violate any rules.  It returns
+// statistics about the block which are gathered along the way.
+//
+// The transaction scripts are only run when allowScripts is set and script
+// validation is not otherwise disabled due to checkpoints or DisableVerify.
+func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block, allowScripts bool) (*blockStats, error) {
 	// If the side chain blocks end up in the database, a call to
-	// checkBlockSanity should be done here in case a previous version
+	// CheckBlockSanity should be done here in case a previous version
 	// allowed a block that is no longer valid.  However, since the
 	// implementation only currently uses memory for the side chain blocks,
 	// it isn't currently necessary.
@@ -732,8 +1013,10 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 
 	// The coinbase for the Genesis block is not spendable, so just return
 	// now.
-	if node.hash.IsEqual(&btcwire.GenesisHash) {
-		return nil
+	stats := newBlockStats(node)
+	stats.scriptTypes = calcScriptTypeCounts(block)
+	if node.hash.IsEqual(b.chainParams.GenesisHash) {
+		return stats, nil
 	}
 
 	// BIP0030 added a rule to prevent blocks which contain duplicate
@@ -744,11 +1027,15 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 	// rule, so the check must be skipped for those blocks. The
 	// isBIP0030Node function is used to determine if this block is one
 	// of the two blocks that must be skipped.
-	enforceBIP0030 := !isBIP0030Node(node)
+	//
+	// The check is also skipped once BIP0034 is active since it makes
+	// duplicate transactions impossible.  See the documentation for
+	// isBIP0030Redundant for more details.
+	enforceBIP0030 := !isBIP0030Node(node) && !b.isBIP0030Redundant(node)
 	if enforceBIP0030 {
 		err := b.checkBIP0030(node, block)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -758,17 +1045,20 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 	// transaction inputs, counting pay-to-script-hashes, and scripts.
 	txInputStore, err := b.fetchInputTransactions(node, block)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// Determine which additional script rules apply to the block.
+	//
 	// BIP0016 describes a pay-to-script-hash type that is considered a
 	// "standard" type.  The rules for this BIP only apply to transactions
 	// after the timestmap defined by btcscript.Bip16Activation. See
 	// https://en.bitcoin.it/wiki/BIP_0016 for more details.
-	enforceBIP0016 := false
-	if node.timestamp.After(btcscript.Bip16Activation) {
-		enforceBIP0016 = true
+	flags, err := b.scriptFlagsForNode(node)
+	if err != nil {
+		return nil, err
 	}
+	enforceBIP0016 := flags&ScriptBip16 == ScriptBip16
 
 	// The number of signature operations must be less than the maximum
 	// allowed per block.  Note that the preliminary sanity checks on a
@@ -781,18 +1071,18 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 	for i, tx := range transactions {
 		// Since the first (and only the first) transaction has already
 		// been verified to be a coinbase transaction, use i == 0
-		// as an optimization for the flag to countSigOps for whether
+		// as an optimization for the flag to CountSigOps for whether
 		// or not the transaction is a coinbase transaction rather than
 		// having to do a full coinbase check again.
-		numsigOps, err := countSigOps(tx, i == 0)
+		numsigOps, err := CountSigOps(tx, i == 0)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if enforceBIP0016 {
-			numP2SHSigOps, err := countP2SHSigOps(tx, i == 0,
+			numP2SHSigOps, err := CountP2SHSigOps(tx, i == 0,
 				txInputStore)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			numsigOps += numP2SHSigOps
 		}
@@ -801,11 +1091,12 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 		// this on every loop to avoid overflow.
 		lastSigops := totalSigOps
 		totalSigOps += numsigOps
-		if totalSigOps < lastSigops || totalSigOps > maxSigOpsPerBlock {
+		maxSigOps := b.chainParams.MaxBlockSigOps
+		if totalSigOps < lastSigops || totalSigOps > maxSigOps {
 			str := fmt.Sprintf("block contains too many "+
 				"signature operations - got %v, max %v",
-				totalSigOps, maxSigOpsPerBlock)
-			return RuleError(str)
+				totalSigOps, maxSigOps)
+			return nil, ruleError(ErrTooManySigOps, str)
 		}
 	}
 
@@ -817,10 +1108,32 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 	// against all the inputs when the signature operations are out of
 	// bounds.
 	var totalFees int64
-	for _, tx := range transactions {
-		txFee, err := checkTransactionInputs(tx, node.height, txInputStore)
+	pver := block.ProtocolVersion()
+	for i, tx := range transactions {
+		txFee, err := CheckTransactionInputs(tx, node.height, txInputStore,
+			b.chainParams)
 		if err != nil {
-			return err
+			txHash, _ := block.TxSha(i)
+			return nil, contextError(err, txContext(txHash))
+		}
+
+		// Keep track of the lowest fee rate paid by the transactions
+		// in the block along with the coin days they destroy.  The
+		// coinbase doesn't pay any fees or spend any coins, so skip
+		// it.
+		if i != 0 {
+			txSize, err := txSerializeSize(tx, pver)
+			if err != nil {
+				return nil, deserializationError(err)
+			}
+			feeRate := txFee * 1000 / int64(txSize)
+			if stats.minFeeRate < 0 || feeRate < stats.minFeeRate {
+				stats.minFeeRate = feeRate
+			}
+
+			stats.coinDaysDestroyed += calcCoinDaysDestroyed(tx,
+				node.height, txInputStore,
+				b.chainParams.TargetTimePerBlock)
 		}
 
 		// Sum the total fees and ensure we don't overflow the
@@ -828,8 +1141,38 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 		lastTotalFees := totalFees
 		totalFees += txFee
 		if totalFees < lastTotalFees {
-			return RuleError("total fees for block overflows " +
-				"accumulator")
+			return nil, ruleError(ErrBadFees, "total fees for block "+
+				"overflows accumulator")
+		}
+	}
+
+	// Ensure the relative lock times of all transactions have passed once
+	// they are active.  This is part of BIP_0068.
+	prevNode, err := b.getPrevNodeFromNode(node)
+	if err != nil {
+		return nil, err
+	}
+	csvActive, err := b.isCSVActive(prevNode)
+	if err != nil {
+		return nil, err
+	}
+	if csvActive {
+		medianTime, err := b.calcPastMedianTime(prevNode)
+		if err != nil {
+			return nil, err
+		}
+		for i, tx := range transactions {
+			lock, err := b.calcSequenceLock(node, tx, txInputStore)
+			if err != nil {
+				return nil, err
+			}
+			if !lock.IsActive(node.height, medianTime) {
+				txHash, _ := block.TxSha(i)
+				str := fmt.Sprintf("block contains transaction "+
+					"%v whose relative lock time has not "+
+					"passed", txHash)
+				return nil, ruleError(ErrSequenceLockNotMet, str)
+			}
 		}
 	}
 
@@ -837,17 +1180,17 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 	// the expected subsidy value plus total transaction fees gained from
 	// mining the block.  It is safe to ignore overflow and out of range
 	// errors here because those error conditions would have already been
-	// caught by checkTransactionSanity.
+	// caught by CheckTransactionSanity.
 	var totalSatoshiOut int64
 	for _, txOut := range transactions[0].TxOut {
 		totalSatoshiOut += txOut.Value
 	}
-	expectedSatoshiOut := calcBlockSubsidy(node.height) + totalFees
+	expectedSatoshiOut := CalcBlockSubsidy(node.height, b.chainParams) + totalFees
 	if totalSatoshiOut > expectedSatoshiOut {
 		str := fmt.Sprintf("coinbase transaction for block pays %v "+
 			"which is more than expected value of %v",
 			totalSatoshiOut, expectedSatoshiOut)
-		return RuleError(str)
+		return nil, ruleError(ErrBadCoinbaseValue, str)
 	}
 
 	// Don't run scripts if this node is before the latest known good
@@ -857,21 +1200,32 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block) er
 	// optimization because running the scripts is the most time consuming
 	// portion of block handling.
 	checkpoint := b.LatestCheckpoint()
-	runScripts := !b.noVerify
+	runScripts := allowScripts && !b.noVerify
 	if checkpoint != nil && node.height <= checkpoint.Height {
 		runScripts = false
 	}
 
+	// Likewise, don't run scripts for the blocks the caller assumes are
+	// valid.  See SetAssumeValid.
+	if runScripts {
+		assumedValid, err := b.isAssumedValid(node)
+		if err != nil {
+			return nil, err
+		}
+		runScripts = !assumedValid
+	}
+
 	// Now that the inexpensive checks are done and have passed, verify the
 	// transactions are actually allowed to spend the coins by running the
 	// expensive ECDSA signature check scripts.  Doing this last helps
 	// prevent CPU exhaustion attacks.
 	if runScripts {
-		err := checkBlockScripts(block, txInputStore)
+		err := checkBlockScripts(block, txInputStore, flags,
+			b.scriptWorkers, b.scriptEngine)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return stats, nil
 }
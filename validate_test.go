@@ -5,19 +5,124 @@
 package btcchain_test
 
 import (
+	"bytes"
 	"github.com/conformal/btcchain"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
+	"math"
+	"math/big"
 	"testing"
 	"time"
 )
 
+// powLimit is the highest proof of work value a block on the main network can
+// have.
+var powLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 224),
+	big.NewInt(1))
+
+// TestCheckBlockSanity ensures CheckBlockSanity accepts a known good block and
+// enforces the block weight and signature operation limits of the passed
+// network parameters.
 func TestCheckBlockSanity(t *testing.T) {
+	timeSource := btcchain.NewMedianTime()
 	block := btcutil.NewBlock(&Block100000, btcwire.ProtocolVersion)
-	err := btcchain.TstCheckBlockSanity(block)
+	err := btcchain.CheckBlockSanity(block, &btcchain.MainNetParams,
+		timeSource, &btcchain.DefaultSanityLimits)
 	if err != nil {
 		t.Errorf("CheckBlockSanity: %v", err)
 	}
+
+	lowWeight := btcchain.MainNetParams
+	lowWeight.MaxBlockWeight = 1000
+	lowSigOps := btcchain.MainNetParams
+	lowSigOps.MaxBlockSigOps = 0
+	tests := []struct {
+		name   string
+		params *btcchain.Params
+		want   btcchain.ErrorCode
+	}{
+		{"block weight limit", &lowWeight, btcchain.ErrBlockTooBig},
+		{"signature operation limit", &lowSigOps,
+			btcchain.ErrTooManySigOps},
+	}
+
+	for i, test := range tests {
+		err := btcchain.CheckBlockSanity(block, test.params, timeSource,
+			&btcchain.DefaultSanityLimits)
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != test.want {
+			t.Errorf("CheckBlockSanity #%d (%s): got %v, want %v", i,
+				test.name, err, test.want)
+		}
+	}
+}
+
+// TestCheckProofOfWork ensures CheckProofOfWork accepts the proof of work of a
+// known good block and rejects targets which are negative or exceed the proof
+// of work limit.
+func TestCheckProofOfWork(t *testing.T) {
+	header := &Block100000.Header
+	hash, err := header.BlockSha(btcwire.ProtocolVersion)
+	if err != nil {
+		t.Errorf("BlockSha: %v", err)
+		return
+	}
+
+	tests := []struct {
+		name  string
+		bits  uint32
+		valid bool
+	}{
+		{"block 100000", header.Bits, true},
+		{"negative target", 0x1d80ffff, false},
+		{"target over limit", 0x2100ffff, false},
+		{"target under hash", 0x1a04864c, false},
+	}
+
+	for _, test := range tests {
+		err := btcchain.CheckProofOfWork(&hash, test.bits, powLimit)
+		if test.valid && err != nil {
+			t.Errorf("CheckProofOfWork (%s): unexpected error: %v",
+				test.name, err)
+			continue
+		}
+		if _, ok := err.(btcchain.RuleError); !test.valid && !ok {
+			t.Errorf("CheckProofOfWork (%s): did not receive "+
+				"expected RuleError - got %v", test.name, err)
+		}
+	}
+}
+
+// TestCheckTransactionSanity ensures CheckTransactionSanity accepts the
+// transactions from a known good block and rejects malformed transactions.
+func TestCheckTransactionSanity(t *testing.T) {
+	for i, tx := range Block100000.Transactions {
+		err := btcchain.CheckTransactionSanity(tx)
+		if err != nil {
+			t.Errorf("CheckTransactionSanity: tx #%d: %v", i, err)
+		}
+	}
+
+	// A transaction with no inputs is invalid.
+	noInputs := btcwire.NewMsgTx()
+	noInputs.AddTxOut(btcwire.NewTxOut(0, []byte{0x51}))
+	err := btcchain.CheckTransactionSanity(noInputs)
+	if _, ok := err.(btcchain.RuleError); !ok {
+		t.Errorf("CheckTransactionSanity: did not receive expected "+
+			"RuleError for tx with no inputs - got %v", err)
+	}
+
+	// A transaction which spends the same output twice is invalid.
+	prevOut := btcwire.NewOutPoint(&btcwire.ShaHash{0x01}, 0)
+	dupInputs := btcwire.NewMsgTx()
+	dupInputs.AddTxIn(btcwire.NewTxIn(prevOut, nil))
+	dupInputs.AddTxIn(btcwire.NewTxIn(prevOut, nil))
+	dupInputs.AddTxOut(btcwire.NewTxOut(0, []byte{0x51}))
+	err = btcchain.CheckTransactionSanity(dupInputs)
+	if _, ok := err.(btcchain.RuleError); !ok {
+		t.Errorf("CheckTransactionSanity: did not receive expected "+
+			"RuleError for tx with duplicate inputs - got %v", err)
+	}
 }
 
 // Block100000 defines block 100,000 of the block chain.  It is used to
@@ -272,3 +377,182 @@ var Block100000 = btcwire.MsgBlock{
 		},
 	},
 }
+
+// TestCoinbaseHeight ensures heights serialized with SerializeCoinbaseHeight
+// are extracted by ExtractCoinbaseHeight and uses the expected encoding.
+func TestCoinbaseHeight(t *testing.T) {
+	tests := []struct {
+		height     int64
+		serialized []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x51}},
+		{16, []byte{0x60}},
+		{17, []byte{0x01, 0x11}},
+		{127, []byte{0x01, 0x7f}},
+		{128, []byte{0x02, 0x80, 0x00}},
+		{255, []byte{0x02, 0xff, 0x00}},
+		{256, []byte{0x02, 0x00, 0x01}},
+		{227931, []byte{0x03, 0x5b, 0x7a, 0x03}},
+		{8388608, []byte{0x04, 0x00, 0x00, 0x80, 0x00}},
+	}
+
+	for i, test := range tests {
+		serialized := btcchain.SerializeCoinbaseHeight(test.height)
+		if !bytes.Equal(serialized, test.serialized) {
+			t.Errorf("SerializeCoinbaseHeight #%d: unexpected "+
+				"serialization - got %x, want %x", i,
+				serialized, test.serialized)
+			continue
+		}
+
+		tx := btcwire.NewMsgTx()
+		sigScript := append(serialized, []byte("extra nonce")...)
+		tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{},
+			math.MaxUint32), sigScript))
+		height, err := btcchain.ExtractCoinbaseHeight(tx)
+		if err != nil {
+			t.Errorf("ExtractCoinbaseHeight #%d: unexpected error: %v",
+				i, err)
+			continue
+		}
+		if height != test.height {
+			t.Errorf("ExtractCoinbaseHeight #%d: unexpected height - "+
+				"got %d, want %d", i, height, test.height)
+		}
+	}
+
+	// A push which is longer than the script is invalid.
+	tx := btcwire.NewMsgTx()
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{},
+		math.MaxUint32), []byte{0x03, 0x01}))
+	if _, err := btcchain.ExtractCoinbaseHeight(tx); err == nil {
+		t.Errorf("ExtractCoinbaseHeight: did not receive expected " +
+			"error for truncated height")
+	}
+
+	// Heights which are not minimally encoded are rejected even though
+	// they decode to the expected height.
+	nonMinimalTests := []struct {
+		name       string
+		serialized []byte
+	}{
+		{"small integer as a data push", []byte{0x01, 0x05}},
+		{"zero as a data push", []byte{0x01, 0x00}},
+		{"extra zero byte", []byte{0x02, 0x11, 0x00}},
+		{"extra zero bytes", []byte{0x04, 0x5b, 0x7a, 0x03, 0x00}},
+	}
+	for i, test := range nonMinimalTests {
+		tx := btcwire.NewMsgTx()
+		sigScript := append(test.serialized, []byte("extra nonce")...)
+		tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{},
+			math.MaxUint32), sigScript))
+		_, err := btcchain.ExtractCoinbaseHeight(tx)
+		rerr, ok := err.(btcchain.RuleError)
+		if !ok || rerr.ErrorCode != btcchain.ErrBadCoinbaseHeight {
+			t.Errorf("ExtractCoinbaseHeight #%d (%s): got %v, want %v",
+				i, test.name, err, btcchain.ErrBadCoinbaseHeight)
+		}
+	}
+}
+
+// TestCalcBlockSubsidy ensures the block subsidy follows the halving schedule
+// of the network parameters and custom subsidy functions are used when set.
+func TestCalcBlockSubsidy(t *testing.T) {
+	params := btcchain.MainNetParams
+	tests := []struct {
+		height  int64
+		subsidy int64
+	}{
+		{0, 5000000000},
+		{209999, 5000000000},
+		{210000, 2500000000},
+		{420000, 1250000000},
+		{210000 * 64, 0},
+	}
+	for _, test := range tests {
+		subsidy := btcchain.CalcBlockSubsidy(test.height, &params)
+		if subsidy != test.subsidy {
+			t.Errorf("CalcBlockSubsidy (height %d): got %d, want %d",
+				test.height, subsidy, test.subsidy)
+		}
+	}
+
+	params.SubsidyFunc = func(height int64) int64 {
+		return 1000 - height
+	}
+	if subsidy := btcchain.CalcBlockSubsidy(10, &params); subsidy != 990 {
+		t.Errorf("CalcBlockSubsidy: custom subsidy function was not "+
+			"used - got %d, want 990", subsidy)
+	}
+}
+
+// TestCheckTransactionInputsMaturity ensures the coinbase maturity enforced by
+// CheckTransactionInputs is the one of the passed network parameters.
+func TestCheckTransactionInputsMaturity(t *testing.T) {
+	coinbase := btcwire.NewMsgTx()
+	coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{},
+		math.MaxUint32), []byte{0x01, 0x05}))
+	coinbase.AddTxOut(btcwire.NewTxOut(5000000000, []byte{0x51}))
+	coinbaseHash, err := coinbase.TxSha(btcwire.ProtocolVersion)
+	if err != nil {
+		t.Fatalf("TxSha: unexpected error %v", err)
+	}
+
+	tx := btcwire.NewMsgTx()
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&coinbaseHash, 0), nil))
+	tx.AddTxOut(btcwire.NewTxOut(4000000000, []byte{0x51}))
+	txStore := btcchain.TxStore{
+		coinbaseHash: &btcchain.TxData{
+			Tx:          coinbase,
+			Hash:        &coinbaseHash,
+			BlockHeight: 5,
+			Spent:       make([]bool, 1),
+		},
+	}
+
+	// The coinbase is immature at the next height on the main network.
+	_, err = btcchain.CheckTransactionInputs(tx, 6, txStore,
+		&btcchain.MainNetParams)
+	ruleErr, ok := err.(btcchain.RuleError)
+	if !ok || ruleErr.ErrorCode != btcchain.ErrImmatureSpend {
+		t.Errorf("CheckTransactionInputs: did not receive expected "+
+			"ErrImmatureSpend - got %v", err)
+	}
+
+	// It is mature at the same height with the regression test network
+	// parameters which only require a single block.
+	fee, err := btcchain.CheckTransactionInputs(tx, 6, txStore,
+		&btcchain.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("CheckTransactionInputs: unexpected error %v", err)
+	}
+	if fee != 1000000000 {
+		t.Errorf("CheckTransactionInputs: got fee %d, want %d", fee,
+			1000000000)
+	}
+}
+
+// TestIsBIP0030Redundant ensures the BIP0030 check is only skipped from the
+// BIP0034 activation height up to the height at which BIP0034 no longer implies
+// BIP0030.
+func TestIsBIP0030Redundant(t *testing.T) {
+	tests := []struct {
+		height int64
+		want   bool
+	}{
+		{227930, false},
+		{227931, true},
+		{227932, true},
+		{1983701, true},
+		{1983702, false},
+		{1983703, false},
+	}
+	for _, test := range tests {
+		got := btcchain.TstIsBIP0030Redundant(227931, test.height)
+		if got != test.want {
+			t.Errorf("isBIP0030Redundant (height %d): got %v, want %v",
+				test.height, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+// VerifyLevel specifies how thoroughly existing main chain blocks are checked
+// by CheckConnectBlock and VerifyChain.  Each level includes all of the checks
+// of the levels before it.
+type VerifyLevel int
+
+const (
+	// VerifyLevelRead only ensures the block can be loaded from the
+	// database.
+	VerifyLevelRead VerifyLevel = iota
+
+	// VerifyLevelSanity additionally performs the context free sanity
+	// checks on the block and its transactions.
+	VerifyLevelSanity
+
+	// VerifyLevelContext additionally performs the checks on the block
+	// header which depend on its position within the block chain such as
+	// the difficulty, timestamp, and checkpoint checks.
+	VerifyLevelContext
+
+	// VerifyLevelConnect additionally performs the checks done when
+	// connecting the block to the main chain, such as double spend and
+	// transaction value checks, with the exception of running the
+	// transaction scripts.
+	VerifyLevelConnect
+
+	// VerifyLevelScripts additionally runs the transaction scripts.  Note
+	// that scripts are still not run for blocks before the latest
+	// checkpoint or when script validation is disabled via
+	// DisableVerify.
+	VerifyLevelScripts
+)
+
+// verifyBlockNode performs the checks for the passed level on the existing
+// main chain block associated with the passed node without modifying the state
+// of the chain.
+func (b *BlockChain) verifyBlockNode(node *blockNode, level VerifyLevel) error {
+	block, err := b.db.FetchBlockBySha(node.hash)
+	if err != nil {
+		return err
+	}
+	if level < VerifyLevelSanity {
+		return nil
+	}
+
+	err = CheckBlockSanity(block, b.chainParams, b.timeSource,
+		&b.sanityLimits)
+	if err != nil {
+		return err
+	}
+	if level < VerifyLevelContext {
+		return nil
+	}
+
+	prevNode, err := b.getPrevNodeFromNode(node)
+	if err != nil {
+		return err
+	}
+	err = b.checkBlockHeaderContext(&block.MsgBlock().Header, node.hash,
+		prevNode)
+	if err != nil {
+		return err
+	}
+	if level < VerifyLevelConnect {
+		return nil
+	}
+
+	// The transaction store used by checkConnectBlock is built from the
+	// point of view of the block, so this works for any block in the main
+	// chain and does not modify the chain.
+	_, err = b.checkConnectBlock(node, block, level >= VerifyLevelScripts)
+	return err
+}
+
+// CheckConnectBlock re-validates the existing main chain block with the passed
+// hash at the passed level as a dry run.  The state of the chain is not
+// modified.  A nil error means the block passed all of the checks for the
+// level.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) CheckConnectBlock(hash *btcwire.ShaHash, level VerifyLevel) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if b.bestChain == nil {
+		return fmt.Errorf("no main chain blocks are available")
+	}
+
+	// Walk backwards from the end of the main chain to find the node for
+	// the block.  This also ensures the block is actually in the main
+	// chain.
+	block, err := b.db.FetchBlockBySha(hash)
+	if err != nil {
+		return err
+	}
+	node := b.bestChain
+	for node != nil && node.height > block.Height() {
+		node, err = b.getPrevNodeFromNode(node)
+		if err != nil {
+			return err
+		}
+	}
+	if node == nil || !node.hash.IsEqual(hash) {
+		return fmt.Errorf("block %v is not in the main chain", hash)
+	}
+
+	return b.verifyBlockNode(node, level)
+}
+
+// VerifyChain re-validates the passed number of blocks at the end of the main
+// chain at the passed level as a dry run, starting with the most recent block.
+// All main chain blocks are checked when numBlocks is zero or less.  The state
+// of the chain is not modified.  It returns an error for the first block which
+// fails the checks for the level.
+//
+// This function is safe for concurrent access, however no blocks can be
+// processed until it completes.
+func (b *BlockChain) VerifyChain(numBlocks int64, level VerifyLevel) error {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	node := b.bestChain
+	for i := int64(0); node != nil && (numBlocks <= 0 || i < numBlocks); i++ {
+		if b.interruptRequested() {
+			return ErrInterrupted
+		}
+
+		err := b.verifyBlockNode(node, level)
+		if err != nil {
+			log.Warnf("Verification of block %v (height %d) "+
+				"failed: %v", node.hash, node.height, err)
+			return err
+		}
+
+		node, err = b.getPrevNodeFromNode(node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
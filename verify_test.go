@@ -0,0 +1,76 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestCheckConnectBlock ensures existing main chain blocks pass the checks of
+// every verify level without modifying the chain and that blocks which are not
+// in the main chain are rejected.
+func TestCheckConnectBlock(t *testing.T) {
+	params := btcchain.RegressionNetParams
+	chain, _, teardown := newTestChain(t, "verifytest", &params, nil)
+	defer teardown()
+
+	// The third block spends the coinbase of the first one and the side
+	// chain block forks from the first one.
+	g := newBlockGenerator(&params)
+	blocks := g.nextBlocks(g.genesis(), 2)
+	blocks = append(blocks, g.nextBlock(blocks[1],
+		func(msgBlock *btcwire.MsgBlock) {
+			msgBlock.AddTransaction(spendTx(blocks[0], 1000))
+		}))
+	sideBlock := g.nextBlock(blocks[0])
+	processBlocks(t, chain, blocks)
+	processBlocks(t, chain, []*btcutil.Block{sideBlock})
+
+	levels := []btcchain.VerifyLevel{
+		btcchain.VerifyLevelRead,
+		btcchain.VerifyLevelSanity,
+		btcchain.VerifyLevelContext,
+		btcchain.VerifyLevelConnect,
+		btcchain.VerifyLevelScripts,
+	}
+	tests := []struct {
+		name    string
+		hash    *btcwire.ShaHash
+		wantErr bool
+	}{
+		{"first block", blockHash(blocks[0]), false},
+		{"block with a spend", blockHash(blocks[2]), false},
+		{"side chain block", blockHash(sideBlock), true},
+		{"unknown block", &btcwire.ShaHash{}, true},
+	}
+
+	for i, test := range tests {
+		for _, level := range levels {
+			err := chain.CheckConnectBlock(test.hash, level)
+			if test.wantErr != (err != nil) {
+				t.Errorf("CheckConnectBlock #%d (%s) level %d: "+
+					"got error %v, want error %v", i,
+					test.name, level, err, test.wantErr)
+			}
+		}
+	}
+
+	// The whole chain and the most recent blocks verify at every level
+	// and the chain is unchanged afterwards.
+	for _, level := range levels {
+		for _, numBlocks := range []int64{0, 2} {
+			err := chain.VerifyChain(numBlocks, level)
+			if err != nil {
+				t.Errorf("VerifyChain (%d blocks, level %d): "+
+					"unexpected error %v", numBlocks, level,
+					err)
+			}
+		}
+	}
+	checkBestBlock(t, "VerifyChain", chain, blocks[2])
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+const (
+	// vbTopBits is the value the top bits of a block version must have to
+	// signal for deployments via version bits as defined by BIP0009.
+	vbTopBits = 0x20000000
+
+	// vbTopMask is the mask which extracts the top bits of a block
+	// version.
+	vbTopMask = 0xe0000000
+
+	// vbNumBits is the number of bits available for deployments to signal
+	// with.
+	vbNumBits = 29
+)
+
+// These constants identify the deployments which are signaled for via version
+// bits.  They are the indices into the Deployments of the network parameters.
+const (
+	// DeploymentCSV is the deployment of the relative lock time rules
+	// defined by BIP0068, BIP0112, and BIP0113.
+	DeploymentCSV = iota
+
+	// numDeployments is the number of deployments.  It must be the last
+	// entry.
+	numDeployments
+)
+
+// ThresholdState defines the states a deployment signaled for via version bits
+// goes through as defined by BIP0009.
+type ThresholdState int
+
+// These constants define the threshold states.
+const (
+	// ThresholdDefined is the state of a deployment before its start time
+	// has been reached.
+	ThresholdDefined ThresholdState = iota
+
+	// ThresholdStarted is the state of a deployment which blocks may
+	// signal for.
+	ThresholdStarted
+
+	// ThresholdLockedIn is the state of a deployment for the retarget
+	// interval after enough blocks signaled for it.
+	ThresholdLockedIn
+
+	// ThresholdActive is the state of a deployment whose rules are in
+	// effect.
+	ThresholdActive
+
+	// ThresholdFailed is the state of a deployment which expired before
+	// enough blocks signaled for it.
+	ThresholdFailed
+)
+
+// thresholdStateStrings is a map of threshold states back to their constant
+// names for pretty printing.
+var thresholdStateStrings = map[ThresholdState]string{
+	ThresholdDefined:  "ThresholdDefined",
+	ThresholdStarted:  "ThresholdStarted",
+	ThresholdLockedIn: "ThresholdLockedIn",
+	ThresholdActive:   "ThresholdActive",
+	ThresholdFailed:   "ThresholdFailed",
+}
+
+// String returns the ThresholdState in human-readable form.
+func (t ThresholdState) String() string {
+	if s, ok := thresholdStateStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ThresholdState (%d)", int(t))
+}
+
+// networkDeployments returns the deployments for the network of the chain.
+func (b *BlockChain) networkDeployments() *[numDeployments]ConsensusDeployment {
+	return &b.chainParams.Deployments
+}
+
+// ruleChangeThreshold returns the number of blocks in a retarget interval which
+// must signal for a deployment for it to lock in.
+func (b *BlockChain) ruleChangeThreshold() int64 {
+	return b.chainParams.RuleChangeActivationThreshold
+}
+
+// isUnknownVersion returns whether or not the passed block version indicates
+// the block follows rules this package does not know about.  That is the case
+// for versions beyond maxKnownBlockVersion unless they are version bits
+// versions which only signal for known deployments.
+func (b *BlockChain) isUnknownVersion(version uint32) bool {
+	if version <= maxKnownBlockVersion {
+		return false
+	}
+	if version&vbTopMask != vbTopBits {
+		return true
+	}
+
+	var knownBits uint32
+	for _, deployment := range b.networkDeployments() {
+		knownBits |= 1 << deployment.BitNumber
+	}
+	return version&^(vbTopMask|knownBits) != 0
+}
+
+// isSignaling returns whether or not the passed block version signals for the
+// passed deployment.
+func isSignaling(version uint32, deployment *ConsensusDeployment) bool {
+	return version&vbTopMask == vbTopBits &&
+		version&(1<<deployment.BitNumber) != 0
+}
+
+// thresholdState returns the state of the deployment with the passed id for the
+// block after the passed node.  The states are calculated once per retarget
+// interval and cached by the last block of the interval.
+func (b *BlockChain) thresholdState(prevNode *blockNode, deploymentID int) (ThresholdState, error) {
+	deployment := &b.networkDeployments()[deploymentID]
+	blocksPerRetarget := b.chainParams.blocksPerRetarget()
+	cache := b.thresholdCaches[deploymentID]
+	if cache == nil {
+		cache = make(map[btcwire.ShaHash]ThresholdState)
+		b.thresholdCaches[deploymentID] = cache
+	}
+
+	// The state only changes at retarget interval boundaries, so find the
+	// last block of the previous interval.
+	if prevNode != nil {
+		boundary := prevNode.height - (prevNode.height+1)%blocksPerRetarget
+		if boundary < 0 {
+			prevNode = nil
+		} else {
+			var err error
+			prevNode, err = b.ancestorNode(prevNode, boundary)
+			if err != nil {
+				return ThresholdFailed, err
+			}
+		}
+	}
+
+	// Walk backwards one interval at a time until a cached state is found
+	// or the deployment could not have started yet.
+	var uncached []*blockNode
+	state := ThresholdDefined
+	for prevNode != nil {
+		if cachedState, ok := cache[*prevNode.hash]; ok {
+			state = cachedState
+			break
+		}
+
+		medianTime, err := b.calcPastMedianTime(prevNode)
+		if err != nil {
+			return ThresholdFailed, err
+		}
+		if medianTime.Unix() < deployment.StartTime {
+			cache[*prevNode.hash] = ThresholdDefined
+			break
+		}
+		uncached = append(uncached, prevNode)
+
+		if prevNode.height < blocksPerRetarget {
+			prevNode = nil
+			break
+		}
+		prevNode, err = b.ancestorNode(prevNode,
+			prevNode.height-blocksPerRetarget)
+		if err != nil {
+			return ThresholdFailed, err
+		}
+	}
+
+	// Calculate the states of the uncached intervals going forward.
+	for i := len(uncached) - 1; i >= 0; i-- {
+		node := uncached[i]
+		medianTime, err := b.calcPastMedianTime(node)
+		if err != nil {
+			return ThresholdFailed, err
+		}
+
+		switch state {
+		case ThresholdDefined:
+			if medianTime.Unix() >= deployment.ExpireTime {
+				state = ThresholdFailed
+			} else if medianTime.Unix() >= deployment.StartTime {
+				state = ThresholdStarted
+			}
+
+		case ThresholdStarted:
+			if medianTime.Unix() >= deployment.ExpireTime {
+				state = ThresholdFailed
+				break
+			}
+
+			// Count the blocks in the interval which signal for
+			// the deployment.
+			var count int64
+			countNode := node
+			for j := int64(0); j < blocksPerRetarget && countNode != nil; j++ {
+				if isSignaling(countNode.version, deployment) {
+					count++
+				}
+				countNode, err = b.getPrevNodeFromNode(countNode)
+				if err != nil {
+					return ThresholdFailed, err
+				}
+			}
+			if count >= b.ruleChangeThreshold() {
+				state = ThresholdLockedIn
+			}
+
+		case ThresholdLockedIn:
+			state = ThresholdActive
+		}
+
+		cache[*node.hash] = state
+	}
+
+	return state, nil
+}
+
+// ThresholdState returns the state of the deployment with the passed id, such
+// as DeploymentCSV, for the block after the end of the main chain.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) ThresholdState(deploymentID int) (ThresholdState, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	if deploymentID < 0 || deploymentID >= numDeployments {
+		return ThresholdFailed, fmt.Errorf("deployment id %d does not "+
+			"exist", deploymentID)
+	}
+	return b.thresholdState(b.bestChain, deploymentID)
+}
+
+// CalcNextBlockVersion returns the version a block which extends the end of the
+// main chain should have.  It signals for all deployments which are in the
+// started or locked in states as defined by BIP0009.  Mining code should use
+// it rather than hardcoding a version so deployments are signaled for
+// correctly.
+//
+// This function is safe for concurrent access, however it waits for any block
+// processing which is in progress to complete.
+func (b *BlockChain) CalcNextBlockVersion() (uint32, error) {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+
+	version := uint32(vbTopBits)
+	for id, deployment := range b.networkDeployments() {
+		state, err := b.thresholdState(b.bestChain, id)
+		if err != nil {
+			return 0, err
+		}
+		if state == ThresholdStarted || state == ThresholdLockedIn {
+			version |= 1 << deployment.BitNumber
+		}
+	}
+	return version, nil
+}
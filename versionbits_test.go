@@ -0,0 +1,251 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain_test
+
+import (
+	"github.com/conformal/btcchain"
+	"testing"
+	"time"
+)
+
+const (
+	// vbSignal is a version bits block version which signals for the
+	// deployment using bit 0 and vbNoSignal is one which does not.
+	vbSignal   = 0x20000001
+	vbNoSignal = 0x20000000
+)
+
+// TestThresholdStateTransitions ensures deployments signaled for via version
+// bits move through the states defined by BIP0009 at retarget interval
+// boundaries.
+func TestThresholdStateTransitions(t *testing.T) {
+	// Use a retarget interval of 10 blocks with a threshold of 8 so the
+	// block after the one at height 9 starts a new interval.
+	start := time.Unix(1400000000, 0)
+	params := btcchain.RegressionNetParams
+	params.TargetTimespan = params.TargetTimePerBlock * 10
+	params.RuleChangeActivationThreshold = 8
+
+	// signalAll signals for the deployment in every block while
+	// signalBelow signals in one block less than the threshold of the
+	// second interval.
+	signalAll := func(height int64) uint32 { return vbSignal }
+	signalBelow := func(height int64) uint32 {
+		if height >= 10 && height < 17 {
+			return vbSignal
+		}
+		return vbNoSignal
+	}
+
+	// always may be signaled for at any time while the others use
+	// another bit, start in the distant future, or expire part way
+	// through the second and third intervals respectively.
+	always := btcchain.ConsensusDeployment{ExpireTime: 1 << 62}
+	otherBit := always
+	otherBit.BitNumber = 1
+	future := always
+	future.StartTime = 1 << 61
+	expireSecond := always
+	expireSecond.ExpireTime = start.Add(params.TargetTimePerBlock * 12).Unix()
+	expireThird := always
+	expireThird.ExpireTime = start.Add(params.TargetTimePerBlock * 20).Unix()
+
+	tests := []struct {
+		name       string
+		deployment btcchain.ConsensusDeployment
+		version    func(height int64) uint32
+		height     int64
+		want       btcchain.ThresholdState
+	}{
+		{
+			name:       "first interval",
+			deployment: always,
+			version:    signalAll,
+			height:     8,
+			want:       btcchain.ThresholdDefined,
+		},
+		{
+			name:       "started",
+			deployment: always,
+			version:    signalAll,
+			height:     9,
+			want:       btcchain.ThresholdStarted,
+		},
+		{
+			name:       "started until the end of the interval",
+			deployment: always,
+			version:    signalAll,
+			height:     18,
+			want:       btcchain.ThresholdStarted,
+		},
+		{
+			name:       "locked in",
+			deployment: always,
+			version:    signalAll,
+			height:     19,
+			want:       btcchain.ThresholdLockedIn,
+		},
+		{
+			name:       "active",
+			deployment: always,
+			version:    signalAll,
+			height:     29,
+			want:       btcchain.ThresholdActive,
+		},
+		{
+			name:       "active stays active without signaling",
+			deployment: always,
+			version: func(height int64) uint32 {
+				if height < 20 {
+					return vbSignal
+				}
+				return 1
+			},
+			height: 49,
+			want:   btcchain.ThresholdActive,
+		},
+		{
+			name:       "one signal below the threshold",
+			deployment: always,
+			version:    signalBelow,
+			height:     29,
+			want:       btcchain.ThresholdStarted,
+		},
+		{
+			name:       "signals for another bit",
+			deployment: otherBit,
+			version:    signalAll,
+			height:     29,
+			want:       btcchain.ThresholdStarted,
+		},
+		{
+			name:       "not started yet",
+			deployment: future,
+			version:    signalAll,
+			height:     29,
+			want:       btcchain.ThresholdDefined,
+		},
+		{
+			name:       "expired before locking in",
+			deployment: expireSecond,
+			version:    signalBelow,
+			height:     19,
+			want:       btcchain.ThresholdFailed,
+		},
+		{
+			name:       "locked in before expiring",
+			deployment: expireThird,
+			version:    signalAll,
+			height:     39,
+			want:       btcchain.ThresholdActive,
+		},
+	}
+
+	for i, test := range tests {
+		params.Deployments[btcchain.DeploymentCSV] = test.deployment
+		versions := make([]uint32, test.height)
+		for j := range versions {
+			versions[j] = test.version(int64(j + 1))
+		}
+		state, err := btcchain.TstThresholdState(&params,
+			btcchain.DeploymentCSV, start, versions)
+		if err != nil {
+			t.Errorf("thresholdState #%d (%s): unexpected error %v", i,
+				test.name, err)
+			continue
+		}
+		if state != test.want {
+			t.Errorf("thresholdState #%d (%s): got %v, want %v", i,
+				test.name, state, test.want)
+		}
+	}
+}
+
+// TestMainNetRuleChangeThreshold ensures a deployment on the main network only
+// locks in once 1916 of the 2016 blocks in a retarget interval signal for it.
+func TestMainNetRuleChangeThreshold(t *testing.T) {
+	params := &btcchain.MainNetParams
+	deployment := &params.Deployments[btcchain.DeploymentCSV]
+	start := time.Unix(deployment.StartTime, 0)
+
+	tests := []struct {
+		numSignaling int
+		want         btcchain.ThresholdState
+	}{
+		{1915, btcchain.ThresholdStarted},
+		{1916, btcchain.ThresholdLockedIn},
+	}
+
+	for i, test := range tests {
+		// The deployment starts with the second interval, so the
+		// blocks which count are those at heights 2016 through 4031.
+		versions := make([]uint32, 4031)
+		for j := range versions {
+			versions[j] = vbNoSignal
+		}
+		for j := 0; j < test.numSignaling; j++ {
+			versions[2015+j] = vbSignal
+		}
+
+		state, err := btcchain.TstThresholdState(params,
+			btcchain.DeploymentCSV, start, versions)
+		if err != nil {
+			t.Errorf("thresholdState #%d: unexpected error %v", i, err)
+			continue
+		}
+		if state != test.want {
+			t.Errorf("thresholdState #%d: got %v with %d signaling "+
+				"blocks, want %v", i, state, test.numSignaling,
+				test.want)
+		}
+	}
+}
+
+// TestCSVActivation ensures the relative lock time rules apply from the CSV
+// height of a network when it has one and once the CSV deployment is active
+// via version bits otherwise.
+func TestCSVActivation(t *testing.T) {
+	start := time.Unix(1400000000, 0)
+	versionBitsParams := btcchain.RegressionNetParams
+	versionBitsParams.TargetTimespan = versionBitsParams.TargetTimePerBlock * 10
+	versionBitsParams.RuleChangeActivationThreshold = 8
+	heightParams := versionBitsParams
+	heightParams.CSVHeight = 15
+
+	tests := []struct {
+		name       string
+		params     *btcchain.Params
+		numBlocks  int
+		numSignal  int
+		wantActive bool
+	}{
+		{"height before activation", &heightParams, 13, 0, false},
+		{"height at activation", &heightParams, 14, 0, true},
+		{"deployment locked in", &versionBitsParams, 28, 28, false},
+		{"deployment active", &versionBitsParams, 29, 29, true},
+		{"deployment never signaled", &versionBitsParams, 29, 0, false},
+	}
+
+	for i, test := range tests {
+		versions := make([]uint32, test.numBlocks)
+		for j := range versions {
+			versions[j] = vbNoSignal
+			if j < test.numSignal {
+				versions[j] = vbSignal
+			}
+		}
+		active, err := btcchain.TstIsCSVActive(test.params, start,
+			versions)
+		if err != nil {
+			t.Errorf("isCSVActive #%d (%s): unexpected error %v", i,
+				test.name, err)
+			continue
+		}
+		if active != test.wantActive {
+			t.Errorf("isCSVActive #%d (%s): got %v, want %v", i,
+				test.name, active, test.wantActive)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2013 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcchain
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+const (
+	// WitnessScaleFactor is the factor serialized data which is not witness
+	// data is scaled by when calculating weight.  Witness data is counted
+	// at face value.
+	WitnessScaleFactor = 4
+
+	// MaxBlockWeight is the maximum weight a block is allowed to have on
+	// the bitcoin networks.  The limit of a chain is the one of its
+	// network parameters.
+	MaxBlockWeight = btcwire.MaxBlockPayload * WitnessScaleFactor
+)
+
+// TxWeight returns the weight of the passed transaction.  The weight of a
+// transaction is its serialized size without witness data multiplied by
+// WitnessScaleFactor plus the size of its witness data.  Transactions do not
+// carry witness data in this package, so the weight is always the scaled
+// serialized size.
+func TxWeight(tx *btcwire.MsgTx, pver uint32) (int64, error) {
+	size, err := txSerializeSize(tx, pver)
+	if err != nil {
+		return 0, err
+	}
+	return int64(size) * WitnessScaleFactor, nil
+}
+
+// TxVirtualSize returns the virtual size of the passed transaction, which is
+// its weight divided by WitnessScaleFactor rounded up.  This is the size fee
+// rates apply to.
+func TxVirtualSize(tx *btcwire.MsgTx, pver uint32) (int64, error) {
+	weight, err := TxWeight(tx, pver)
+	if err != nil {
+		return 0, err
+	}
+	return (weight + WitnessScaleFactor - 1) / WitnessScaleFactor, nil
+}
+
+// BlockWeight returns the weight of the passed block using the same accounting
+// as TxWeight.
+func BlockWeight(block *btcutil.Block) (int64, error) {
+	var size byteCounter
+	err := block.MsgBlock().BtcEncode(&size, block.ProtocolVersion())
+	if err != nil {
+		return 0, err
+	}
+	return int64(size) * WitnessScaleFactor, nil
+}